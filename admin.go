@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// 一覧を出力するサブコマンドの形式
+var outputFlag = &cli.StringFlag{
+	Name:  "output, o",
+	Value: "table",
+	Usage: "output format (table or json)",
+}
+
+var roomsCommand = cli.Command{
+	Name:  "rooms",
+	Usage: "inspect rooms of the running server",
+	Subcommands: []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list open rooms",
+			Flags:  []cli.Flag{serverFlag, outputFlag},
+			Action: listRooms,
+		},
+	},
+}
+
+var participantsCommand = cli.Command{
+	Name:  "participants",
+	Usage: "inspect participants of the running server",
+	Subcommands: []cli.Command{
+		{
+			Name:  "list",
+			Usage: "list participants in a room",
+			Flags: []cli.Flag{
+				serverFlag,
+				outputFlag,
+				&cli.StringFlag{
+					Name:     "room",
+					Required: true,
+				},
+			},
+			Action: listParticipants,
+		},
+	},
+}
+
+var participantCommand = cli.Command{
+	Name:  "participant",
+	Usage: "manage a participant of the running server",
+	Subcommands: []cli.Command{
+		{
+			Name:      "kick",
+			Usage:     "disconnect a participant from a room",
+			ArgsUsage: "ID",
+			Flags: []cli.Flag{
+				serverFlag,
+				&cli.StringFlag{
+					Name:     "room",
+					Required: true,
+				},
+			},
+			Action: kickParticipant,
+		},
+	},
+}
+
+var statsCommand = cli.Command{
+	Name:   "stats",
+	Usage:  "show per-track statistics of the running server",
+	Flags:  []cli.Flag{serverFlag, outputFlag},
+	Action: showStats,
+}
+
+var logLevelCommand = cli.Command{
+	Name:      "log-level",
+	Usage:     "show or change the log level of the running server",
+	ArgsUsage: "[LEVEL]",
+	Flags:     []cli.Flag{serverFlag},
+	Action:    logLevel,
+}
+
+// output は --output に従って v を JSON で、または header と rows を表で出力する
+func output(cxt *cli.Context, v any, header []string, rows [][]string) error {
+	switch cxt.String("output") {
+	case "json":
+		return printJSON(v)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", cxt.String("output"))
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+func listRooms(cxt *cli.Context) error {
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	rooms, err := client.Rooms()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(rooms))
+	for _, r := range rooms {
+		rows = append(rows, []string{r.Name, formatTime(r.CreatedAt)})
+	}
+	return output(cxt, rooms, []string{"NAME", "CREATED"}, rows)
+}
+
+func listParticipants(cxt *cli.Context) error {
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	participants, err := client.Participants(cxt.String("room"))
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(participants))
+	for _, p := range participants {
+		rows = append(rows, []string{p.ID, p.Name, formatTime(p.JoinedAt)})
+	}
+	return output(cxt, participants, []string{"ID", "NAME", "JOINED"}, rows)
+}
+
+func kickParticipant(cxt *cli.Context) error {
+	if cxt.NArg() != 1 {
+		return errors.New("participant id is required")
+	}
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	return client.KickParticipant(cxt.String("room"), cxt.Args().First())
+}
+
+func showStats(cxt *cli.Context) error {
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	stats, err := client.Stats()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		rows = append(rows, []string{
+			s.Room,
+			s.TrackID,
+			s.Participant,
+			s.Kind,
+			strconv.FormatBool(s.Muted),
+			strconv.FormatUint(s.NACKReceived, 10),
+			strconv.FormatUint(s.Retransmitted, 10),
+			strconv.FormatUint(s.CacheMissed, 10),
+		})
+	}
+	return output(cxt, stats, []string{
+		"ROOM", "TRACK", "PARTICIPANT", "KIND", "MUTED", "NACK", "RETRANSMITTED", "CACHE MISSED",
+	}, rows)
+}
+
+// logLevel は LEVEL (debug, info, warn, error) を指定した場合はログの出力レベルを変更し、現在のレベルを表示する
+func logLevel(cxt *cli.Context) error {
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	var level string
+	switch cxt.NArg() {
+	case 0:
+		level, err = client.LogLevel()
+	case 1:
+		level, err = client.SetLogLevel(cxt.Args().First())
+	default:
+		return errors.New("too many arguments")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(level)
+	return nil
+}
@@ -1,36 +1,120 @@
 package app
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"net/http"
 	"os"
+	"path"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 const baseURL = "ruyka/meet"
 
+// ブラウザには毎回 ETag で更新を確かめさせる。ファイル名に版を含めていないので長くキャッシュさせない
+const CACHE_CONTROL = "no-cache"
+
 var (
-	SIGNALING_API_URL_FORMAT = "ws://%s/api/v1/signaling"
+	// スキームは TLS で配信しているときだけ wss にする
+	SIGNALING_API_URL_FORMAT = "%s://%s/api/v1/signaling"
 )
 
-func Router(engine *echo.Echo) error {
+//go:embed index.html index.js style.css
+var assets embed.FS
+
+type handler struct {
+	files fs.FS
+	// 埋め込んだファイルを使うときだけ起動時に解析しておく
+	tmpl *template.Template
+}
+
+// Router はバイナリに埋め込んだデモアプリを配信する。
+// dir を指定した場合は、開発中に編集をすぐ反映できるよう、リクエストのたびに dir のファイルを読む
+func Router(engine *echo.Echo, dir string) error {
+	h := &handler{files: assets}
+	if dir != "" {
+		h.files = os.DirFS(dir)
+	}
+	// 起動時にテンプレートの誤りを検出する
+	tmpl, err := h.template()
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		h.tmpl = tmpl
+	}
+
 	app := engine.Group(baseURL)
 	{
-		text, err := os.ReadFile("app/index.js")
-		if err != nil {
-			return err
-		}
-
-		tmpl := template.Must(template.New("").Parse(string(text)))
-		app.GET("/index.js", func(ctx echo.Context) error {
-			return tmpl.Execute(
-				ctx.Response().Writer,
-				fmt.Sprintf(SIGNALING_API_URL_FORMAT, ctx.Request().Host),
-			)
-		})
-		app.File("", "app/index.html")
-		app.Static("", "app")
+		app.GET("/index.js", h.script)
+		app.GET("", h.static)
+		app.GET("/*", h.static)
 	}
 	return nil
 }
+
+func (h *handler) template() (*template.Template, error) {
+	if h.tmpl != nil {
+		return h.tmpl, nil
+	}
+	text, err := fs.ReadFile(h.files, "index.js")
+	if err != nil {
+		return nil, err
+	}
+	return template.New("index.js").Parse(string(text))
+}
+
+// script は index.js にシグナリングの URL を埋め込んで返す
+func (h *handler) script(ctx echo.Context) error {
+	tmpl, err := h.template()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, fmt.Sprintf(SIGNALING_API_URL_FORMAT, signalingScheme(ctx), ctx.Request().Host))
+	if err != nil {
+		return err
+	}
+	return serve(ctx, "index.js", buf.Bytes())
+}
+
+func (h *handler) static(ctx echo.Context) error {
+	name := path.Clean("/" + ctx.Param("*"))[1:]
+	if name == "" {
+		name = "index.html"
+	}
+	body, err := fs.ReadFile(h.files, name)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return serve(ctx, name, body)
+}
+
+// serve は内容から作った ETag を付けて返す。If-None-Match が一致すれば 304 を返す
+func serve(ctx echo.Context, name string, body []byte) error {
+	sum := sha256.Sum256(body)
+	header := ctx.Response().Header()
+	header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	header.Set(echo.HeaderCacheControl, CACHE_CONTROL)
+	http.ServeContent(ctx.Response(), ctx.Request(), name, time.Time{}, bytes.NewReader(body))
+	return nil
+}
+
+// signalingScheme は X-Forwarded-Proto も考慮して、TLS を終端するリバースプロキシの後ろでも wss を返す
+func signalingScheme(ctx echo.Context) string {
+	if ctx.Scheme() == "https" {
+		return "wss"
+	}
+	return "ws"
+}
@@ -4,6 +4,10 @@ class RuykaClient {
 
   constructor() {
     this.mediaType = 'video';
+    this.muted = false;
+    this.remoteElements = {};
+    this.mutedTracks = {};
+    this.senderTrackIds = {};
 
     // setup video elements
     const localVideo = document.createElement('video');
@@ -20,7 +24,15 @@ class RuykaClient {
   };
 
   connect() {
-    const ws = new WebSocket("{{.}}");
+    // ?room=<name> で参加するルームを、?token=<token> で参加トークンを指定できる
+    const params = new URLSearchParams(window.location.search);
+    const room = params.get('room');
+    const token = params.get('token');
+    const url = new URL("{{.}}");
+    if (room) url.searchParams.set('room', room);
+    if (token) url.searchParams.set('token', token);
+
+    const ws = new WebSocket(url);
     ws.onmessage = async (event) => {
       const message = JSON.parse(event.data);
       if (!message) return;
@@ -36,6 +48,7 @@ class RuykaClient {
 
             const answer = await this.peer.createAnswer();
             await this.peer.setLocalDescription(answer);
+            this.#updateSenderTrackIds(answer.sdp);
 
             // sdpを画面上に表示する
             this.latestAnswer.innerText = answer.sdp;
@@ -47,6 +60,16 @@ class RuykaClient {
 
             await this.peer.addIceCandidate(candidate);
             return;
+          case 'track-muted':
+            this.mutedTracks[message.track] = message.muted;
+            this.#updateMutedElement(message.track);
+            return;
+          case 'error':
+            // room-full: 満室または配信者数の上限, room-closed: ルームの期限切れ,
+            // publish-not-permitted: トークンで配信が許可されていない, kicked: admin API で退出させられた,
+            // mute-failed: 送信しているトラックのミュートを切り替えられなかった
+            window.alert(`${message.code}: ${message.message}`);
+            return;
         };
       } catch (error) {
         window.alert(error);
@@ -62,6 +85,10 @@ class RuykaClient {
     this.ws.close(1000);
 
     this.mediaType = 'video';
+    this.muted = false;
+    this.remoteElements = {};
+    this.mutedTracks = {};
+    this.senderTrackIds = {};
     this.remoteVideos.childNodes.forEach(node => {
       this.remoteVideos.removeChild(node);
     });
@@ -74,6 +101,20 @@ class RuykaClient {
     if (batchClassList.contains('-active')) batchClassList.remove('-active');
   };
 
+  // 自分が送信しているトラックのミュートを切り替える。
+  // replaceTrack で張り替えても再ネゴシエーションしないので、MediaStreamTrack.id ではなく
+  // サーバが SDP の msid で知っているトラック ID を送る
+  toggleMute() {
+    this.muted = !this.muted;
+    Object.values(this.senderTrackIds).forEach(id => {
+      this.ws.send(JSON.stringify({
+        event: this.muted ? 'mute' : 'unmute',
+        track: id,
+      }));
+    });
+    return this.muted;
+  };
+
   switchMediaType() {
     this.mediaType = (this.mediaType === 'video') ? 'display' : 'video';
     this.#updateStream();
@@ -90,6 +131,8 @@ class RuykaClient {
       video.autoplay = true;
       video.disablePictureInPicture = true;
       this.remoteVideos.appendChild(video);
+      this.remoteElements[event.track.id] = video;
+      this.#updateMutedElement(event.track.id);
 
       event.track.onmute = () => video.play();
       event.streams[0].onremovetrack = () => {
@@ -123,6 +166,25 @@ class RuykaClient {
     this.peer = peer;
   };
 
+  #updateMutedElement(id) {
+    const element = this.remoteElements[id];
+    if (!element) return;
+
+    if (this.mutedTracks[id]) element.classList.add('-muted');
+    else element.classList.remove('-muted');
+  };
+
+  // アンサーの a=msid から、送信するトランシーバの mid ごとにネゴシエートしたトラック ID を覚える
+  #updateSenderTrackIds(sdp) {
+    const senderTrackIds = {};
+    sdp.split(/\r?\n(?=m=)/).forEach(section => {
+      const mid = section.match(/^a=mid:(\S+)/m);
+      const msid = section.match(/^a=msid:\S+ (\S+)/m);
+      if (mid && msid) senderTrackIds[mid[1]] = msid[1];
+    });
+    this.senderTrackIds = senderTrackIds;
+  };
+
   // stream を張り替える
   async #updateStream() {
     try {
@@ -165,17 +227,25 @@ class RuykaClient {
 const client = new RuykaClient();
 const connectButton = document.getElementById('connect-button');
 const closeButton = document.getElementById('close-button');
+const muteButton = document.getElementById('mute-button');
 const videoSourceToggleSwitch = document.getElementById('video-source-toggle-switch');
 
 connectButton.onclick = () => {
   client.connect();
   connectButton.disabled = true;
   closeButton.disabled = false;
+  muteButton.disabled = false;
 };
 closeButton.onclick = () => {
   client.close();
   connectButton.disabled = false;
   closeButton.disabled = true;
+  muteButton.disabled = true;
+  document.getElementById('mute-button-text').innerText = 'Mute';
+};
+muteButton.onclick = () => {
+  const muted = client.toggleMute();
+  document.getElementById('mute-button-text').innerText = muted ? 'Unmute' : 'Mute';
 };
 videoSourceToggleSwitch.onclick = () => {
   client.switchMediaType();
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"ruyka/pkg/loadtest"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/urfave/cli"
+)
+
+var loadtestCommand = cli.Command{
+	Name:  "loadtest",
+	Usage: "join synthetic publishers and subscribers to a room and report media statistics",
+	Flags: []cli.Flag{
+		serverFlag,
+		&cli.StringFlag{
+			Name:  "room",
+			Value: "loadtest",
+		},
+		&cli.StringFlag{
+			Name:  "token",
+			Usage: "join token shared by all peers (without it, a token is created per peer if auth.secret is configured)",
+		},
+		&cli.IntFlag{
+			Name:  "publishers",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "subscribers",
+			Value: 1,
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Value: 30 * time.Second,
+			Usage: "how long to measure after all peers joined",
+		},
+		&cli.DurationFlag{
+			Name:  "ramp-up",
+			Value: 100 * time.Millisecond,
+			Usage: "interval between joining peers",
+		},
+		&cli.IntFlag{
+			Name:  "video-bitrate",
+			Value: 500_000,
+			Usage: "bits per second of each published VP8 track (0 disables video)",
+		},
+		&cli.IntFlag{
+			Name:  "audio-bitrate",
+			Value: 32_000,
+			Usage: "bits per second of each published Opus track (0 disables audio)",
+		},
+		&cli.Float64Flag{
+			Name:  "frame-rate",
+			Value: 30,
+		},
+		&cli.StringSliceFlag{
+			Name:  "ice-server",
+			Usage: "STUN/TURN server URL used by the peers",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the report as JSON",
+		},
+	},
+	Action: runLoadtest,
+}
+
+// signalingURL はサーバのベース URL から WebSocket のシグナリング URL を作る
+func signalingURL(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/signaling"
+	return u.String(), nil
+}
+
+func runLoadtest(cxt *cli.Context) error {
+	u, err := signalingURL(cxt.String("server"))
+	if err != nil {
+		return err
+	}
+	conf := webrtc.Configuration{}
+	if servers := cxt.StringSlice("ice-server"); len(servers) > 0 {
+		conf.ICEServers = []webrtc.ICEServer{{URLs: servers}}
+	}
+
+	// auth.secret を設定していれば、参加者ごとに権限に合わせたトークンを作る
+	c, err := loadConfig(cxt)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := c.TLS.Client.Build()
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C で止めた場合もそれまでの結果を出力する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := loadtest.Run(ctx, loadtest.Options{
+		URL:          u,
+		Room:         cxt.String("room"),
+		Token:        cxt.String("token"),
+		Secret:       c.Auth.Secret,
+		Publishers:   cxt.Int("publishers"),
+		Subscribers:  cxt.Int("subscribers"),
+		Duration:     cxt.Duration("duration"),
+		RampUp:       cxt.Duration("ramp-up"),
+		VideoBitrate: cxt.Int("video-bitrate"),
+		AudioBitrate: cxt.Int("audio-bitrate"),
+		FrameRate:    cxt.Float64("frame-rate"),
+		WebRTC:       conf,
+		TLS:          tlsConfig,
+	})
+	if err != nil {
+		return err
+	}
+	if cxt.Bool("json") {
+		return printJSON(report)
+	}
+	fmt.Print(report.Summary())
+	for reason, n := range report.Errors {
+		fmt.Printf("  failed to join (%d): %s\n", n, reason)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"ruyka/pkg/player"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/store"
+	"strings"
+	"time"
+)
+
+const CLIENT_TIMEOUT = 10 * time.Second
+
+// APIError は admin API がエラーで応答したときの内容
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("admin api: %d %s", e.Status, e.Message)
+}
+
+// Client は起動中の ruyka の admin API を呼び出す
+type Client interface {
+	Rooms() ([]store.Room, error)
+	Participants(room string) ([]store.Participant, error)
+	KickParticipant(room, participant string) error
+	Stats() ([]rtc.TrackStats, error)
+	StartPlayback(room string, o player.Options) (player.Playback, error)
+	StopPlayback(id string) error
+	Playbacks() ([]player.Playback, error)
+	LogLevel() (string, error)
+	SetLogLevel(level string) (string, error)
+}
+
+type client struct {
+	server string
+	key    string
+	http   *http.Client
+}
+
+// NewClient は server (例: http://127.0.0.1:19000) の admin API を key で呼び出す。
+// key が空の場合は認証しない。tlsConfig は https で接続するときの設定で、nil の場合は既定の設定を使う
+func NewClient(server, key string, tlsConfig *tls.Config) Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &client{
+		server: strings.TrimSuffix(server, "/"),
+		key:    key,
+		http:   &http.Client{Timeout: CLIENT_TIMEOUT, Transport: transport},
+	}
+}
+
+// do は in を JSON で送り、応答の JSON を out に読み込む。in と out は nil でもよい
+func (c *client) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.server+"/api/v1/admin"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		e := struct {
+			Message string `json:"message"`
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Message == "" {
+			e.Message = http.StatusText(res.StatusCode)
+		}
+		return &APIError{Status: res.StatusCode, Message: e.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *client) Rooms() ([]store.Room, error) {
+	res := struct {
+		Rooms []store.Room `json:"rooms"`
+	}{}
+	err := c.do(http.MethodGet, "/rooms", nil, &res)
+	return res.Rooms, err
+}
+
+func (c *client) Participants(room string) ([]store.Participant, error) {
+	res := struct {
+		Participants []store.Participant `json:"participants"`
+	}{}
+	err := c.do(http.MethodGet, "/rooms/"+url.PathEscape(room)+"/participants", nil, &res)
+	return res.Participants, err
+}
+
+func (c *client) KickParticipant(room, participant string) error {
+	return c.do(http.MethodDelete, "/rooms/"+url.PathEscape(room)+"/participants/"+url.PathEscape(participant), nil, nil)
+}
+
+func (c *client) Stats() ([]rtc.TrackStats, error) {
+	res := struct {
+		Tracks []rtc.TrackStats `json:"tracks"`
+	}{}
+	err := c.do(http.MethodGet, "/stats", nil, &res)
+	return res.Tracks, err
+}
+
+func (c *client) StartPlayback(room string, o player.Options) (player.Playback, error) {
+	pb := player.Playback{}
+	err := c.do(http.MethodPost, "/rooms/"+url.PathEscape(room)+"/playbacks", o, &pb)
+	return pb, err
+}
+
+func (c *client) StopPlayback(id string) error {
+	return c.do(http.MethodDelete, "/playbacks/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *client) Playbacks() ([]player.Playback, error) {
+	res := struct {
+		Playbacks []player.Playback `json:"playbacks"`
+	}{}
+	err := c.do(http.MethodGet, "/playbacks", nil, &res)
+	return res.Playbacks, err
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (c *client) LogLevel() (string, error) {
+	res := logLevel{}
+	err := c.do(http.MethodGet, "/log-level", nil, &res)
+	return res.Level, err
+}
+
+func (c *client) SetLogLevel(level string) (string, error) {
+	res := logLevel{}
+	err := c.do(http.MethodPut, "/log-level", logLevel{Level: level}, &res)
+	return res.Level, err
+}
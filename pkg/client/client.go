@@ -0,0 +1,451 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"ruyka/pkg/rtc"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// 切断をサーバに伝えるのを待つ時間
+const CLOSE_TIMEOUT = time.Second
+
+var (
+	ErrAlreadyConnected = errors.New("client is already connected")
+	ErrClosed           = errors.New("client is closed")
+)
+
+type Config struct {
+	// シグナリングの URL (例: ws://127.0.0.1:19000/api/v1/signaling)
+	URL  string
+	Room string
+	// サーバに auth.secret を設定している場合に必要な参加トークン
+	Token string
+	// ICE サーバなどの設定
+	WebRTC webrtc.Configuration
+	// 省略した場合は既定のコーデックとインターセプタを使う
+	API *webrtc.API
+	// 配信するトラック。サーバのオファーには音声と映像の受信枠が 1 つずつあるので、それぞれ 1 本まで配信できる
+	Tracks []webrtc.TrackLocal
+	// 省略した場合は websocket.DefaultDialer に TLS を設定して使う
+	Dialer *websocket.Dialer
+	// Dialer を省略したときに wss で使う設定。nil の場合は既定の設定で接続する
+	TLS *tls.Config
+}
+
+// TrackMuted はサーバから届くトラックのミュート状態
+type TrackMuted struct {
+	TrackID     string
+	Participant string
+	Muted       bool
+	ServerMuted bool
+}
+
+// Client は app/index.js と同じ手順で ruyka のシグナリングに参加する。
+// サーバからのオファーに応答するだけで、自分からはオファーを送らない。
+// コールバックは Connect の前に設定する
+type Client interface {
+	Connect(ctx context.Context) error
+	Close() error
+	// PeerConnection が最初に接続されると閉じられる
+	Connected() <-chan struct{}
+	// シグナリングが切れると閉じられる。理由は Err で取得する
+	Done() <-chan struct{}
+	Err() error
+	PeerConnection() *webrtc.PeerConnection
+	Mute(trackID string, muted bool) error
+	SetLayer(trackID string, spatial, temporal uint8) error
+	OnTrack(func(*webrtc.TrackRemote, *webrtc.RTPReceiver))
+	OnTrackMuted(func(TrackMuted))
+	OnParticipantJoined(func(participant string))
+	OnParticipantLeft(func(participant string))
+	OnError(func(rtc.ErrorMessage))
+}
+
+type client struct {
+	config Config
+	peer   *webrtc.PeerConnection
+
+	mux       sync.Mutex
+	conn      rtc.SignalConnection
+	ws        *websocket.Conn
+	published bool
+	// 最初の応答を送るまでに集まった ICE candidate
+	answered   bool
+	candidates []webrtc.ICECandidateInit
+	err        error
+	connected  chan struct{}
+	done       chan struct{}
+	once       sync.Once
+
+	onTrackMuted        func(TrackMuted)
+	onParticipantJoined func(string)
+	onParticipantLeft   func(string)
+	onError             func(rtc.ErrorMessage)
+}
+
+// message はサーバとやり取りする全てのイベントのフィールドを持つ。使わないフィールドは送らない
+type message struct {
+	Event              rtc.EventType                     `json:"event"`
+	SessionDescription *rtc.SessionDescriptionSerializer `json:"sdp,omitempty"`
+	ICECandidate       *rtc.ICECandidateSerializer       `json:"ice,omitempty"`
+	TrackID            string                            `json:"track,omitempty"`
+	Participant        string                            `json:"participant,omitempty"`
+	Muted              bool                              `json:"muted,omitempty"`
+	ServerMuted        bool                              `json:"server_muted,omitempty"`
+	SpatialLayer       *uint8                            `json:"spatial,omitempty"`
+	TemporalLayer      *uint8                            `json:"temporal,omitempty"`
+	Code               rtc.ErrorCode                     `json:"code,omitempty"`
+	Message            string                            `json:"message,omitempty"`
+}
+
+func New(c Config) (Client, error) {
+	if c.API == nil {
+		api, err := defaultAPI()
+		if err != nil {
+			return nil, err
+		}
+		c.API = api
+	}
+	if c.Dialer == nil {
+		dialer := *websocket.DefaultDialer
+		dialer.TLSClientConfig = c.TLS
+		c.Dialer = &dialer
+	}
+	peer, err := c.API.NewPeerConnection(c.WebRTC)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &client{
+		config:    c,
+		peer:      peer,
+		mux:       sync.Mutex{},
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	connected := sync.Once{}
+	peer.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateConnected {
+			connected.Do(func() {
+				close(cl.connected)
+			})
+		}
+	})
+	peer.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+		// 候補は応答を作った直後から集まり始めるが、サーバは応答を受け取るまで候補を追加できない
+		cl.mux.Lock()
+		if !cl.answered {
+			cl.candidates = append(cl.candidates, i.ToJSON())
+			cl.mux.Unlock()
+			return
+		}
+		cl.mux.Unlock()
+		if err := cl.writeCandidate(i.ToJSON()); err != nil {
+			cl.close(err)
+		}
+	})
+	return cl, nil
+}
+
+// defaultAPI は webrtc.NewPeerConnection と同じく、既定のコーデックとインターセプタを登録する。
+// ICE-TCP だけを待ち受けるサーバにもつながるように、TCP の候補も使う
+func defaultAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	s := webrtc.SettingEngine{}
+	s.SetNetworkTypes([]webrtc.NetworkType{
+		webrtc.NetworkTypeUDP4,
+		webrtc.NetworkTypeUDP6,
+		webrtc.NetworkTypeTCP4,
+		webrtc.NetworkTypeTCP6,
+	})
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
+}
+
+func (c *client) Connect(ctx context.Context) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conn != nil {
+		return ErrAlreadyConnected
+	}
+	u, err := url.Parse(c.config.URL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if c.config.Room != "" {
+		q.Set("room", c.config.Room)
+	}
+	if c.config.Token != "" {
+		q.Set("token", c.config.Token)
+	}
+	u.RawQuery = q.Encode()
+	ws, _, err := c.config.Dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	c.ws = ws
+	c.conn = rtc.NewSignalConnection(ws)
+
+	go c.read()
+	return nil
+}
+
+// read はシグナリングが切れるまでサーバからのイベントを処理する
+func (c *client) read() {
+	// オファーより先に届いた ICE candidate は remote description を設定するまで保留する
+	pending := []webrtc.ICECandidateInit{}
+	for {
+		msg := message{}
+		if err := c.conn.ReadMessage(&msg); err != nil {
+			c.close(err)
+			return
+		}
+
+		switch msg.Event {
+		case rtc.EventTypeOffer:
+			if msg.SessionDescription == nil {
+				continue
+			}
+			if err := c.answer(msg.SessionDescription.SessionDescription); err != nil {
+				c.close(err)
+				return
+			}
+			for _, candidate := range pending {
+				if err := c.peer.AddICECandidate(candidate); err != nil {
+					c.close(err)
+					return
+				}
+			}
+			pending = pending[:0]
+		case rtc.EventTypeCandidate:
+			if msg.ICECandidate == nil {
+				continue
+			}
+			if c.peer.RemoteDescription() == nil {
+				pending = append(pending, msg.ICECandidate.ICECandidateInit)
+				continue
+			}
+			if err := c.peer.AddICECandidate(msg.ICECandidate.ICECandidateInit); err != nil {
+				c.close(err)
+				return
+			}
+		default:
+			c.dispatch(msg)
+		}
+	}
+}
+
+// answer はオファーに応答する。
+// 最初のオファーでは、サーバが用意した受信枠に配信するトラックを割り当てる
+func (c *client) answer(offer webrtc.SessionDescription) error {
+	if err := c.peer.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	c.mux.Lock()
+	publish := !c.published
+	c.published = true
+	c.mux.Unlock()
+	if publish {
+		for _, track := range c.config.Tracks {
+			sender, err := c.peer.AddTrack(track)
+			if err != nil {
+				return err
+			}
+			go readRTCP(sender)
+		}
+	}
+
+	answer, err := c.peer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := c.peer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	if err := c.write(message{
+		Event:              rtc.EventTypeAnswer,
+		SessionDescription: &rtc.SessionDescriptionSerializer{SessionDescription: answer},
+	}); err != nil {
+		return err
+	}
+
+	// 応答を送るまで保留していた候補を送る
+	c.mux.Lock()
+	c.answered = true
+	candidates := c.candidates
+	c.candidates = nil
+	c.mux.Unlock()
+	for _, candidate := range candidates {
+		if err := c.writeCandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) writeCandidate(candidate webrtc.ICECandidateInit) error {
+	return c.write(message{
+		Event:        rtc.EventTypeCandidate,
+		ICECandidate: &rtc.ICECandidateSerializer{ICECandidateInit: candidate},
+	})
+}
+
+// readRTCP はインターセプタを動かすために送信側の RTCP を読み続ける
+func readRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (c *client) write(msg message) error {
+	c.mux.Lock()
+	conn := c.conn
+	c.mux.Unlock()
+	if conn == nil {
+		return ErrClosed
+	}
+	return conn.WriteMessage(msg)
+}
+
+// dispatch はシグナリング以外のイベントをコールバックに渡す
+func (c *client) dispatch(msg message) {
+	c.mux.Lock()
+	onTrackMuted, onError := c.onTrackMuted, c.onError
+	onParticipantJoined, onParticipantLeft := c.onParticipantJoined, c.onParticipantLeft
+	c.mux.Unlock()
+
+	switch {
+	case msg.Event == rtc.EventTypeTrackMuted && onTrackMuted != nil:
+		onTrackMuted(TrackMuted{
+			TrackID:     msg.TrackID,
+			Participant: msg.Participant,
+			Muted:       msg.Muted,
+			ServerMuted: msg.ServerMuted,
+		})
+	case msg.Event == rtc.EventTypeParticipantJoined && onParticipantJoined != nil:
+		onParticipantJoined(msg.Participant)
+	case msg.Event == rtc.EventTypeParticipantLeft && onParticipantLeft != nil:
+		onParticipantLeft(msg.Participant)
+	case msg.Event == rtc.EventTypeError && onError != nil:
+		onError(rtc.ErrorMessage{Event: msg.Event, Code: msg.Code, Message: msg.Message})
+	}
+}
+
+// close は最初の理由だけを Err として残す
+func (c *client) close(err error) {
+	c.once.Do(func() {
+		c.mux.Lock()
+		c.err = err
+		ws := c.ws
+		c.mux.Unlock()
+
+		c.peer.Close()
+		if ws != nil {
+			ws.Close()
+		}
+		close(c.done)
+	})
+}
+
+func (c *client) Close() error {
+	c.mux.Lock()
+	ws := c.ws
+	c.mux.Unlock()
+	if ws != nil {
+		// サーバに正常な切断を伝えてから閉じる
+		// WriteControl は他の書き込みと並行して呼べる
+		ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(CLOSE_TIMEOUT),
+		)
+	}
+	c.close(ErrClosed)
+	return nil
+}
+
+func (c *client) Connected() <-chan struct{} {
+	return c.connected
+}
+
+func (c *client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *client) Err() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.err
+}
+
+func (c *client) PeerConnection() *webrtc.PeerConnection {
+	return c.peer
+}
+
+func (c *client) Mute(trackID string, muted bool) error {
+	event := rtc.EventTypeUnmute
+	if muted {
+		event = rtc.EventTypeMute
+	}
+	return c.write(message{Event: event, TrackID: trackID})
+}
+
+// SetLayer は購読しているサイマルキャスト・SVC のトラックについて、受け取るレイヤーの上限を変更する
+func (c *client) SetLayer(trackID string, spatial, temporal uint8) error {
+	return c.write(message{
+		Event:         rtc.EventTypeLayer,
+		TrackID:       trackID,
+		SpatialLayer:  &spatial,
+		TemporalLayer: &temporal,
+	})
+}
+
+func (c *client) OnTrack(f func(*webrtc.TrackRemote, *webrtc.RTPReceiver)) {
+	c.peer.OnTrack(f)
+}
+
+func (c *client) OnTrackMuted(f func(TrackMuted)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.onTrackMuted = f
+}
+
+func (c *client) OnParticipantJoined(f func(string)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.onParticipantJoined = f
+}
+
+func (c *client) OnParticipantLeft(f func(string)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.onParticipantLeft = f
+}
+
+func (c *client) OnError(f func(rtc.ErrorMessage)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.onError = f
+}
@@ -1,25 +1,47 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"ruyka/pkg/egress"
+	"ruyka/pkg/hls"
+	"ruyka/pkg/ingest"
+	"ruyka/pkg/player"
 	"ruyka/pkg/rtc"
+	"ruyka/pkg/rtmp"
 	"ruyka/pkg/server"
 	"ruyka/pkg/service"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Port        int           `yaml:"port,omitempty"`
+	TLS         TLSConfig     `yaml:"tls,omitempty"`
 	CORS        CORSConfig    `yaml:"cors,omitempty"`
 	RTC         RTCConfig     `yaml:"rtc,omitempty"`
 	Logging     LoggingConfig `yaml:"logging,omitempty"`
+	Admin       AdminConfig   `yaml:"admin,omitempty"`
+	Auth        AuthConfig    `yaml:"auth,omitempty"`
+	Store       StoreConfig   `yaml:"store,omitempty"`
+	Webhook     WebhookConfig `yaml:"webhook,omitempty"`
+	Forward     ForwardConfig `yaml:"forward,omitempty"`
+	RTMP        RTMPConfig    `yaml:"rtmp,omitempty"`
+	HLS         HLSConfig     `yaml:"hls,omitempty"`
+	Player      PlayerConfig  `yaml:"player,omitempty"`
+	App         AppConfig     `yaml:"app,omitempty"`
 	Development bool          `yaml:"development,omitempty"`
 }
 
@@ -32,6 +54,32 @@ type CORSConfig struct {
 type RTCConfig struct {
 	ICEServers []string     `yaml:"ice_servers,omitempty"`
 	ICETCP     ICETCPConfig `yaml:"ice_tcp,omitempty"`
+	// ICE の候補をループバックアドレスに限る。同じマシンの中だけで接続するテスト用
+	ICELoopback bool              `yaml:"ice_loopback,omitempty"`
+	Codecs      CodecPolicyConfig `yaml:"codecs,omitempty"`
+	// パケットロスの多い購読者に向けて音声を RED で冗長化する
+	AdaptiveRED bool                  `yaml:"adaptive_red,omitempty"`
+	Rooms       map[string]RoomConfig `yaml:"rooms,omitempty"`
+	Policy      RoomPolicyConfig      `yaml:"policy,omitempty"`
+	// 中継元として参照できる他の ruyka ノードの名前と接続先
+	Nodes map[string]NodeConfig `yaml:"nodes,omitempty"`
+}
+
+// NodeConfig は中継元のノード。URL だけを文字列で書くこともできる
+type NodeConfig struct {
+	// シグナリング URL (例: ws://127.0.0.1:19000/api/v1/signaling)
+	URL string `yaml:"url"`
+	// 中継元のノードの auth.secret。設定した場合は接続ごとに購読だけを許可する参加トークンを作る
+	Secret string `yaml:"secret,omitempty"`
+}
+
+func (c *NodeConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = NodeConfig{}
+		return value.Decode(&c.URL)
+	}
+	type plain NodeConfig
+	return value.Decode((*plain)(c))
 }
 
 type ICETCPConfig struct {
@@ -39,6 +87,112 @@ type ICETCPConfig struct {
 	Port    int  `yaml:"port,omitempty"`
 }
 
+type CodecPolicyConfig struct {
+	// 優先度の高い順に並べる
+	Allowed             []string `yaml:"allowed,omitempty"`
+	H264ProfileLevelIDs []string `yaml:"h264_profile_level_ids,omitempty"`
+	RTX                 *bool    `yaml:"rtx,omitempty"`
+	// 配信者からの映像の ULPFEC は SFU で欠損の復元に使うだけで、購読者には転送しない
+	FEC *bool `yaml:"fec,omitempty"`
+}
+
+// RoomConfig は特定のルームにだけ適用する設定で、省略した項目は全体の設定を引き継ぐ
+type RoomConfig struct {
+	Codecs      CodecPolicyConfig `yaml:"codecs,omitempty"`
+	AdaptiveRED *bool             `yaml:"adaptive_red,omitempty"`
+	// nodes に登録したノードの名前。そのノードの同名のルームからトラックを中継する。
+	// 中継は一方向で、互いに中継し合うとトラックが循環するので設定しないこと
+	Upstream string           `yaml:"upstream,omitempty"`
+	Policy   RoomPolicyConfig `yaml:"policy,omitempty"`
+}
+
+// RoomPolicyConfig は省略した項目を全体の設定から引き継ぐ。上限の 0 は無制限を表す。
+// empty_timeout は省略すると rtc.DEFAULT_EMPTY_TIMEOUT で、0 の場合は空になったルームを閉じない
+// 中継や RTP・RTMP の取り込みは max_participants に数えず、それだけが残ったルームは空として扱う
+type RoomPolicyConfig struct {
+	MaxParticipants *int           `yaml:"max_participants,omitempty"`
+	MaxPublishers   *int           `yaml:"max_publishers,omitempty"`
+	EmptyTimeout    *time.Duration `yaml:"empty_timeout,omitempty"`
+	MaxDuration     *time.Duration `yaml:"max_duration,omitempty"`
+	// ビットレートは bps で指定する
+	MaxAudioBitrate *uint64 `yaml:"max_audio_bitrate,omitempty"`
+	MaxVideoBitrate *uint64 `yaml:"max_video_bitrate,omitempty"`
+	EgressBitrate   *uint64 `yaml:"egress_bitrate,omitempty"`
+}
+
+type AdminConfig struct {
+	// 空の場合は認証しない代わりに、ループバックアドレスからのリクエストだけを受け付ける。
+	// 他のマシンから admin API を使う場合は必ず設定する
+	Key string `yaml:"key,omitempty"`
+}
+
+type AuthConfig struct {
+	// 参加トークンの HMAC-SHA256 署名に使う。空の場合はトークンなしで参加できる
+	Secret string `yaml:"secret,omitempty"`
+}
+
+type StoreConfig struct {
+	// memory または sqlite。sqlite のファイルは、ロードバランサの後ろに置いた複数のインスタンスで共有できる
+	Type string `yaml:"type,omitempty"`
+	// type が sqlite のときの保存先
+	Path string `yaml:"path,omitempty"`
+	// Store を共有するインスタンスごとに異なる、再起動しても変わらない名前。
+	// 起動時には同じ名前のインスタンスが残した参加者だけを削除する。空の場合はホスト名とポート番号から作る
+	Instance string `yaml:"instance,omitempty"`
+}
+
+type WebhookConfig struct {
+	URLs []string `yaml:"urls,omitempty"`
+	// 本文の HMAC-SHA256 署名に使う
+	Secret  string        `yaml:"secret,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ForwardConfig は admin API の RTP 転送の設定
+type ForwardConfig struct {
+	// 転送先として許可する IP アドレスまたは CIDR (例: 10.0.0.0/8)。
+	// 任意の宛先に UDP を送らせないよう、空の場合は転送を受け付けない
+	AllowedDestinations []string `yaml:"allowed_destinations,omitempty"`
+}
+
+type RTMPConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	Port    int  `yaml:"port,omitempty"`
+	// AAC の音声の扱い。reject は切断し、drop は映像だけを配信し、transcode は ffmpeg で Opus に変換する
+	AAC string `yaml:"aac,omitempty"`
+	// transcode で使う ffmpeg のパス。libopus が有効なビルドが必要
+	FFmpeg string `yaml:"ffmpeg,omitempty"`
+	// ストリームキーごとの配信先
+	Keys map[string]RTMPKeyConfig `yaml:"keys,omitempty"`
+}
+
+// HLSConfig を有効にすると /hls/<room>/index.m3u8 でルームの H.264 映像と Opus 音声を配信する。
+// auth.secret を設定した場合は、シグナリングと同じく ?token= で購読を許可する参加トークンを渡す
+type HLSConfig struct {
+	Enabled         bool          `yaml:"enabled,omitempty"`
+	SegmentDuration time.Duration `yaml:"segment_duration,omitempty"`
+	// LL-HLS のパートを作る
+	LowLatency   bool          `yaml:"low_latency,omitempty"`
+	PartDuration time.Duration `yaml:"part_duration,omitempty"`
+}
+
+type PlayerConfig struct {
+	// admin API から再生できるメディアファイルを置くディレクトリ。この外のファイルは再生しない
+	Dir string `yaml:"dir,omitempty"`
+}
+
+// AppConfig は開発モードで /ruyka/meet に配信するデモアプリの設定
+type AppConfig struct {
+	// 指定した場合はバイナリに埋め込んだファイルの代わりにこのディレクトリのファイルを配信する。
+	// リクエストのたびに読み込むので、編集がすぐに反映される
+	Dir string `yaml:"dir,omitempty"`
+}
+
+type RTMPKeyConfig struct {
+	Room        string `yaml:"room,omitempty"`
+	Participant string `yaml:"participant,omitempty"`
+}
+
 type LoggingConfig struct {
 	zap.Config `yaml:",inline"`
 }
@@ -56,6 +210,28 @@ var defaultConfig = Config{
 			Port:    19443,
 		},
 	},
+	Store: StoreConfig{
+		Type: "memory",
+		Path: "ruyka-store.db",
+	},
+	Webhook: WebhookConfig{
+		Timeout: 5 * time.Second,
+	},
+	RTMP: RTMPConfig{
+		Enabled: false,
+		Port:    1935,
+		AAC:     string(ingest.AACPolicyReject),
+		FFmpeg:  "ffmpeg",
+	},
+	HLS: HLSConfig{
+		Enabled:         false,
+		SegmentDuration: 2 * time.Second,
+		LowLatency:      false,
+		PartDuration:    500 * time.Millisecond,
+	},
+	Player: PlayerConfig{
+		Dir: "media",
+	},
 	Logging: LoggingConfig{
 		zap.Config{
 			Level: zap.NewAtomicLevelAt(zapcore.DebugLevel),
@@ -86,8 +262,25 @@ var defaultConfig = Config{
 	Development: false,
 }
 
+// New は既定の設定のコピーを返す
 func New() *Config {
-	return &defaultConfig
+	c := defaultConfig
+	// AtomicLevel は参照を共有するので、admin API での変更が既定の設定に及ばないよう作り直す
+	c.Logging.Level = zap.NewAtomicLevelAt(defaultConfig.Logging.Level.Level())
+	return &c
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := New()
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func (c *Config) DevMode() {
@@ -98,15 +291,33 @@ func (c *Config) DevMode() {
 }
 
 func (c *Config) Build() (server.Server, error) {
-	engine, err := c.buildEngine()
+	logger, err := c.Logging.Build()
 	if err != nil {
 		return nil, err
 	}
-	logger, err := c.Logging.Build()
+	engine, err := c.buildEngine(logger)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.Store.build()
+	if err != nil {
+		return nil, err
+	}
+	// Webhook の配送キューはルームと HLS で共有する
+	hook := webhook.New(c.Webhook.URLs, c.Webhook.Secret, c.Webhook.Timeout)
+	r, err := c.buildRTC(st, hook)
+	if err != nil {
+		return nil, err
+	}
+	runners, err := c.buildRunners(r)
 	if err != nil {
 		return nil, err
 	}
-	rtcService, err := c.buildRTCService()
+	hlsService, err := c.HLS.build(r, hook, c.Auth.Secret)
+	if err != nil {
+		return nil, err
+	}
+	forwarder, err := c.Forward.build(r)
 	if err != nil {
 		return nil, err
 	}
@@ -114,20 +325,67 @@ func (c *Config) Build() (server.Server, error) {
 	return server.New(
 		engine,
 		logger,
-		rtcService,
+		r,
+		st,
+		service.NewRTCService(r, c.Auth.Secret),
+		service.NewAdminService(
+			r,
+			st,
+			forwarder,
+			ingest.NewRTPIngester(r),
+			player.NewPlayer(r, c.Player.Dir),
+			c.Logging.Level,
+			c.Admin.Key,
+		),
+		hlsService,
 		c.Development,
+		c.App.Dir,
+		runners...,
 	)
 }
 
-func (c *Config) buildEngine() (*echo.Echo, error) {
+func (c *Config) buildRunners(r rtc.RTC) ([]server.Runner, error) {
+	runners := []server.Runner{}
+	if c.RTMP.Enabled {
+		targets := make(map[string]ingest.RTMPTarget, len(c.RTMP.Keys))
+		for key, target := range c.RTMP.Keys {
+			targets[key] = ingest.RTMPTarget{Room: target.Room, Participant: target.Participant}
+		}
+		h, err := ingest.NewRTMPHandler(r, targets, ingest.AACPolicy(c.RTMP.AAC), c.RTMP.FFmpeg)
+		if err != nil {
+			return nil, err
+		}
+		addr := net.TCPAddr{IP: net.IP{0, 0, 0, 0}, Port: c.RTMP.Port}
+		if c.Development {
+			addr.IP = net.IP{127, 0, 0, 1}
+		}
+		l, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		runners = append(runners, rtmp.NewServer(l, h))
+	}
+	return runners, nil
+}
+
+func (c *Config) buildEngine(logger *zap.Logger) (*echo.Echo, error) {
 	addr := net.TCPAddr{IP: net.IP{0, 0, 0, 0}, Port: c.Port}
-	if c.Development {
+	// TLS は他のマシンのブラウザからデモを使うためのものなので、開発モードでも全てのアドレスで待ち受ける
+	if c.Development && !c.TLS.Enabled {
 		addr.IP = net.IP{127, 0, 0, 1}
 	}
 	listener, err := net.Listen("tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
+	if c.TLS.Enabled {
+		conf, err := c.TLS.build()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, conf)
+	}
 	cors := middleware.CORSConfig{
 		Skipper:      middleware.DefaultSkipper,
 		AllowOrigins: c.CORS.AllowOrigins,
@@ -140,35 +398,198 @@ func (c *Config) buildEngine() (*echo.Echo, error) {
 	e.HideBanner = true
 	e.HidePort = true
 	e.Use(middleware.Recover())
+	e.Use(middleware.RequestID())
+	e.Use(requestLogger(logger))
 	e.Use(middleware.CORSWithConfig(cors))
 	return e, nil
 }
 
-func (c *Config) buildRTCService() (service.Service, error) {
-	i := &interceptor.Registry{}
-	m, err := rtc.NewMediaEngine()
+// requestLogger は HTTP のリクエストを RequestID ミドルウェアの ID と共に記録する。
+// シグナリングのリクエストは WebSocket が閉じたときに記録される。
+// echo の RequestLogger は作るたびにパッケージ変数を書き換えるので、サーバを複数作るテストで競合しないよう使わない
+func requestLogger(logger *zap.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(cxt echo.Context) error {
+			start := time.Now()
+			err := next(cxt)
+			if err != nil {
+				// ステータスコードを確定させるため、先にエラーハンドラで応答する
+				cxt.Error(err)
+			}
+			fields := []zap.Field{
+				zap.String("request_id", cxt.Response().Header().Get(echo.HeaderXRequestID)),
+				zap.String("method", cxt.Request().Method),
+				zap.String("path", cxt.Request().URL.Path),
+				zap.Int("status", cxt.Response().Status),
+				zap.Duration("latency", time.Since(start)),
+				zap.String("remote_ip", cxt.RealIP()),
+			}
+			if err != nil {
+				fields = append(fields, zap.Error(err))
+			}
+			logger.Info("http request", fields...)
+			return err
+		}
+	}
+}
+
+// build は HLS の配信を有効にした場合だけサービスを返す
+// secret を設定した場合はシグナリングと同じ参加トークンを要求する
+func (c HLSConfig) build(r rtc.RTC, hook webhook.Notifier, secret string) (service.Service, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	conf := hls.Config{SegmentDuration: c.SegmentDuration}
+	if c.LowLatency {
+		conf.PartDuration = c.PartDuration
+	}
+	h, err := egress.NewHLS(conf, hook)
 	if err != nil {
 		return nil, err
 	}
+	r.Observe(h)
+	return service.NewHLSService(h, secret), nil
+}
+
+func (c ForwardConfig) build(r rtc.RTC) (egress.RTPForwarder, error) {
+	allowed := make([]*net.IPNet, 0, len(c.AllowedDestinations))
+	for _, dst := range c.AllowedDestinations {
+		if _, n, err := net.ParseCIDR(dst); err == nil {
+			allowed = append(allowed, n)
+			continue
+		}
+		ip := net.ParseIP(dst)
+		if ip == nil {
+			return nil, fmt.Errorf("forward: invalid allowed destination: %s", dst)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return egress.NewRTPForwarder(r, allowed), nil
+}
+
+func (c StoreConfig) build() (store.Store, error) {
+	switch c.Type {
+	case "", "memory":
+		return store.NewMemoryStore(), nil
+	case "sqlite":
+		return store.NewSQLiteStore(c.Path)
+	default:
+		return nil, fmt.Errorf("unsupported store type: %s", c.Type)
+	}
+}
+
+func (c *Config) buildRTC(st store.Store, hook webhook.Notifier) (rtc.RTC, error) {
 	s, err := c.buildSettingEngine()
 	if err != nil {
 		return nil, err
 	}
+	instance, err := c.instance()
+	if err != nil {
+		return nil, err
+	}
 
-	r, err := rtc.NewAPI(s, m, i, &webrtc.Configuration{
+	defaults := c.RTC.Policy.apply(rtc.RoomOptions{
+		Codecs:       c.RTC.Codecs.apply(rtc.DefaultCodecPolicy),
+		AdaptiveRED:  c.RTC.AdaptiveRED,
+		EmptyTimeout: rtc.DEFAULT_EMPTY_TIMEOUT,
+	})
+	upstreamTLS, err := c.TLS.Client.Build()
+	if err != nil {
+		return nil, err
+	}
+	rooms := make(map[string]rtc.RoomOptions, len(c.RTC.Rooms))
+	for name, room := range c.RTC.Rooms {
+		o := room.apply(defaults)
+		if room.Upstream != "" {
+			node, ok := c.RTC.Nodes[room.Upstream]
+			if !ok {
+				return nil, fmt.Errorf("room %s: unknown node: %s", name, room.Upstream)
+			}
+			o.Upstream, o.UpstreamSecret, o.UpstreamTLS = node.URL, node.Secret, upstreamTLS
+		}
+		rooms[name] = o
+	}
+
+	return rtc.NewAPI(s, &webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{URLs: c.RTC.ICEServers},
 		},
-	})
+	}, defaults, rooms, st, instance, hook)
+}
+
+// instance は同じマシンで複数のインスタンスを動かしても重ならないよう、既定ではポート番号を含める
+func (c *Config) instance() (string, error) {
+	if c.Store.Instance != "" {
+		return c.Store.Instance, nil
+	}
+	host, err := os.Hostname()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port)), nil
+}
+
+func (c RoomConfig) apply(o rtc.RoomOptions) rtc.RoomOptions {
+	o.Codecs = c.Codecs.apply(o.Codecs)
+	if c.AdaptiveRED != nil {
+		o.AdaptiveRED = *c.AdaptiveRED
 	}
-	svc := service.NewRTCService(r)
-	return svc, nil
+	return c.Policy.apply(o)
+}
+
+func (c RoomPolicyConfig) apply(o rtc.RoomOptions) rtc.RoomOptions {
+	if c.MaxParticipants != nil {
+		o.MaxParticipants = *c.MaxParticipants
+	}
+	if c.MaxPublishers != nil {
+		o.MaxPublishers = *c.MaxPublishers
+	}
+	if c.EmptyTimeout != nil {
+		o.EmptyTimeout = *c.EmptyTimeout
+	}
+	if c.MaxDuration != nil {
+		o.MaxDuration = *c.MaxDuration
+	}
+	if c.MaxAudioBitrate != nil {
+		o.MaxAudioBitrate = *c.MaxAudioBitrate
+	}
+	if c.MaxVideoBitrate != nil {
+		o.MaxVideoBitrate = *c.MaxVideoBitrate
+	}
+	if c.EgressBitrate != nil {
+		o.EgressBitrate = *c.EgressBitrate
+	}
+	return o
+}
+
+func (c CodecPolicyConfig) apply(p rtc.CodecPolicy) rtc.CodecPolicy {
+	if len(c.Allowed) > 0 {
+		p.Codecs = c.Allowed
+	}
+	if len(c.H264ProfileLevelIDs) > 0 {
+		p.H264ProfileLevelIDs = c.H264ProfileLevelIDs
+	}
+	if c.RTX != nil {
+		p.RTX = *c.RTX
+	}
+	if c.FEC != nil {
+		p.FEC = *c.FEC
+	}
+	return p
 }
 
 func (c *Config) buildSettingEngine() (*webrtc.SettingEngine, error) {
 	s := &webrtc.SettingEngine{}
+	if c.RTC.ICELoopback {
+		s.SetIncludeLoopbackCandidate(true)
+		s.SetIPFilter(func(ip net.IP) bool {
+			return ip.IsLoopback()
+		})
+	}
 	if !c.RTC.ICETCP.Enabled {
 		return s, nil
 	}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	ErrTLSNoCertificate = errors.New("tls: cert_file and key_file, or self_signed is required")
+	ErrTLSInvalidCA     = errors.New("tls: client_ca_file has no certificates")
+	ErrTLSInvalidRootCA = errors.New("tls: client.ca_file has no certificates")
+	ErrTLSClientKeyPair = errors.New("tls: client.cert_file and client.key_file must be set together")
+)
+
+// 自己署名証明書の有効期間
+const SELF_SIGNED_CERTIFICATE_VALIDITY = 365 * 24 * time.Hour
+
+// TLSConfig を有効にすると HTTPS と WSS で配信する
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled,omitempty"`
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// 証明書を指定しない場合に、起動のたびに自己署名証明書を生成する。開発用
+	SelfSigned bool `yaml:"self_signed,omitempty"`
+	// 自己署名証明書に含めるホスト名と IP アドレス
+	Hosts []string `yaml:"hosts,omitempty"`
+	// 指定した場合は、この CA が署名したクライアント証明書を持つクライアントだけを受け付ける
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+	// 中継や CLI のサブコマンドが TLS を有効にしたサーバに接続するときの設定。enabled に関わらず使う
+	Client ClientTLSConfig `yaml:"client,omitempty"`
+}
+
+// ClientTLSConfig は self_signed や client_ca_file を設定したサーバに接続するための設定
+type ClientTLSConfig struct {
+	// サーバ証明書を検証する CA。省略した場合はシステムの CA を使う
+	CAFile string `yaml:"ca_file,omitempty"`
+	// client_ca_file を設定したサーバに提示するクライアント証明書
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// サーバ証明書を検証しない。self_signed のサーバに接続する開発用
+	Insecure bool `yaml:"insecure,omitempty"`
+}
+
+func (c TLSConfig) build() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case c.CertFile != "" && c.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case c.SelfSigned:
+		cert, err := selfSignedCertificate(c.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	default:
+		return nil, ErrTLSNoCertificate
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile, ErrTLSInvalidCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Build は接続に使う tls.Config を作る。何も設定していない場合は nil を返し、既定の設定で接続する
+func (c ClientTLSConfig) Build() (*tls.Config, error) {
+	if c == (ClientTLSConfig{}) {
+		return nil, nil
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile, ErrTLSInvalidRootCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	switch {
+	case c.CertFile != "" && c.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case c.CertFile != "" || c.KeyFile != "":
+		return nil, ErrTLSClientKeyPair
+	}
+	return conf, nil
+}
+
+// loadCertPool は PEM の証明書を読み込む。証明書が 1 つも無い場合は invalid を返す
+func loadCertPool(path string, invalid error) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, invalid
+	}
+	return pool, nil
+}
+
+// selfSignedCertificate は hosts に対する ECDSA P-256 の自己署名証明書を作る
+func selfSignedCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ruyka development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SELF_SIGNED_CERTIFICATE_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,3 @@
+// Package e2e はサーバを同じプロセスで起動し、実際のシグナリングを通して複数のピアをつなぐ結合テストを置く。
+// テストは go test ./pkg/e2e で動かす
+package e2e
@@ -0,0 +1,380 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"ruyka/pkg/admin"
+	"ruyka/pkg/config"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/token"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestForwardsPublishedTracks(t *testing.T) {
+	h := newHarness(t, nil)
+	pub := h.join("publisher", "forward", true)
+	pub.waitConnected()
+	sub := h.join("subscriber", "forward", false)
+	sub.waitConnected()
+
+	tracks := sub.waitTracks(2)
+	for _, local := range pub.local {
+		tr, ok := tracks[local.ID()]
+		if !ok {
+			t.Fatalf("track %s is not forwarded", local.ID())
+		}
+		if tr.Codec().MimeType != local.Codec().MimeType {
+			t.Errorf("track %s: codec %s, want %s", local.ID(), tr.Codec().MimeType, local.Codec().MimeType)
+		}
+		want := opusPayload
+		if local.Codec().MimeType == webrtc.MimeTypeVP8 {
+			want = vp8Payload
+		}
+		if got := readPayload(t, tr); !bytes.Equal(got, want) {
+			t.Errorf("track %s: payload %x, want %x", local.ID(), got, want)
+		}
+	}
+	if len(pub.tracks) != 0 {
+		t.Error("publisher receives its own tracks")
+	}
+}
+
+func TestRenegotiatesWhenPublisherJoinsAndLeaves(t *testing.T) {
+	h := newHarness(t, nil)
+	sub := h.join("subscriber", "renegotiation", false)
+	sub.waitConnected()
+
+	// 購読者の接続後に配信が始まっても、再ネゴシエーションでトラックが届く
+	pub := h.join("publisher", "renegotiation", true)
+	joined := sub.waitEvent(rtc.EventTypeParticipantJoined)
+	tracks := sub.waitTracks(2)
+	for _, tr := range tracks {
+		readPayload(t, tr)
+	}
+
+	// 配信者が退出すると、再ネゴシエーションでトラックが取り除かれる
+	pub.close()
+	left := sub.waitEvent(rtc.EventTypeParticipantLeft)
+	if left.participant != joined.participant {
+		t.Errorf("left participant %s, want %s", left.participant, joined.participant)
+	}
+	for id, tr := range tracks {
+		done := make(chan error, 1)
+		go func(tr *webrtc.TrackRemote) {
+			for {
+				if _, _, err := tr.ReadRTP(); err != nil {
+					done <- err
+					return
+				}
+			}
+		}(tr)
+		select {
+		case <-done:
+		case <-time.After(eventTimeout):
+			t.Errorf("track %s is not removed", id)
+		}
+	}
+}
+
+func TestNotifiesExistingParticipants(t *testing.T) {
+	h := newHarness(t, nil)
+	first := h.join("first", "members", false)
+	first.waitConnected()
+	second := h.join("second", "members", false)
+
+	// 後から参加したピアはすでにいる参加者を知らされ、先にいたピアは新しい参加者を知らされる
+	existing := second.waitEvent(rtc.EventTypeParticipantJoined)
+	newcomer := first.waitEvent(rtc.EventTypeParticipantJoined)
+	if existing.participant == newcomer.participant {
+		t.Errorf("both peers are notified of the same participant %s", existing.participant)
+	}
+}
+
+func TestMuteIsNotifiedToSubscribers(t *testing.T) {
+	h := newHarness(t, nil)
+	pub := h.join("publisher", "mute", true)
+	pub.waitConnected()
+	sub := h.join("subscriber", "mute", false)
+	joined := sub.waitEvent(rtc.EventTypeParticipantJoined)
+	sub.waitTracks(2)
+
+	track := pub.local[0].ID()
+	if err := pub.Mute(track, true); err != nil {
+		t.Fatal(err)
+	}
+	e := sub.waitEvent(rtc.EventTypeTrackMuted)
+	if e.track != track || !e.muted || e.participant != joined.participant {
+		t.Errorf("unexpected track-muted event: %+v", e)
+	}
+}
+
+func TestMuteFailureIsNotifiedToSender(t *testing.T) {
+	h := newHarness(t, nil)
+	pub := h.join("publisher", "mute-failed", true)
+	pub.waitConnected()
+
+	// ネゴシエートしていないトラック ID ではミュートできない
+	if err := pub.Mute("unknown", true); err != nil {
+		t.Fatal(err)
+	}
+	if e := pub.waitEvent(rtc.EventTypeError); e.code != rtc.ErrorCodeMuteFailed {
+		t.Errorf("error code %s, want %s", e.code, rtc.ErrorCodeMuteFailed)
+	}
+}
+
+func TestRejectsPeersOverCapacity(t *testing.T) {
+	h := newHarness(t, func(c *config.Config) {
+		limit := 1
+		c.RTC.Policy.MaxParticipants = &limit
+	})
+	first := h.join("first", "capacity", false)
+	first.waitConnected()
+
+	second := h.join("second", "capacity", false)
+	if e := second.waitEvent(rtc.EventTypeError); e.code != rtc.ErrorCodeRoomFull {
+		t.Errorf("error code %s, want %s", e.code, rtc.ErrorCodeRoomFull)
+	}
+	select {
+	case <-second.Done():
+	case <-time.After(eventTimeout):
+		t.Error("rejected peer is not disconnected")
+	}
+}
+
+func TestTeardownRemovesRoomAndParticipants(t *testing.T) {
+	h := newHarness(t, func(c *config.Config) {
+		emptyTimeout := 100 * time.Millisecond
+		c.RTC.Policy.EmptyTimeout = &emptyTimeout
+	})
+	pub := h.join("publisher", "teardown", true)
+	pub.waitConnected()
+	sub := h.join("subscriber", "teardown", false)
+	sub.waitTracks(2)
+
+	participants := struct {
+		Participants []struct {
+			ID string `json:"id"`
+		} `json:"participants"`
+	}{}
+	h.getJSON("/rooms/teardown/participants", &participants)
+	if n := len(participants.Participants); n != 2 {
+		t.Fatalf("%d participants, want 2", n)
+	}
+
+	rooms := func() int {
+		res := struct {
+			Rooms []struct {
+				Name string `json:"name"`
+			} `json:"rooms"`
+		}{}
+		h.getJSON("/rooms", &res)
+		return len(res.Rooms)
+	}
+	if n := rooms(); n != 1 {
+		t.Fatalf("%d rooms, want 1", n)
+	}
+
+	// 最後の参加者が退出すると、ルームは閉じられて一覧から消える
+	sub.close()
+	pub.close()
+	h.eventually("room is removed", func() bool {
+		return rooms() == 0
+	})
+}
+
+func TestRelaysFromAuthenticatedUpstream(t *testing.T) {
+	upstream := newHarness(t, func(c *config.Config) {
+		c.Auth.Secret = "upstream-secret"
+	})
+	downstream := newHarness(t, func(c *config.Config) {
+		c.RTC.Nodes = map[string]config.NodeConfig{
+			"upstream": {URL: upstream.signalingURL(), Secret: "upstream-secret"},
+		}
+		c.RTC.Rooms = map[string]config.RoomConfig{
+			"relay": {Upstream: "upstream"},
+		}
+	})
+
+	pub := upstream.join("publisher", "relay", true)
+	pub.waitConnected()
+	sub := downstream.join("subscriber", "relay", false)
+	sub.waitConnected()
+
+	// 上流のノードに中継の参加トークンが受け付けられれば、配信者のトラックが届く
+	for _, tr := range sub.waitTracks(2) {
+		want := opusPayload
+		if tr.Codec().MimeType == webrtc.MimeTypeVP8 {
+			want = vp8Payload
+		}
+		if got := readPayload(t, tr); !bytes.Equal(got, want) {
+			t.Errorf("track %s: payload %x, want %x", tr.ID(), got, want)
+		}
+	}
+}
+
+func TestRelaysFromSelfSignedUpstreamWithClientCertificate(t *testing.T) {
+	ca, cert, key := writeClientCertificate(t, t.TempDir())
+	client := config.ClientTLSConfig{CertFile: cert, KeyFile: key, Insecure: true}
+	upstream := newHarness(t, func(c *config.Config) {
+		c.TLS = config.TLSConfig{Enabled: true, SelfSigned: true, ClientCAFile: ca, Client: client}
+	})
+	downstream := newHarness(t, func(c *config.Config) {
+		// 下流のノード自身は TLS を使わず、上流への接続にだけ tls.client を使う
+		c.TLS.Client = client
+		c.RTC.Nodes = map[string]config.NodeConfig{
+			"upstream": {URL: upstream.signalingURL()},
+		}
+		c.RTC.Rooms = map[string]config.RoomConfig{
+			"relay": {Upstream: "upstream"},
+		}
+	})
+
+	pub := upstream.join("publisher", "relay", true)
+	pub.waitConnected()
+	sub := downstream.join("subscriber", "relay", false)
+	sub.waitConnected()
+
+	// 上流のノードがクライアント証明書を受け付ければ、配信者のトラックが wss で中継される
+	for _, tr := range sub.waitTracks(2) {
+		want := opusPayload
+		if tr.Codec().MimeType == webrtc.MimeTypeVP8 {
+			want = vp8Payload
+		}
+		if got := readPayload(t, tr); !bytes.Equal(got, want) {
+			t.Errorf("track %s: payload %x, want %x", tr.ID(), got, want)
+		}
+	}
+
+	// admin の CLI も同じ tls.client の設定で接続できる
+	participants, err := admin.NewClient("https://"+upstream.addr, "", upstream.tls).Participants("relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 2 {
+		t.Errorf("participants: %d, want 2", len(participants))
+	}
+}
+
+func TestRelayReconnectsAsTheSameParticipant(t *testing.T) {
+	upstream := newHarness(t, func(c *config.Config) {
+		c.Auth.Secret = "upstream-secret"
+	})
+	downstream := newHarness(t, func(c *config.Config) {
+		c.RTC.Nodes = map[string]config.NodeConfig{
+			"upstream": {URL: upstream.signalingURL(), Secret: "upstream-secret"},
+		}
+		c.RTC.Rooms = map[string]config.RoomConfig{
+			"reconnect": {Upstream: "upstream"},
+		}
+	})
+
+	pub := upstream.join("publisher", "reconnect", true)
+	pub.waitConnected()
+	sub := downstream.join("subscriber", "reconnect", false)
+	sub.waitConnected()
+	sub.waitTracks(2)
+
+	relay, ok := downstream.participants("reconnect")[upstream.signalingURL()]
+	if !ok {
+		t.Fatal("relay is not a participant of the downstream room")
+	}
+	kicked, ok := upstream.participants("reconnect")[rtc.RELAY_IDENTITY]
+	if !ok {
+		t.Fatal("relay is not a participant of the upstream room")
+	}
+
+	// 上流で切断された中継は再接続し、トラックを配信し直す
+	upstream.delete("/rooms/reconnect/participants/" + kicked)
+	upstream.eventually("relay reconnects to upstream", func() bool {
+		id, ok := upstream.participants("reconnect")[rtc.RELAY_IDENTITY]
+		return ok && id != kicked
+	})
+	for _, tr := range sub.waitTracks(2) {
+		want := opusPayload
+		if tr.Codec().MimeType == webrtc.MimeTypeVP8 {
+			want = vp8Payload
+		}
+		if got := readPayload(t, tr); !bytes.Equal(got, want) {
+			t.Errorf("track %s: payload %x, want %x", tr.ID(), got, want)
+		}
+	}
+
+	// 下流のルームでは同じ参加者のまま配信を続ける
+	participants := downstream.participants("reconnect")
+	if id := participants[upstream.signalingURL()]; id != relay {
+		t.Errorf("relay participant %s, want %s", id, relay)
+	}
+	if n := len(participants); n != 2 {
+		t.Errorf("%d downstream participants, want 2", n)
+	}
+}
+
+func TestRelayStopsWhenServerCloses(t *testing.T) {
+	upstream := newHarness(t, func(c *config.Config) {
+		c.Auth.Secret = "upstream-secret"
+	})
+	pub := upstream.join("publisher", "stop", true)
+	pub.waitConnected()
+	downstream := newHarness(t, func(c *config.Config) {
+		c.RTC.Nodes = map[string]config.NodeConfig{
+			"upstream": {URL: upstream.signalingURL(), Secret: "upstream-secret"},
+		}
+		c.RTC.Rooms = map[string]config.RoomConfig{
+			"stop": {Upstream: "upstream"},
+		}
+	})
+	upstream.eventually("relay joins upstream", func() bool {
+		_, ok := upstream.participants("stop")[rtc.RELAY_IDENTITY]
+		return ok
+	})
+
+	// 下流のサーバを止めると、中継は上流から退出して再接続しない
+	downstream.close()
+	upstream.eventually("relay leaves upstream", func() bool {
+		_, ok := upstream.participants("stop")[rtc.RELAY_IDENTITY]
+		return !ok
+	})
+}
+
+func TestHLSRequiresJoinToken(t *testing.T) {
+	h := newHarness(t, func(c *config.Config) {
+		c.Auth.Secret = "secret"
+		c.HLS.Enabled = true
+	})
+	get := func(grant *token.Grant) int {
+		u := fmt.Sprintf("http://%s/hls/hls/index.m3u8", h.addr)
+		if grant != nil {
+			joinToken, err := token.Create("secret", *grant, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u += "?token=" + joinToken
+		}
+		res, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, c := range []struct {
+		name  string
+		grant *token.Grant
+		want  int
+	}{
+		{"without token", nil, http.StatusUnauthorized},
+		{"other room", &token.Grant{Room: "other", Identity: "viewer", CanSubscribe: true}, http.StatusForbidden},
+		{"publish only", &token.Grant{Room: "hls", Identity: "viewer", CanPublish: true}, http.StatusForbidden},
+		// トークンが通れば、配信していないルームとして扱う
+		{"valid", &token.Grant{Room: "hls", Identity: "viewer", CanSubscribe: true}, http.StatusNotFound},
+	} {
+		if got := get(c.grant); got != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, got, c.want)
+		}
+	}
+}
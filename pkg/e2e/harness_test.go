@@ -0,0 +1,472 @@
+package e2e
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"ruyka/pkg/client"
+	"ruyka/pkg/config"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/token"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// イベントを待つ時間の上限。ループバックでの接続は通常 1 秒もかからない
+const eventTimeout = 10 * time.Second
+
+// 合成したメディアのペイロード。VP8 はキーフレームとして転送される
+var (
+	vp8Payload  = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a, 0x01, 0x02, 0x03}
+	opusPayload = []byte{0xfc, 0xff, 0xfe}
+)
+
+type harness struct {
+	t    *testing.T
+	addr string
+	api  *webrtc.API
+	// 空でなければ参加するときにトークンを作る
+	secret string
+	// tls.enabled の場合は https と wss で、tls.client の設定を使って接続する
+	scheme string
+	tls    *tls.Config
+	http   *http.Client
+	// close はサーバを止める。テストの終わりにも呼ばれる
+	close func()
+}
+
+// newHarness はループバックの ICE だけを使うサーバを空いているポートで起動する。
+// configure で既定の設定を書き換えられる
+func newHarness(t *testing.T, configure func(*config.Config)) *harness {
+	t.Helper()
+
+	c := config.New()
+	c.Port = 0
+	c.RTC.ICEServers = nil
+	c.RTC.ICETCP.Enabled = false
+	c.RTC.ICELoopback = true
+	c.Logging.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
+	if configure != nil {
+		configure(c)
+	}
+	scheme, tlsConfig := "http", (*tls.Config)(nil)
+	if c.TLS.Enabled {
+		// self_signed の証明書はテストごとに作られるので検証しない
+		client := c.TLS.Client
+		client.Insecure = true
+		built, err := client.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheme, tlsConfig = "https", built
+	}
+	s, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Run()
+	var once sync.Once
+	close := func() {
+		once.Do(func() {
+			if err := s.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(close)
+
+	_, port, err := net.SplitHostPort(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &harness{
+		t:      t,
+		addr:   net.JoinHostPort("127.0.0.1", port),
+		api:    loopbackAPI(t),
+		secret: c.Auth.Secret,
+		scheme: scheme,
+		tls:    tlsConfig,
+		http:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		close:  close,
+	}
+}
+
+func loopbackAPI(t *testing.T) *webrtc.API {
+	t.Helper()
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		t.Fatal(err)
+	}
+	s := webrtc.SettingEngine{}
+	s.SetIncludeLoopbackCandidate(true)
+	s.SetIPFilter(func(ip net.IP) bool {
+		return ip.IsLoopback()
+	})
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+}
+
+func (h *harness) signalingURL() string {
+	if h.tls != nil {
+		return fmt.Sprintf("wss://%s/api/v1/signaling", h.addr)
+	}
+	return fmt.Sprintf("ws://%s/api/v1/signaling", h.addr)
+}
+
+// getJSON は admin API の応答を out に読み込む
+func (h *harness) getJSON(path string, out any) {
+	h.t.Helper()
+
+	res, err := h.http.Get(fmt.Sprintf("%s://%s/api/v1/admin%s", h.scheme, h.addr, path))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		h.t.Fatalf("GET %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// delete は admin API に DELETE を送る
+func (h *harness) delete(path string) {
+	h.t.Helper()
+
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s://%s/api/v1/admin%s", h.scheme, h.addr, path), nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	res, err := h.http.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		h.t.Fatalf("DELETE %s: %s", path, res.Status)
+	}
+}
+
+// participants はルームの参加者の名前と ID を返す
+func (h *harness) participants(room string) map[string]string {
+	h.t.Helper()
+
+	res := struct {
+		Participants []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"participants"`
+	}{}
+	h.getJSON("/rooms/"+room+"/participants", &res)
+	participants := map[string]string{}
+	for _, p := range res.Participants {
+		participants[p.Name] = p.ID
+	}
+	return participants
+}
+
+// eventually は cond が true を返すまで繰り返す
+func (h *harness) eventually(msg string, cond func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(eventTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out: %s", msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+type event struct {
+	typ         rtc.EventType
+	participant string
+	track       string
+	muted       bool
+	code        rtc.ErrorCode
+}
+
+// peer はシグナリングのイベントと受信したトラックをチャネルで受け取る
+type peer struct {
+	client.Client
+	t      *testing.T
+	name   string
+	events chan event
+	tracks chan *webrtc.TrackRemote
+	local  []*webrtc.TrackLocalStaticRTP
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// join はピアをルームに参加させる。publish を指定した場合は VP8 と Opus の合成メディアを配信する
+func (h *harness) join(name, room string, publish bool) *peer {
+	h.t.Helper()
+
+	p := &peer{
+		t:      h.t,
+		name:   name,
+		events: make(chan event, 64),
+		tracks: make(chan *webrtc.TrackRemote, 8),
+		stop:   make(chan struct{}),
+	}
+	tracks := []webrtc.TrackLocal{}
+	if publish {
+		streamID := xid.New().String()
+		for _, codec := range []webrtc.RTPCodecCapability{
+			{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		} {
+			track, err := webrtc.NewTrackLocalStaticRTP(codec, xid.New().String(), streamID)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			p.local = append(p.local, track)
+			tracks = append(tracks, track)
+		}
+	}
+
+	joinToken := ""
+	if h.secret != "" {
+		var err error
+		joinToken, err = token.Create(h.secret, token.Grant{
+			Room:         room,
+			Identity:     name,
+			CanPublish:   publish,
+			CanSubscribe: true,
+		}, time.Minute)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	c, err := client.New(client.Config{
+		URL:    h.signalingURL(),
+		Room:   room,
+		Token:  joinToken,
+		API:    h.api,
+		Tracks: tracks,
+		TLS:    h.tls,
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	p.Client = c
+	c.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		p.tracks <- tr
+	})
+	c.OnParticipantJoined(func(participant string) {
+		p.events <- event{typ: rtc.EventTypeParticipantJoined, participant: participant}
+	})
+	c.OnParticipantLeft(func(participant string) {
+		p.events <- event{typ: rtc.EventTypeParticipantLeft, participant: participant}
+	})
+	c.OnTrackMuted(func(m client.TrackMuted) {
+		p.events <- event{typ: rtc.EventTypeTrackMuted, participant: m.Participant, track: m.TrackID, muted: m.Muted}
+	})
+	c.OnError(func(e rtc.ErrorMessage) {
+		p.events <- event{typ: rtc.EventTypeError, code: e.Code}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(p.close)
+	if publish {
+		go p.publish()
+	}
+	return p
+}
+
+// publish は 20ms ごとに合成した RTP パケットを送る
+func (p *peer) publish() {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for seq := uint16(0); ; seq++ {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+		for _, track := range p.local {
+			payload, rate := opusPayload, uint32(48000)
+			if track.Codec().MimeType == webrtc.MimeTypeVP8 {
+				payload, rate = vp8Payload, 90000
+			}
+			pkt := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         true,
+					SequenceNumber: seq,
+					Timestamp:      uint32(seq) * rate / 50,
+				},
+				Payload: payload,
+			}
+			if err := track.WriteRTP(pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *peer) close() {
+	p.once.Do(func() {
+		close(p.stop)
+		p.Client.Close()
+	})
+}
+
+func (p *peer) waitConnected() {
+	p.t.Helper()
+
+	select {
+	case <-p.Connected():
+	case <-p.Done():
+		p.t.Fatalf("%s: disconnected before connecting: %v", p.name, p.Err())
+	case <-time.After(eventTimeout):
+		p.t.Fatalf("%s: timed out waiting for connection", p.name)
+	}
+}
+
+// waitEvent は typ のイベントが届くまで待つ。他のイベントは読み捨てる
+func (p *peer) waitEvent(typ rtc.EventType) event {
+	p.t.Helper()
+
+	timeout := time.After(eventTimeout)
+	for {
+		select {
+		case e := <-p.events:
+			if e.typ == typ {
+				return e
+			}
+		case <-timeout:
+			p.t.Fatalf("%s: timed out waiting for %s", p.name, typ)
+		}
+	}
+}
+
+// waitTracks は n 本のトラックを受信するまで待ち、トラック ID で引けるようにして返す
+func (p *peer) waitTracks(n int) map[string]*webrtc.TrackRemote {
+	p.t.Helper()
+
+	tracks := map[string]*webrtc.TrackRemote{}
+	timeout := time.After(eventTimeout)
+	for len(tracks) < n {
+		select {
+		case tr := <-p.tracks:
+			tracks[tr.ID()] = tr
+		case <-timeout:
+			p.t.Fatalf("%s: received %d of %d tracks", p.name, len(tracks), n)
+		}
+	}
+	return tracks
+}
+
+// readPayload は tr から RTP パケットを 1 つ読む
+func readPayload(t *testing.T, tr *webrtc.TrackRemote) []byte {
+	t.Helper()
+
+	type result struct {
+		pkt *rtp.Packet
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		pkt, _, err := tr.ReadRTP()
+		ch <- result{pkt, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("read %s: %v", tr.ID(), r.err)
+		}
+		return r.pkt.Payload
+	case <-time.After(eventTimeout):
+		t.Fatalf("timed out reading %s", tr.ID())
+	}
+	return nil
+}
+
+// writeClientCertificate は CA とその CA が署名したクライアント証明書を dir に書き出し、
+// CA、証明書、秘密鍵のパスを返す
+func writeClientCertificate(t *testing.T, dir string) (ca, cert, key string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ruyka test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ruyka test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write("ca.pem", "CERTIFICATE", caDER),
+		write("client.pem", "CERTIFICATE", clientDER),
+		write("client-key.pem", "EC PRIVATE KEY", keyDER)
+}
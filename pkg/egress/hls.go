@@ -0,0 +1,353 @@
+package egress
+
+import (
+	"encoding/binary"
+	"net/url"
+	"ruyka/pkg/hls"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/webhook"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// 配信が終わったプレイリストを、プレイヤーが最後まで再生できるように残しておく時間
+const HLS_ENDED_RETENTION = time.Minute
+
+// HLS はルームの H.264 映像と Opus 音声を HLS で配信する。
+// 映像のないルームは配信しない
+type HLS interface {
+	rtc.TrackObserver
+	Muxer(room string) (*hls.Muxer, bool)
+}
+
+type hlsEgress struct {
+	config hls.Config
+	hook   webhook.Notifier
+	mux    sync.Mutex
+	rooms  map[string]*hlsRoom
+}
+
+// hlsRoom はルームごとに 1 本の映像と 1 本の音声を購読する。
+// 映像の配信者が入れ替わった場合は新しい Muxer で配信し直す
+type hlsRoom struct {
+	name  string
+	start time.Time
+	muxer atomic.Pointer[hls.Muxer]
+	// 終端して recording_finished を通知した Muxer
+	ended *hls.Muxer
+	video *hlsVideoSink
+	audio *hlsAudioSink
+}
+
+// NewHLS は映像の配信が終わってプレイリストを終端するたびに、hook に recording_finished を通知する
+func NewHLS(c hls.Config, hook webhook.Notifier) (HLS, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &hlsEgress{
+		config: c,
+		hook:   hook,
+		mux:    sync.Mutex{},
+		rooms:  make(map[string]*hlsRoom),
+	}, nil
+}
+
+func (h *hlsEgress) Muxer(room string) (*hls.Muxer, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	r, ok := h.rooms[room]
+	if !ok {
+		return nil, false
+	}
+	m := r.muxer.Load()
+	return m, m != nil
+}
+
+func (h *hlsEgress) TrackPublished(t rtc.PublishedTrack) rtc.TrackSink {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	r, ok := h.rooms[t.Room]
+	if !ok {
+		r = &hlsRoom{name: t.Room, start: time.Now()}
+		h.rooms[t.Room] = r
+	}
+	switch {
+	case strings.EqualFold(t.Codec.MimeType, webrtc.MimeTypeH264) && r.video == nil:
+		r.video = newHLSVideoSink(h, r, t)
+		zap.L().Info("hls: subscribe video", zap.String("room", t.Room), zap.String("track", t.TrackID))
+		return r.video
+	case strings.EqualFold(t.Codec.MimeType, webrtc.MimeTypeOpus) && r.audio == nil:
+		r.audio = &hlsAudioSink{egress: h, room: r, clock: newRTPClock(r.start, t.Codec.ClockRate)}
+		zap.L().Info("hls: subscribe audio", zap.String("room", t.Room), zap.String("track", t.TrackID))
+		return r.audio
+	}
+	return nil
+}
+
+// startMuxer は最初のキーフレームが届いた時点で、購読している音声と合わせて初期化セグメントを作る
+func (h *hlsEgress) startMuxer(r *hlsRoom, sps, pps []byte) (*hls.Muxer, error) {
+	h.mux.Lock()
+	channels := uint8(0)
+	if r.audio != nil {
+		channels = 2
+	}
+	h.mux.Unlock()
+
+	m, err := hls.NewMuxer(h.config, sps, pps, channels)
+	if err != nil {
+		return nil, err
+	}
+	r.muxer.Store(m)
+	return m, nil
+}
+
+// endVideo は映像の配信が終わったルームのプレイリストを終端する。
+// 終端したプレイリストは HLS_ENDED_RETENTION の間だけ最後まで再生できる
+func (h *hlsEgress) endVideo(r *hlsRoom) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	r.video = nil
+	if m := r.muxer.Load(); m != nil && m != r.ended {
+		m.Close()
+		r.ended = m
+		h.hook.Notify(webhook.Event{
+			Event:    webhook.EventTypeRecordingFinished,
+			Room:     r.name,
+			Location: "/hls/" + url.PathEscape(r.name) + "/index.m3u8",
+		})
+	}
+	h.cleanup(r)
+}
+
+func (h *hlsEgress) endAudio(r *hlsRoom) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	r.audio = nil
+	h.cleanup(r)
+}
+
+// cleanup は何も購読していないルームをしばらくしてから取り除く。h.mux を Lock した状態で呼ぶ
+func (h *hlsEgress) cleanup(r *hlsRoom) {
+	if r.video != nil || r.audio != nil {
+		return
+	}
+	time.AfterFunc(HLS_ENDED_RETENTION, func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		if h.rooms[r.name] == r && r.video == nil && r.audio == nil {
+			delete(h.rooms, r.name)
+		}
+	})
+}
+
+// rtpClock は RTP タイムスタンプを、ルームの配信開始からのトラックごとのデコード時刻に変換する。
+// 音声と映像の同期には最初のパケットが届いた時刻を使う
+type rtpClock struct {
+	start   time.Time
+	rate    uint32
+	started bool
+	base    int64
+	last    uint32
+	elapsed int64
+}
+
+func newRTPClock(start time.Time, rate uint32) *rtpClock {
+	return &rtpClock{start: start, rate: rate}
+}
+
+func (c *rtpClock) dts(timestamp uint32) int64 {
+	if !c.started {
+		c.started = true
+		c.base = int64(time.Since(c.start).Seconds() * float64(c.rate))
+		c.last = timestamp
+	}
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+	return c.base + c.elapsed
+}
+
+type hlsAudioSink struct {
+	egress *hlsEgress
+	room   *hlsRoom
+	clock  *rtpClock
+}
+
+func (s *hlsAudioSink) WriteRTP(pkt *rtp.Packet) error {
+	dts := s.clock.dts(pkt.Timestamp)
+	m := s.room.muxer.Load()
+	if m == nil || !m.HasAudio() || len(pkt.Payload) == 0 {
+		return nil
+	}
+	m.WriteAudio(dts, pkt.Payload)
+	return nil
+}
+
+func (s *hlsAudioSink) Close() error {
+	s.egress.endAudio(s.room)
+	return nil
+}
+
+type hlsVideoSink struct {
+	egress *hlsEgress
+	room   *hlsRoom
+	track  rtc.PublishedTrack
+	clock  *rtpClock
+	done   chan struct{}
+	once   sync.Once
+
+	depacketizer *codecs.H264Packet
+	frame        []byte
+	timestamp    uint32
+	lastSeq      uint16
+	started      bool
+	// パケットが欠けたフレームを捨て、次のキーフレームまで書き込まない
+	broken   bool
+	dropping bool
+	dropTS   uint32
+	sps, pps []byte
+	muxer    *hls.Muxer
+}
+
+func newHLSVideoSink(h *hlsEgress, r *hlsRoom, t rtc.PublishedTrack) *hlsVideoSink {
+	s := &hlsVideoSink{
+		egress:       h,
+		room:         r,
+		track:        t,
+		clock:        newRTPClock(r.start, t.Codec.ClockRate),
+		done:         make(chan struct{}),
+		depacketizer: &codecs.H264Packet{IsAVC: true},
+	}
+	go s.requestKeyframes()
+	return s
+}
+
+// requestKeyframes はセグメントを区切れるよう、セグメントの長さごとにキーフレームを要求する
+func (s *hlsVideoSink) requestKeyframes() {
+	s.track.RequestKeyframe()
+
+	ticker := time.NewTicker(s.egress.config.SegmentDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.track.RequestKeyframe()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *hlsVideoSink) WriteRTP(pkt *rtp.Packet) error {
+	if s.started && pkt.SequenceNumber != s.lastSeq+1 {
+		s.broken = true
+		s.dropping, s.dropTS = true, pkt.Timestamp
+		s.frame = nil
+		s.depacketizer = &codecs.H264Packet{IsAVC: true}
+		s.track.RequestKeyframe()
+	}
+	s.started = true
+	s.lastSeq = pkt.SequenceNumber
+	if s.dropping {
+		if pkt.Timestamp == s.dropTS {
+			return nil
+		}
+		s.dropping = false
+	}
+
+	if len(s.frame) > 0 && pkt.Timestamp != s.timestamp {
+		s.writeFrame()
+	}
+	s.timestamp = pkt.Timestamp
+
+	data, err := s.depacketizer.Unmarshal(pkt.Payload)
+	if err != nil {
+		s.broken = true
+		return nil
+	}
+	s.frame = append(s.frame, data...)
+	if pkt.Marker {
+		s.writeFrame()
+	}
+	return nil
+}
+
+// writeFrame は 1 フレーム分の NALU を Muxer に書き込む。SPS と PPS はキーフレームの先頭にそろえる
+func (s *hlsVideoSink) writeFrame() {
+	frame := s.frame
+	s.frame = nil
+	dts := s.clock.dts(s.timestamp)
+
+	nalus := [][]byte{}
+	keyframe := false
+	for len(frame) >= 4 {
+		n := int(binary.BigEndian.Uint32(frame))
+		if n == 0 || len(frame) < 4+n {
+			s.broken = true
+			return
+		}
+		nalu := frame[4 : 4+n]
+		frame = frame[4+n:]
+
+		switch nalu[0] & 0x1f {
+		case hls.NALUTypeSPS:
+			s.sps = nalu
+		case hls.NALUTypePPS:
+			s.pps = nalu
+		case hls.NALUTypeAUD:
+		case hls.NALUTypeIDR:
+			keyframe = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	if keyframe {
+		if s.sps == nil || s.pps == nil {
+			return
+		}
+		s.broken = false
+		nalus = append([][]byte{s.sps, s.pps}, nalus...)
+	}
+	if s.broken || len(nalus) == 0 {
+		return
+	}
+
+	if s.muxer == nil {
+		if !keyframe {
+			return
+		}
+		m, err := s.egress.startMuxer(s.room, s.sps, s.pps)
+		if err != nil {
+			zap.L().Warn("hls: failed to start muxer", zap.String("room", s.track.Room), zap.Error(err))
+			s.broken = true
+			return
+		}
+		s.muxer = m
+	}
+
+	sample := []byte{}
+	for _, nalu := range nalus {
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	s.muxer.WriteVideo(dts, keyframe, sample)
+}
+
+func (s *hlsVideoSink) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.egress.endVideo(s.room)
+	})
+	return nil
+}
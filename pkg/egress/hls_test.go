@@ -0,0 +1,429 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"ruyka/pkg/hls"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/webhook"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// 320x240 の Baseline プロファイルの SPS と PPS
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x05, 0x07, 0xe4}
+	testPPS = []byte{0x68, 0xce, 0x38, 0x80}
+)
+
+const (
+	testFrameRate   = 30
+	testKeyInterval = 30
+)
+
+type recordingNotifier struct {
+	mux    sync.Mutex
+	events []webhook.Event
+}
+
+func (n *recordingNotifier) Notify(e webhook.Event) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.events = append(n.events, e)
+}
+
+// rtpWriter は H.264 と Opus の合成した RTP パケットを購読者に書き込む
+type rtpWriter struct {
+	t            *testing.T
+	video, audio rtc.TrackSink
+	videoSeq     uint16
+	audioSeq     uint16
+	audioSent    int
+}
+
+func newRTPWriter(t *testing.T, h HLS, room string) *rtpWriter {
+	t.Helper()
+
+	// 初期化セグメントに音声を含めるため、映像のキーフレームより先に音声を購読させる
+	audio := h.TrackPublished(rtc.PublishedTrack{
+		Room:            room,
+		TrackID:         "audio",
+		Kind:            webrtc.RTPCodecTypeAudio,
+		Codec:           webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		RequestKeyframe: func() {},
+	})
+	video := h.TrackPublished(rtc.PublishedTrack{
+		Room:            room,
+		TrackID:         "video",
+		Kind:            webrtc.RTPCodecTypeVideo,
+		Codec:           webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		RequestKeyframe: func() {},
+	})
+	if audio == nil || video == nil {
+		t.Fatal("hls does not subscribe h264 and opus tracks")
+	}
+	return &rtpWriter{t: t, video: video, audio: audio}
+}
+
+func (w *rtpWriter) write(sink rtc.TrackSink, seq *uint16, timestamp uint32, marker bool, payload []byte) {
+	w.t.Helper()
+
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: *seq,
+			Timestamp:      timestamp,
+			Marker:         marker,
+		},
+		Payload: payload,
+	}
+	*seq++
+	if err := sink.WriteRTP(pkt); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+// frames はフレームごとに映像を書き込み、その時刻までの 20ms ごとの音声を続けて書き込む。
+// キーフレームは SPS と PPS を単一 NAL で送り、IDR を FU-A で 2 つに分ける
+func (w *rtpWriter) frames(from, to int) {
+	w.t.Helper()
+
+	for i := from; i < to; i++ {
+		timestamp := uint32(i * 90000 / testFrameRate)
+		if i%testKeyInterval == 0 {
+			idr := append([]byte{0x65}, bytes.Repeat([]byte{byte(i)}, 200)...)
+			w.write(w.video, &w.videoSeq, timestamp, false, testSPS)
+			w.write(w.video, &w.videoSeq, timestamp, false, testPPS)
+			w.write(w.video, &w.videoSeq, timestamp, false, append([]byte{0x7c, 0x85}, idr[1:101]...))
+			w.write(w.video, &w.videoSeq, timestamp, true, append([]byte{0x7c, 0x45}, idr[101:]...))
+		} else {
+			w.write(w.video, &w.videoSeq, timestamp, true, []byte{0x41, 0x9a, byte(i)})
+		}
+
+		for ; w.audioSent*20 <= i*1000/testFrameRate; w.audioSent++ {
+			w.write(w.audio, &w.audioSeq, uint32(w.audioSent*960), true, []byte{0xfc, 0xff, 0xfe})
+		}
+	}
+}
+
+type box struct {
+	typ  string
+	body []byte
+	// 親のボックス (トップレベルの場合はファイル) の先頭からの位置
+	offset int
+}
+
+// parseBoxes は b に並んだボックスを読む
+func parseBoxes(t *testing.T, b []byte) []box {
+	t.Helper()
+
+	boxes := []box{}
+	for offset := 0; offset < len(b); {
+		if len(b)-offset < 8 {
+			t.Fatalf("truncated box header at %d", offset)
+		}
+		size := int(binary.BigEndian.Uint32(b[offset:]))
+		if size < 8 || offset+size > len(b) {
+			t.Fatalf("invalid box size %d at %d", size, offset)
+		}
+		boxes = append(boxes, box{typ: string(b[offset+4 : offset+8]), body: b[offset+8 : offset+size], offset: offset})
+		offset += size
+	}
+	return boxes
+}
+
+func boxTypes(boxes []box) string {
+	types := make([]string, 0, len(boxes))
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	return strings.Join(types, " ")
+}
+
+// child は path ("mdia/minf") をたどった先のボックスを返す。skip は中身の前にあるフィールドの長さ
+func child(t *testing.T, parent box, path string, skip map[string]int) box {
+	t.Helper()
+
+	current := parent
+	for _, typ := range strings.Split(path, "/") {
+		found := false
+		for _, b := range parseBoxes(t, current.body[skip[current.typ]:]) {
+			if b.typ == typ {
+				current, found = b, true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("%s has no %s", current.typ, typ)
+		}
+	}
+	return current
+}
+
+// サンプルエントリなど、子のボックスの前にフィールドを持つボックス
+var boxFields = map[string]int{"stsd": 8, "avc3": 78, "Opus": 28}
+
+func checkInitSegment(t *testing.T, init []byte) {
+	t.Helper()
+
+	top := parseBoxes(t, init)
+	if got := boxTypes(top); got != "ftyp moov" {
+		t.Fatalf("init segment boxes %q, want \"ftyp moov\"", got)
+	}
+	moov := top[1]
+	traks := parseBoxes(t, moov.body)
+	if got := boxTypes(traks); got != "mvhd trak trak mvex" {
+		t.Fatalf("moov boxes %q, want \"mvhd trak trak mvex\"", got)
+	}
+
+	video, audio := traks[1], traks[2]
+	tkhd := child(t, video, "tkhd", nil)
+	if width, height := binary.BigEndian.Uint32(tkhd.body[76:]), binary.BigEndian.Uint32(tkhd.body[80:]); width != 320<<16 || height != 240<<16 {
+		t.Errorf("video size %dx%d, want 320x240", width>>16, height>>16)
+	}
+	if handler := string(child(t, video, "mdia/hdlr", nil).body[8:12]); handler != "vide" {
+		t.Errorf("video handler %q, want vide", handler)
+	}
+	avcC := child(t, video, "mdia/minf/stbl/stsd/avc3/avcC", boxFields)
+	if !bytes.Contains(avcC.body, testSPS) || !bytes.Contains(avcC.body, testPPS) {
+		t.Error("avcC does not contain the sps and pps")
+	}
+	if handler := string(child(t, audio, "mdia/hdlr", nil).body[8:12]); handler != "soun" {
+		t.Errorf("audio handler %q, want soun", handler)
+	}
+	dOps := child(t, audio, "mdia/minf/stbl/stsd/Opus/dOps", boxFields)
+	if channels := dOps.body[1]; channels != 2 {
+		t.Errorf("opus channels %d, want 2", channels)
+	}
+}
+
+// checkFragments は moof と mdat の組を確かめ、映像と音声のサンプル数を返す
+func checkFragments(t *testing.T, data []byte) (video, audio int) {
+	t.Helper()
+
+	top := parseBoxes(t, data)
+	if len(top) == 0 || len(top)%2 != 0 {
+		t.Fatalf("fragment boxes %q, want pairs of moof and mdat", boxTypes(top))
+	}
+	for i := 0; i < len(top); i += 2 {
+		moof, mdat := top[i], top[i+1]
+		if moof.typ != "moof" || mdat.typ != "mdat" {
+			t.Fatalf("fragment boxes %q, want pairs of moof and mdat", boxTypes(top))
+		}
+		mdatStart, mdatEnd := mdat.offset+8-moof.offset, mdat.offset+8+len(mdat.body)-moof.offset
+
+		boxes := parseBoxes(t, moof.body)
+		if boxes[0].typ != "mfhd" {
+			t.Fatalf("moof starts with %s, want mfhd", boxes[0].typ)
+		}
+		total := 0
+		for _, traf := range boxes[1:] {
+			if traf.typ != "traf" {
+				t.Fatalf("moof has %s, want traf", traf.typ)
+			}
+			trackID := binary.BigEndian.Uint32(child(t, traf, "tfhd", nil).body[4:])
+			trun := child(t, traf, "trun", nil).body
+			flags := binary.BigEndian.Uint32(trun) & 0xffffff
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			// tfhd の default-base-is-moof により moof の先頭からの位置
+			dataOffset := int(binary.BigEndian.Uint32(trun[8:]))
+
+			entry := 8
+			if flags&0x400 != 0 {
+				entry = 12
+			}
+			if len(trun) != 12+count*entry {
+				t.Fatalf("track %d: trun has %d bytes for %d samples", trackID, len(trun), count)
+			}
+			size := 0
+			for s := 0; s < count; s++ {
+				e := trun[12+s*entry:]
+				size += int(binary.BigEndian.Uint32(e[4:]))
+				// 映像のフラグメントはキーフレームから始まる
+				if trackID == 1 && s == 0 && binary.BigEndian.Uint32(e[8:]) != 0x02000000 {
+					t.Errorf("video fragment does not start with a sync sample")
+				}
+			}
+			if dataOffset < mdatStart || dataOffset+size > mdatEnd {
+				t.Fatalf("track %d: samples [%d, %d) are outside mdat [%d, %d)", trackID, dataOffset, dataOffset+size, mdatStart, mdatEnd)
+			}
+			total += size
+
+			switch trackID {
+			case 1:
+				video += count
+				// avc3 なのでパラメータセットをキーフレームのサンプルに含める
+				sample := data[moof.offset+dataOffset:]
+				if n := int(binary.BigEndian.Uint32(sample)); n != len(testSPS) || !bytes.Equal(sample[4:4+n], testSPS) {
+					t.Error("video fragment does not start with the sps")
+				}
+			case 2:
+				audio += count
+			default:
+				t.Fatalf("unexpected track id %d", trackID)
+			}
+		}
+		if total != len(mdat.body) {
+			t.Errorf("mdat has %d bytes, samples have %d", len(mdat.body), total)
+		}
+	}
+	return video, audio
+}
+
+var extinf = regexp.MustCompile(`#EXTINF:([0-9.]+),\n(segment-\d+\.m4s)\n`)
+
+func TestHLSSegmentsSyntheticRTP(t *testing.T) {
+	notifier := &recordingNotifier{}
+	h, err := NewHLS(hls.Config{SegmentDuration: time.Second}, notifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newRTPWriter(t, h, "room")
+	w.frames(0, 105)
+	w.video.Close()
+
+	m, ok := h.Muxer("room")
+	if !ok {
+		t.Fatal("muxer is not started")
+	}
+	b, err := m.Playlist(context.Background(), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(b)
+	for _, tag := range []string{
+		"#EXTM3U\n",
+		"#EXT-X-VERSION:6\n",
+		"#EXT-X-TARGETDURATION:1\n",
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-INDEPENDENT-SEGMENTS\n",
+		"#EXT-X-MAP:URI=\"init.mp4\"\n",
+	} {
+		if !strings.Contains(playlist, tag) {
+			t.Errorf("playlist has no %q:\n%s", tag, playlist)
+		}
+	}
+	// 映像の配信が終わるとプレイリストを終端する
+	if !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist is not ended:\n%s", playlist)
+	}
+
+	init, err := m.File(context.Background(), "init.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInitSegment(t, init)
+
+	// 1 秒ごとのキーフレームで区切り、最後は終端までの 0.5 秒
+	segments := extinf.FindAllStringSubmatch(playlist, -1)
+	wantDurations := []string{"1.000", "1.000", "1.000", "0.500"}
+	if len(segments) != len(wantDurations) {
+		t.Fatalf("%d segments, want %d:\n%s", len(segments), len(wantDurations), playlist)
+	}
+	video, audio := 0, 0
+	for i, s := range segments {
+		if s[1] != wantDurations[i] {
+			t.Errorf("%s: duration %s, want %s", s[2], s[1], wantDurations[i])
+		}
+		data, err := m.File(context.Background(), s[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, a := checkFragments(t, data)
+		video += v
+		audio += a
+	}
+	if video != 105 {
+		t.Errorf("%d video samples, want 105", video)
+	}
+	// 最初のキーフレームより前の音声と、最後の音声は書き込まれない
+	if audio < 170 || audio > 176 {
+		t.Errorf("%d audio samples, want about 175", audio)
+	}
+
+	notifier.mux.Lock()
+	defer notifier.mux.Unlock()
+	if len(notifier.events) != 1 || notifier.events[0].Event != webhook.EventTypeRecordingFinished {
+		t.Fatalf("events %+v, want one recording_finished", notifier.events)
+	}
+	if location := notifier.events[0].Location; location != "/hls/room/index.m3u8" {
+		t.Errorf("location %q, want /hls/room/index.m3u8", location)
+	}
+}
+
+var extPart = regexp.MustCompile(`#EXT-X-PART:DURATION=([0-9.]+),URI="(part-\d+-\d+\.m4s)"(,INDEPENDENT=YES)?\n`)
+
+func TestHLSLowLatencyParts(t *testing.T) {
+	h, err := NewHLS(hls.Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond}, &recordingNotifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newRTPWriter(t, h, "room")
+	w.frames(0, 45)
+
+	m, ok := h.Muxer("room")
+	if !ok {
+		t.Fatal("muxer is not started")
+	}
+	b, err := m.Playlist(context.Background(), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(b)
+	for _, tag := range []string{
+		"#EXT-X-VERSION:9\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.600\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.200\n",
+	} {
+		if !strings.Contains(playlist, tag) {
+			t.Errorf("playlist has no %q:\n%s", tag, playlist)
+		}
+	}
+	if strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		t.Errorf("playlist is ended while streaming:\n%s", playlist)
+	}
+	if !regexp.MustCompile(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-\d+-\d+\.m4s"\n$`).MatchString(playlist) {
+		t.Errorf("playlist does not end with a preload hint:\n%s", playlist)
+	}
+
+	parts := extPart.FindAllStringSubmatch(playlist, -1)
+	if len(parts) < 5 {
+		t.Fatalf("%d parts, want at least 5:\n%s", len(parts), playlist)
+	}
+	for i, p := range parts {
+		duration, err := strconv.ParseFloat(p[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duration > 0.2 {
+			t.Errorf("%s: duration %s exceeds the part target", p[2], p[1])
+		}
+		// セグメントの先頭のパートだけがキーフレームから始まる
+		var msn, index int
+		if _, err := fmt.Sscanf(p[2], "part-%d-%d.m4s", &msn, &index); err != nil {
+			t.Fatal(err)
+		}
+		if independent := p[3] != ""; independent != (index == 0) {
+			t.Errorf("part %d (%s): independent %v", i, p[2], independent)
+		}
+
+		data, err := m.File(context.Background(), p[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == 0 {
+			checkFragments(t, data)
+		} else if got := boxTypes(parseBoxes(t, data)); got != "moof mdat" {
+			t.Errorf("%s: boxes %q, want \"moof mdat\"", p[2], got)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package egress
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"ruyka/pkg/rtc"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrForwardNotFound      = errors.New("rtp forward is not found")
+	ErrUnsupportedSRTPSuite = errors.New("unsupported srtp crypto suite")
+	ErrInvalidSRTPKey       = errors.New("srtp key must be base64 of a 16 byte master key and a 14 byte master salt")
+	ErrInvalidForwardDst    = errors.New("rtp forward destination must have a host and a port")
+	ErrForwardDstNotAllowed = errors.New("rtp forward destination is not in forward.allowed_destinations")
+)
+
+const (
+	// 転送先の SDP で使うペイロードタイプ
+	RTP_FORWARD_VIDEO_PAYLOAD_TYPE = 96
+	RTP_FORWARD_AUDIO_PAYLOAD_TYPE = 111
+
+	srtpMasterKeyLen  = 16
+	srtpMasterSaltLen = 14
+)
+
+// SRTP のクリプトスイートは SDP の a=crypto (RFC 4568) と同じ名前で指定する
+var srtpSuites = map[string]srtp.ProtectionProfile{
+	"AES_CM_128_HMAC_SHA1_80": srtp.ProtectionProfileAes128CmHmacSha1_80,
+	"AES_CM_128_HMAC_SHA1_32": srtp.ProtectionProfileAes128CmHmacSha1_32,
+}
+
+type RTPForwardOptions struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// 空でなければ SRTP で暗号化する
+	SRTP *SRTPOptions `json:"srtp,omitempty"`
+}
+
+type SRTPOptions struct {
+	Suite string `json:"suite"`
+	// マスターキーとマスターソルトを連結して base64 にしたもの (a=crypto の inline と同じ形式)
+	Key string `json:"key"`
+}
+
+type RTPForward struct {
+	ID          string    `json:"id"`
+	Room        string    `json:"room"`
+	TrackID     string    `json:"track"`
+	Participant string    `json:"participant"`
+	Destination string    `json:"destination"`
+	SRTP        bool      `json:"srtp"`
+	SDP         string    `json:"sdp"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RTPForwarder は配信されたトラックを RTP (または SRTP) で UDP の宛先に転送する。
+// 転送はトラックの配信が終わると止まる
+type RTPForwarder interface {
+	Start(trackID string, o RTPForwardOptions) (RTPForward, error)
+	Stop(id string) error
+	Forwards() []RTPForward
+	Forward(id string) (RTPForward, error)
+}
+
+type rtpForwarder struct {
+	rtc      rtc.RTC
+	allowed  []*net.IPNet
+	mux      sync.Mutex
+	forwards map[string]*rtpForwardSink
+}
+
+// NewRTPForwarder は allowed に含まれるアドレスにだけ転送する。
+// allowed が空の場合は転送を受け付けない
+func NewRTPForwarder(r rtc.RTC, allowed []*net.IPNet) RTPForwarder {
+	return &rtpForwarder{
+		rtc:      r,
+		allowed:  allowed,
+		mux:      sync.Mutex{},
+		forwards: make(map[string]*rtpForwardSink),
+	}
+}
+
+// isAllowed は名前解決した後のアドレスで判定し、許可したホスト名が別のアドレスを指すように変えられても転送しない
+func (f *rtpForwarder) isAllowed(ip net.IP) bool {
+	for _, n := range f.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *rtpForwarder) Start(trackID string, o RTPForwardOptions) (RTPForward, error) {
+	t, err := f.rtc.PublishedTrack(trackID)
+	if err != nil {
+		return RTPForward{}, err
+	}
+	if o.Host == "" || o.Port <= 0 || o.Port > 0xffff {
+		return RTPForward{}, ErrInvalidForwardDst
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(o.Host, strconv.Itoa(o.Port)))
+	if err != nil {
+		return RTPForward{}, err
+	}
+	if !f.isAllowed(addr.IP) {
+		return RTPForward{}, ErrForwardDstNotAllowed
+	}
+
+	var ctx *srtp.Context
+	if o.SRTP != nil {
+		ctx, err = newSRTPContext(o.SRTP)
+		if err != nil {
+			return RTPForward{}, err
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return RTPForward{}, err
+	}
+
+	payloadType := uint8(RTP_FORWARD_VIDEO_PAYLOAD_TYPE)
+	if t.Kind == webrtc.RTPCodecTypeAudio {
+		payloadType = RTP_FORWARD_AUDIO_PAYLOAD_TYPE
+	}
+	ssrc := make([]byte, 4)
+	if _, err := rand.Read(ssrc); err != nil {
+		conn.Close()
+		return RTPForward{}, err
+	}
+	id := xid.New().String()
+	s := &rtpForwardSink{
+		forwarder:   f,
+		logger:      rtc.RoomLogger(zap.L(), t.Room).With(zap.String("id", id), zap.String("track", t.TrackID)),
+		conn:        conn,
+		srtp:        ctx,
+		payloadType: payloadType,
+		ssrc:        binary.BigEndian.Uint32(ssrc),
+		info: RTPForward{
+			ID:          id,
+			Room:        t.Room,
+			TrackID:     t.TrackID,
+			Participant: t.Participant,
+			Destination: conn.RemoteAddr().String(),
+			SRTP:        ctx != nil,
+			SDP:         forwardSDP(t, addr.IP, o, payloadType),
+			CreatedAt:   time.Now(),
+		},
+	}
+
+	f.mux.Lock()
+	f.forwards[s.info.ID] = s
+	f.mux.Unlock()
+	if err := f.rtc.Subscribe(trackID, s); err != nil {
+		s.Close()
+		return RTPForward{}, err
+	}
+	// 転送先がすぐにデコードを始められるようにする
+	t.RequestKeyframe()
+
+	s.logger.Info("rtp forward: started", zap.String("destination", s.info.Destination))
+	return s.info, nil
+}
+
+func newSRTPContext(o *SRTPOptions) (*srtp.Context, error) {
+	profile, ok := srtpSuites[o.Suite]
+	if !ok {
+		return nil, ErrUnsupportedSRTPSuite
+	}
+	key, err := base64.StdEncoding.DecodeString(o.Key)
+	if err != nil || len(key) != srtpMasterKeyLen+srtpMasterSaltLen {
+		return nil, ErrInvalidSRTPKey
+	}
+	return srtp.CreateContext(key[:srtpMasterKeyLen], key[srtpMasterKeyLen:], profile)
+}
+
+// forwardSDP は ffmpeg や GStreamer に渡せる受信用の SDP を作る
+func forwardSDP(t rtc.PublishedTrack, ip net.IP, o RTPForwardOptions, payloadType uint8) string {
+	addrType := "IP4"
+	if ip.To4() == nil {
+		addrType = "IP6"
+	}
+	media, proto := "video", "RTP/AVP"
+	if t.Kind == webrtc.RTPCodecTypeAudio {
+		media = "audio"
+	}
+	if o.SRTP != nil {
+		proto = "RTP/SAVP"
+	}
+	codec := strings.TrimPrefix(strings.TrimPrefix(t.Codec.MimeType, "video/"), "audio/")
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "v=0\r\n")
+	fmt.Fprintf(b, "o=- %d 0 IN %s %s\r\n", time.Now().Unix(), addrType, ip)
+	fmt.Fprintf(b, "s=ruyka %s\r\n", t.TrackID)
+	fmt.Fprintf(b, "c=IN %s %s\r\n", addrType, ip)
+	fmt.Fprintf(b, "t=0 0\r\n")
+	fmt.Fprintf(b, "m=%s %d %s %d\r\n", media, o.Port, proto, payloadType)
+	if t.Codec.Channels > 0 {
+		fmt.Fprintf(b, "a=rtpmap:%d %s/%d/%d\r\n", payloadType, codec, t.Codec.ClockRate, t.Codec.Channels)
+	} else {
+		fmt.Fprintf(b, "a=rtpmap:%d %s/%d\r\n", payloadType, codec, t.Codec.ClockRate)
+	}
+	if t.Codec.SDPFmtpLine != "" {
+		fmt.Fprintf(b, "a=fmtp:%d %s\r\n", payloadType, t.Codec.SDPFmtpLine)
+	}
+	if o.SRTP != nil {
+		fmt.Fprintf(b, "a=crypto:1 %s inline:%s\r\n", o.SRTP.Suite, o.SRTP.Key)
+	}
+	fmt.Fprintf(b, "a=recvonly\r\n")
+	return b.String()
+}
+
+func (f *rtpForwarder) Stop(id string) error {
+	f.mux.Lock()
+	s, ok := f.forwards[id]
+	f.mux.Unlock()
+	if !ok {
+		return ErrForwardNotFound
+	}
+	f.rtc.Unsubscribe(s.info.TrackID, s)
+	return s.Close()
+}
+
+func (f *rtpForwarder) Forwards() []RTPForward {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	forwards := make([]RTPForward, 0, len(f.forwards))
+	for id := range f.forwards {
+		forwards = append(forwards, f.forwards[id].info)
+	}
+	return forwards
+}
+
+func (f *rtpForwarder) Forward(id string) (RTPForward, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	s, ok := f.forwards[id]
+	if !ok {
+		return RTPForward{}, ErrForwardNotFound
+	}
+	return s.info, nil
+}
+
+type rtpForwardSink struct {
+	forwarder   *rtpForwarder
+	logger      *zap.Logger
+	conn        *net.UDPConn
+	srtp        *srtp.Context
+	payloadType uint8
+	ssrc        uint32
+	info        RTPForward
+	once        sync.Once
+}
+
+func (s *rtpForwardSink) WriteRTP(pkt *rtp.Packet) error {
+	pkt.PayloadType = s.payloadType
+	pkt.SSRC = s.ssrc
+	// 転送先がネゴシエートしていないヘッダ拡張は外す
+	pkt.Extension = false
+	pkt.Extensions = nil
+
+	b, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	if s.srtp != nil {
+		if b, err = s.srtp.EncryptRTP(nil, b, &pkt.Header); err != nil {
+			return err
+		}
+	}
+	// 転送先が起動していない間の ICMP unreachable では止めない
+	if _, err := s.conn.Write(b); err != nil && !isConnRefused(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *rtpForwardSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.forwarder.mux.Lock()
+		delete(s.forwarder.forwards, s.info.ID)
+		s.forwarder.mux.Unlock()
+
+		err = s.conn.Close()
+		s.logger.Info("rtp forward: stopped")
+	})
+	return err
+}
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
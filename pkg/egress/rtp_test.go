@@ -0,0 +1,274 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"ruyka/pkg/rtc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// testRTC は配信中のトラックを 1 本だけ持ち、購読した sink を記録する
+type testRTC struct {
+	rtc.RTC
+	track rtc.PublishedTrack
+	sink  rtc.TrackSink
+}
+
+func (r *testRTC) PublishedTrack(trackID string) (rtc.PublishedTrack, error) {
+	if trackID != r.track.TrackID {
+		return rtc.PublishedTrack{}, rtc.ErrTrackNotFound
+	}
+	return r.track, nil
+}
+
+func (r *testRTC) Subscribe(trackID string, s rtc.TrackSink) error {
+	r.sink = s
+	return nil
+}
+
+func (r *testRTC) Unsubscribe(trackID string, s rtc.TrackSink) {
+	r.sink = nil
+}
+
+func newTestRTC(kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) *testRTC {
+	return &testRTC{track: rtc.PublishedTrack{
+		Room:            "room",
+		TrackID:         "track",
+		Participant:     "publisher",
+		Kind:            kind,
+		Codec:           codec,
+		RequestKeyframe: func() {},
+	}}
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// testSRTPKey は 16 バイトのマスターキーと 14 バイトのマスターソルト
+var testSRTPKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x5a}, srtpMasterKeyLen+srtpMasterSaltLen))
+
+func TestRTPForwarderAllowedDestinations(t *testing.T) {
+	vp8 := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		port    int
+		err     error
+	}{
+		{name: "ipv4 in range", allowed: []string{"127.0.0.0/8"}, host: "127.0.0.2", port: 5004},
+		{name: "ipv6 in range", allowed: []string{"127.0.0.0/8", "::1/128"}, host: "::1", port: 5004},
+		{name: "out of range", allowed: []string{"127.0.0.0/8"}, host: "10.0.0.1", port: 5004, err: ErrForwardDstNotAllowed},
+		{name: "ipv4 is not in ipv6 range", allowed: []string{"::1/128"}, host: "127.0.0.1", port: 5004, err: ErrForwardDstNotAllowed},
+		{name: "nothing allowed", allowed: nil, host: "127.0.0.1", port: 5004, err: ErrForwardDstNotAllowed},
+		{name: "no host", allowed: []string{"0.0.0.0/0"}, host: "", port: 5004, err: ErrInvalidForwardDst},
+		{name: "port out of range", allowed: []string{"0.0.0.0/0"}, host: "127.0.0.1", port: 65536, err: ErrInvalidForwardDst},
+	}
+	for _, tt := range tests {
+		r := newTestRTC(webrtc.RTPCodecTypeVideo, vp8)
+		f := NewRTPForwarder(r, mustParseCIDRs(t, tt.allowed...))
+		info, err := f.Start("track", RTPForwardOptions{Host: tt.host, Port: tt.port})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			if r.sink != nil || len(f.Forwards()) != 0 {
+				t.Errorf("%s: rejected forward is subscribed", tt.name)
+			}
+			continue
+		}
+		if err := f.Stop(info.ID); err != nil {
+			t.Errorf("%s: stop: %v", tt.name, err)
+		}
+	}
+}
+
+func TestNewSRTPContext(t *testing.T) {
+	tests := []struct {
+		name string
+		o    SRTPOptions
+		err  error
+	}{
+		{name: "80", o: SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_80", Key: testSRTPKey}},
+		{name: "32", o: SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_32", Key: testSRTPKey}},
+		{name: "unknown suite", o: SRTPOptions{Suite: "AEAD_AES_128_GCM", Key: testSRTPKey}, err: ErrUnsupportedSRTPSuite},
+		{name: "not base64", o: SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_80", Key: "!"}, err: ErrInvalidSRTPKey},
+		{name: "short key", o: SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_80", Key: base64.StdEncoding.EncodeToString(make([]byte, srtpMasterKeyLen))}, err: ErrInvalidSRTPKey},
+	}
+	for _, tt := range tests {
+		ctx, err := newSRTPContext(&tt.o)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && ctx == nil {
+			t.Errorf("%s: context is nil", tt.name)
+		}
+	}
+}
+
+func TestRTPForwardEncryptsWithSRTP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	r := newTestRTC(webrtc.RTPCodecTypeAudio, opus)
+	f := NewRTPForwarder(r, mustParseCIDRs(t, "127.0.0.0/8"))
+	info, err := f.Start("track", RTPForwardOptions{
+		Host: "127.0.0.1",
+		Port: conn.LocalAddr().(*net.UDPAddr).Port,
+		SRTP: &SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_80", Key: testSRTPKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop(info.ID)
+	if !info.SRTP {
+		t.Error("forward is not marked as srtp")
+	}
+
+	payload := []byte{0xfc, 0xff, 0xfe}
+	err = r.sink.WriteRTP(&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    63,
+			SequenceNumber: 1,
+			Timestamp:      960,
+			SSRC:           1234,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], payload) {
+		t.Error("payload is sent in clear text")
+	}
+
+	// 転送先は SDP の a=crypto と同じキーで復号できる
+	key, _ := base64.StdEncoding.DecodeString(testSRTPKey)
+	ctx, err := srtp.CreateContext(key[:srtpMasterKeyLen], key[srtpMasterKeyLen:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &rtp.Header{}
+	decrypted, err := ctx.DecryptRTP(nil, buf[:n], header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt.Payload, payload) {
+		t.Errorf("payload %x, want %x", pkt.Payload, payload)
+	}
+	if pkt.PayloadType != RTP_FORWARD_AUDIO_PAYLOAD_TYPE || pkt.SSRC == 1234 {
+		t.Errorf("payload type %d, ssrc %d: header is not rewritten", pkt.PayloadType, pkt.SSRC)
+	}
+}
+
+func TestForwardSDP(t *testing.T) {
+	tests := []struct {
+		name  string
+		track rtc.PublishedTrack
+		ip    net.IP
+		o     RTPForwardOptions
+		pt    uint8
+		want  []string
+	}{
+		{
+			name: "vp8 rtp",
+			track: rtc.PublishedTrack{
+				TrackID: "video",
+				Kind:    webrtc.RTPCodecTypeVideo,
+				Codec:   webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			},
+			ip: net.ParseIP("192.0.2.1"),
+			o:  RTPForwardOptions{Port: 5004},
+			pt: RTP_FORWARD_VIDEO_PAYLOAD_TYPE,
+			want: []string{
+				"v=0",
+				"s=ruyka video",
+				"c=IN IP4 192.0.2.1",
+				"t=0 0",
+				"m=video 5004 RTP/AVP 96",
+				"a=rtpmap:96 VP8/90000",
+				"a=recvonly",
+			},
+		},
+		{
+			name: "opus srtp ipv6",
+			track: rtc.PublishedTrack{
+				TrackID: "audio",
+				Kind:    webrtc.RTPCodecTypeAudio,
+				Codec: webrtc.RTPCodecCapability{
+					MimeType:    webrtc.MimeTypeOpus,
+					ClockRate:   48000,
+					Channels:    2,
+					SDPFmtpLine: "minptime=10;useinbandfec=1",
+				},
+			},
+			ip: net.ParseIP("2001:db8::1"),
+			o:  RTPForwardOptions{Port: 5006, SRTP: &SRTPOptions{Suite: "AES_CM_128_HMAC_SHA1_80", Key: testSRTPKey}},
+			pt: RTP_FORWARD_AUDIO_PAYLOAD_TYPE,
+			want: []string{
+				"v=0",
+				"s=ruyka audio",
+				"c=IN IP6 2001:db8::1",
+				"t=0 0",
+				"m=audio 5006 RTP/SAVP 111",
+				"a=rtpmap:111 opus/48000/2",
+				"a=fmtp:111 minptime=10;useinbandfec=1",
+				"a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:" + testSRTPKey,
+				"a=recvonly",
+			},
+		},
+	}
+	for _, tt := range tests {
+		sdp := forwardSDP(tt.track, tt.ip, tt.o, tt.pt)
+		if !strings.HasSuffix(sdp, "\r\n") {
+			t.Errorf("%s: sdp does not end with CRLF", tt.name)
+		}
+		// o= 行は生成した時刻を含むので除いて比べる
+		lines := []string{}
+		for _, line := range strings.Split(strings.TrimSuffix(sdp, "\r\n"), "\r\n") {
+			if !strings.HasPrefix(line, "o=") {
+				lines = append(lines, line)
+			}
+		}
+		if got, want := strings.Join(lines, "\n"), strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s: sdp\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
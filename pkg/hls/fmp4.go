@@ -0,0 +1,305 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ref: ISO/IEC 14496-12 (ISOBMFF), ISO/IEC 14496-15 (AVC), https://opus-codec.org/docs/opus_in_isobmff.html
+
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+
+	VIDEO_TIMESCALE = 90000
+	AUDIO_TIMESCALE = 48000
+
+	// trun のフラグ
+	trunDataOffset     = 0x000001
+	trunSampleDuration = 0x000100
+	trunSampleSize     = 0x000200
+	trunSampleFlags    = 0x000400
+	// tfhd のフラグ
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+type sample struct {
+	dts      int64
+	duration uint32
+	keyframe bool
+	data     []byte
+}
+
+type boxWriter struct {
+	bytes.Buffer
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *boxWriter) zeros(n int) {
+	w.Write(make([]byte, n))
+}
+
+// box は fn で書いた内容を typ のボックスで包む
+func (w *boxWriter) box(typ string, fn func()) {
+	start := w.Len()
+	w.u32(0)
+	w.WriteString(typ)
+	fn()
+	binary.BigEndian.PutUint32(w.Bytes()[start:], uint32(w.Len()-start))
+}
+
+func (w *boxWriter) fullBox(typ string, version uint8, flags uint32, fn func()) {
+	w.box(typ, func() {
+		w.u32(uint32(version)<<24 | flags)
+		fn()
+	})
+}
+
+// initSegment は EXT-X-MAP で参照する初期化セグメントを作る
+func initSegment(video *h264Params, audio *opusParams) []byte {
+	w := &boxWriter{}
+	w.box("ftyp", func() {
+		w.WriteString("iso6")
+		w.u32(0x200)
+		for _, brand := range []string{"iso6", "isom", "mp41"} {
+			w.WriteString(brand)
+		}
+	})
+	w.box("moov", func() {
+		w.fullBox("mvhd", 0, 0, func() {
+			w.zeros(8) // creation_time, modification_time
+			w.u32(1000)
+			w.u32(0) // duration
+			w.u32(0x00010000)
+			w.u16(0x0100)
+			w.zeros(10)
+			for _, v := range unityMatrix {
+				w.u32(v)
+			}
+			w.zeros(24)
+			w.u32(audioTrackID + 1)
+		})
+		w.videoTrak(video)
+		if audio != nil {
+			w.audioTrak(audio)
+		}
+		w.box("mvex", func() {
+			w.trex(videoTrackID)
+			if audio != nil {
+				w.trex(audioTrackID)
+			}
+		})
+	})
+	return w.Bytes()
+}
+
+func (w *boxWriter) trex(trackID uint32) {
+	w.fullBox("trex", 0, 0, func() {
+		w.u32(trackID)
+		w.u32(1) // default_sample_description_index
+		w.zeros(12)
+	})
+}
+
+func (w *boxWriter) tkhd(trackID uint32, volume uint16, width, height uint16) {
+	// track_enabled | track_in_movie
+	w.fullBox("tkhd", 0, 3, func() {
+		w.zeros(8)
+		w.u32(trackID)
+		w.zeros(4)
+		w.u32(0) // duration
+		w.zeros(8)
+		w.u16(0) // layer
+		w.u16(0) // alternate_group
+		w.u16(volume)
+		w.zeros(2)
+		for _, v := range unityMatrix {
+			w.u32(v)
+		}
+		w.u32(uint32(width) << 16)
+		w.u32(uint32(height) << 16)
+	})
+}
+
+func (w *boxWriter) mdia(timescale uint32, handler, name string, header func(), entry func()) {
+	w.box("mdia", func() {
+		w.fullBox("mdhd", 0, 0, func() {
+			w.zeros(8)
+			w.u32(timescale)
+			w.u32(0)
+			w.u16(0x55c4) // und
+			w.u16(0)
+		})
+		w.fullBox("hdlr", 0, 0, func() {
+			w.u32(0)
+			w.WriteString(handler)
+			w.zeros(12)
+			w.WriteString(name)
+			w.u8(0)
+		})
+		w.box("minf", func() {
+			header()
+			w.box("dinf", func() {
+				w.fullBox("dref", 0, 0, func() {
+					w.u32(1)
+					w.fullBox("url ", 0, 1, func() {})
+				})
+			})
+			w.box("stbl", func() {
+				w.fullBox("stsd", 0, 0, func() {
+					w.u32(1)
+					entry()
+				})
+				// サンプルの情報は moof に書くので空にする
+				for _, typ := range []string{"stts", "stsc", "stco"} {
+					w.fullBox(typ, 0, 0, func() { w.u32(0) })
+				}
+				w.fullBox("stsz", 0, 0, func() { w.zeros(8) })
+			})
+		})
+	})
+}
+
+func (w *boxWriter) videoTrak(p *h264Params) {
+	w.box("trak", func() {
+		w.tkhd(videoTrackID, 0, p.width, p.height)
+		w.mdia(VIDEO_TIMESCALE, "vide", "VideoHandler", func() {
+			w.fullBox("vmhd", 0, 1, func() { w.zeros(8) })
+		}, func() {
+			// 解像度の変更に追従できるよう、パラメータセットをサンプルにも含められる avc3 を使う
+			w.box("avc3", func() {
+				w.zeros(6)
+				w.u16(1) // data_reference_index
+				w.zeros(16)
+				w.u16(p.width)
+				w.u16(p.height)
+				w.u32(0x00480000)
+				w.u32(0x00480000)
+				w.zeros(4)
+				w.u16(1) // frame_count
+				w.zeros(32)
+				w.u16(0x0018)
+				w.u16(0xffff)
+				w.box("avcC", func() {
+					w.Write(p.decoderConfigurationRecord())
+				})
+			})
+		})
+	})
+}
+
+func (w *boxWriter) audioTrak(p *opusParams) {
+	w.box("trak", func() {
+		w.tkhd(audioTrackID, 0x0100, 0, 0)
+		w.mdia(AUDIO_TIMESCALE, "soun", "SoundHandler", func() {
+			w.fullBox("smhd", 0, 0, func() { w.zeros(4) })
+		}, func() {
+			w.box("Opus", func() {
+				w.zeros(6)
+				w.u16(1)
+				w.zeros(8)
+				w.u16(uint16(p.channels))
+				w.u16(16)
+				w.zeros(4)
+				w.u32(AUDIO_TIMESCALE << 16)
+				w.box("dOps", func() {
+					w.u8(0)
+					w.u8(p.channels)
+					w.u16(0) // pre_skip
+					w.u32(AUDIO_TIMESCALE)
+					w.u16(0) // output_gain
+					w.u8(0)  // channel_mapping_family
+				})
+			})
+		})
+	})
+}
+
+// fragment は 1 つのパート (LL-HLS を使わない場合はセグメント) の moof と mdat を作る
+func fragment(sequence uint32, video, audio []sample) []byte {
+	type run struct {
+		trackID uint32
+		samples []sample
+		flags   bool
+		offset  int
+	}
+	runs := []*run{}
+	if len(video) > 0 {
+		runs = append(runs, &run{trackID: videoTrackID, samples: video, flags: true})
+	}
+	if len(audio) > 0 {
+		runs = append(runs, &run{trackID: audioTrackID, samples: audio})
+	}
+
+	w := &boxWriter{}
+	w.box("moof", func() {
+		w.fullBox("mfhd", 0, 0, func() { w.u32(sequence) })
+		for _, r := range runs {
+			r := r
+			w.box("traf", func() {
+				w.fullBox("tfhd", 0, tfhdDefaultBaseIsMoof, func() { w.u32(r.trackID) })
+				w.fullBox("tfdt", 1, 0, func() { w.u64(uint64(r.samples[0].dts)) })
+
+				flags := uint32(trunDataOffset | trunSampleDuration | trunSampleSize)
+				if r.flags {
+					flags |= trunSampleFlags
+				}
+				w.fullBox("trun", 0, flags, func() {
+					w.u32(uint32(len(r.samples)))
+					// data_offset は moof の大きさが決まってから書き込む
+					r.offset = w.Len()
+					w.u32(0)
+					for _, s := range r.samples {
+						w.u32(s.duration)
+						w.u32(uint32(len(s.data)))
+						if !r.flags {
+							continue
+						}
+						if s.keyframe {
+							w.u32(sampleFlagsSync)
+						} else {
+							w.u32(sampleFlagsNonSync)
+						}
+					}
+				})
+			})
+		}
+	})
+
+	// mdat のヘッダの直後から映像、音声の順にサンプルを並べる
+	offset := w.Len() + 8
+	for _, r := range runs {
+		binary.BigEndian.PutUint32(w.Bytes()[r.offset:], uint32(offset))
+		for _, s := range r.samples {
+			offset += len(s.data)
+		}
+	}
+	w.box("mdat", func() {
+		for _, r := range runs {
+			for _, s := range r.samples {
+				w.Write(s.data)
+			}
+		}
+	})
+	return w.Bytes()
+}
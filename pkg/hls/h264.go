@@ -0,0 +1,217 @@
+package hls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ref: ITU-T H.264 (7.3.2.1.1), ISO/IEC 14496-15 (5.3.3.1)
+
+var ErrInvalidSPS = errors.New("invalid h264 sequence parameter set")
+
+const (
+	NALUTypeIDR = 5
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+	NALUTypeAUD = 9
+)
+
+type h264Params struct {
+	sps, pps      []byte
+	width, height uint16
+
+	chromaFormat   uint32
+	bitDepthLuma   uint32
+	bitDepthChroma uint32
+}
+
+type opusParams struct {
+	channels uint8
+}
+
+func newH264Params(sps, pps []byte) (*h264Params, error) {
+	if len(sps) < 4 {
+		return nil, ErrInvalidSPS
+	}
+	p := &h264Params{sps: sps, pps: pps, chromaFormat: 1}
+	if err := p.parseSPS(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *h264Params) decoderConfigurationRecord() []byte {
+	b := []byte{1, p.sps[1], p.sps[2], p.sps[3], 0xfc | 3, 0xe0 | 1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p.sps)))
+	b = append(b, p.sps...)
+	b = append(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p.pps)))
+	b = append(b, p.pps...)
+	if hasChromaFormat(p.sps[1]) {
+		b = append(b,
+			0xfc|byte(p.chromaFormat),
+			0xf8|byte(p.bitDepthLuma),
+			0xf8|byte(p.bitDepthChroma),
+			0, // numOfSequenceParameterSetExt
+		)
+	}
+	return b
+}
+
+func hasChromaFormat(profile byte) bool {
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135, 144:
+		return true
+	}
+	return false
+}
+
+// parseSPS は初期化セグメントに書く解像度とクロマの情報を読む
+func (p *h264Params) parseSPS() error {
+	r := &expGolombReader{data: unescapeRBSP(p.sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // constraint_set_flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	if hasChromaFormat(byte(profile)) {
+		p.chromaFormat = r.ue()
+		if p.chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		p.bitDepthLuma = r.ue()
+		p.bitDepthChroma = r.ue()
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if p.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				r.skipScalingList(size)
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	width := widthInMbs * 16
+	height := (2 - frameMbsOnly) * heightInMapUnits * 16
+	if r.bits(1) == 1 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		if p.chromaFormat != 0 {
+			if p.chromaFormat != 3 {
+				cropX = 2
+			}
+			if p.chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+	if r.err != nil || width > 0xffff || height > 0xffff {
+		return ErrInvalidSPS
+	}
+	p.width, p.height = uint16(width), uint16(height)
+	return nil
+}
+
+// unescapeRBSP はエミュレーション防止バイト (00 00 03) を取り除く
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+type expGolombReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *expGolombReader) bits(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = ErrInvalidSPS
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *expGolombReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = ErrInvalidSPS
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *expGolombReader) se() int32 {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int32(v / 2)
+	}
+	return int32(v/2 + 1)
+}
+
+func (r *expGolombReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ref: https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis
+
+var (
+	ErrNotFound      = errors.New("hls: file is not found")
+	ErrBadRequest    = errors.New("hls: requested segment is too far in the future")
+	ErrInvalidConfig = errors.New("hls: part duration must be shorter than segment duration")
+)
+
+const (
+	// プレイリストに載せるセグメントの数
+	PLAYLIST_SEGMENTS = 6
+	// プレイリストから外れた後も、取得中のプレイヤーのために残しておくセグメントの数
+	RETAINED_SEGMENTS = 2
+	// パートを載せる直近のセグメントの数
+	PART_SEGMENTS = 3
+	// ブロッキングリクエストを待たせる時間の上限 (ターゲット時間に対する倍数)
+	BLOCKING_TIMEOUT_FACTOR = 3
+
+	initName = "init.mp4"
+)
+
+type Config struct {
+	// セグメントはこの長さを超えた後のキーフレームで区切る
+	SegmentDuration time.Duration
+	// 0 でなければ LL-HLS のパートをこの長さで作る
+	PartDuration time.Duration
+}
+
+func (c Config) Validate() error {
+	if c.PartDuration > 0 && c.PartDuration >= c.SegmentDuration {
+		return ErrInvalidConfig
+	}
+	return nil
+}
+
+func (c Config) lowLatency() bool {
+	return c.PartDuration > 0
+}
+
+type part struct {
+	data        []byte
+	duration    float64
+	independent bool
+}
+
+type segment struct {
+	msn      uint64
+	parts    []*part
+	duration float64
+}
+
+func (s *segment) data() []byte {
+	b := []byte{}
+	for _, p := range s.parts {
+		b = append(b, p.data...)
+	}
+	return b
+}
+
+// Muxer は H.264 と Opus のサンプルから fMP4 のセグメントとプレイリストを作る。
+// 映像のキーフレームから書き始め、音声は映像に合わせて同じフラグメントに入れる
+type Muxer struct {
+	config Config
+	init   []byte
+	audio  bool
+
+	mux      sync.Mutex
+	updated  chan struct{}
+	closed   bool
+	segments []*segment
+	// 作成中のセグメント。最初のパートができるまでは nil
+	current  *segment
+	nextMSN  uint64
+	sequence uint32
+
+	started      bool
+	segmentStart int64
+	partStart    int64
+	videoSamples []sample
+	audioSamples []sample
+	// 次のサンプルが届くまで長さが決まらないサンプル
+	pendingVideo *sample
+	pendingAudio *sample
+	// 最後のフレームの長さ。終端のフレームの長さに使う
+	frameDuration uint32
+}
+
+// NewMuxer は SPS と PPS から初期化セグメントを作る。audioChannels が 0 の場合は映像だけを扱う
+func NewMuxer(c Config, sps, pps []byte, audioChannels uint8) (*Muxer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	video, err := newH264Params(sps, pps)
+	if err != nil {
+		return nil, err
+	}
+	var audio *opusParams
+	if audioChannels > 0 {
+		audio = &opusParams{channels: audioChannels}
+	}
+	return &Muxer{
+		config:  c,
+		init:    initSegment(video, audio),
+		audio:   audio != nil,
+		mux:     sync.Mutex{},
+		updated: make(chan struct{}),
+	}, nil
+}
+
+func (m *Muxer) HasAudio() bool {
+	return m.audio
+}
+
+// WriteVideo は 1 フレーム分の NALU (4 バイトの長さ付き) を書き込む。dts は 90kHz
+func (m *Muxer) WriteVideo(dts int64, keyframe bool, data []byte) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.closed {
+		return
+	}
+	if !m.started {
+		if !keyframe {
+			return
+		}
+		m.started = true
+		m.segmentStart, m.partStart = dts, dts
+	}
+
+	if prev := m.pendingVideo; prev != nil {
+		// WebRTC の H.264 は B フレームを含まないので、デコード順に時刻が進む
+		if dts <= prev.dts {
+			dts = prev.dts + 1
+		}
+		prev.duration = uint32(dts - prev.dts)
+		m.frameDuration = prev.duration
+		m.videoSamples = append(m.videoSamples, *prev)
+
+		segmentTarget := int64(m.config.SegmentDuration.Seconds() * VIDEO_TIMESCALE)
+		partTarget := int64(m.config.PartDuration.Seconds() * VIDEO_TIMESCALE)
+		switch {
+		case keyframe && dts-m.segmentStart >= segmentTarget:
+			m.flush(dts, true)
+		// パートの長さが目標を超えないよう、次のフレームで超える時点で区切る
+		case m.config.lowLatency() && dts-m.partStart+int64(prev.duration) > partTarget:
+			m.flush(dts, false)
+		}
+	}
+	m.pendingVideo = &sample{dts: dts, keyframe: keyframe, data: data}
+}
+
+// WriteAudio は Opus のフレームを書き込む。dts は 48kHz
+func (m *Muxer) WriteAudio(dts int64, data []byte) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.closed || !m.audio || !m.started {
+		return
+	}
+	if prev := m.pendingAudio; prev != nil {
+		if dts <= prev.dts {
+			return
+		}
+		prev.duration = uint32(dts - prev.dts)
+		m.audioSamples = append(m.audioSamples, *prev)
+	}
+	m.pendingAudio = &sample{dts: dts, keyframe: true, data: data}
+}
+
+// flush は書き込まれたサンプルをパートにする。m.mux を Lock した状態で呼ぶ
+func (m *Muxer) flush(end int64, endSegment bool) {
+	if len(m.videoSamples) == 0 {
+		return
+	}
+	m.sequence++
+	p := &part{
+		data:        fragment(m.sequence, m.videoSamples, m.audioSamples),
+		duration:    float64(end-m.partStart) / VIDEO_TIMESCALE,
+		independent: m.videoSamples[0].keyframe,
+	}
+	m.videoSamples, m.audioSamples = nil, nil
+	m.partStart = end
+
+	if m.current == nil {
+		m.current = &segment{msn: m.nextMSN}
+		m.nextMSN++
+	}
+	m.current.parts = append(m.current.parts, p)
+	m.current.duration += p.duration
+
+	if endSegment {
+		m.segments = append(m.segments, m.current)
+		m.current = nil
+		m.segmentStart = end
+		if n := len(m.segments) - PLAYLIST_SEGMENTS - RETAINED_SEGMENTS; n > 0 {
+			m.segments = m.segments[n:]
+		}
+	}
+	m.notify()
+}
+
+// notify はブロッキングリクエストで待っているプレイヤーを起こす。m.mux を Lock した状態で呼ぶ
+func (m *Muxer) notify() {
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// Close は書きかけのサンプルをセグメントにして、プレイリストを終端する
+func (m *Muxer) Close() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.closed {
+		return
+	}
+	if prev := m.pendingVideo; prev != nil {
+		prev.duration = m.frameDuration
+		if prev.duration == 0 {
+			prev.duration = 1
+		}
+		m.videoSamples = append(m.videoSamples, *prev)
+		m.pendingVideo = nil
+		m.flush(prev.dts+int64(prev.duration), true)
+	}
+	m.closed = true
+	m.notify()
+}
+
+// wait は ready が true を返すか、Muxer が閉じられるまで待つ。
+// 待ち時間の上限を過ぎた場合はその時点の状態で返す
+func (m *Muxer) wait(ctx context.Context, ready func() bool) error {
+	timeout := time.NewTimer(BLOCKING_TIMEOUT_FACTOR * m.config.SegmentDuration)
+	defer timeout.Stop()
+
+	for {
+		m.mux.Lock()
+		if m.closed || ready() {
+			m.mux.Unlock()
+			return nil
+		}
+		updated := m.updated
+		m.mux.Unlock()
+
+		select {
+		case <-updated:
+		case <-timeout.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// hasPart は msn のセグメントに index 番目のパートがあるかを返す。index が負の場合はセグメントの完成を確かめる。
+// m.mux を Lock した状態で呼ぶ
+func (m *Muxer) hasPart(msn uint64, index int) bool {
+	if n := len(m.segments); n > 0 && m.segments[n-1].msn >= msn {
+		return true
+	}
+	if index < 0 || m.current == nil {
+		return false
+	}
+	return m.current.msn > msn || (m.current.msn == msn && len(m.current.parts) > index)
+}
+
+// Playlist はメディアプレイリストを返す。msn が負でなければ、LL-HLS のブロッキングリクエストとして
+// msn のセグメント (part が負でなければそのパート) ができるまで待つ
+func (m *Muxer) Playlist(ctx context.Context, msn int64, part int) ([]byte, error) {
+	if msn >= 0 {
+		m.mux.Lock()
+		// 次に作るセグメントより 2 つ以上先は作られるまでに時間がかかりすぎる
+		tooFar := uint64(msn) > m.nextMSN+1
+		m.mux.Unlock()
+		if tooFar {
+			return nil, ErrBadRequest
+		}
+		err := m.wait(ctx, func() bool {
+			return m.hasPart(uint64(msn), part)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.playlist(), nil
+}
+
+// File は初期化セグメント、セグメント、パートを名前で返す。
+// プリロードヒントで案内したパートは、できるまで待ってから返す
+func (m *Muxer) File(ctx context.Context, name string) ([]byte, error) {
+	if name == initName {
+		return m.init, nil
+	}
+
+	var msn uint64
+	var index int
+	if _, err := fmt.Sscanf(name, segmentNameFormat, &msn); err == nil {
+		return m.segment(msn)
+	}
+	if _, err := fmt.Sscanf(name, partNameFormat, &msn, &index); err != nil || index < 0 {
+		return nil, ErrNotFound
+	}
+
+	m.mux.Lock()
+	hinted := !m.closed && m.isNextPart(msn, index)
+	m.mux.Unlock()
+	if hinted {
+		err := m.wait(ctx, func() bool {
+			return m.hasPart(msn, index)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.part(msn, index)
+}
+
+func (m *Muxer) segment(msn uint64) ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, s := range m.segments {
+		if s.msn == msn {
+			return s.data(), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Muxer) part(msn uint64, index int) ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	segments := m.segments
+	if m.current != nil {
+		segments = append(segments[:len(segments):len(segments)], m.current)
+	}
+	for _, s := range segments {
+		if s.msn == msn && index < len(s.parts) {
+			return s.parts[index].data, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// isNextPart は次に作られるパートかどうかを返す。m.mux を Lock した状態で呼ぶ
+func (m *Muxer) isNextPart(msn uint64, index int) bool {
+	if m.current != nil {
+		return m.current.msn == msn && len(m.current.parts) == index
+	}
+	return m.nextMSN == msn && index == 0
+}
@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	segmentNameFormat = "segment-%d.m4s"
+	partNameFormat    = "part-%d-%d.m4s"
+)
+
+// playlist はメディアプレイリストを作る。m.mux を Lock した状態で呼ぶ
+func (m *Muxer) playlist() []byte {
+	listed := m.segments
+	if n := len(listed) - PLAYLIST_SEGMENTS; n > 0 {
+		listed = listed[n:]
+	}
+
+	target := m.config.SegmentDuration.Seconds()
+	for _, s := range listed {
+		target = math.Max(target, s.duration)
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	if m.config.lowLatency() {
+		part := m.config.PartDuration.Seconds()
+		b.WriteString("#EXT-X-VERSION:9\n")
+		fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", part*3)
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", part)
+	} else {
+		b.WriteString("#EXT-X-VERSION:6\n")
+		fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	}
+	first := m.nextMSN
+	if len(listed) > 0 {
+		first = listed[0].msn
+	} else if m.current != nil {
+		first = m.current.msn
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", initName)
+
+	for i, s := range listed {
+		// パートは作成中のセグメントを含めて直近のセグメントにだけ載せる
+		if m.config.lowLatency() && len(listed)-i < PART_SEGMENTS {
+			writeParts(b, s)
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", s.duration)
+		fmt.Fprintf(b, segmentNameFormat+"\n", s.msn)
+	}
+	if m.config.lowLatency() && m.current != nil {
+		writeParts(b, m.current)
+	}
+
+	switch {
+	case m.closed:
+		b.WriteString("#EXT-X-ENDLIST\n")
+	case m.config.lowLatency():
+		msn, index := m.nextMSN, 0
+		if m.current != nil {
+			msn, index = m.current.msn, len(m.current.parts)
+		}
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\""+partNameFormat+"\"\n", msn, index)
+	}
+	return []byte(b.String())
+}
+
+func writeParts(b *strings.Builder, s *segment) {
+	for i, p := range s.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\""+partNameFormat+"\"", p.duration, s.msn, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
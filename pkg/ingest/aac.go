@@ -0,0 +1,166 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"ruyka/pkg/rtc"
+	"strconv"
+	"time"
+
+	"github.com/pion/rtp"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidAACConfig = errors.New("invalid aac audio specific config: only aac main, lc, ssr and ltp are supported")
+)
+
+const (
+	OPUS_CLOCK_RATE = 48000
+	OPUS_BITRATE    = "96k"
+	// 入力を閉じてから ffmpeg の終了を待つ時間
+	FFMPEG_STOP_TIMEOUT = 5 * time.Second
+
+	adtsHeaderLength = 7
+	// ADTS の frame_length は 13 bit
+	adtsMaxFrameLength = 1<<13 - 1
+)
+
+// adtsHeader は AudioSpecificConfig から ADTS のヘッダーを作るのに必要な値 (ISO/IEC 14496-3 1.6.2.1)
+type adtsHeader struct {
+	profile        byte
+	frequencyIndex byte
+	channelConfig  byte
+}
+
+func parseAudioSpecificConfig(config []byte) (adtsHeader, error) {
+	if len(config) < 2 {
+		return adtsHeader{}, ErrInvalidAACConfig
+	}
+	objectType := config[0] >> 3
+	h := adtsHeader{
+		frequencyIndex: (config[0]&0x07)<<1 | config[1]>>7,
+		channelConfig:  (config[1] >> 3) & 0x0f,
+	}
+	// ADTS の profile は object type - 1 の 2 bit しかなく、周波数も表の値しか表せない
+	if objectType < 1 || objectType > 4 || h.frequencyIndex > 12 || h.channelConfig > 7 {
+		return adtsHeader{}, ErrInvalidAACConfig
+	}
+	h.profile = objectType - 1
+	return h, nil
+}
+
+// frame は AAC の生のフレームに ADTS のヘッダーを付ける (protection_absent = 1)
+func (h adtsHeader) frame(raw []byte) ([]byte, error) {
+	length := adtsHeaderLength + len(raw)
+	if length > adtsMaxFrameLength {
+		return nil, fmt.Errorf("aac frame is too large: %d bytes", len(raw))
+	}
+	return append([]byte{
+		0xff,
+		0xf1,
+		h.profile<<6 | h.frequencyIndex<<2 | h.channelConfig>>2,
+		h.channelConfig<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length<<5) | 0x1f,
+		0xfc,
+	}, raw...), nil
+}
+
+// aacTranscoder は ffmpeg に ADTS で AAC を渡し、Opus にエンコードされた RTP をトラックに書き込む
+type aacTranscoder struct {
+	header adtsHeader
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	conn   net.PacketConn
+	done   chan struct{}
+}
+
+func newAACTranscoder(ffmpeg string, config []byte, track rtc.LocalTrack) (*aacTranscoder, error) {
+	header, err := parseAudioSpecificConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// 入力を溜め込まないよう、最小限の解析だけで変換を始める
+	cmd := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0",
+		"-f", "aac", "-i", "pipe:0",
+		"-vn", "-c:a", "libopus", "-b:a", OPUS_BITRATE, "-ar", strconv.Itoa(OPUS_CLOCK_RATE), "-ac", "2",
+		"-f", "rtp", "rtp://127.0.0.1:"+strconv.Itoa(port)+"?pkt_size="+strconv.Itoa(RTP_MTU),
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t := &aacTranscoder{
+		header: header,
+		cmd:    cmd,
+		stdin:  stdin,
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	go t.receive(track)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			zap.L().Warn("rtmp: ffmpeg exited", zap.Error(err))
+		}
+		// ffmpeg が終了したら受信も止める
+		conn.Close()
+		close(t.done)
+	}()
+	return t, nil
+}
+
+func (t *aacTranscoder) receive(track rtc.LocalTrack) {
+	buf := make([]byte, RTP_INGEST_BUFFER_SIZE)
+	for {
+		n, _, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+			continue
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			zap.L().Warn("rtmp: failed to write audio", zap.Error(err))
+		}
+	}
+}
+
+func (t *aacTranscoder) write(raw []byte) error {
+	frame, err := t.header.frame(raw)
+	if err != nil {
+		return err
+	}
+	_, err = t.stdin.Write(frame)
+	return err
+}
+
+// Close は ffmpeg の入力を閉じ、残りを変換し終えて終了するのを待つ。終了しなければ強制終了する
+func (t *aacTranscoder) Close() error {
+	err := t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(FFMPEG_STOP_TIMEOUT):
+		t.cmd.Process.Kill()
+		<-t.done
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// recordingTrack は書き込まれた RTP パケットを記録する
+type recordingTrack struct {
+	mux     sync.Mutex
+	packets []*rtp.Packet
+}
+
+func (t *recordingTrack) ID() string {
+	return "recording"
+}
+
+func (t *recordingTrack) WriteRTP(pkt *rtp.Packet) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.packets = append(t.packets, pkt)
+	return nil
+}
+
+func (t *recordingTrack) written() []*rtp.Packet {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return append([]*rtp.Packet{}, t.packets...)
+}
+
+func TestADTSHeaderFromAudioSpecificConfig(t *testing.T) {
+	// AAC LC, 44.1kHz, ステレオ
+	h, err := parseAudioSpecificConfig([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := h.frame(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// frame_length 107 = 0b0000001101011
+	want := []byte{0xff, 0xf1, 0x50, 0x80, 0x0d, 0x7f, 0xfc}
+	if !bytes.Equal(frame[:adtsHeaderLength], want) {
+		t.Errorf("adts header % x, want % x", frame[:adtsHeaderLength], want)
+	}
+	if len(frame) != 107 {
+		t.Errorf("frame length %d, want 107", len(frame))
+	}
+
+	// HE-AAC を明示した AudioSpecificConfig は ADTS で表せない
+	if _, err := parseAudioSpecificConfig([]byte{0x2b, 0x92}); !errors.Is(err, ErrInvalidAACConfig) {
+		t.Errorf("object type 5 is accepted: %v", err)
+	}
+}
+
+func TestRTMPHandlerRequiresFFmpegToTranscode(t *testing.T) {
+	_, err := NewRTMPHandler(nil, nil, AACPolicyTranscode, "ruyka-ffmpeg-not-found")
+	if !errors.Is(err, ErrFFmpegNotFound) {
+		t.Errorf("error %v, want %v", err, ErrFFmpegNotFound)
+	}
+}
+
+func TestAACTranscoderWritesOpus(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not found")
+	}
+	// 1 秒の AAC LC (48kHz, ステレオ) を ADTS で作る
+	adts, err := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000:duration=1",
+		"-ac", "2", "-c:a", "aac", "-f", "adts", "pipe:1",
+	).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	track := &recordingTrack{}
+	// AAC LC, 48kHz, ステレオ
+	transcoder, err := newAACTranscoder(ffmpeg, []byte{0x11, 0x90}, track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RTMP と同じく ADTS のヘッダーを外した生のフレームを渡す
+	for i := 0; i+adtsHeaderLength <= len(adts); {
+		length := int(adts[i+3]&0x03)<<11 | int(adts[i+4])<<3 | int(adts[i+5])>>5
+		if length < adtsHeaderLength || i+length > len(adts) {
+			t.Fatalf("invalid adts frame at %d", i)
+		}
+		if err := transcoder.write(adts[i+adtsHeaderLength : i+length]); err != nil {
+			t.Fatal(err)
+		}
+		i += length
+	}
+	if err := transcoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := track.written()
+	// 20ms のフレームで 1 秒分
+	if len(packets) < 40 {
+		t.Fatalf("%d opus packets written, want about 50", len(packets))
+	}
+	for i := 1; i < len(packets); i++ {
+		if packets[i].SequenceNumber != packets[i-1].SequenceNumber+1 {
+			t.Errorf("packet %d: sequence number %d follows %d", i, packets[i].SequenceNumber, packets[i-1].SequenceNumber)
+		}
+		if d := packets[i].Timestamp - packets[i-1].Timestamp; d != 960 {
+			t.Errorf("packet %d: timestamp advances by %d, want 960", i, d)
+		}
+	}
+}
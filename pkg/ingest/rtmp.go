@@ -0,0 +1,299 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/rtmp"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+// ref: https://veovera.org/docs/legacy/video-file-format-v10-1-spec.pdf (E.4.2, E.4.3)
+
+var (
+	ErrUnknownStreamKey      = errors.New("unknown stream key")
+	ErrUnsupportedVideoCodec = errors.New("unsupported video codec: only h264 is supported")
+	ErrAudioRejected         = errors.New("aac audio is rejected: browsers require opus")
+	ErrFFmpegNotFound        = errors.New("ffmpeg is not found: aac transcoding requires ffmpeg with libopus")
+	ErrInvalidAVCConfig      = errors.New("invalid avc decoder configuration record")
+)
+
+const (
+	RTP_MTU         = 1200
+	H264_CLOCK_RATE = 90000
+
+	flvCodecAVC         = 7
+	flvSoundFormatAAC   = 10
+	aacPacketTypeConfig = 0
+	aacPacketTypeRaw    = 1
+	flvFrameTypeKey     = 1
+	avcPacketTypeConfig = 0
+	avcPacketTypeNALU   = 1
+)
+
+type AACPolicy string
+
+const (
+	// AAC を含む配信を切断する
+	AACPolicyReject AACPolicy = "reject"
+	// 音声を捨てて映像だけを配信する
+	AACPolicyDrop AACPolicy = "drop"
+	// ffmpeg で Opus に変換して配信する
+	AACPolicyTranscode AACPolicy = "transcode"
+)
+
+// RTMPTarget はストリームキーに対応する配信先
+type RTMPTarget struct {
+	Room        string
+	Participant string
+}
+
+type rtmpHandler struct {
+	rtc     rtc.RTC
+	targets map[string]RTMPTarget
+	aac     AACPolicy
+	ffmpeg  string
+}
+
+// NewRTMPHandler はストリームキーごとにルームへ配信する rtmp.Handler を返す。
+// H.264 はそのまま RTP に詰め替え、AAC は aac の方針に従う。transcode では ffmpeg を使う
+func NewRTMPHandler(r rtc.RTC, targets map[string]RTMPTarget, aac AACPolicy, ffmpeg string) (rtmp.Handler, error) {
+	switch aac {
+	case AACPolicyReject, AACPolicyDrop:
+	case AACPolicyTranscode:
+		// 配信が始まってから失敗しないよう、起動時に ffmpeg を探しておく
+		path, err := exec.LookPath(ffmpeg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+		}
+		ffmpeg = path
+	default:
+		return nil, fmt.Errorf("unsupported aac policy: %s", aac)
+	}
+	return &rtmpHandler{rtc: r, targets: targets, aac: aac, ffmpeg: ffmpeg}, nil
+}
+
+func (h *rtmpHandler) Publish(app, key string) (rtmp.Stream, error) {
+	target, ok := h.targets[key]
+	if !ok {
+		return nil, ErrUnknownStreamKey
+	}
+	p, err := h.rtc.NewLocalParticipant(target.Room, target.Participant)
+	if err != nil {
+		return nil, err
+	}
+	zap.L().Info("rtmp: publish", zap.String("app", app), zap.String("room", target.Room), zap.String("participant", target.Participant))
+
+	return &rtmpStream{
+		participant: p,
+		aac:         h.aac,
+		ffmpeg:      h.ffmpeg,
+		streamID:    xid.New().String(),
+	}, nil
+}
+
+type rtmpStream struct {
+	participant rtc.LocalParticipant
+	aac         AACPolicy
+	ffmpeg      string
+	streamID    string
+
+	video     rtc.LocalTrack
+	payloader codecs.H264Payloader
+	sps, pps  [][]byte
+	// NALU の長さを表すバイト数
+	lengthSize int
+	sequence   uint16
+
+	audio        *aacTranscoder
+	droppedAudio bool
+}
+
+func (s *rtmpStream) WriteAudio(timestamp uint32, data []byte) error {
+	if data[0]>>4 == flvSoundFormatAAC {
+		switch s.aac {
+		case AACPolicyReject:
+			return ErrAudioRejected
+		case AACPolicyTranscode:
+			return s.transcodeAudio(data)
+		}
+	}
+	if !s.droppedAudio {
+		s.droppedAudio = true
+		zap.L().Info("rtmp: audio is dropped", zap.Uint8("sound_format", data[0]>>4))
+	}
+	return nil
+}
+
+// transcodeAudio は AAC のシーケンスヘッダーで Opus のトラックと ffmpeg を用意し、以降のフレームを渡す
+func (s *rtmpStream) transcodeAudio(data []byte) error {
+	if len(data) < 3 {
+		return nil
+	}
+	switch data[1] {
+	case aacPacketTypeConfig:
+		if s.audio != nil {
+			return nil
+		}
+		codec := webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   OPUS_CLOCK_RATE,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		}
+		track, err := s.participant.NewTrack(codec, xid.New().String(), s.streamID)
+		if err != nil {
+			return err
+		}
+		s.audio, err = newAACTranscoder(s.ffmpeg, data[2:], track)
+		return err
+	case aacPacketTypeRaw:
+		if s.audio == nil {
+			return nil
+		}
+		return s.audio.write(data[2:])
+	}
+	return nil
+}
+
+func (s *rtmpStream) WriteVideo(timestamp uint32, data []byte) error {
+	if data[0]&0x0f != flvCodecAVC {
+		return ErrUnsupportedVideoCodec
+	}
+	if len(data) < 5 {
+		return nil
+	}
+	keyframe := data[0]>>4 == flvFrameTypeKey
+	// composition time offset (符号付き 24 bit) を足して表示時刻にする
+	cts := int32(uint32(data[2])<<16|uint32(data[3])<<8|uint32(data[4])) << 8 >> 8
+	body := data[5:]
+
+	switch data[1] {
+	case avcPacketTypeConfig:
+		return s.configure(body)
+	case avcPacketTypeNALU:
+		if s.video == nil {
+			return nil
+		}
+		return s.writeNALUs(uint32(int64(timestamp)+int64(cts)), body, keyframe)
+	}
+	return nil
+}
+
+// configure は AVCDecoderConfigurationRecord から SPS/PPS を取り出し、最初の 1 回でトラックを作る
+func (s *rtmpStream) configure(record []byte) error {
+	if len(record) < 7 {
+		return ErrInvalidAVCConfig
+	}
+	s.lengthSize = int(record[4]&0x03) + 1
+
+	i := 5
+	readSets := func(n int) ([][]byte, error) {
+		sets := [][]byte{}
+		for k := 0; k < n; k++ {
+			if i+2 > len(record) {
+				return nil, ErrInvalidAVCConfig
+			}
+			size := int(record[i])<<8 | int(record[i+1])
+			i += 2
+			if i+size > len(record) {
+				return nil, ErrInvalidAVCConfig
+			}
+			sets = append(sets, record[i:i+size])
+			i += size
+		}
+		return sets, nil
+	}
+
+	n := int(record[i] & 0x1f)
+	i++
+	sps, err := readSets(n)
+	if err != nil {
+		return err
+	}
+	if i >= len(record) {
+		return ErrInvalidAVCConfig
+	}
+	n = int(record[i])
+	i++
+	pps, err := readSets(n)
+	if err != nil {
+		return err
+	}
+	s.sps, s.pps = sps, pps
+
+	if s.video != nil {
+		return nil
+	}
+	codec := webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: H264_CLOCK_RATE,
+		SDPFmtpLine: fmt.Sprintf(
+			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%02x%02x%02x",
+			record[1], record[2], record[3],
+		),
+	}
+	s.video, err = s.participant.NewTrack(codec, xid.New().String(), s.streamID)
+	return err
+}
+
+// writeNALUs は長さ付きの NALU を Annex-B に並べ替えて RTP に詰める。
+// 途中から購読した人がデコードできるよう、キーフレームには SPS/PPS を付ける
+func (s *rtmpStream) writeNALUs(timestamp uint32, body []byte, keyframe bool) error {
+	annexB := []byte{}
+	startCode := []byte{0, 0, 0, 1}
+	if keyframe {
+		for _, set := range append(append([][]byte{}, s.sps...), s.pps...) {
+			annexB = append(append(annexB, startCode...), set...)
+		}
+	}
+	for i := 0; i+s.lengthSize <= len(body); {
+		size := 0
+		for _, b := range body[i : i+s.lengthSize] {
+			size = size<<8 | int(b)
+		}
+		i += s.lengthSize
+		if size == 0 || i+size > len(body) {
+			break
+		}
+		annexB = append(append(annexB, startCode...), body[i:i+size]...)
+		i += size
+	}
+
+	payloads := s.payloader.Payload(RTP_MTU, annexB)
+	for n, payload := range payloads {
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         n == len(payloads)-1,
+				SequenceNumber: s.sequence,
+				Timestamp:      timestamp * (H264_CLOCK_RATE / 1000),
+			},
+			Payload: payload,
+		}
+		s.sequence++
+		if err := s.video.WriteRTP(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *rtmpStream) Done() <-chan struct{} {
+	return s.participant.Done()
+}
+
+func (s *rtmpStream) Close() error {
+	if s.audio != nil {
+		if err := s.audio.Close(); err != nil {
+			zap.L().Warn("rtmp: failed to stop transcoding", zap.Error(err))
+		}
+	}
+	return s.participant.Close()
+}
@@ -0,0 +1,207 @@
+package ingest
+
+import (
+	"errors"
+	"net"
+	"ruyka/pkg/rtc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrIngestNotFound   = errors.New("rtp ingest is not found")
+	ErrUnsupportedCodec = errors.New("unsupported codec: vp8, h264 and opus are supported")
+)
+
+const (
+	// 受信する UDP パケットの最大長
+	RTP_INGEST_BUFFER_SIZE = 1500
+	// 宛先を省略した場合はローカルからの送信だけを受け付ける
+	DEFAULT_RTP_INGEST_ADDRESS = "127.0.0.1:0"
+)
+
+// 取り込む RTP のコーデック。送信側はこのパラメータでエンコードする
+var rtpIngestCodecs = map[string]webrtc.RTPCodecCapability{
+	"vp8": {
+		MimeType:  webrtc.MimeTypeVP8,
+		ClockRate: 90000,
+	},
+	"h264": {
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   H264_CLOCK_RATE,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	},
+	"opus": {
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	},
+}
+
+type RTPIngestOptions struct {
+	Participant string `json:"participant"`
+	// vp8, h264, opus のいずれか
+	Codec string `json:"codec"`
+	// 受信する UDP のアドレス。ポートを 0 にすると空いているポートを使う
+	Address string `json:"address"`
+}
+
+type RTPIngest struct {
+	ID          string    `json:"id"`
+	Room        string    `json:"room"`
+	Participant string    `json:"participant"`
+	TrackID     string    `json:"track"`
+	Codec       string    `json:"codec"`
+	Address     string    `json:"address"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RTPIngester は UDP で受け取った RTP を、サーバ内の参加者のトラックとしてルームに配信する
+type RTPIngester interface {
+	Start(room string, o RTPIngestOptions) (RTPIngest, error)
+	Stop(id string) error
+	Ingests() []RTPIngest
+}
+
+type rtpIngester struct {
+	rtc     rtc.RTC
+	mux     sync.Mutex
+	ingests map[string]*rtpIngest
+}
+
+func NewRTPIngester(r rtc.RTC) RTPIngester {
+	return &rtpIngester{
+		rtc:     r,
+		mux:     sync.Mutex{},
+		ingests: make(map[string]*rtpIngest),
+	}
+}
+
+type rtpIngest struct {
+	info        RTPIngest
+	conn        net.PacketConn
+	participant rtc.LocalParticipant
+	track       rtc.LocalTrack
+}
+
+func (i *rtpIngester) Start(room string, o RTPIngestOptions) (RTPIngest, error) {
+	codec, ok := rtpIngestCodecs[strings.ToLower(o.Codec)]
+	if !ok {
+		return RTPIngest{}, ErrUnsupportedCodec
+	}
+	if o.Address == "" {
+		o.Address = DEFAULT_RTP_INGEST_ADDRESS
+	}
+	if o.Participant == "" {
+		o.Participant = "rtp-ingest"
+	}
+
+	conn, err := net.ListenPacket("udp", o.Address)
+	if err != nil {
+		return RTPIngest{}, err
+	}
+	p, err := i.rtc.NewLocalParticipant(room, o.Participant)
+	if err != nil {
+		conn.Close()
+		return RTPIngest{}, err
+	}
+	track, err := p.NewTrack(codec, xid.New().String(), xid.New().String())
+	if err != nil {
+		conn.Close()
+		p.Close()
+		return RTPIngest{}, err
+	}
+
+	in := &rtpIngest{
+		info: RTPIngest{
+			ID:          xid.New().String(),
+			Room:        room,
+			Participant: o.Participant,
+			TrackID:     track.ID(),
+			Codec:       strings.ToLower(o.Codec),
+			Address:     conn.LocalAddr().String(),
+			CreatedAt:   time.Now(),
+		},
+		conn:        conn,
+		participant: p,
+		track:       track,
+	}
+	i.mux.Lock()
+	i.ingests[in.info.ID] = in
+	i.mux.Unlock()
+
+	go i.receive(in)
+	zap.L().Info("rtp ingest: started",
+		zap.String("id", in.info.ID),
+		zap.String("room", room),
+		zap.String("address", in.info.Address),
+	)
+	return in.info, nil
+}
+
+// receive は Stop で UDP のソケットが閉じられるか、ルームが閉じられて参加者が退出するまで RTP を受け取る
+func (i *rtpIngester) receive(in *rtpIngest) {
+	go func() {
+		<-in.participant.Done()
+		in.conn.Close()
+	}()
+
+	defer func() {
+		in.conn.Close()
+		i.mux.Lock()
+		delete(i.ingests, in.info.ID)
+		i.mux.Unlock()
+
+		if err := in.participant.Close(); err != nil {
+			zap.L().Warn("rtp ingest: failed to close participant", zap.Error(err))
+		}
+		zap.L().Info("rtp ingest: stopped", zap.String("id", in.info.ID))
+	}()
+
+	buf := make([]byte, RTP_INGEST_BUFFER_SIZE)
+	for {
+		n, _, err := in.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				zap.L().Warn("rtp ingest: failed to read", zap.String("id", in.info.ID), zap.Error(err))
+			}
+			return
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+			continue
+		}
+		// 一部の購読者への送信に失敗しても受信は続ける
+		if err := in.track.WriteRTP(pkt); err != nil {
+			zap.L().Warn("rtp ingest: failed to write", zap.String("id", in.info.ID), zap.Error(err))
+		}
+	}
+}
+
+func (i *rtpIngester) Stop(id string) error {
+	i.mux.Lock()
+	in, ok := i.ingests[id]
+	i.mux.Unlock()
+	if !ok {
+		return ErrIngestNotFound
+	}
+	return in.conn.Close()
+}
+
+func (i *rtpIngester) Ingests() []RTPIngest {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	ingests := make([]RTPIngest, 0, len(i.ingests))
+	for id := range i.ingests {
+		ingests = append(ingests, i.ingests[id].info)
+	}
+	return ingests
+}
@@ -0,0 +1,32 @@
+package ingest
+
+import (
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRTPIngestStopsWhenRoomCloses(t *testing.T) {
+	o := rtc.RoomOptions{Codecs: rtc.DefaultCodecPolicy, MaxDuration: 50 * time.Millisecond}
+	r, err := rtc.NewAPI(&webrtc.SettingEngine{}, &webrtc.Configuration{}, o, nil, store.NewMemoryStore(), "node-1", webhook.New(nil, "", time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	i := NewRTPIngester(r)
+	if _, err := i.Start("room", RTPIngestOptions{Codec: "vp8"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(i.Ingests()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("rtp ingest is still listed after max_duration")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
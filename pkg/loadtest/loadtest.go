@@ -0,0 +1,360 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ruyka/pkg/client"
+	"ruyka/pkg/token"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrNoPeers          = errors.New("at least one publisher or subscriber is required")
+	ErrInvalidDuration  = errors.New("duration must be positive")
+	ErrInvalidFrameRate = errors.New("frame rate must be positive")
+	ErrInvalidBitrate   = errors.New("bitrate must not be negative")
+	ErrJoinTimeout      = errors.New("timed out waiting for the peer connection")
+)
+
+const (
+	// 参加してから PeerConnection がつながるまで待つ時間の上限
+	JOIN_TIMEOUT = 15 * time.Second
+	// Secret から作る参加トークンの有効期間。トークンは参加するときにだけ検証される
+	TOKEN_TTL = time.Minute
+)
+
+type Options struct {
+	// シグナリングの URL (例: ws://127.0.0.1:19000/api/v1/signaling)
+	URL  string
+	Room string
+	// 全員で共有する参加トークン
+	Token string
+	// サーバの auth.secret。Token が空の場合は参加者ごとにトークンを作る
+	Secret      string
+	Publishers  int
+	Subscribers int
+	// 全員が参加してから計測する時間
+	Duration time.Duration
+	// 参加者を 1 人ずつ参加させる間隔。0 の場合は同時に参加させる
+	RampUp time.Duration
+	// 0 の場合は映像・音声を配信しない
+	VideoBitrate int
+	AudioBitrate int
+	FrameRate    float64
+	WebRTC       webrtc.Configuration
+	// 省略した場合は client の既定の API を使う
+	API *webrtc.API
+	// wss で接続するときの設定。nil の場合は既定の設定で接続する
+	TLS *tls.Config
+}
+
+// Report は負荷試験の結果。送受信の量と欠損・ジッタは計測期間中のものだけを数える
+type Report struct {
+	Room        string `json:"room"`
+	Publishers  int    `json:"publishers"`
+	Subscribers int    `json:"subscribers"`
+	Joined      int    `json:"joined"`
+	Failed      int    `json:"failed"`
+	// 計測期間中にシグナリングが切れた参加者の数
+	Disconnected int           `json:"disconnected"`
+	Duration     time.Duration `json:"duration_ns"`
+	// 参加してから PeerConnection がつながるまでの時間
+	JoinLatency Distribution `json:"join_latency"`
+	Sent        Traffic      `json:"sent"`
+	Received    Traffic      `json:"received"`
+	PacketsLost uint64       `json:"packets_lost"`
+	LossRate    float64      `json:"loss_rate"`
+	// 受信したトラックごとのジッタ
+	Jitter Distribution `json:"jitter"`
+	// 参加に失敗した理由ごとの数
+	Errors map[string]int `json:"errors,omitempty"`
+}
+
+type peer struct {
+	client     client.Client
+	generators []*generator
+	tracks     []*webrtc.TrackLocalStaticRTP
+	latency    time.Duration
+	err        error
+
+	mux       sync.Mutex
+	receivers []*receiver
+	sent      Traffic
+}
+
+// runner は全ての参加者の計測を共有する
+type runner struct {
+	options   Options
+	measuring atomic.Bool
+}
+
+// Run は参加者を参加させ、全員の参加が終わってから Duration の間だけ送受信を計測する。
+// ctx がキャンセルされた場合は、それまでの計測結果を返す
+func Run(ctx context.Context, o Options) (Report, error) {
+	if o.Publishers+o.Subscribers <= 0 {
+		return Report{}, ErrNoPeers
+	}
+	if o.Duration <= 0 {
+		return Report{}, ErrInvalidDuration
+	}
+	if o.FrameRate <= 0 {
+		return Report{}, ErrInvalidFrameRate
+	}
+	if o.VideoBitrate < 0 || o.AudioBitrate < 0 {
+		return Report{}, ErrInvalidBitrate
+	}
+
+	r := &runner{options: o}
+	peers := make([]*peer, o.Publishers+o.Subscribers)
+	started := 0
+	wg := sync.WaitGroup{}
+	for i := range peers {
+		if i > 0 && o.RampUp > 0 {
+			select {
+			case <-time.After(o.RampUp):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peers[i] = r.join(ctx, i, i < o.Publishers)
+		}(i)
+	}
+	wg.Wait()
+	peers = peers[:started]
+	defer func() {
+		for _, p := range peers {
+			if p.client != nil {
+				p.client.Close()
+			}
+		}
+	}()
+
+	r.measuring.Store(true)
+	start := time.Now()
+	select {
+	case <-time.After(o.Duration):
+	case <-ctx.Done():
+	}
+	r.measuring.Store(false)
+
+	return r.report(peers, time.Since(start)), nil
+}
+
+// token は参加者に渡す参加トークンを返す。配信者以外には配信を許可しない
+func (r *runner) token(i int, publish bool) (string, error) {
+	if r.options.Token != "" || r.options.Secret == "" {
+		return r.options.Token, nil
+	}
+	return token.Create(r.options.Secret, token.Grant{
+		Room:         r.options.Room,
+		Identity:     fmt.Sprintf("loadtest-%d", i),
+		CanPublish:   publish,
+		CanSubscribe: true,
+	}, TOKEN_TTL)
+}
+
+// join は参加者を 1 人参加させ、PeerConnection がつながるまで待つ
+func (r *runner) join(ctx context.Context, i int, publish bool) *peer {
+	p := &peer{}
+	t, err := r.token(i, publish)
+	if err != nil {
+		p.err = err
+		return p
+	}
+	if publish {
+		streamID := xid.New().String()
+		if r.options.VideoBitrate > 0 {
+			p.generators = append(p.generators, newVideoGenerator(r.options.VideoBitrate, r.options.FrameRate))
+		}
+		if r.options.AudioBitrate > 0 {
+			p.generators = append(p.generators, newAudioGenerator(r.options.AudioBitrate))
+		}
+		for _, g := range p.generators {
+			track, err := webrtc.NewTrackLocalStaticRTP(g.codec, xid.New().String(), streamID)
+			if err != nil {
+				p.err = err
+				return p
+			}
+			p.tracks = append(p.tracks, track)
+		}
+	}
+	tracks := make([]webrtc.TrackLocal, 0, len(p.tracks))
+	for _, t := range p.tracks {
+		tracks = append(tracks, t)
+	}
+
+	c, err := client.New(client.Config{
+		URL:    r.options.URL,
+		Room:   r.options.Room,
+		Token:  t,
+		WebRTC: r.options.WebRTC,
+		API:    r.options.API,
+		Tracks: tracks,
+		TLS:    r.options.TLS,
+	})
+	if err != nil {
+		p.err = err
+		return p
+	}
+	p.client = c
+	c.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		go r.receive(p, tr)
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, JOIN_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	if err := c.Connect(ctx); err != nil {
+		p.err = err
+		return p
+	}
+	select {
+	case <-c.Connected():
+		p.latency = time.Since(start)
+	case <-c.Done():
+		p.err = c.Err()
+		return p
+	case <-ctx.Done():
+		p.err = ErrJoinTimeout
+		return p
+	}
+
+	for i := range p.generators {
+		go r.publish(p, p.generators[i], p.tracks[i])
+	}
+	return p
+}
+
+// publish は生成したフレームを一定間隔で送る
+func (r *runner) publish(p *peer, g *generator, track *webrtc.TrackLocalStaticRTP) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.client.Done():
+			return
+		}
+		for _, pkt := range g.next() {
+			if err := track.WriteRTP(pkt); err != nil {
+				return
+			}
+			if r.measuring.Load() {
+				p.mux.Lock()
+				p.sent.add(pkt)
+				p.mux.Unlock()
+			}
+		}
+	}
+}
+
+// receive はトラックが閉じられるまで読み、計測期間中のパケットを数える
+func (r *runner) receive(p *peer, tr *webrtc.TrackRemote) {
+	rc := newReceiver(tr.Codec().ClockRate)
+	p.mux.Lock()
+	p.receivers = append(p.receivers, rc)
+	p.mux.Unlock()
+
+	for {
+		pkt, _, err := tr.ReadRTP()
+		if err != nil {
+			return
+		}
+		if r.measuring.Load() {
+			rc.receive(pkt, time.Now())
+		}
+	}
+}
+
+func (r *runner) report(peers []*peer, elapsed time.Duration) Report {
+	report := Report{
+		Room:        r.options.Room,
+		Publishers:  r.options.Publishers,
+		Subscribers: r.options.Subscribers,
+		Duration:    elapsed,
+	}
+	latencies := []time.Duration{}
+	jitters := []time.Duration{}
+	var expected uint64
+	for _, p := range peers {
+		if p.err != nil {
+			report.Failed++
+			if report.Errors == nil {
+				report.Errors = map[string]int{}
+			}
+			report.Errors[p.err.Error()]++
+			continue
+		}
+		report.Joined++
+		latencies = append(latencies, p.latency)
+		select {
+		case <-p.client.Done():
+			report.Disconnected++
+		default:
+		}
+
+		p.mux.Lock()
+		report.Sent.Packets += p.sent.Packets
+		report.Sent.Bytes += p.sent.Bytes
+		receivers := p.receivers
+		p.mux.Unlock()
+		for _, rc := range receivers {
+			traffic, n, jitter := rc.result()
+			if n == 0 {
+				continue
+			}
+			report.Received.Packets += traffic.Packets
+			report.Received.Bytes += traffic.Bytes
+			expected += n
+			jitters = append(jitters, jitter)
+		}
+	}
+
+	report.Sent.rate(elapsed)
+	report.Received.rate(elapsed)
+	if expected > report.Received.Packets {
+		report.PacketsLost = expected - report.Received.Packets
+	}
+	if expected > 0 {
+		report.LossRate = float64(report.PacketsLost) / float64(expected)
+	}
+	report.JoinLatency = distribution(latencies)
+	report.Jitter = distribution(jitters)
+	return report
+}
+
+// Summary は Report を人が読むための文字列にする
+func (r Report) Summary() string {
+	return fmt.Sprintf(
+		"room:          %s\n"+
+			"peers:         %d publishers, %d subscribers (%d joined, %d failed, %d disconnected)\n"+
+			"duration:      %s\n"+
+			"join latency:  min %.1fms, mean %.1fms, p50 %.1fms, p95 %.1fms, max %.1fms\n"+
+			"sent:          %d packets, %d bytes, %.1f kbps, %.1f pps\n"+
+			"received:      %d packets, %d bytes, %.1f kbps, %.1f pps\n"+
+			"packet loss:   %d (%.2f%%)\n"+
+			"jitter:        min %.1fms, mean %.1fms, p50 %.1fms, p95 %.1fms, max %.1fms (%d tracks)\n",
+		r.Room,
+		r.Publishers, r.Subscribers, r.Joined, r.Failed, r.Disconnected,
+		r.Duration.Round(time.Millisecond),
+		r.JoinLatency.Min, r.JoinLatency.Mean, r.JoinLatency.P50, r.JoinLatency.P95, r.JoinLatency.Max,
+		r.Sent.Packets, r.Sent.Bytes, r.Sent.Bitrate/1000, r.Sent.PacketRate,
+		r.Received.Packets, r.Received.Bytes, r.Received.Bitrate/1000, r.Received.PacketRate,
+		r.PacketsLost, r.LossRate*100,
+		r.Jitter.Min, r.Jitter.Mean, r.Jitter.P50, r.Jitter.P95, r.Jitter.Max, r.Jitter.Count,
+	)
+}
@@ -0,0 +1,102 @@
+package loadtest
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	RTP_MTU = 1200
+	// Opus は 20ms ごとにフレームを送る
+	AUDIO_FRAME_INTERVAL = 20 * time.Millisecond
+	// 途中から参加した購読者が映像を表示できるように、一定間隔でキーフレームを送る
+	KEYFRAME_INTERVAL = time.Second
+	VIDEO_CLOCK_RATE  = 90000
+	OPUS_CLOCK_RATE   = 48000
+)
+
+// generator は指定したビットレートになる大きさの合成フレームを作り、RTP パケットに分割する
+type generator struct {
+	codec     webrtc.RTPCodecCapability
+	payloader rtp.Payloader
+	interval  time.Duration
+	// 1 フレームのバイト数
+	size      int
+	keyframes int
+	frames    int
+	sequence  uint16
+	timestamp uint32
+}
+
+func newVideoGenerator(bitrate int, frameRate float64) *generator {
+	interval := time.Duration(float64(time.Second) / frameRate)
+	return &generator{
+		codec:     webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: VIDEO_CLOCK_RATE},
+		payloader: &codecs.VP8Payloader{EnablePictureID: true},
+		interval:  interval,
+		// キーフレームの開始コードを含められる大きさは確保する
+		size:      maxInt(frameSize(bitrate, interval), 10),
+		keyframes: maxInt(int(KEYFRAME_INTERVAL/interval), 1),
+	}
+}
+
+func newAudioGenerator(bitrate int) *generator {
+	return &generator{
+		codec:     webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: OPUS_CLOCK_RATE, Channels: 2},
+		payloader: &codecs.OpusPayloader{},
+		interval:  AUDIO_FRAME_INTERVAL,
+		size:      maxInt(frameSize(bitrate, AUDIO_FRAME_INTERVAL), 3),
+	}
+}
+
+func frameSize(bitrate int, interval time.Duration) int {
+	return int(float64(bitrate) / 8 * interval.Seconds())
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// next は次のフレームを RTP パケットにして返す
+func (g *generator) next() []*rtp.Packet {
+	frame := make([]byte, g.size)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	switch g.codec.MimeType {
+	case webrtc.MimeTypeVP8:
+		// フレームタグの最下位ビットが 0 ならキーフレーム。キーフレームは 3 バイト目から開始コードが続く
+		frame[0] = 0x01
+		if g.frames%g.keyframes == 0 {
+			frame[0] = 0x00
+			frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+		}
+	case webrtc.MimeTypeOpus:
+		// TOC: CELT FB 20ms, ステレオ, 1 フレーム
+		frame[0] = 0xfc
+	}
+	g.frames++
+
+	payloads := g.payloader.Payload(RTP_MTU, frame)
+	pkts := make([]*rtp.Packet, 0, len(payloads))
+	for i, payload := range payloads {
+		pkts = append(pkts, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: g.sequence,
+				Timestamp:      g.timestamp,
+			},
+			Payload: payload,
+		})
+		g.sequence++
+	}
+	g.timestamp += uint32(g.interval.Seconds() * float64(g.codec.ClockRate))
+	return pkts
+}
@@ -0,0 +1,141 @@
+package loadtest
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Distribution はミリ秒単位の値の分布
+type Distribution struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func distribution(values []time.Duration) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	ms := make([]float64, 0, len(values))
+	sum := 0.0
+	for _, v := range values {
+		f := float64(v) / float64(time.Millisecond)
+		ms = append(ms, f)
+		sum += f
+	}
+	sort.Float64s(ms)
+	return Distribution{
+		Count: len(ms),
+		Min:   ms[0],
+		Mean:  sum / float64(len(ms)),
+		P50:   percentile(ms, 0.5),
+		P95:   percentile(ms, 0.95),
+		Max:   ms[len(ms)-1],
+	}
+}
+
+// percentile は昇順に並んだ values の p 分位点を最近傍で返す
+func percentile(values []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
+
+// Traffic は計測期間中に送受信したメディアの量。ペイロードのバイト数で数える
+type Traffic struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// 計測期間で割った値
+	Bitrate    float64 `json:"bitrate_bps"`
+	PacketRate float64 `json:"packet_rate_pps"`
+}
+
+func (t *Traffic) add(pkt *rtp.Packet) {
+	t.Packets++
+	t.Bytes += uint64(len(pkt.Payload))
+}
+
+func (t *Traffic) rate(elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	t.Bitrate = float64(t.Bytes*8) / elapsed.Seconds()
+	t.PacketRate = float64(t.Packets) / elapsed.Seconds()
+}
+
+// receiver は受信したトラックごとに RFC 3550 と同じ方法で欠損とジッタを計算する
+type receiver struct {
+	mux       sync.Mutex
+	clockRate float64
+	traffic   Traffic
+	started   bool
+	// 拡張シーケンス番号
+	base    uint32
+	highest uint32
+	// 周回を考慮した RTP タイムスタンプ
+	timestamp     float64
+	lastTimestamp uint32
+	// 到着時刻と RTP タイムスタンプの差の変化量 (クロック単位)
+	jitter      float64
+	lastTransit float64
+	epoch       time.Time
+}
+
+func newReceiver(clockRate uint32) *receiver {
+	return &receiver{
+		mux:       sync.Mutex{},
+		clockRate: float64(clockRate),
+	}
+}
+
+func (r *receiver) receive(pkt *rtp.Packet, at time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.traffic.add(pkt)
+	if !r.started {
+		r.started = true
+		r.base = uint32(pkt.SequenceNumber)
+		r.highest = r.base
+		r.lastTimestamp = pkt.Timestamp
+		r.epoch = at
+		return
+	}
+
+	// 直前の最大値から半周以内に進んでいれば、周回したとみなして拡張する
+	if int16(pkt.SequenceNumber-uint16(r.highest)) > 0 {
+		seq := r.highest&0xffff0000 | uint32(pkt.SequenceNumber)
+		if seq < r.highest {
+			seq += 1 << 16
+		}
+		r.highest = seq
+	}
+
+	r.timestamp += float64(int32(pkt.Timestamp - r.lastTimestamp))
+	r.lastTimestamp = pkt.Timestamp
+	transit := at.Sub(r.epoch).Seconds()*r.clockRate - r.timestamp
+	r.jitter += (math.Abs(transit-r.lastTransit) - r.jitter) / 16
+	r.lastTransit = transit
+}
+
+// result は受信したパケット数、期待したパケット数、ジッタを返す
+func (r *receiver) result() (Traffic, uint64, time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.started {
+		return r.traffic, 0, 0
+	}
+	expected := uint64(r.highest-r.base) + 1
+	jitter := time.Duration(r.jitter / r.clockRate * float64(time.Second))
+	return r.traffic, expected, jitter
+}
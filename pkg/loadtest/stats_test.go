@@ -0,0 +1,160 @@
+package loadtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestDistribution(t *testing.T) {
+	// 1ms から 20ms までを順不同で並べる
+	values := []time.Duration{}
+	for i := 20; i >= 1; i-- {
+		values = append(values, time.Duration(i)*time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		values []time.Duration
+		want   Distribution
+	}{
+		{name: "empty", values: nil, want: Distribution{}},
+		{
+			name:   "single",
+			values: []time.Duration{1500 * time.Microsecond},
+			want:   Distribution{Count: 1, Min: 1.5, Mean: 1.5, P50: 1.5, P95: 1.5, Max: 1.5},
+		},
+		{
+			name:   "1 to 20",
+			values: values,
+			// 最近傍なので p50 は 10 番目、p95 は 19 番目の値
+			want: Distribution{Count: 20, Min: 1, Mean: 10.5, P50: 10, P95: 19, Max: 20},
+		},
+	}
+	for _, tt := range tests {
+		if got := distribution(tt.values); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{p: 0, want: 1},
+		{p: 0.25, want: 1},
+		{p: 0.26, want: 2},
+		{p: 0.5, want: 2},
+		{p: 0.95, want: 4},
+		{p: 1, want: 4},
+	}
+	for _, tt := range tests {
+		if got := percentile(values, tt.p); got != tt.want {
+			t.Errorf("percentile(%v): %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestTrafficRate(t *testing.T) {
+	tr := Traffic{}
+	for i := 0; i < 10; i++ {
+		tr.add(&rtp.Packet{Payload: make([]byte, 100)})
+	}
+	tr.rate(2 * time.Second)
+	if tr.Packets != 10 || tr.Bytes != 1000 {
+		t.Errorf("%d packets, %d bytes, want 10, 1000", tr.Packets, tr.Bytes)
+	}
+	if tr.Bitrate != 4000 || tr.PacketRate != 5 {
+		t.Errorf("bitrate %v, packet rate %v, want 4000, 5", tr.Bitrate, tr.PacketRate)
+	}
+
+	// 計測期間が無い場合は計算しない
+	tr = Traffic{Packets: 1, Bytes: 1}
+	tr.rate(0)
+	if tr.Bitrate != 0 || tr.PacketRate != 0 {
+		t.Errorf("bitrate %v, packet rate %v for zero elapsed, want 0", tr.Bitrate, tr.PacketRate)
+	}
+}
+
+func TestReceiverExpectedPackets(t *testing.T) {
+	tests := []struct {
+		name     string
+		seqs     []uint16
+		expected uint64
+	}{
+		{name: "in order", seqs: []uint16{10, 11, 12}, expected: 3},
+		{name: "lost", seqs: []uint16{10, 12, 15}, expected: 6},
+		// 0 が欠けたまま周回する
+		{name: "wraparound", seqs: []uint16{65534, 65535, 1, 2}, expected: 5},
+		// 遅れて届いたパケットは最大値を戻さない
+		{name: "reordered", seqs: []uint16{10, 12, 11, 13}, expected: 4},
+		{name: "reordered across wraparound", seqs: []uint16{65535, 1, 0, 2}, expected: 4},
+		// 半周以内の後退は大きくても遅れて届いたパケットとみなす
+		{name: "late packet", seqs: []uint16{40000, 40001, 39000}, expected: 2},
+		// 番号が小さくても半周未満の前進であれば周回したとみなす
+		{name: "jump across wraparound", seqs: []uint16{40000, 40001, 5000}, expected: 30537},
+	}
+	for _, tt := range tests {
+		r := newReceiver(90000)
+		at := time.Now()
+		for _, seq := range tt.seqs {
+			r.receive(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, at)
+		}
+		traffic, expected, _ := r.result()
+		if traffic.Packets != uint64(len(tt.seqs)) {
+			t.Errorf("%s: %d packets received, want %d", tt.name, traffic.Packets, len(tt.seqs))
+		}
+		if expected != tt.expected {
+			t.Errorf("%s: %d packets expected, want %d", tt.name, expected, tt.expected)
+		}
+	}
+}
+
+func TestReceiverJitter(t *testing.T) {
+	const (
+		clockRate = 48000
+		// 20ms ごとの Opus のパケット
+		interval  = 20 * time.Millisecond
+		timestamp = 960
+	)
+	tests := []struct {
+		name string
+		// 届いた時刻の予定からのずれ
+		delays []time.Duration
+		// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1)) / 16 をクロック単位で計算した値
+		want float64
+	}{
+		{name: "constant", delays: []time.Duration{0, 0, 0, 0}, want: 0},
+		// 2 番目のパケットだけ 10ms (480) 遅れる: 480/16 = 30、30 + (480-30)/16 = 58.125
+		{name: "one delayed", delays: []time.Duration{0, 10 * time.Millisecond, 0}, want: 58.125},
+		// 遅れが一定になればジッタは減っていく: 30 + (0-30)/16 = 28.125
+		{name: "constant delay", delays: []time.Duration{0, 10 * time.Millisecond, 10 * time.Millisecond}, want: 28.125},
+	}
+	for _, tt := range tests {
+		r := newReceiver(clockRate)
+		start := time.Now()
+		// RTP タイムスタンプの周回をまたぐ
+		ts := uint32(0xffffffff - timestamp)
+		for i, d := range tt.delays {
+			pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: ts}}
+			r.receive(pkt, start.Add(time.Duration(i)*interval+d))
+			ts += timestamp
+		}
+		_, _, jitter := r.result()
+		want := time.Duration(tt.want / clockRate * float64(time.Second))
+		if diff := jitter - want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("%s: jitter %v, want %v", tt.name, jitter, want)
+		}
+	}
+}
+
+func TestReceiverWithoutPackets(t *testing.T) {
+	traffic, expected, jitter := newReceiver(90000).result()
+	if traffic.Packets != 0 || expected != 0 || jitter != 0 {
+		t.Errorf("%d packets, %d expected, jitter %v, want zero", traffic.Packets, expected, jitter)
+	}
+}
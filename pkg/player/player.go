@@ -0,0 +1,285 @@
+package player
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"ruyka/pkg/rtc"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrPlaybackNotFound = errors.New("playback is not found")
+	ErrNoFiles          = errors.New("at least one media file is required")
+	ErrInvalidFrameRate = errors.New("frame rate must be positive")
+)
+
+const (
+	RTP_MTU = 1200
+	// H.264 (Annex-B) のフレームレートを省略した場合の値
+	DEFAULT_FRAME_RATE = 30
+)
+
+type Options struct {
+	Participant string `json:"participant"`
+	// 再生するファイルのパス (メディアディレクトリからの相対パス)。ファイルごとに 1 トラックを配信する
+	Files []string `json:"files"`
+	// ファイルの終わりで先頭から繰り返す
+	Loop bool `json:"loop"`
+	// H.264 (Annex-B) のファイルは時刻を持たないので、このフレームレートで送る
+	FrameRate float64 `json:"frame_rate"`
+}
+
+type PlaybackTrack struct {
+	TrackID string `json:"track"`
+	File    string `json:"file"`
+	Codec   string `json:"codec"`
+}
+
+type Playback struct {
+	ID          string          `json:"id"`
+	Room        string          `json:"room"`
+	Participant string          `json:"participant"`
+	Tracks      []PlaybackTrack `json:"tracks"`
+	Loop        bool            `json:"loop"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Player はサーバ上のメディアファイルを、ブラウザと同じく TrackManager.Join で参加した参加者として配信する。
+// 再生はファイルが終わるか、Stop されるか、ルームが閉じられると止まる
+type Player interface {
+	Start(room string, o Options) (Playback, error)
+	Stop(id string) error
+	Playbacks() []Playback
+}
+
+type player struct {
+	rtc       rtc.RTC
+	dir       string
+	mux       sync.Mutex
+	playbacks map[string]*playback
+}
+
+// NewPlayer は dir の中のファイルだけを再生する
+func NewPlayer(r rtc.RTC, dir string) Player {
+	return &player{
+		rtc:       r,
+		dir:       dir,
+		mux:       sync.Mutex{},
+		playbacks: make(map[string]*playback),
+	}
+}
+
+type playback struct {
+	info        Playback
+	participant rtc.LocalParticipant
+	frameRate   float64
+	stop        chan struct{}
+	once        sync.Once
+}
+
+func (p *player) Start(room string, o Options) (Playback, error) {
+	if len(o.Files) == 0 {
+		return Playback{}, ErrNoFiles
+	}
+	if o.FrameRate < 0 {
+		return Playback{}, ErrInvalidFrameRate
+	}
+	if o.FrameRate == 0 {
+		o.FrameRate = DEFAULT_FRAME_RATE
+	}
+	if o.Participant == "" {
+		o.Participant = "player"
+	}
+
+	// 先に全てのファイルを開いて、形式の誤りを参加前に返す
+	readers := make([]sampleReader, 0, len(o.Files))
+	closeReaders := func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}
+	for _, file := range o.Files {
+		r, err := openReader(p.path(file), o.FrameRate)
+		if err != nil {
+			closeReaders()
+			return Playback{}, err
+		}
+		readers = append(readers, r)
+	}
+
+	participant, err := p.rtc.JoinLocalParticipant(room, o.Participant)
+	if err != nil {
+		closeReaders()
+		return Playback{}, err
+	}
+	pb := &playback{
+		info: Playback{
+			ID:          xid.New().String(),
+			Room:        room,
+			Participant: o.Participant,
+			Loop:        o.Loop,
+			CreatedAt:   time.Now(),
+		},
+		participant: participant,
+		frameRate:   o.FrameRate,
+		stop:        make(chan struct{}),
+	}
+	tracks := make([]rtc.LocalTrack, 0, len(readers))
+	streamID := xid.New().String()
+	for i, r := range readers {
+		t, err := participant.NewTrack(r.codec(), xid.New().String(), streamID)
+		if err != nil {
+			closeReaders()
+			participant.Close()
+			return Playback{}, err
+		}
+		tracks = append(tracks, t)
+		pb.info.Tracks = append(pb.info.Tracks, PlaybackTrack{
+			TrackID: t.ID(),
+			File:    o.Files[i],
+			Codec:   r.codec().MimeType,
+		})
+	}
+
+	p.mux.Lock()
+	p.playbacks[pb.info.ID] = pb
+	p.mux.Unlock()
+
+	go p.run(pb, readers, tracks)
+	zap.L().Info("player: started",
+		zap.String("id", pb.info.ID),
+		zap.String("room", room),
+		zap.Strings("files", o.Files),
+	)
+	return pb.info, nil
+}
+
+// path はメディアディレクトリの外を指すパスを、ディレクトリの中に閉じ込める
+func (p *player) path(file string) string {
+	return filepath.Join(p.dir, filepath.Clean("/"+file))
+}
+
+// run は全てのトラックの再生が終わるとルームから退出する
+func (p *player) run(pb *playback, readers []sampleReader, tracks []rtc.LocalTrack) {
+	wg := sync.WaitGroup{}
+	for i := range readers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := pb.play(p.path(pb.info.Tracks[i].File), readers[i], tracks[i]); err != nil {
+				zap.L().Warn("player: failed to play",
+					zap.String("id", pb.info.ID),
+					zap.String("file", pb.info.Tracks[i].File),
+					zap.Error(err),
+				)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	p.mux.Lock()
+	delete(p.playbacks, pb.info.ID)
+	p.mux.Unlock()
+
+	if err := pb.participant.Close(); err != nil {
+		zap.L().Warn("player: failed to close participant", zap.Error(err))
+	}
+	zap.L().Info("player: stopped", zap.String("id", pb.info.ID))
+}
+
+// play はサンプルをファイルの時刻に合わせて送る。
+// ループするときは最後のフレームの長さだけ空けて、先頭からタイムスタンプを続ける
+func (pb *playback) play(path string, r sampleReader, t rtc.LocalTrack) error {
+	// ループで開き直したファイルを閉じるため、r を後から参照する
+	defer func() {
+		r.Close()
+	}()
+
+	clockRate := float64(r.codec().ClockRate)
+	payloader := r.payloader()
+	start := time.Now()
+	var sequence uint16
+	var base, last, frame uint64
+	for {
+		s, err := r.next()
+		if errors.Is(err, io.EOF) {
+			if !pb.info.Loop {
+				return nil
+			}
+			r.Close()
+			next, err := openReader(path, pb.frameRate)
+			if err != nil {
+				return err
+			}
+			r = next
+			base += last + frame
+			last = 0
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.timestamp > last {
+			frame = s.timestamp - last
+		}
+		last = s.timestamp
+		timestamp := base + s.timestamp
+
+		at := start.Add(time.Duration(float64(timestamp) / clockRate * float64(time.Second)))
+		select {
+		case <-time.After(time.Until(at)):
+		case <-pb.stop:
+			return nil
+		case <-pb.participant.Done():
+			return nil
+		}
+
+		payloads := payloader.Payload(RTP_MTU, s.data)
+		for i, payload := range payloads {
+			pkt := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         i == len(payloads)-1,
+					SequenceNumber: sequence,
+					Timestamp:      uint32(timestamp),
+				},
+				Payload: payload,
+			}
+			sequence++
+			// 一部の購読者への送信に失敗しても再生は続ける
+			if err := t.WriteRTP(pkt); err != nil {
+				zap.L().Warn("player: failed to write", zap.String("id", pb.info.ID), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (p *player) Stop(id string) error {
+	p.mux.Lock()
+	pb, ok := p.playbacks[id]
+	p.mux.Unlock()
+	if !ok {
+		return ErrPlaybackNotFound
+	}
+	pb.once.Do(func() {
+		close(pb.stop)
+	})
+	return nil
+}
+
+func (p *player) Playbacks() []Playback {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	playbacks := make([]Playback, 0, len(p.playbacks))
+	for id := range p.playbacks {
+		playbacks = append(playbacks, p.playbacks[id].info)
+	}
+	return playbacks
+}
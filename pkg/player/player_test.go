@@ -0,0 +1,157 @@
+package player
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"ruyka/pkg/rtc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+)
+
+type testParticipant struct {
+	done chan struct{}
+}
+
+func (p *testParticipant) ID() rtc.PeerConnectionID {
+	return rtc.PeerConnectionID(xid.New())
+}
+
+func (p *testParticipant) NewTrack(webrtc.RTPCodecCapability, string, string) (rtc.LocalTrack, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *testParticipant) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *testParticipant) Close() error {
+	return nil
+}
+
+// testTrack は書き込まれたパケットを記録し、n 個を超えたら stop を閉じる
+type testTrack struct {
+	n    int
+	stop chan struct{}
+	mux  sync.Mutex
+	pkts []*rtp.Packet
+}
+
+func (t *testTrack) ID() string {
+	return "track"
+}
+
+func (t *testTrack) WriteRTP(pkt *rtp.Packet) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.pkts = append(t.pkts, pkt)
+	if len(t.pkts) == t.n {
+		close(t.stop)
+	}
+	return nil
+}
+
+func TestPlayContinuesTimestampsWhenLooping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.ivf")
+	// 10ms ごとの 3 フレーム
+	writeIVF(t, path, []uint64{0, 1, 2})
+	r, err := openReader(path, DEFAULT_FRAME_RATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pb := &playback{
+		info:        Playback{Loop: true},
+		participant: &testParticipant{done: make(chan struct{})},
+		frameRate:   DEFAULT_FRAME_RATE,
+		stop:        make(chan struct{}),
+	}
+	track := &testTrack{n: 8, stop: pb.stop}
+	if err := pb.play(path, r, track); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 周目以降も最後のフレームの長さだけ空けてタイムスタンプを続ける
+	for i, pkt := range track.pkts {
+		if want := uint32(i * 900); pkt.Timestamp != want {
+			t.Errorf("packet %d: timestamp %d, want %d", i, pkt.Timestamp, want)
+		}
+		if pkt.SequenceNumber != uint16(i) {
+			t.Errorf("packet %d: sequence number %d, want %d", i, pkt.SequenceNumber, i)
+		}
+	}
+}
+
+func TestPlayStopsAtEndWithoutLoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.ivf")
+	writeIVF(t, path, []uint64{0, 1, 2})
+	r, err := openReader(path, DEFAULT_FRAME_RATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pb := &playback{
+		participant: &testParticipant{done: make(chan struct{})},
+		frameRate:   DEFAULT_FRAME_RATE,
+		stop:        make(chan struct{}),
+	}
+	track := &testTrack{stop: pb.stop}
+	done := make(chan error)
+	go func() {
+		done <- pb.play(path, r, track)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("play does not stop at the end of the file")
+	}
+	if len(track.pkts) != 3 {
+		t.Errorf("%d packets, want 3", len(track.pkts))
+	}
+}
+
+func TestPlayerPathStaysInMediaDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "media")
+	p := &player{dir: dir}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "video.ivf", want: filepath.Join(dir, "video.ivf")},
+		{file: "sub/video.ivf", want: filepath.Join(dir, "sub", "video.ivf")},
+		{file: "../video.ivf", want: filepath.Join(dir, "video.ivf")},
+		{file: "sub/../../../etc/passwd", want: filepath.Join(dir, "etc", "passwd")},
+		{file: "/etc/passwd", want: filepath.Join(dir, "etc", "passwd")},
+	}
+	for _, tt := range tests {
+		if got := p.path(tt.file); got != tt.want {
+			t.Errorf("path(%q): %s, want %s", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestStartRejectsFilesOutsideMediaDirectory(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "media")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	// メディアディレクトリの外にだけ再生できるファイルがある
+	writeIVF(t, filepath.Join(root, "outside.ivf"), []uint64{0})
+
+	// ルームに参加する前にファイルを開けずに失敗する
+	_, err := NewPlayer(nil, dir).Start("room", Options{Files: []string{"../outside.ivf"}})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Start: %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -0,0 +1,370 @@
+package player
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+var (
+	ErrUnsupportedFile = errors.New("unsupported media file: ivf (vp8, vp9), h264 (annex-b) and ogg (opus) are supported")
+	ErrInvalidOgg      = errors.New("invalid ogg page")
+)
+
+const (
+	VIDEO_CLOCK_RATE = 90000
+	OPUS_CLOCK_RATE  = 48000
+)
+
+// sample は 1 フレーム分のデータ。timestamp はファイルの先頭からの時刻 (RTP のクロック)
+type sample struct {
+	data      []byte
+	timestamp uint64
+}
+
+// sampleReader はメディアファイルからサンプルを時刻順に読む。ファイルの終わりでは io.EOF を返す
+type sampleReader interface {
+	codec() webrtc.RTPCodecCapability
+	payloader() rtp.Payloader
+	next() (sample, error)
+	io.Closer
+}
+
+// openReader は拡張子でファイルの形式を決める。
+// H.264 の Annex-B は時刻を持たないので frameRate で時刻を割り当てる
+func openReader(path string, frameRate float64) (sampleReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r sampleReader
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		r, err = newIVFReader(f)
+	case ".h264", ".264":
+		r, err = newH264Reader(f, frameRate)
+	case ".ogg", ".opus":
+		r, err = newOggReader(f)
+	default:
+		err = ErrUnsupportedFile
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+type ivfReader struct {
+	file   *os.File
+	reader *ivfreader.IVFReader
+	header *ivfreader.IVFFileHeader
+}
+
+func newIVFReader(f *os.File) (sampleReader, error) {
+	reader, header, err := ivfreader.NewWith(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" && header.FourCC != "VP90" {
+		return nil, fmt.Errorf("%w: ivf fourcc %q", ErrUnsupportedFile, header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 || header.TimebaseNumerator == 0 {
+		return nil, fmt.Errorf("%w: ivf timebase is zero", ErrUnsupportedFile)
+	}
+	return &ivfReader{file: f, reader: reader, header: header}, nil
+}
+
+func (r *ivfReader) codec() webrtc.RTPCodecCapability {
+	if r.header.FourCC == "VP90" {
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeVP9,
+			ClockRate:   VIDEO_CLOCK_RATE,
+			SDPFmtpLine: "profile-id=0",
+		}
+	}
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: VIDEO_CLOCK_RATE}
+}
+
+func (r *ivfReader) payloader() rtp.Payloader {
+	if r.header.FourCC == "VP90" {
+		return &codecs.VP9Payloader{}
+	}
+	return &codecs.VP8Payloader{EnablePictureID: true}
+}
+
+func (r *ivfReader) next() (sample, error) {
+	frame, header, err := r.reader.ParseNextFrame()
+	if err != nil {
+		return sample{}, eof(err)
+	}
+	// IVF の時刻は timebase (numerator/denominator 秒) 単位
+	ts := header.Timestamp * uint64(r.header.TimebaseNumerator) * VIDEO_CLOCK_RATE / uint64(r.header.TimebaseDenominator)
+	return sample{data: frame, timestamp: ts}, nil
+}
+
+func (r *ivfReader) Close() error {
+	return r.file.Close()
+}
+
+type h264Reader struct {
+	file      *os.File
+	reader    *h264reader.H264Reader
+	frameRate float64
+	frames    uint64
+	// 次のアクセスユニットの先頭として読んでしまった NALU
+	pending  *h264reader.NAL
+	sps, pps []byte
+	profile  string
+}
+
+func newH264Reader(f *os.File, frameRate float64) (sampleReader, error) {
+	reader, err := h264reader.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	r := &h264Reader{file: f, reader: reader, frameRate: frameRate}
+	// SDP の profile-level-id を決めるため、最初の SPS まで読み進める
+	for r.sps == nil {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			return nil, fmt.Errorf("%w: h264 has no sps", ErrUnsupportedFile)
+		}
+		if nal.UnitType == h264reader.NalUnitTypeSPS && len(nal.Data) >= 4 {
+			r.sps = nal.Data
+			r.profile = fmt.Sprintf("%02x%02x%02x", nal.Data[1], nal.Data[2], nal.Data[3])
+			r.pending = nal
+		}
+	}
+	return r, nil
+}
+
+func (r *h264Reader) codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   VIDEO_CLOCK_RATE,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + r.profile,
+	}
+}
+
+func (r *h264Reader) payloader() rtp.Payloader {
+	return &codecs.H264Payloader{}
+}
+
+// next は 1 フレーム分 (アクセスユニット) の NALU を Annex-B で返す。
+// 途中から購読した人がデコードできるよう、SPS/PPS のない IDR には直前の SPS/PPS を付ける
+func (r *h264Reader) next() (sample, error) {
+	nalus := []*h264reader.NAL{}
+	hasSlice := false
+	for {
+		nal := r.pending
+		r.pending = nil
+		if nal == nil {
+			var err error
+			if nal, err = r.reader.NextNAL(); err != nil {
+				if len(nalus) > 0 && errors.Is(eof(err), io.EOF) {
+					break
+				}
+				return sample{}, eof(err)
+			}
+		}
+		if hasSlice && startsAccessUnit(nal) {
+			r.pending = nal
+			break
+		}
+		if isSlice(nal) {
+			hasSlice = true
+		}
+		nalus = append(nalus, nal)
+	}
+
+	hasSPS, idr := false, false
+	for _, nal := range nalus {
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeSPS:
+			r.sps, hasSPS = nal.Data, true
+		case h264reader.NalUnitTypePPS:
+			r.pps = nal.Data
+		case h264reader.NalUnitTypeCodedSliceIdr:
+			idr = true
+		}
+	}
+	startCode := []byte{0, 0, 0, 1}
+	data := []byte{}
+	if idr && !hasSPS && r.pps != nil {
+		data = append(append(append(data, startCode...), r.sps...), append(startCode, r.pps...)...)
+	}
+	for _, nal := range nalus {
+		if nal.UnitType == h264reader.NalUnitTypeAUD {
+			continue
+		}
+		data = append(append(data, startCode...), nal.Data...)
+	}
+
+	ts := uint64(float64(r.frames) * VIDEO_CLOCK_RATE / r.frameRate)
+	r.frames++
+	return sample{data: data, timestamp: ts}, nil
+}
+
+func (r *h264Reader) Close() error {
+	return r.file.Close()
+}
+
+func isSlice(nal *h264reader.NAL) bool {
+	return nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr
+}
+
+// startsAccessUnit は NALU が新しいアクセスユニットの始まりかどうかを返す (H.264 7.4.1.2.3)
+func startsAccessUnit(nal *h264reader.NAL) bool {
+	switch nal.UnitType {
+	case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS, h264reader.NalUnitTypeSEI:
+		return true
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		// first_mb_in_slice が 0 (ue(v) の先頭ビットが 1) のスライスはフレームの先頭
+		return len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+	}
+	return false
+}
+
+// oggReader は Ogg のページを Opus のパケットに分ける。
+// pion の oggreader はページ単位でしか読めないので、レーシング値からパケットを取り出す
+type oggReader struct {
+	file      *os.File
+	reader    *bufio.Reader
+	timestamp uint64
+	// 前のページから続いているパケット
+	partial []byte
+	packets [][]byte
+}
+
+func newOggReader(f *os.File) (sampleReader, error) {
+	r := &oggReader{file: f, reader: bufio.NewReader(f)}
+	head, err := r.packet()
+	if err != nil || !strings.HasPrefix(string(head), "OpusHead") {
+		return nil, fmt.Errorf("%w: ogg has no opus header", ErrUnsupportedFile)
+	}
+	return r, nil
+}
+
+func (r *oggReader) codec() webrtc.RTPCodecCapability {
+	// WebRTC の Opus はモノラルでも opus/48000/2 としてネゴシエートする
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   OPUS_CLOCK_RATE,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	}
+}
+
+func (r *oggReader) payloader() rtp.Payloader {
+	return &codecs.OpusPayloader{}
+}
+
+func (r *oggReader) next() (sample, error) {
+	for {
+		packet, err := r.packet()
+		if err != nil {
+			return sample{}, eof(err)
+		}
+		if len(packet) == 0 || strings.HasPrefix(string(packet), "OpusTags") {
+			continue
+		}
+		s := sample{data: packet, timestamp: r.timestamp}
+		r.timestamp += uint64(opusSamples(packet))
+		return s, nil
+	}
+}
+
+func (r *oggReader) packet() ([]byte, error) {
+	for len(r.packets) == 0 {
+		if err := r.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	p := r.packets[0]
+	r.packets = r.packets[1:]
+	return p, nil
+}
+
+// readPage は 1 ページを読み、完結したパケットを r.packets に加える (RFC 3533)
+func (r *oggReader) readPage() error {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return ErrInvalidOgg
+	}
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(r.reader, lacing); err != nil {
+		return err
+	}
+	size := 0
+	for _, l := range lacing {
+		size += int(l)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return err
+	}
+
+	offset := 0
+	for _, l := range lacing {
+		r.partial = append(r.partial, body[offset:offset+int(l)]...)
+		offset += int(l)
+		// 255 のレーシング値はパケットが次のセグメントに続くことを表す
+		if l < 255 {
+			r.packets = append(r.packets, r.partial)
+			r.partial = nil
+		}
+	}
+	return nil
+}
+
+func (r *oggReader) Close() error {
+	return r.file.Close()
+}
+
+// opusSamples は TOC バイトから Opus のパケットの長さを 48kHz のサンプル数で返す (RFC 6716 3.1)
+func opusSamples(packet []byte) uint32 {
+	toc := packet[0]
+	config := toc >> 3
+	var frame uint32
+	switch {
+	case config < 12:
+		frame = []uint32{480, 960, 1920, 2880}[config&3]
+	case config < 16:
+		frame = []uint32{480, 960}[config&1]
+	default:
+		frame = []uint32{120, 240, 480, 960}[config&3]
+	}
+	switch toc & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return frame
+		}
+		return frame * uint32(packet[1]&0x3f)
+	}
+}
+
+// eof はファイルの途中で切れている場合もファイルの終わりとして扱う
+func eof(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// writeIVF は timebase が 1/100 秒の VP8 の IVF ファイルを書き出す。timestamps は timebase 単位
+func writeIVF(t *testing.T, path string, timestamps []uint64) {
+	t.Helper()
+
+	b := &bytes.Buffer{}
+	b.WriteString("DKIF")
+	binary.Write(b, binary.LittleEndian, uint16(0))  // version
+	binary.Write(b, binary.LittleEndian, uint16(32)) // header size
+	b.WriteString("VP80")
+	binary.Write(b, binary.LittleEndian, uint16(640))
+	binary.Write(b, binary.LittleEndian, uint16(480))
+	binary.Write(b, binary.LittleEndian, uint32(100)) // timebase denominator
+	binary.Write(b, binary.LittleEndian, uint32(1))   // timebase numerator
+	binary.Write(b, binary.LittleEndian, uint32(len(timestamps)))
+	binary.Write(b, binary.LittleEndian, uint32(0))
+	for i, ts := range timestamps {
+		frame := []byte{0x10, 0x02, 0x9d, 0x01, 0x2a, byte(i)}
+		binary.Write(b, binary.LittleEndian, uint32(len(frame)))
+		binary.Write(b, binary.LittleEndian, ts)
+		b.Write(frame)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// oggPage は CRC を省いた Ogg のページを作る。segments はレーシング値の列
+func oggPage(segments []byte, body []byte) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString("OggS")
+	b.Write(make([]byte, 22)) // version, header type, granule position, serial, sequence, crc
+	b.WriteByte(byte(len(segments)))
+	b.Write(segments)
+	b.Write(body)
+	return b.Bytes()
+}
+
+var (
+	h264SPS    = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01}
+	h264PPS    = []byte{0x68, 0xce, 0x3c, 0x80}
+	h264IDR    = []byte{0x65, 0x88, 0x84, 0x21}
+	h264NonIDR = []byte{0x41, 0x9a, 0x21, 0x6c}
+	h264AUD    = []byte{0x09, 0xf0}
+)
+
+func annexB(nalus ...[]byte) []byte {
+	out := []byte{}
+	for _, nal := range nalus {
+		out = append(append(out, 0, 0, 0, 1), nal...)
+	}
+	return out
+}
+
+// readAll はファイルの終わりまでサンプルを読む
+func readAll(t *testing.T, r sampleReader) []sample {
+	t.Helper()
+
+	samples := []sample{}
+	for {
+		s, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return samples
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, s)
+	}
+}
+
+func TestIVFReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.ivf")
+	writeIVF(t, path, []uint64{0, 1, 3})
+
+	r, err := openReader(path, DEFAULT_FRAME_RATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if mimeType := r.codec().MimeType; mimeType != webrtc.MimeTypeVP8 {
+		t.Errorf("codec %s, want %s", mimeType, webrtc.MimeTypeVP8)
+	}
+
+	// timebase の 1/100 秒を 90kHz のクロックに直す
+	want := []uint64{0, 900, 2700}
+	samples := readAll(t, r)
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, want %d", len(samples), len(want))
+	}
+	for i, s := range samples {
+		if s.timestamp != want[i] {
+			t.Errorf("sample %d: timestamp %d, want %d", i, s.timestamp, want[i])
+		}
+		if len(s.data) != 6 || s.data[5] != byte(i) {
+			t.Errorf("sample %d: data %x", i, s.data)
+		}
+	}
+}
+
+func TestIVFReaderRejectsZeroTimebase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.ivf")
+	writeIVF(t, path, []uint64{0})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// timebase の分母を 0 にする
+	binary.LittleEndian.PutUint32(b[16:], 0)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openReader(path, DEFAULT_FRAME_RATE); !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("openReader: %v, want %v", err, ErrUnsupportedFile)
+	}
+}
+
+func TestH264Reader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.h264")
+	data := annexB(
+		h264SPS, h264PPS, h264IDR,
+		h264NonIDR,
+		// SPS と PPS のない IDR には直前の SPS と PPS を付ける
+		h264AUD, h264IDR,
+	)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openReader(path, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if fmtp := r.codec().SDPFmtpLine; !strings.HasSuffix(fmtp, "profile-level-id=42c01f") {
+		t.Errorf("fmtp %q, want profile-level-id=42c01f", fmtp)
+	}
+
+	want := []sample{
+		{data: annexB(h264SPS, h264PPS, h264IDR), timestamp: 0},
+		{data: annexB(h264NonIDR), timestamp: 3600},
+		{data: annexB(h264SPS, h264PPS, h264IDR), timestamp: 7200},
+	}
+	samples := readAll(t, r)
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, want %d", len(samples), len(want))
+	}
+	for i, s := range samples {
+		if s.timestamp != want[i].timestamp {
+			t.Errorf("sample %d: timestamp %d, want %d", i, s.timestamp, want[i].timestamp)
+		}
+		if !bytes.Equal(s.data, want[i].data) {
+			t.Errorf("sample %d: data %x, want %x", i, s.data, want[i].data)
+		}
+	}
+}
+
+func TestH264ReaderRequiresSPS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.264")
+	if err := os.WriteFile(path, annexB(h264NonIDR), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openReader(path, DEFAULT_FRAME_RATE); !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("openReader: %v, want %v", err, ErrUnsupportedFile)
+	}
+}
+
+func TestOggReader(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), 0, 0, 0, 0, 0, 0, 0, 0)
+	// 20ms (960 サンプル) のフレームが 1 つのパケットと 2 つのパケット
+	single := []byte{0xfc, 0x01}
+	double := append([]byte{0xfd}, bytes.Repeat([]byte{0x02}, 299)...)
+
+	data := append(oggPage([]byte{byte(len(head))}, head), oggPage([]byte{byte(len(tags))}, tags)...)
+	// double はページをまたぐ
+	data = append(data, oggPage([]byte{byte(len(single)), 255}, append(append([]byte{}, single...), double[:255]...))...)
+	data = append(data, oggPage([]byte{byte(len(double) - 255), byte(len(single))}, append(append([]byte{}, double[255:]...), single...))...)
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openReader(path, DEFAULT_FRAME_RATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	want := []sample{
+		{data: single, timestamp: 0},
+		{data: double, timestamp: 960},
+		{data: single, timestamp: 2880},
+	}
+	samples := readAll(t, r)
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, want %d", len(samples), len(want))
+	}
+	for i, s := range samples {
+		if s.timestamp != want[i].timestamp {
+			t.Errorf("sample %d: timestamp %d, want %d", i, s.timestamp, want[i].timestamp)
+		}
+		if !bytes.Equal(s.data, want[i].data) {
+			t.Errorf("sample %d: %d bytes, want %d", i, len(s.data), len(want[i].data))
+		}
+	}
+}
+
+func TestOggReaderRequiresOpusHead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	body := []byte("vorbis")
+	if err := os.WriteFile(path, oggPage([]byte{byte(len(body))}, body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openReader(path, DEFAULT_FRAME_RATE); !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("openReader: %v, want %v", err, ErrUnsupportedFile)
+	}
+}
+
+func TestOpenReaderRejectsUnknownExtension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, []byte{0}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openReader(path, DEFAULT_FRAME_RATE); !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("openReader: %v, want %v", err, ErrUnsupportedFile)
+	}
+}
@@ -1,54 +1,279 @@
 package rtc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
+	"sync"
+	"time"
+
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
 	"go.uber.org/zap"
 )
 
+const (
+	NACK_GENERATOR_SIZE     = 512
+	NACK_GENERATOR_INTERVAL = 100 * time.Millisecond
+)
+
 type RTC interface {
-	NewPeerConnection(SignalConnection) (PeerConnection, error)
+	// logger にはリクエストのフィールドを付けておくと、参加者のログに引き継がれる
+	NewPeerConnection(room string, sc SignalConnection, perm Permission, logger *zap.Logger) (PeerConnection, error)
+	NewLocalParticipant(room, participant string) (LocalParticipant, error)
+	JoinLocalParticipant(room, participant string) (LocalParticipant, error)
+	KickParticipant(room, participant string) error
+	MuteTrack(trackID string, muted bool) error
+	TrackStats() []TrackStats
+	Observe(o TrackObserver)
+	PublishedTrack(trackID string) (PublishedTrack, error)
+	Subscribe(trackID string, s TrackSink) error
+	Unsubscribe(trackID string, s TrackSink)
+	// Close は上流のノードからの中継を止める
+	Close() error
 }
 
 type rtc struct {
-	api   *webrtc.API
-	conf  *webrtc.Configuration
-	track TrackManager
+	// 中継などルームの外で動かす処理を、Close で止める
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mux      sync.Mutex
+	setting  *webrtc.SettingEngine
+	conf     *webrtc.Configuration
+	defaults RoomOptions
+	options  map[string]RoomOptions
+	store    store.Store
+	// Store を共有する他のインスタンスと区別する名前
+	instance string
+	hook     webhook.Notifier
+	rooms    map[string]*room
+	// 全てのルームに適用するサーバ内の購読者
+	observers []TrackObserver
 }
 
 func NewAPI(
 	s *webrtc.SettingEngine,
-	m *webrtc.MediaEngine,
-	i *interceptor.Registry,
 	c *webrtc.Configuration,
+	defaults RoomOptions,
+	options map[string]RoomOptions,
+	st store.Store,
+	instance string,
+	hook webhook.Notifier,
 ) (RTC, error) {
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+	// 設定の誤りはルームが作られるのを待たずに起動時に検出する
+	if _, _, err := defaults.Codecs.Parameters(); err != nil {
+		return nil, err
+	}
+	for name := range options {
+		if _, _, err := options[name].Codecs.Parameters(); err != nil {
+			return nil, fmt.Errorf("room %s: %w", name, err)
+		}
+	}
+
+	if err := removeStaleParticipants(st, instance); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &rtc{
+		ctx:      ctx,
+		cancel:   cancel,
+		mux:      sync.Mutex{},
+		setting:  s,
+		conf:     c,
+		defaults: defaults,
+		options:  options,
+		store:    st,
+		instance: instance,
+		hook:     hook,
+		rooms:    make(map[string]*room),
+	}
+	// 中継するルームは参加者を待たずに上流のノードから受信を始める
+	for name := range options {
+		if options[name].Upstream == "" {
+			continue
+		}
+		if _, err := r.room(name); err != nil {
+			cancel()
+			return nil, fmt.Errorf("room %s: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *rtc) Close() error {
+	r.cancel()
+	return nil
+}
+
+// removeStaleParticipants はこのインスタンスの前回の起動時に残った参加者を削除する。
+// PeerConnection はプロセスと一緒に失われているので、再起動後に接続し直してもらう。
+// Store を共有する他のインスタンスの参加者は接続中なので残す
+func removeStaleParticipants(st store.Store, instance string) error {
+	rooms, err := st.Rooms()
+	if err != nil {
+		return err
+	}
+	for _, rm := range rooms {
+		participants, err := st.Participants(rm.Name)
+		if err != nil {
+			return err
+		}
+		for _, p := range participants {
+			if p.Instance != instance {
+				continue
+			}
+			if err := st.DeleteParticipant(rm.Name, p.ID); err != nil && !errors.Is(err, store.ErrParticipantNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rtc) room(name string) (*room, error) {
+	if name == "" {
+		name = DEFAULT_ROOM
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if rm, ok := r.rooms[name]; ok {
+		return rm, nil
+	}
+
+	o, ok := r.options[name]
+	if !ok {
+		o = r.defaults
+	}
+	var rm *room
+	ctx, cancel := context.WithCancel(r.ctx)
+	rm, err := newRoom(name, r.setting, o, r.store, r.instance, r.hook, func(markClosed func() bool) {
+		r.closeRoom(rm, markClosed)
+		cancel()
+	})
+	if err != nil {
+		cancel()
 		return nil, err
 	}
+	r.rooms[name] = rm
+	for _, ob := range r.observers {
+		rm.track.Observe(ob)
+	}
+	if o.Upstream != "" {
+		go rm.relay(ctx, o.Upstream, o.UpstreamSecret, o.UpstreamTLS, *r.conf)
+	}
+	return rm, nil
+}
+
+// closeRoom はポリシーで閉じたルームを取り除き、次の参加者には新しいルームを作る。
+// 一覧から取り除くのと同じロックの中で markClosed を呼ぶので、r.room が閉じたルームを返すことはない。
+// Store の後始末もロックの中で行い、同じ名前で作り直したルームの参加者を消さないようにする
+func (r *rtc) closeRoom(rm *room, markClosed func() bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.rooms[rm.name] == rm {
+		delete(r.rooms, rm.name)
+	}
+	if !markClosed() {
+		return
+	}
+
+	logger := RoomLogger(zap.L(), rm.name)
+	// 他のインスタンスで同じ名前のルームに参加者がいる間は Store のルームを残す
+	participants, err := r.store.Participants(rm.name)
+	if err != nil && !errors.Is(err, store.ErrRoomNotFound) {
+		logger.Warn("close room: failed to get participants", zap.Error(err))
+		return
+	}
+	for _, p := range participants {
+		if p.Instance != r.instance {
+			return
+		}
+	}
+	if err := r.store.DeleteRoom(rm.name); err != nil && !errors.Is(err, store.ErrRoomNotFound) {
+		logger.Warn("close room: failed to delete room", zap.Error(err))
+	}
+}
+
+func (r *rtc) eachRoom(fn func(*room)) {
+	r.mux.Lock()
+	rooms := make([]*room, 0, len(r.rooms))
+	for name := range r.rooms {
+		rooms = append(rooms, r.rooms[name])
+	}
+	r.mux.Unlock()
+
+	for _, rm := range rooms {
+		fn(rm)
+	}
+}
+
+// NACK への応答は trackLocal のキャッシュで行うため、
+// デフォルトのインターセプタから responder を除いて登録する
+func registerInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor(
+		nack.GeneratorSize(NACK_GENERATOR_SIZE),
+		nack.GeneratorInterval(NACK_GENERATOR_INTERVAL),
+	)
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(generator)
 
-	return &rtc{
-		api: webrtc.NewAPI(
-			webrtc.WithSettingEngine(*s),
-			webrtc.WithMediaEngine(m),
-			webrtc.WithInterceptorRegistry(i),
-		),
-		conf:  c,
-		track: newTrackManager(),
-	}, nil
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(m, i)
 }
 
 func (r *rtc) NewPeerConnection(
+	name string,
+	sc SignalConnection,
+	perm Permission,
+	logger *zap.Logger,
+) (PeerConnection, error) {
+	return r.newPeerConnection(name, sc, perm, logger, true)
+}
+
+// newPeerConnection は retry の場合、閉じている最中のルームに当たったら一度だけ参加し直す。
+// 閉じたルームは一覧から取り除かれているので、参加し直すと作り直したルームに参加する
+func (r *rtc) newPeerConnection(
+	name string,
 	sc SignalConnection,
+	perm Permission,
+	logger *zap.Logger,
+	retry bool,
 ) (PeerConnection, error) {
-	p, err := r.api.NewPeerConnection(*r.conf)
+	rm, err := r.room(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := rm.api.NewPeerConnection(*r.conf)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := newPeerConnection(sc, p, rm.track, rm.options, perm, RoomLogger(logger, rm.name))
 	if err != nil {
+		p.Close()
 		return nil, err
 	}
-	peer, err := newPeerConnection(sc, p, r.track)
+	ch, err := rm.track.Join(peer)
+	if errors.Is(err, ErrRoomClosed) && retry {
+		p.Close()
+		return r.newPeerConnection(name, sc, perm, logger, false)
+	}
 	if err != nil {
+		p.Close()
 		return nil, err
 	}
-	ch := r.track.Join(peer)
 
 	setup := func(p *webrtc.PeerConnection) error {
 		type message struct {
@@ -56,56 +281,35 @@ func (r *rtc) NewPeerConnection(
 			ICECandidate ICECandidateSerializer `json:"ice,omitempty"`
 		}
 
-		if _, err := p.AddTransceiverFromKind(
-			webrtc.RTPCodecTypeAudio,
-			webrtc.RTPTransceiverInit{
-				Direction:     webrtc.RTPTransceiverDirectionRecvonly,
-				SendEncodings: []webrtc.RTPEncodingParameters{},
-			},
-		); err != nil {
+		if err := rm.addRecvonlyTransceiver(p, webrtc.RTPCodecTypeAudio); err != nil {
 			return err
 		}
-		if _, err := p.AddTransceiverFromKind(
-			webrtc.RTPCodecTypeVideo,
-			webrtc.RTPTransceiverInit{
-				Direction:     webrtc.RTPTransceiverDirectionRecvonly,
-				SendEncodings: []webrtc.RTPEncodingParameters{},
-			},
-		); err != nil {
+		if err := rm.addRecvonlyTransceiver(p, webrtc.RTPCodecTypeVideo); err != nil {
 			return err
 		}
 
 		p.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-			tl, err := webrtc.NewTrackLocalStaticRTP(
-				tr.Codec().RTPCodecCapability,
-				tr.ID(),
-				tr.StreamID(),
-			)
-			if err != nil {
-				zap.L().Warn("on track: failed new track local static rtp")
+			if !perm.CanPublish {
+				if err := peer.Notify(NewErrorMessage(ErrorCodePublishNotPermitted, ErrPublishNotPermitted)); err != nil {
+					peer.logger.Warn(err.Error())
+				}
 				return
 			}
-			ch <- RTCEventMessage{Event: RTCEventTypeAddTrack, LocalTrack: tl}
-			defer func() {
-				ch <- RTCEventMessage{Event: RTCEventTypeRemoveTrack, LocalTrack: tl}
-			}()
-
-			for {
-				pkt, _, err := tr.ReadRTP()
-				if err != nil {
-					return
-				}
-				if err := tl.WriteRTP(pkt); err != nil {
-					return
+			if err := rm.track.CanPublish(peer.ID()); err != nil {
+				if err := peer.Notify(NewErrorMessage(ErrorCodeRoomFull, err)); err != nil {
+					peer.logger.Warn(err.Error())
 				}
+				return
 			}
+			rm.publish(ch, peer.ID(), p, tr, r, peer.logger)
 		})
 		p.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+			peer.logger.Info("peer connection state changed", zap.Stringer("state", pcs))
 			switch pcs {
 			case webrtc.PeerConnectionStateConnected:
 				ch <- RTCEventMessage{Event: RTCEventTypeSyncSDP}
 			case webrtc.PeerConnectionStateClosed:
-				ch <- RTCEventMessage{Event: RTCEventTypeSyncSDP}
+				ch <- RTCEventMessage{Event: RTCEventTypeLeave, participant: peer.ID()}
 			case webrtc.PeerConnectionStateFailed:
 				p.Close()
 			}
@@ -115,7 +319,7 @@ func (r *rtc) NewPeerConnection(
 				return
 			}
 
-			zap.L().Info("on ice candidate: send message to client")
+			peer.logger.Info("on ice candidate: send message to client")
 			err := sc.WriteMessage(message{
 				Event: EventTypeCandidate,
 				ICECandidate: ICECandidateSerializer{
@@ -123,17 +327,58 @@ func (r *rtc) NewPeerConnection(
 				},
 			})
 			if err != nil {
-				zap.L().Warn(err.Error())
+				peer.logger.Warn(err.Error())
 			}
 		})
 		return nil
 	}
 
+	// 状態の変化を受け取る前に失敗した場合は、退出を自分で伝える
 	if err := setup(p); err != nil {
 		p.Close()
+		ch <- RTCEventMessage{Event: RTCEventTypeLeave, participant: peer.ID()}
 		return nil, err
 	}
 
 	ch <- RTCEventMessage{Event: RTCEventTypeSyncSDP}
 	return peer, nil
 }
+
+// KickParticipant は開いているルームの参加者を退出させる。ルームを新しく作ることはしない
+func (r *rtc) KickParticipant(name, participant string) error {
+	if name == "" {
+		name = DEFAULT_ROOM
+	}
+	r.mux.Lock()
+	rm, ok := r.rooms[name]
+	r.mux.Unlock()
+	if !ok {
+		return ErrRoomNotFound
+	}
+	id, err := xid.FromString(participant)
+	if err != nil {
+		return ErrParticipantNotFound
+	}
+	return rm.track.Kick(PeerConnectionID(id))
+}
+
+func (r *rtc) MuteTrack(trackID string, muted bool) error {
+	err := ErrTrackNotFound
+	r.eachRoom(func(rm *room) {
+		if err == ErrTrackNotFound {
+			err = rm.track.ServerMute(trackID, muted)
+		}
+	})
+	return err
+}
+
+func (r *rtc) TrackStats() []TrackStats {
+	stats := []TrackStats{}
+	r.eachRoom(func(rm *room) {
+		for _, s := range rm.track.Stats() {
+			s.Room = rm.name
+			stats = append(stats, s)
+		}
+	})
+	return stats
+}
@@ -0,0 +1,33 @@
+package rtc
+
+import (
+	"ruyka/pkg/store"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleParticipantsKeepsOtherInstances(t *testing.T) {
+	st := store.NewMemoryStore()
+	if err := st.PutRoom(store.Room{Name: "room", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []store.Participant{
+		{ID: "stale", Room: "room", Instance: "node-1", JoinedAt: time.Now()},
+		{ID: "other", Room: "room", Instance: "node-2", JoinedAt: time.Now()},
+	} {
+		if err := st.PutParticipant(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removeStaleParticipants(st, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	participants, err := st.Participants("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 1 || participants[0].ID != "other" {
+		t.Errorf("participants %+v, want only the participant of node-2", participants)
+	}
+}
@@ -0,0 +1,142 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	REMB_INTERVAL = time.Second
+	// 予算を使い切るまでに一度に送れる量 (秒数)
+	EGRESS_BUDGET_BURST = 0.5
+)
+
+// limitBandwidth は受信する m-line に b=AS と b=TIAS を付け、配信者の送信ビットレートを制限する
+func limitBandwidth(desc webrtc.SessionDescription, audio, video uint64) (webrtc.SessionDescription, error) {
+	if audio == 0 && video == 0 {
+		return desc, nil
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		return desc, err
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if _, ok := m.Attribute(webrtc.RTPTransceiverDirectionSendonly.String()); ok {
+			continue
+		}
+		if _, ok := m.Attribute(webrtc.RTPTransceiverDirectionInactive.String()); ok {
+			continue
+		}
+
+		bitrate := uint64(0)
+		switch m.MediaName.Media {
+		case webrtc.RTPCodecTypeAudio.String():
+			bitrate = audio
+		case webrtc.RTPCodecTypeVideo.String():
+			bitrate = video
+		}
+		if bitrate == 0 {
+			continue
+		}
+		m.Bandwidth = append(m.Bandwidth,
+			sdp.Bandwidth{Type: "AS", Bandwidth: bitrate / 1000},
+			sdp.Bandwidth{Type: "TIAS", Bandwidth: bitrate},
+		)
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return desc, err
+	}
+	desc.SDP = string(raw)
+	return desc, nil
+}
+
+// sendREMB は配信者に REMB を送り続け、帯域推定の上限を制限する。done が閉じられたら終える
+func (f *forwarder) sendREMB(bitrate uint64, done <-chan struct{}) {
+	ticker := time.NewTicker(REMB_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := f.peer.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(bitrate),
+			SSRCs:   []uint32{uint32(f.remote.SSRC())},
+		}}); err != nil {
+			f.logger.Warn("send remb: failed to write rtcp", zap.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// egressBudget はルーム全体で購読者に送るビットレートを制限するトークンバケット
+type egressBudget struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newEgressBudget は bitrate が 0 の場合は制限しない nil を返す
+func newEgressBudget(bitrate uint64) *egressBudget {
+	if bitrate == 0 {
+		return nil
+	}
+	rate := float64(bitrate) / 8
+	return &egressBudget{
+		mux:    sync.Mutex{},
+		rate:   rate,
+		burst:  rate * EGRESS_BUDGET_BURST,
+		tokens: rate * EGRESS_BUDGET_BURST,
+		last:   time.Now(),
+	}
+}
+
+// refill は b.mux を Lock した状態で呼ぶ
+func (b *egressBudget) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow は n バイトを送る余裕があるかどうかを返す
+func (b *egressBudget) Allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.refill()
+	return b.tokens >= float64(n)
+}
+
+// Take は n バイト分の予算を使う。force の場合は予算を超えても送る
+func (b *egressBudget) Take(n int, force bool) bool {
+	if b == nil {
+		return true
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.refill()
+	if !force && b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,42 @@
+package rtc
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+const PACKET_CACHE_SIZE = 1024
+
+// packetCache は送信済みの RTP パケットをシーケンス番号で引けるように保持するリングバッファ
+type packetCache struct {
+	mux     sync.RWMutex
+	packets [PACKET_CACHE_SIZE]*rtp.Packet
+}
+
+func newPacketCache() *packetCache {
+	return &packetCache{mux: sync.RWMutex{}}
+}
+
+func (c *packetCache) Push(pkt *rtp.Packet) {
+	clone := &rtp.Packet{
+		Header:      pkt.Header.Clone(),
+		Payload:     append([]byte(nil), pkt.Payload...),
+		PaddingSize: pkt.PaddingSize,
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.packets[pkt.SequenceNumber%PACKET_CACHE_SIZE] = clone
+}
+
+func (c *packetCache) Get(seq uint16) (*rtp.Packet, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	pkt := c.packets[seq%PACKET_CACHE_SIZE]
+	if pkt == nil || pkt.SequenceNumber != seq {
+		return nil, false
+	}
+	return pkt, true
+}
@@ -0,0 +1,60 @@
+package rtc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestPacketCacheWraparound(t *testing.T) {
+	c := newPacketCache()
+	// リングバッファを 1 周以上し、シーケンス番号の折り返しもまたぐ
+	start := uint16(65535 - PACKET_CACHE_SIZE)
+	for i := 0; i < PACKET_CACHE_SIZE+16; i++ {
+		seq := start + uint16(i)
+		c.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: []byte{byte(seq)}})
+	}
+
+	tests := []struct {
+		seq uint16
+		ok  bool
+	}{
+		// 同じ位置を後のパケットが上書きしている
+		{seq: start, ok: false},
+		{seq: start + 15, ok: false},
+		{seq: start + 16, ok: true},
+		{seq: 65535, ok: true},
+		{seq: 0, ok: true},
+		{seq: 14, ok: true},
+		// まだ届いていない
+		{seq: 15, ok: false},
+	}
+	for _, tt := range tests {
+		pkt, ok := c.Get(tt.seq)
+		if ok != tt.ok {
+			t.Errorf("Get(%d): %v, want %v", tt.seq, ok, tt.ok)
+			continue
+		}
+		if ok && (pkt.SequenceNumber != tt.seq || !bytes.Equal(pkt.Payload, []byte{byte(tt.seq)})) {
+			t.Errorf("Get(%d): packet %d %x", tt.seq, pkt.SequenceNumber, pkt.Payload)
+		}
+	}
+}
+
+func TestPacketCacheCopiesPacket(t *testing.T) {
+	c := newPacketCache()
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 1, SSRC: 1}, Payload: []byte{0x01}}
+	c.Push(pkt)
+
+	// 転送のために書き換えられてもキャッシュの内容は変わらない
+	pkt.SSRC = 2
+	pkt.Payload[0] = 0x02
+	cached, ok := c.Get(1)
+	if !ok {
+		t.Fatal("packet is not cached")
+	}
+	if cached.SSRC != 1 || cached.Payload[0] != 0x01 {
+		t.Errorf("cached packet: ssrc %d, payload %x, want 1, 01", cached.SSRC, cached.Payload)
+	}
+}
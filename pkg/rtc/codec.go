@@ -0,0 +1,74 @@
+package rtc
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// 無音を表す Opus の DTX フレーム
+var opusSilenceFrame = []byte{0xf8, 0xff, 0xfe}
+
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	default:
+		// 判定できないコーデックは常に再開可能とみなす
+		return true
+	}
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	p := &codecs.VP8Packet{}
+	body, err := p.Unmarshal(payload)
+	if err != nil || len(body) == 0 {
+		return false
+	}
+	return p.S == 1 && p.PID == 0 && body[0]&0x01 == 0
+}
+
+func isVP9Keyframe(payload []byte) bool {
+	p := &codecs.VP9Packet{}
+	if _, err := p.Unmarshal(payload); err != nil {
+		return false
+	}
+	return !p.P && p.B && p.SID == 0
+}
+
+func isH264Keyframe(payload []byte) bool {
+	const (
+		naluTypeIDR  = 5
+		naluTypeSPS  = 7
+		naluTypeSTAP = 24
+		naluTypeFU   = 28
+	)
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch typ := payload[0] & 0x1f; typ {
+	case naluTypeIDR, naluTypeSPS:
+		return true
+	case naluTypeSTAP:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == naluTypeIDR || t == naluTypeSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case naluTypeFU:
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		return start && payload[1]&0x1f == naluTypeIDR
+	}
+	return false
+}
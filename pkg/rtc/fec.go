@@ -0,0 +1,191 @@
+package rtc
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/rtp"
+)
+
+// ref: https://www.rfc-editor.org/rfc/rfc5109
+// libwebrtc と同じくレベル 0 の保護のみを扱う
+
+const (
+	ULPFEC_MEDIA_HISTORY_SIZE = 256
+	ULPFEC_MAX_PENDING        = 32
+
+	ulpfecHeaderSize = 10
+	rtpHeaderSize    = 12
+)
+
+type ulpfecPacket struct {
+	seq        uint16
+	recovery   [2]byte
+	seqBase    uint16
+	timestamp  uint32
+	length     uint16
+	protection []byte
+	protected  []uint16
+}
+
+func parseULPFEC(seq uint16, payload []byte) (*ulpfecPacket, bool) {
+	if len(payload) < ulpfecHeaderSize+4 {
+		return nil, false
+	}
+
+	p := &ulpfecPacket{
+		seq:       seq,
+		recovery:  [2]byte{payload[0], payload[1]},
+		seqBase:   binary.BigEndian.Uint16(payload[2:4]),
+		timestamp: binary.BigEndian.Uint32(payload[4:8]),
+		length:    binary.BigEndian.Uint16(payload[8:10]),
+	}
+
+	maskSize := 2
+	if payload[0]&0x40 != 0 {
+		maskSize = 6
+	}
+	i := ulpfecHeaderSize
+	if len(payload) < i+2+maskSize {
+		return nil, false
+	}
+	protectionLength := int(binary.BigEndian.Uint16(payload[i : i+2]))
+	mask := payload[i+2 : i+2+maskSize]
+	i += 2 + maskSize
+	if len(payload) < i+protectionLength {
+		return nil, false
+	}
+	p.protection = payload[i : i+protectionLength]
+
+	for n := 0; n < maskSize*8; n++ {
+		if mask[n/8]&(0x80>>(n%8)) != 0 {
+			p.protected = append(p.protected, p.seqBase+uint16(n))
+		}
+	}
+	return p, true
+}
+
+type ulpfecDecoder struct {
+	media   [ULPFEC_MEDIA_HISTORY_SIZE]*rtp.Packet
+	pending []*ulpfecPacket
+}
+
+func newULPFECDecoder() *ulpfecDecoder {
+	return &ulpfecDecoder{}
+}
+
+func (d *ulpfecDecoder) get(seq uint16) (*rtp.Packet, bool) {
+	pkt := d.media[seq%ULPFEC_MEDIA_HISTORY_SIZE]
+	if pkt == nil || pkt.SequenceNumber != seq {
+		return nil, false
+	}
+	return pkt, true
+}
+
+func (d *ulpfecDecoder) AddMedia(pkt *rtp.Packet) []*rtp.Packet {
+	d.put(pkt)
+	return d.recover()
+}
+
+// put は復元に使うパケットを保持する。
+// 転送するパケットは forwarder がシーケンス番号を書き換えるので、ヘッダを複製して受信した値のまま残す
+func (d *ulpfecDecoder) put(pkt *rtp.Packet) {
+	d.media[pkt.SequenceNumber%ULPFEC_MEDIA_HISTORY_SIZE] = &rtp.Packet{
+		Header:      pkt.Header.Clone(),
+		Payload:     pkt.Payload,
+		PaddingSize: pkt.PaddingSize,
+	}
+}
+
+func (d *ulpfecDecoder) AddFEC(seq uint16, payload []byte) []*rtp.Packet {
+	p, ok := parseULPFEC(seq, payload)
+	if !ok {
+		return nil
+	}
+	d.pending = append(d.pending, p)
+	if len(d.pending) > ULPFEC_MAX_PENDING {
+		d.pending = d.pending[len(d.pending)-ULPFEC_MAX_PENDING:]
+	}
+	return d.recover()
+}
+
+// recover は保護対象のうちちょうど 1 つだけが欠けている FEC パケットから欠損を復元する。
+// 復元したパケットで別の FEC パケットが使えるようになることがあるので、復元できなくなるまで繰り返す
+func (d *ulpfecDecoder) recover() []*rtp.Packet {
+	recovered := []*rtp.Packet{}
+	for {
+		progress := false
+		pending := d.pending[:0]
+		for _, p := range d.pending {
+			missing, n := uint16(0), 0
+			for _, seq := range p.protected {
+				if _, ok := d.get(seq); !ok {
+					missing = seq
+					n++
+				}
+			}
+
+			switch n {
+			case 0:
+				// 全て揃っているので不要
+			case 1:
+				if pkt, ok := d.restore(p, missing); ok {
+					d.put(pkt)
+					recovered = append(recovered, pkt)
+					progress = true
+				}
+			default:
+				pending = append(pending, p)
+			}
+		}
+		d.pending = pending
+		if !progress {
+			return recovered
+		}
+	}
+}
+
+func (d *ulpfecDecoder) restore(p *ulpfecPacket, seq uint16) (*rtp.Packet, bool) {
+	header := p.recovery
+	timestamp := p.timestamp
+	length := p.length
+	payload := make([]byte, len(p.protection))
+	copy(payload, p.protection)
+
+	var ssrc uint32
+	for _, s := range p.protected {
+		if s == seq {
+			continue
+		}
+		pkt, _ := d.get(s)
+		raw, err := pkt.Marshal()
+		if err != nil || len(raw) < rtpHeaderSize {
+			return nil, false
+		}
+		ssrc = pkt.SSRC
+
+		header[0] ^= raw[0]
+		header[1] ^= raw[1]
+		timestamp ^= pkt.Timestamp
+		length ^= uint16(len(raw) - rtpHeaderSize)
+		for i := 0; i < len(payload) && rtpHeaderSize+i < len(raw); i++ {
+			payload[i] ^= raw[rtpHeaderSize+i]
+		}
+	}
+	if int(length) > len(payload) {
+		return nil, false
+	}
+
+	raw := make([]byte, rtpHeaderSize+int(length))
+	raw[0] = 0x80 | header[0]&0x3f
+	raw[1] = header[1]
+	binary.BigEndian.PutUint16(raw[2:4], seq)
+	binary.BigEndian.PutUint32(raw[4:8], timestamp)
+	binary.BigEndian.PutUint32(raw[8:12], ssrc)
+	copy(raw[rtpHeaderSize:], payload[:length])
+
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(raw); err != nil {
+		return nil, false
+	}
+	return pkt, true
+}
@@ -0,0 +1,236 @@
+package rtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+// ulpfecPayload は pkts を保護するレベル 0 の ULPFEC ペイロードを作る (RFC 5109 10.)
+func ulpfecPayload(t *testing.T, pkts []*rtp.Packet) []byte {
+	t.Helper()
+
+	raws := make([][]byte, len(pkts))
+	protectionLength := 0
+	for i, pkt := range pkts {
+		raw, err := pkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws[i] = raw
+		if l := len(raw) - rtpHeaderSize; l > protectionLength {
+			protectionLength = l
+		}
+	}
+
+	header := make([]byte, ulpfecHeaderSize+4)
+	protection := make([]byte, protectionLength)
+	var length uint16
+	for _, raw := range raws {
+		header[0] ^= raw[0]
+		header[1] ^= raw[1]
+		for i := 4; i < 8; i++ {
+			header[i] ^= raw[i]
+		}
+		length ^= uint16(len(raw) - rtpHeaderSize)
+		for i := rtpHeaderSize; i < len(raw); i++ {
+			protection[i-rtpHeaderSize] ^= raw[i]
+		}
+	}
+	// E と L は 0 で、短いマスクを使う
+	header[0] &= 0x3f
+	binary.BigEndian.PutUint16(header[2:4], pkts[0].SequenceNumber)
+	binary.BigEndian.PutUint16(header[8:10], length)
+	binary.BigEndian.PutUint16(header[10:12], uint16(protectionLength))
+	var mask uint16
+	for _, pkt := range pkts {
+		mask |= 0x8000 >> (pkt.SequenceNumber - pkts[0].SequenceNumber)
+	}
+	binary.BigEndian.PutUint16(header[12:14], mask)
+	return append(header, protection...)
+}
+
+func testMediaPackets() []*rtp.Packet {
+	pkts := []*rtp.Packet{}
+	for i, payload := range [][]byte{{0x10, 0x11, 0x12}, {0x20}, {0x30, 0x31, 0x32, 0x33, 0x34}, {0x40, 0x41}} {
+		pkts = append(pkts, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == 3,
+				PayloadType:    96,
+				SequenceNumber: uint16(65534 + i),
+				Timestamp:      90000 + uint32(i/2)*3000,
+				SSRC:           0x1234,
+			},
+			Payload: payload,
+		})
+	}
+	return pkts
+}
+
+func TestULPFECRecoversLostMediaPacket(t *testing.T) {
+	for lost := range testMediaPackets() {
+		pkts := testMediaPackets()
+		fec := ulpfecPayload(t, pkts)
+
+		d := newULPFECDecoder()
+		for i, pkt := range pkts {
+			if i == lost {
+				continue
+			}
+			if recovered := d.AddMedia(pkt); len(recovered) != 0 {
+				t.Fatalf("lost %d: %d packets recovered without fec", lost, len(recovered))
+			}
+		}
+		recovered := d.AddFEC(100, fec)
+		if len(recovered) != 1 {
+			t.Fatalf("lost %d: %d packets recovered, want 1", lost, len(recovered))
+		}
+
+		want, _ := pkts[lost].Marshal()
+		got, err := recovered[0].Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("lost %d: recovered %x, want %x", lost, got, want)
+		}
+	}
+}
+
+func TestULPFECWaitsForMediaAfterFEC(t *testing.T) {
+	pkts := testMediaPackets()
+	d := newULPFECDecoder()
+
+	// 2 つ欠けている間は復元できず、保護対象が揃うのを待つ
+	if recovered := d.AddFEC(100, ulpfecPayload(t, pkts)); len(recovered) != 0 {
+		t.Fatalf("%d packets recovered before media", len(recovered))
+	}
+	d.AddMedia(pkts[0])
+	d.AddMedia(pkts[1])
+	recovered := d.AddMedia(pkts[3])
+	if len(recovered) != 1 || recovered[0].SequenceNumber != pkts[2].SequenceNumber {
+		t.Fatalf("recovered %d packets, want sequence %d", len(recovered), pkts[2].SequenceNumber)
+	}
+	if !bytes.Equal(recovered[0].Payload, pkts[2].Payload) {
+		t.Errorf("payload %x, want %x", recovered[0].Payload, pkts[2].Payload)
+	}
+}
+
+// recordingSink はサーバ内の購読者として受け取ったパケットを記録する
+type recordingSink struct {
+	pkts []*rtp.Packet
+}
+
+func (s *recordingSink) WriteRTP(pkt *rtp.Packet) error {
+	s.pkts = append(s.pkts, pkt)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestForwarderRecoversWithULPFECAfterMute(t *testing.T) {
+	const (
+		redPayloadType = 63
+		fecPayloadType = 117
+		vp8PayloadType = 96
+	)
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	f, err := newLocalForwarder(PeerConnectionID(xid.New()), codec, "video", "stream", RoomOptions{}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.red = newREDDecoder(webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeULPFEC, ClockRate: 90000}, PayloadType: fecPayloadType},
+	})
+	sink := &recordingSink{}
+	f.addSink(sink)
+
+	keyframe := []byte{0x10, 0x00, 0x00, 0x00}
+	media := make([]*rtp.Packet, 6)
+	for seq := range media {
+		media[seq] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				PayloadType:    vp8PayloadType,
+				SequenceNumber: uint16(seq),
+				Timestamp:      uint32(seq) * 3000,
+				SSRC:           0x1234,
+			},
+			Payload: append(keyframe, byte(seq)),
+		}
+	}
+	red := func(pkt *rtp.Packet, pt uint8, payload []byte) *rtp.Packet {
+		h := pkt.Header.Clone()
+		h.PayloadType = redPayloadType
+		return &rtp.Packet{Header: h, Payload: append([]byte{pt}, payload...)}
+	}
+	process := func(pkt *rtp.Packet) {
+		t.Helper()
+		if err := f.process(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process(red(media[0], vp8PayloadType, media[0].Payload))
+	// ミュート中に破棄したパケットの分だけ、以降のシーケンス番号が詰められる
+	f.setMuted(true, false)
+	process(red(media[1], vp8PayloadType, media[1].Payload))
+	f.setMuted(false, false)
+	process(red(media[2], vp8PayloadType, media[2].Payload))
+	process(red(media[4], vp8PayloadType, media[4].Payload))
+
+	fec := ulpfecPayload(t, media[2:5])
+	fecPacket := &rtp.Packet{Header: media[5].Header.Clone()}
+	process(red(fecPacket, fecPayloadType, fec))
+
+	var recovered *rtp.Packet
+	for _, pkt := range sink.pkts {
+		if bytes.Equal(pkt.Payload, media[3].Payload) {
+			recovered = pkt
+		}
+	}
+	if recovered == nil {
+		t.Fatal("lost packet is not recovered after mute")
+	}
+	if recovered.SequenceNumber != 2 {
+		t.Errorf("recovered sequence %d, want 2 after the dropped packet", recovered.SequenceNumber)
+	}
+}
+
+func TestParseULPFECRejectsMalformedPayloads(t *testing.T) {
+	pkts := testMediaPackets()
+	fec := ulpfecPayload(t, pkts)
+
+	long := append([]byte{}, fec...)
+	long[0] |= 0x40 // L: 6 バイトのマスクなのに 2 バイトしかない
+	long = long[:ulpfecHeaderSize+6]
+	for _, c := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"truncated header", fec[:ulpfecHeaderSize]},
+		{"truncated long mask", long},
+		{"protection longer than payload", fec[:len(fec)-1]},
+	} {
+		if _, ok := parseULPFEC(100, c.payload); ok {
+			t.Errorf("%s: parsed", c.name)
+		}
+	}
+
+	// 途中で切れたパケットを渡してもパニックしない
+	for n := 0; n < len(fec); n++ {
+		d := newULPFECDecoder()
+		d.AddMedia(pkts[0])
+		d.AddFEC(100, fec[:n])
+	}
+}
@@ -0,0 +1,323 @@
+package rtc
+
+import (
+	"ruyka/pkg/store"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	KEYFRAME_REQUEST_MIN_INTERVAL = 500 * time.Millisecond
+	// RED のプライマリコーデックを特定するまでに読み進めるパケット数の上限
+	RED_PROBE_PACKET_LIMIT = 64
+)
+
+type keyframeRequestType int
+
+const (
+	// パケットロスからの回復を求める
+	keyframeRequestTypePLI keyframeRequestType = iota
+	// 新しい受信者のためにデコードの起点を求める
+	keyframeRequestTypeFIR
+)
+
+type forwarder struct {
+	owner  PeerConnectionID
+	peer   *webrtc.PeerConnection
+	remote *webrtc.TrackRemote
+	local  *trackLocal
+	// 配信を始めた時刻
+	published time.Time
+	// 0 でなければ配信者に REMB で伝えるビットレートの上限
+	remb uint64
+
+	// サーバ内の購読者
+	sinks sinks
+	// 配信者とトラックのフィールドを付けたロガー
+	logger *zap.Logger
+
+	selfMuted   atomic.Bool
+	serverMuted atomic.Bool
+	resync      atomic.Bool
+
+	// 配信者にキーフレームを要求する RTCP を送る。サーバ内の参加者が配信するトラックでは nil
+	writeRTCP func([]rtcp.Packet) error
+	// 配信者とネゴシエートした RTCP フィードバックと SSRC
+	feedback            []webrtc.RTCPFeedback
+	ssrc                uint32
+	lastKeyframeRequest atomic.Int64
+	firSequenceNumber   atomic.Uint32
+
+	// forward を実行する goroutine からのみ触る
+	red       *redDecoder
+	pending   []*rtp.Packet
+	seqOffset uint16
+}
+
+func newForwarder(
+	owner PeerConnectionID,
+	p *webrtc.PeerConnection,
+	remote *webrtc.TrackRemote,
+	receiver *webrtc.RTPReceiver,
+	o RoomOptions,
+	egress *egressBudget,
+	logger *zap.Logger,
+) (*forwarder, error) {
+	f := &forwarder{
+		owner:     owner,
+		peer:      p,
+		remote:    remote,
+		published: time.Now(),
+		logger:    logger.With(zap.String("track", remote.ID())),
+		writeRTCP: p.WriteRTCP,
+		feedback:  remote.Codec().RTCPFeedback,
+		ssrc:      uint32(remote.SSRC()),
+	}
+
+	// RED で受け取ったトラックは中身のコーデックのトラックとして購読者に配る
+	codec := remote.Codec().RTPCodecCapability
+	if isRED(codec.MimeType) {
+		params := receiver.GetParameters().Codecs
+		f.red = newREDDecoder(remote.Kind(), params)
+		primary, err := f.primaryCodec(params)
+		if err != nil {
+			return nil, err
+		}
+		codec = primary
+	}
+
+	local, err := webrtc.NewTrackLocalStaticRTP(codec, remote.ID(), remote.StreamID())
+	if err != nil {
+		return nil, err
+	}
+	parser := newLayerParser(codec, receiver.GetParameters().HeaderExtensions)
+	f.local = newTrackLocal(local, f.RequestKeyframe, o.AdaptiveRED, parser, egress)
+
+	// REMB は接続全体の帯域に効くので、映像の上限に音声の分を足して伝える
+	if remote.Kind() == webrtc.RTPCodecTypeVideo && o.MaxVideoBitrate > 0 {
+		f.remb = o.MaxVideoBitrate + o.MaxAudioBitrate
+	}
+	return f, nil
+}
+
+// newLocalForwarder は WebRTC 以外の経路から受け取ったメディアをルームに配る forwarder を作る
+func newLocalForwarder(
+	owner PeerConnectionID,
+	codec webrtc.RTPCodecCapability,
+	trackID string,
+	streamID string,
+	o RoomOptions,
+	egress *egressBudget,
+	logger *zap.Logger,
+) (*forwarder, error) {
+	local, err := webrtc.NewTrackLocalStaticRTP(codec, trackID, streamID)
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{
+		owner:     owner,
+		published: time.Now(),
+		logger:    logger.With(zap.String("track", trackID)),
+	}
+	f.local = newTrackLocal(local, f.RequestKeyframe, o.AdaptiveRED, newLayerParser(codec, nil), egress)
+	return f, nil
+}
+
+// primaryCodec は RED に包まれているコーデックを最初のメディアパケットから特定する。
+// 読み進めたパケットは forward で最初に転送する
+func (f *forwarder) primaryCodec(params []webrtc.RTPCodecParameters) (webrtc.RTPCodecCapability, error) {
+	for len(f.pending) < RED_PROBE_PACKET_LIMIT {
+		pkt, _, err := f.remote.ReadRTP()
+		if err != nil {
+			return webrtc.RTPCodecCapability{}, err
+		}
+		f.pending = append(f.pending, pkt)
+
+		pt, ok := f.red.primaryPayloadType(pkt)
+		if !ok {
+			continue
+		}
+		for _, c := range params {
+			if uint8(c.PayloadType) == pt {
+				return c.RTPCodecCapability, nil
+			}
+		}
+		return webrtc.RTPCodecCapability{}, ErrUnsupportedCodec
+	}
+	return webrtc.RTPCodecCapability{}, ErrUnsupportedCodec
+}
+
+func (f *forwarder) ID() string {
+	return f.local.ID()
+}
+
+func (f *forwarder) Muted() bool {
+	return f.selfMuted.Load() || f.serverMuted.Load()
+}
+
+func (f *forwarder) ServerMuted() bool {
+	return f.serverMuted.Load()
+}
+
+// setMuted はミュート状態を更新し、実際の状態が変化したかどうかを返す
+func (f *forwarder) setMuted(muted, server bool) bool {
+	before := f.Muted()
+	if server {
+		f.serverMuted.Store(muted)
+	} else {
+		f.selfMuted.Store(muted)
+	}
+	after := f.Muted()
+
+	if before && !after && f.local.Kind() == webrtc.RTPCodecTypeVideo {
+		// 途中のフレームから再開すると映像が崩れるのでキーフレームを待つ
+		f.resync.Store(true)
+		f.RequestKeyframe(keyframeRequestTypePLI)
+	}
+	return before != after
+}
+
+func (f *forwarder) Stats() TrackStats {
+	return TrackStats{
+		TrackID:       f.ID(),
+		Participant:   f.owner.String(),
+		Kind:          f.local.Kind().String(),
+		Muted:         f.Muted(),
+		NACKReceived:  f.local.nackReceived.Load(),
+		Retransmitted: f.local.retransmitted.Load(),
+		CacheMissed:   f.local.cacheMissed.Load(),
+	}
+}
+
+// Metadata は Store に保存するトラックの情報を返す
+func (f *forwarder) Metadata(room string) store.Track {
+	return store.Track{
+		ID:          f.ID(),
+		Room:        room,
+		Participant: f.owner.String(),
+		Kind:        f.local.Kind().String(),
+		MimeType:    f.local.Codec().MimeType,
+		Muted:       f.Muted(),
+		ServerMuted: f.ServerMuted(),
+		PublishedAt: f.published,
+	}
+}
+
+// RequestKeyframe は配信者にキーフレームを要求する。
+// 購読者からの要求が重なっても配信者に負荷をかけないよう、トラックごとに間引く
+func (f *forwarder) RequestKeyframe(typ keyframeRequestType) {
+	// サーバ内の参加者が配信するトラックには要求する相手がいない
+	if f.writeRTCP == nil || f.local.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := f.lastKeyframeRequest.Load()
+	if now-last < int64(KEYFRAME_REQUEST_MIN_INTERVAL) {
+		return
+	}
+	if !f.lastKeyframeRequest.CompareAndSwap(last, now) {
+		return
+	}
+
+	if err := f.writeRTCP([]rtcp.Packet{f.keyframeRequest(typ)}); err != nil {
+		f.logger.Warn("request keyframe: failed to write rtcp", zap.Error(err))
+	}
+}
+
+// keyframeRequest は配信者とネゴシエートした RTCP フィードバックに応じて PLI と FIR を使い分ける
+func (f *forwarder) keyframeRequest(typ keyframeRequestType) rtcp.Packet {
+	pli, fir := false, false
+	for _, fb := range f.feedback {
+		switch {
+		case fb.Type == webrtc.TypeRTCPFBNACK && fb.Parameter == "pli":
+			pli = true
+		case fb.Type == webrtc.TypeRTCPFBCCM && fb.Parameter == "fir":
+			fir = true
+		}
+	}
+
+	ssrc := f.ssrc
+	if fir && (typ == keyframeRequestTypeFIR || !pli) {
+		return &rtcp.FullIntraRequest{
+			MediaSSRC: ssrc,
+			FIR: []rtcp.FIREntry{
+				{SSRC: ssrc, SequenceNumber: uint8(f.firSequenceNumber.Add(1))},
+			},
+		}
+	}
+	return &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+}
+
+func (f *forwarder) forward() {
+	if f.remb > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go f.sendREMB(f.remb, done)
+	}
+
+	for _, pkt := range f.pending {
+		if err := f.process(pkt); err != nil {
+			return
+		}
+	}
+	f.pending = nil
+
+	for {
+		pkt, _, err := f.remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := f.process(pkt); err != nil {
+			return
+		}
+	}
+}
+
+func (f *forwarder) process(pkt *rtp.Packet) error {
+	pkts := []*rtp.Packet{pkt}
+	if f.red != nil {
+		pkts = f.red.decode(pkt)
+	}
+
+	for _, p := range pkts {
+		if !f.rewrite(p) {
+			continue
+		}
+		if err := f.local.WriteRTP(p); err != nil {
+			return err
+		}
+		f.writeSinks(p)
+	}
+	return nil
+}
+
+// rewrite は転送するパケットを書き換える。false を返したパケットは破棄する
+func (f *forwarder) rewrite(pkt *rtp.Packet) bool {
+	mimeType := f.local.Codec().MimeType
+	switch {
+	case f.Muted():
+		if strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+			pkt.Payload = opusSilenceFrame
+			break
+		}
+		f.seqOffset++
+		return false
+	case f.resync.Load():
+		if !isKeyframe(mimeType, pkt.Payload) {
+			f.seqOffset++
+			return false
+		}
+		f.resync.Store(false)
+	}
+
+	// 破棄したパケットの分だけシーケンス番号を詰めて、受信側に欠損と判断させない
+	pkt.SequenceNumber -= f.seqOffset
+	return true
+}
@@ -0,0 +1,158 @@
+package rtc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+// newKeyframeTestForwarder は配信者に送る RTCP を記録する forwarder を作る
+func newKeyframeTestForwarder(t *testing.T, mimeType string, feedback []webrtc.RTCPFeedback) (*forwarder, func() []rtcp.Packet) {
+	t.Helper()
+
+	codec := webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}
+	if mimeType == webrtc.MimeTypeOpus {
+		codec = webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 48000, Channels: 2}
+	}
+	f, err := newLocalForwarder(PeerConnectionID(xid.New()), codec, "track", "stream", RoomOptions{}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mux     sync.Mutex
+		written []rtcp.Packet
+	)
+	f.writeRTCP = func(pkts []rtcp.Packet) error {
+		mux.Lock()
+		defer mux.Unlock()
+		written = append(written, pkts...)
+		return nil
+	}
+	f.feedback = feedback
+	f.ssrc = 1234
+	return f, func() []rtcp.Packet {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]rtcp.Packet(nil), written...)
+	}
+}
+
+func TestRequestKeyframeThrottlesPerTrack(t *testing.T) {
+	pli := []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"}}
+	f, written := newKeyframeTestForwarder(t, webrtc.MimeTypeVP8, pli)
+	other, otherWritten := newKeyframeTestForwarder(t, webrtc.MimeTypeVP8, pli)
+
+	// 購読者からの要求が同時に重なっても配信者には 1 度だけ送る
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.RequestKeyframe(keyframeRequestTypePLI)
+		}()
+	}
+	wg.Wait()
+	f.RequestKeyframe(keyframeRequestTypeFIR)
+	if n := len(written()); n != 1 {
+		t.Errorf("%d requests within the interval, want 1", n)
+	}
+
+	// 間引きはトラックごとなので、別のトラックの要求は送る
+	other.RequestKeyframe(keyframeRequestTypePLI)
+	if n := len(otherWritten()); n != 1 {
+		t.Errorf("other track: %d requests, want 1", n)
+	}
+
+	// 間隔が空けば再び送る
+	f.lastKeyframeRequest.Store(time.Now().Add(-KEYFRAME_REQUEST_MIN_INTERVAL).UnixNano())
+	f.RequestKeyframe(keyframeRequestTypePLI)
+	if n := len(written()); n != 2 {
+		t.Errorf("%d requests after the interval, want 2", n)
+	}
+}
+
+func TestRequestKeyframeIgnoresAudio(t *testing.T) {
+	f, written := newKeyframeTestForwarder(t, webrtc.MimeTypeOpus, nil)
+	f.RequestKeyframe(keyframeRequestTypePLI)
+	if n := len(written()); n != 0 {
+		t.Errorf("%d requests for an audio track, want 0", n)
+	}
+}
+
+func TestRequestKeyframeChoosesPLIOrFIR(t *testing.T) {
+	var (
+		pli = webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"}
+		fir = webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"}
+		// pli を付けない nack は再送の要求で、キーフレームの要求には使えない
+		nack = webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK}
+	)
+	tests := []struct {
+		name     string
+		feedback []webrtc.RTCPFeedback
+		typ      keyframeRequestType
+		wantFIR  bool
+	}{
+		{name: "pli and fir, loss", feedback: []webrtc.RTCPFeedback{pli, fir}, typ: keyframeRequestTypePLI, wantFIR: false},
+		{name: "pli and fir, new subscriber", feedback: []webrtc.RTCPFeedback{pli, fir}, typ: keyframeRequestTypeFIR, wantFIR: true},
+		{name: "pli only, new subscriber", feedback: []webrtc.RTCPFeedback{nack, pli}, typ: keyframeRequestTypeFIR, wantFIR: false},
+		{name: "fir only, loss", feedback: []webrtc.RTCPFeedback{nack, fir}, typ: keyframeRequestTypePLI, wantFIR: true},
+		{name: "fir only, new subscriber", feedback: []webrtc.RTCPFeedback{fir}, typ: keyframeRequestTypeFIR, wantFIR: true},
+		{name: "none", feedback: []webrtc.RTCPFeedback{nack}, typ: keyframeRequestTypeFIR, wantFIR: false},
+	}
+	for _, tt := range tests {
+		f, written := newKeyframeTestForwarder(t, webrtc.MimeTypeVP8, tt.feedback)
+		f.RequestKeyframe(tt.typ)
+		pkts := written()
+		if len(pkts) != 1 {
+			t.Errorf("%s: %d requests, want 1", tt.name, len(pkts))
+			continue
+		}
+		switch p := pkts[0].(type) {
+		case *rtcp.FullIntraRequest:
+			if !tt.wantFIR {
+				t.Errorf("%s: FIR, want PLI", tt.name)
+			}
+			if p.MediaSSRC != 1234 || len(p.FIR) != 1 || p.FIR[0].SSRC != 1234 {
+				t.Errorf("%s: FIR %+v, want ssrc 1234", tt.name, p)
+			}
+		case *rtcp.PictureLossIndication:
+			if tt.wantFIR {
+				t.Errorf("%s: PLI, want FIR", tt.name)
+			}
+			if p.MediaSSRC != 1234 {
+				t.Errorf("%s: PLI media ssrc %d, want 1234", tt.name, p.MediaSSRC)
+			}
+		default:
+			t.Errorf("%s: unexpected packet %T", tt.name, p)
+		}
+	}
+}
+
+func TestRequestKeyframeIncrementsFIRSequenceNumber(t *testing.T) {
+	fir := []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"}}
+	f, written := newKeyframeTestForwarder(t, webrtc.MimeTypeVP8, fir)
+	for i := 0; i < 3; i++ {
+		f.lastKeyframeRequest.Store(0)
+		f.RequestKeyframe(keyframeRequestTypeFIR)
+	}
+	pkts := written()
+	if len(pkts) != 3 {
+		t.Fatalf("%d requests, want 3", len(pkts))
+	}
+	for i, pkt := range pkts {
+		p, ok := pkt.(*rtcp.FullIntraRequest)
+		if !ok {
+			t.Fatalf("request %d: %T, want FIR", i, pkt)
+		}
+		// 同じ要求の再送と区別されるよう、要求ごとに番号を進める
+		if want := uint8(i + 1); p.FIR[0].SequenceNumber != want {
+			t.Errorf("request %d: sequence number %d, want %d", i, p.FIR[0].SequenceNumber, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package rtc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrLocalPeerNoSession = errors.New("local participant has no session description")
+)
+
+// LocalParticipant は WebRTC 以外の経路 (RTMP や RTP の取り込みなど) から受け取ったメディアを、
+// サーバ内の参加者としてルームに配信する
+type LocalParticipant interface {
+	ID() PeerConnectionID
+	NewTrack(codec webrtc.RTPCodecCapability, trackID, streamID string) (LocalTrack, error)
+	// Close するか、ルームが閉じられて退出すると閉じられる
+	Done() <-chan struct{}
+	Close() error
+}
+
+// LocalTrack に書き込んだ RTP パケットはルームの購読者に転送される。
+// ペイロードタイプと SSRC は購読者ごとに書き換えるので任意の値でよい
+type LocalTrack interface {
+	ID() string
+	WriteRTP(*rtp.Packet) error
+}
+
+type localParticipant struct {
+	id     PeerConnectionID
+	name   string
+	room   *room
+	ch     chan<- RTCEventMessage
+	mux    sync.Mutex
+	tracks []*forwarder
+	closed bool
+	done   chan struct{}
+}
+
+// NewLocalParticipant は TrackManager.Publish でルームに配信する。
+// 参加者数の上限は適用されず、ルームが閉じられると退出する
+func (r *rtc) NewLocalParticipant(name, participant string) (LocalParticipant, error) {
+	return r.newLocalParticipant(name, participant, true)
+}
+
+// newLocalParticipant は retry の場合、閉じている最中のルームに当たったら一度だけ作り直したルームに配信し直す
+func (r *rtc) newLocalParticipant(name, participant string, retry bool) (LocalParticipant, error) {
+	rm, err := r.room(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &localParticipant{
+		id:   PeerConnectionID(xid.New()),
+		name: participant,
+		room: rm,
+		mux:  sync.Mutex{},
+		done: make(chan struct{}),
+	}
+	// ルームが Publish の直後に閉じても、ch を設定するまで Close を待たせる
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	ch, err := rm.track.Publish(p.id, participant, p)
+	if errors.Is(err, ErrRoomClosed) && retry {
+		return r.newLocalParticipant(name, participant, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.ch = ch
+	return p, nil
+}
+
+// JoinLocalParticipant はブラウザの参加者と同じく TrackManager.Join でルームに参加する。
+// 参加者数の上限が適用され、ルームが閉じられると退出する。トラックは購読しない
+func (r *rtc) JoinLocalParticipant(name, participant string) (LocalParticipant, error) {
+	return r.joinLocalParticipant(name, participant, true)
+}
+
+// joinLocalParticipant は retry の場合、閉じている最中のルームに当たったら一度だけ作り直したルームに参加し直す
+func (r *rtc) joinLocalParticipant(name, participant string, retry bool) (LocalParticipant, error) {
+	rm, err := r.room(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &localParticipant{
+		id:   PeerConnectionID(xid.New()),
+		name: participant,
+		room: rm,
+		mux:  sync.Mutex{},
+		done: make(chan struct{}),
+	}
+	ch, err := rm.track.Join(&localPeer{participant: p, name: participant})
+	if errors.Is(err, ErrRoomClosed) && retry {
+		return r.joinLocalParticipant(name, participant, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.ch = ch
+	return p, nil
+}
+
+func (p *localParticipant) ID() PeerConnectionID {
+	return p.id
+}
+
+func (p *localParticipant) NewTrack(
+	codec webrtc.RTPCodecCapability,
+	trackID string,
+	streamID string,
+) (LocalTrack, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return nil, ErrPeerConnClosed
+	}
+	if err := p.room.track.CanPublish(p.id); err != nil {
+		return nil, err
+	}
+	f, err := newLocalForwarder(p.id, codec, trackID, streamID, p.room.options, p.room.egress, p.logger())
+	if err != nil {
+		return nil, err
+	}
+	p.ch <- RTCEventMessage{Event: RTCEventTypeAddTrack, LocalTrack: f.local, forwarder: f}
+	p.tracks = append(p.tracks, f)
+	return f, nil
+}
+
+// Close は配信していたトラックを取り除き、ルームから退出する
+func (p *localParticipant) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for _, f := range p.tracks {
+		p.ch <- RTCEventMessage{Event: RTCEventTypeRemoveTrack, LocalTrack: f.local}
+	}
+	p.ch <- RTCEventMessage{Event: RTCEventTypeLeave, participant: p.id}
+	close(p.done)
+	return nil
+}
+
+func (p *localParticipant) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *localParticipant) logger() *zap.Logger {
+	return participantLogger(RoomLogger(zap.L(), p.room.name), p.name, p.id)
+}
+
+// localPeer は JoinLocalParticipant の参加者を TrackManager からはピアとして見せる。
+// シグナリングを持たないので、通知とトラックの更新は受け流す
+type localPeer struct {
+	participant *localParticipant
+	name        string
+}
+
+func (p *localPeer) Close() error {
+	return p.participant.Close()
+}
+
+func (p *localPeer) ID() PeerConnectionID {
+	return p.participant.id
+}
+
+func (p *localPeer) Logger() *zap.Logger {
+	return p.participant.logger()
+}
+
+func (p *localPeer) MuteTrack(string, bool) error {
+	return ErrTrackNotOwned
+}
+
+func (p *localPeer) SetLayer(string, uint8, uint8) error {
+	return nil
+}
+
+func (p *localPeer) Notify(Message) error {
+	return nil
+}
+
+func (p *localPeer) UpdateLocalDescription() (SessionDescriptionSerializer, error) {
+	return SessionDescriptionSerializer{}, ErrLocalPeerNoSession
+}
+
+func (p *localPeer) UpdateRemoteDescription(SessionDescriptionSerializer) error {
+	return ErrLocalPeerNoSession
+}
+
+func (p *localPeer) UpdateICECandidate(ICECandidateSerializer) error {
+	return ErrLocalPeerNoSession
+}
+
+func (p *localPeer) UpdateTrack(TrackLocals) error {
+	return nil
+}
+
+// WriteRTP は LocalTrack として受け取ったパケットを、WebRTC の配信者から届いたパケットと同じように転送する。
+// 同じトラックへの書き込みは 1 つの goroutine から行う
+func (f *forwarder) WriteRTP(pkt *rtp.Packet) error {
+	return f.process(pkt)
+}
@@ -0,0 +1,13 @@
+package rtc
+
+import "go.uber.org/zap"
+
+// RoomLogger はルームに関するログにルーム名を付ける。rtc の外でルームのトラックを扱うパッケージからも使う
+func RoomLogger(l *zap.Logger, room string) *zap.Logger {
+	return l.With(zap.String("room", room))
+}
+
+// participantLogger は参加者ごとのログに参加者の名前と PeerConnectionID を付ける
+func participantLogger(l *zap.Logger, participant string, id PeerConnectionID) *zap.Logger {
+	return l.With(zap.String("participant", participant), zap.Stringer("peer_connection_id", id))
+}
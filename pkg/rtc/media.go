@@ -1,20 +1,176 @@
 package rtc
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/pion/webrtc/v3"
 )
 
-func NewMediaEngine() (m *webrtc.MediaEngine, err error) {
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrNoCodecAllowed   = errors.New("no codec is allowed")
+	ErrDuplicateCodec   = errors.New("codec is listed more than once")
+	ErrPayloadTypesFull = errors.New("too many codecs for the dynamic payload types (96-127)")
+)
+
+const (
+	mimeTypeRTX    = "video/rtx"
+	mimeTypeULPFEC = "video/ulpfec"
+)
+
+type CodecPolicy struct {
+	// 優先度の高い順に並べた、利用を許可するコーデック名 (例: opus, VP8, H264)
+	Codecs              []string
+	H264ProfileLevelIDs []string
+	RTX                 bool
+	// 配信者から RED と ULPFEC を受け取る。映像の ULPFEC は SFU で欠損の復元に使って終端し、
+	// 購読者には転送しない。購読者に向けた冗長化は音声の RED (RoomOptions.AdaptiveRED) だけ
+	FEC bool
+}
+
+var DefaultCodecPolicy = CodecPolicy{
+	Codecs:              []string{"opus", "G722", "PCMU", "PCMA", "VP8", "VP9", "H264", "AV1"},
+	H264ProfileLevelIDs: []string{"42001f", "42e01f", "640032"},
+	RTX:                 true,
+	FEC:                 true,
+}
+
+// Parameters はポリシーから MediaEngine に登録するコーデックを優先度順に組み立てる
+func (p CodecPolicy) Parameters() (audio, video []webrtc.RTPCodecParameters, err error) {
+	// nack, nack pli は registerInterceptors で登録する
+	videoRTCPFeedback := []webrtc.RTCPFeedback{
+		{Type: webrtc.TypeRTCPFBGoogREMB},
+		{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+	}
+
+	// 動的ペイロードタイプを先頭から順に割り当てる。111 は Opus に予約する。
+	// uint8 で折り返さないよう int で数え、127 を超えたら最後にエラーにする
+	pt := 96
+	nextPayloadType := func() webrtc.PayloadType {
+		if pt == 111 {
+			pt++
+		}
+		pt++
+		return webrtc.PayloadType(pt - 1)
+	}
+	addVideo := func(mimeType, fmtp string) {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     mimeType,
+				ClockRate:    90000,
+				SDPFmtpLine:  fmtp,
+				RTCPFeedback: videoRTCPFeedback,
+			},
+			PayloadType: nextPayloadType(),
+		}
+		video = append(video, codec)
+		if !p.RTX {
+			return
+		}
+		video = append(video, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeRTX,
+				ClockRate:   90000,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", codec.PayloadType),
+			},
+			PayloadType: nextPayloadType(),
+		})
+	}
+	addAudio := func(mimeType string, clockRate uint32, channels uint16, fmtp string, pt webrtc.PayloadType) {
+		audio = append(audio, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeType,
+				ClockRate:   clockRate,
+				Channels:    channels,
+				SDPFmtpLine: fmtp,
+			},
+			PayloadType: pt,
+		})
+	}
+
+	listed := map[string]bool{}
+	for _, name := range p.Codecs {
+		if listed[strings.ToLower(name)] {
+			return nil, nil, fmt.Errorf("%w: %s", ErrDuplicateCodec, name)
+		}
+		listed[strings.ToLower(name)] = true
+
+		switch strings.ToLower(name) {
+		case "opus":
+			fmtp := "minptime=10"
+			if p.FEC {
+				// 配信者に RED で送ってもらえるよう Opus より先に並べる
+				addAudio(mimeTypeAudioRED, 48000, 2, "111/111", 63)
+				fmtp += ";useinbandfec=1"
+			}
+			addAudio(webrtc.MimeTypeOpus, 48000, 2, fmtp, 111)
+		case "g722":
+			addAudio(webrtc.MimeTypeG722, 8000, 0, "", 9)
+		case "pcmu":
+			addAudio(webrtc.MimeTypePCMU, 8000, 0, "", 0)
+		case "pcma":
+			addAudio(webrtc.MimeTypePCMA, 8000, 0, "", 8)
+		case "vp8":
+			addVideo(webrtc.MimeTypeVP8, "")
+		case "vp9":
+			addVideo(webrtc.MimeTypeVP9, "profile-id=0")
+			addVideo(webrtc.MimeTypeVP9, "profile-id=1")
+		case "h264":
+			for _, id := range p.H264ProfileLevelIDs {
+				addVideo(webrtc.MimeTypeH264, fmt.Sprintf(
+					"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s", id,
+				))
+			}
+		case "av1":
+			addVideo(webrtc.MimeTypeAV1, "")
+		default:
+			return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, name)
+		}
+	}
+	if len(audio) == 0 && len(video) == 0 {
+		return nil, nil, ErrNoCodecAllowed
+	}
+
+	// ブラウザは RED と ULPFEC の両方がネゴシエートされたときに映像の ULPFEC を送る
+	if p.FEC && len(video) > 0 {
+		addVideo(mimeTypeVideoRED, "")
+		video = append(video, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeULPFEC, ClockRate: 90000},
+			PayloadType:        nextPayloadType(),
+		})
+	}
+	if pt-1 > 127 {
+		return nil, nil, ErrPayloadTypesFull
+	}
+	return audio, video, nil
+}
+
+func NewMediaEngine(p CodecPolicy) (m *webrtc.MediaEngine, err error) {
 	var extensions = []string{
 		"urn:ietf:params:rtp-hdrext:sdes:mid",
 		"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
 		"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		dependencyDescriptorURI,
 	}
 
-	m = &webrtc.MediaEngine{}
-	if err = m.RegisterDefaultCodecs(); err != nil {
+	audio, video, err := p.Parameters()
+	if err != nil {
 		return
 	}
+
+	m = &webrtc.MediaEngine{}
+	for _, codec := range audio {
+		if err = m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return
+		}
+	}
+	for _, codec := range video {
+		if err = m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return
+		}
+	}
 	for _, uri := range extensions {
 		if err = m.RegisterHeaderExtension(
 			webrtc.RTPHeaderExtensionCapability{URI: uri},
@@ -0,0 +1,41 @@
+package rtc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodecPolicyParameters(t *testing.T) {
+	audio, video, err := DefaultCodecPolicy.Parameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[uint8]string{}
+	for _, c := range append(audio, video...) {
+		pt := uint8(c.PayloadType)
+		if other, ok := seen[pt]; ok {
+			t.Errorf("payload type %d is used by %s and %s", pt, other, c.MimeType)
+		}
+		seen[pt] = c.MimeType
+		if pt > 127 {
+			t.Errorf("%s: payload type %d is out of range", c.MimeType, pt)
+		}
+	}
+
+	manyProfiles := DefaultCodecPolicy
+	manyProfiles.H264ProfileLevelIDs = []string{"42001f", "42e01f", "4d001f", "4d0032", "640032", "64001f", "640c1f", "f4001f", "42c01f", "42c032", "4d401f", "640034"}
+	for _, c := range []struct {
+		name   string
+		policy CodecPolicy
+		want   error
+	}{
+		{"duplicate codec", CodecPolicy{Codecs: []string{"opus", "VP8", "vp8"}}, ErrDuplicateCodec},
+		{"too many payload types", manyProfiles, ErrPayloadTypesFull},
+		{"unsupported codec", CodecPolicy{Codecs: []string{"theora"}}, ErrUnsupportedCodec},
+		{"no codec", CodecPolicy{}, ErrNoCodecAllowed},
+	} {
+		if _, _, err := c.policy.Parameters(); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package rtc
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
@@ -10,47 +11,80 @@ import (
 )
 
 var (
-	ErrPeerConnClosed = errors.New("peer connection is already closed")
+	ErrPeerConnClosed      = errors.New("peer connection is already closed")
+	ErrPublishNotPermitted = errors.New("participant is not permitted to publish")
 )
 
 type PeerConnectionID xid.ID
 
+// Permission は参加者に許可する操作。トークンで参加した参加者はトークンの内容に従う
+type Permission struct {
+	// 参加者の名前。空の場合は付けない
+	Identity     string
+	CanPublish   bool
+	CanSubscribe bool
+}
+
+// FullPermission はトークンを検証しない場合に全ての参加者に与える
+var FullPermission = Permission{CanPublish: true, CanSubscribe: true}
+
 type PeerConnection interface {
 	Close() error
-	DispatchKeyframeRequest()
 	ID() PeerConnectionID
+	// ルーム、参加者、PeerConnectionID を付けたロガー
+	Logger() *zap.Logger
+	MuteTrack(trackID string, muted bool) error
+	SetLayer(trackID string, spatial, temporal uint8) error
+	Notify(Message) error
 	UpdateLocalDescription() (SessionDescriptionSerializer, error)
 	UpdateRemoteDescription(SessionDescriptionSerializer) error
 	UpdateICECandidate(ICECandidateSerializer) error
 	UpdateTrack(TrackLocals) error
 }
 
+func (id PeerConnectionID) String() string {
+	return xid.ID(id).String()
+}
+
 type connection struct {
-	id   PeerConnectionID
-	conn SignalConnection
-	peer *webrtc.PeerConnection
+	id         PeerConnectionID
+	conn       SignalConnection
+	peer       *webrtc.PeerConnection
+	track      TrackManager
+	options    RoomOptions
+	permission Permission
+	logger     *zap.Logger
+	// オファーの作成とアンサーの適用はルームとシグナリングの goroutine から呼ばれるので、順に行う
+	negotiation sync.Mutex
 }
 
 func newPeerConnection(
 	c SignalConnection,
 	p *webrtc.PeerConnection,
 	m TrackManager,
-) (PeerConnection, error) {
+	o RoomOptions,
+	perm Permission,
+	logger *zap.Logger,
+) (*connection, error) {
+	id := PeerConnectionID(xid.New())
 	conn := &connection{
-		id:   PeerConnectionID(xid.New()),
-		conn: c,
-		peer: p,
+		id:          id,
+		conn:        c,
+		peer:        p,
+		track:       m,
+		options:     o,
+		permission:  perm,
+		logger:      participantLogger(logger, perm.Identity, id),
+		negotiation: sync.Mutex{},
 	}
 	return conn, nil
 }
 
+// Close は PeerConnection とシグナリングを切る。シグナリングはすでに閉じていることがあるので、その失敗は無視する
 func (c *connection) Close() error {
-	return c.peer.Close()
-}
-
-func (c *connection) DispatchKeyframeRequest() {
-	// FIXME: replace to dispatch FIR
-	c.dispatchPLIToReceivers()
+	err := c.peer.Close()
+	c.conn.Close()
+	return err
 }
 
 func (c *connection) dispatchOffer() error {
@@ -59,7 +93,7 @@ func (c *connection) dispatchOffer() error {
 		SessionDescription SessionDescriptionSerializer `json:"sdp,omitempty"`
 	}
 
-	sdp, err := c.UpdateLocalDescription()
+	sdp, err := c.updateLocalDescription()
 	if err != nil {
 		return err
 	}
@@ -73,7 +107,44 @@ func (c *connection) ID() PeerConnectionID {
 	return c.id
 }
 
+func (c *connection) Logger() *zap.Logger {
+	return c.logger
+}
+
+func (c *connection) MuteTrack(trackID string, muted bool) error {
+	c.logger.Info("mute track", zap.String("track", trackID), zap.Bool("muted", muted))
+	return c.track.Mute(c.id, trackID, muted)
+}
+
+// SetLayer は購読しているトラックについて、受け取る空間・時間レイヤーの上限を変更する
+func (c *connection) SetLayer(trackID string, spatial, temporal uint8) error {
+	for _, sender := range c.peer.GetSenders() {
+		track, ok := sender.Track().(*trackLocal)
+		if !ok || track.ID() != trackID {
+			continue
+		}
+
+		encodings := sender.GetParameters().Encodings
+		if len(encodings) == 0 {
+			return ErrTrackNotFound
+		}
+		return track.setTargetLayer(encodings[0].SSRC, spatial, temporal)
+	}
+	return ErrTrackNotFound
+}
+
+func (c *connection) Notify(msg Message) error {
+	return c.conn.WriteMessage(msg)
+}
+
 func (c *connection) UpdateLocalDescription() (SessionDescriptionSerializer, error) {
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+	return c.updateLocalDescription()
+}
+
+// updateLocalDescription は c.negotiation を Lock した状態で呼ぶ
+func (c *connection) updateLocalDescription() (SessionDescriptionSerializer, error) {
 	s := SessionDescriptionSerializer{}
 	offer, err := c.peer.CreateOffer(&webrtc.OfferOptions{})
 	if err != nil {
@@ -83,29 +154,43 @@ func (c *connection) UpdateLocalDescription() (SessionDescriptionSerializer, err
 	if err := c.peer.SetLocalDescription(offer); err != nil {
 		return s, err
 	}
-	s.SessionDescription = offer
+	// pion は生成したオファーの書き換えを受け付けないので、帯域の指定は相手に送る SDP にだけ加える
+	s.SessionDescription, err = limitBandwidth(offer, c.options.MaxAudioBitrate, c.options.MaxVideoBitrate)
 	return s, err
 }
 
 func (c *connection) UpdateRemoteDescription(
 	desc SessionDescriptionSerializer,
 ) error {
-	zap.L().Info("set remote description")
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+
+	c.logger.Info("set remote description")
 	return c.peer.SetRemoteDescription(desc.SessionDescription)
 }
 
 func (c *connection) UpdateICECandidate(
 	serializer ICECandidateSerializer,
 ) error {
-	zap.L().Info("add ice candidate")
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+
+	c.logger.Info("add ice candidate")
 	return c.peer.AddICECandidate(serializer.ICECandidateInit)
 }
 
 func (c *connection) UpdateTrack(tracks TrackLocals) error {
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+
 	state := c.peer.ConnectionState()
 	if state == webrtc.PeerConnectionStateClosed {
 		return ErrPeerConnClosed
 	}
+	// 購読を許可されていない参加者にはトラックを送らず、オファーだけを更新する
+	if !c.permission.CanSubscribe {
+		tracks = TrackLocals{}
+	}
 
 	m := map[string]bool{}
 	for _, sender := range c.peer.GetSenders() {
@@ -131,49 +216,41 @@ func (c *connection) UpdateTrack(tracks TrackLocals) error {
 
 	for id, track := range tracks {
 		if _, ok := m[id]; !ok {
-			if _, err := c.peer.AddTrack(track); err != nil {
+			sender, err := c.peer.AddTrack(track)
+			if err != nil {
 				return err
 			}
+			go c.readRTCP(sender)
 		}
 	}
 	return c.dispatchOffer()
 }
 
-//lint:ignore U1000 PLIとFIRを使い分けるようにするまで一旦、定義したままにする
-func (c *connection) dispatchFIRToReceivers() {
-	for _, receiver := range c.peer.GetReceivers() {
-		track := receiver.Track()
-		if track == nil {
-			continue
+// readRTCP は購読者から届く RTCP を処理する。インターセプタを動かすためにも読み続ける必要がある
+func (c *connection) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
 		}
 
-		pkts := []rtcp.Packet{
-			&rtcp.FullIntraRequest{
-				MediaSSRC: uint32(track.SSRC()),
-			},
-		}
-
-		if err := c.peer.WriteRTCP(pkts); err != nil {
+		track, ok := sender.Track().(*trackLocal)
+		if !ok {
 			continue
 		}
-	}
-}
-
-func (c *connection) dispatchPLIToReceivers() {
-	for _, receiver := range c.peer.GetReceivers() {
-		track := receiver.Track()
-		if track == nil {
-			continue
-		}
-
-		pkts := []rtcp.Packet{
-			&rtcp.PictureLossIndication{
-				MediaSSRC: uint32(track.SSRC()),
-			},
-		}
-
-		if err := c.peer.WriteRTCP(pkts); err != nil {
-			continue
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.TransportLayerNack:
+				track.retransmit(pkt)
+			case *rtcp.PictureLossIndication:
+				track.keyframe(keyframeRequestTypePLI)
+			case *rtcp.FullIntraRequest:
+				track.keyframe(keyframeRequestTypeFIR)
+			case *rtcp.ReceiverReport:
+				for _, r := range pkt.Reports {
+					track.reportLoss(r.SSRC, r.FractionLost)
+				}
+			}
 		}
 	}
 }
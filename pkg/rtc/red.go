@@ -0,0 +1,217 @@
+package rtc
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// ref: https://www.rfc-editor.org/rfc/rfc2198
+
+var ErrInvalidREDPacket = errors.New("invalid red packet")
+
+const (
+	mimeTypeAudioRED = "audio/red"
+	mimeTypeVideoRED = "video/red"
+
+	// 冗長化する過去のパケット数
+	RED_DISTANCE = 2
+)
+
+func isRED(mimeType string) bool {
+	return strings.EqualFold(mimeType, mimeTypeAudioRED) || strings.EqualFold(mimeType, mimeTypeVideoRED)
+}
+
+type redBlock struct {
+	payloadType     uint8
+	timestampOffset uint32
+	payload         []byte
+}
+
+// parseRED は RED ペイロードを古い順のブロックに分解する。最後のブロックがプライマリ
+func parseRED(payload []byte) ([]redBlock, error) {
+	blocks := []redBlock{}
+	lengths := []int{}
+	i := 0
+	for {
+		if i >= len(payload) {
+			return nil, ErrInvalidREDPacket
+		}
+		if payload[i]&0x80 == 0 {
+			blocks = append(blocks, redBlock{payloadType: payload[i] & 0x7f})
+			i++
+			break
+		}
+		if i+4 > len(payload) {
+			return nil, ErrInvalidREDPacket
+		}
+		blocks = append(blocks, redBlock{
+			payloadType:     payload[i] & 0x7f,
+			timestampOffset: uint32(payload[i+1])<<6 | uint32(payload[i+2])>>2,
+		})
+		lengths = append(lengths, int(payload[i+2]&0x03)<<8|int(payload[i+3]))
+		i += 4
+	}
+
+	for n, length := range lengths {
+		if i+length > len(payload) {
+			return nil, ErrInvalidREDPacket
+		}
+		blocks[n].payload = payload[i : i+length]
+		i += length
+	}
+	blocks[len(blocks)-1].payload = payload[i:]
+	return blocks, nil
+}
+
+type redHistory struct {
+	timestamp uint32
+	payload   []byte
+}
+
+// encodeRED は過去のペイロードを冗長ブロックとして primary の前に積んだ RED ペイロードを作る
+func encodeRED(payloadType uint8, pkt *rtp.Packet, history []redHistory) []byte {
+	const (
+		maxTimestampOffset = 1 << 14
+		maxBlockLength     = 1 << 10
+	)
+
+	redundant := make([]redHistory, 0, len(history))
+	for _, h := range history {
+		offset := pkt.Timestamp - h.timestamp
+		if offset == 0 || offset >= maxTimestampOffset || len(h.payload) >= maxBlockLength {
+			continue
+		}
+		redundant = append(redundant, h)
+	}
+
+	size := 1 + len(pkt.Payload)
+	for _, h := range redundant {
+		size += 4 + len(h.payload)
+	}
+	buf := make([]byte, 0, size)
+	for _, h := range redundant {
+		offset := pkt.Timestamp - h.timestamp
+		length := len(h.payload)
+		buf = append(buf,
+			0x80|payloadType,
+			byte(offset>>6),
+			byte(offset<<2)|byte(length>>8),
+			byte(length),
+		)
+	}
+	buf = append(buf, payloadType&0x7f)
+	for _, h := range redundant {
+		buf = append(buf, h.payload...)
+	}
+	return append(buf, pkt.Payload...)
+}
+
+// redDecoder は配信者から届いた RED パケットをプライマリのコーデックのパケットに戻す。
+// 音声は冗長ブロックから、映像は ULPFEC から欠損したパケットを復元する
+type redDecoder struct {
+	kind           webrtc.RTPCodecType
+	fecPayloadType uint8
+	fec            *ulpfecDecoder
+
+	started bool
+	lastSeq uint16
+}
+
+func newREDDecoder(kind webrtc.RTPCodecType, codecs []webrtc.RTPCodecParameters) *redDecoder {
+	d := &redDecoder{kind: kind, fec: newULPFECDecoder()}
+	for _, c := range codecs {
+		if strings.EqualFold(c.MimeType, mimeTypeULPFEC) {
+			d.fecPayloadType = uint8(c.PayloadType)
+		}
+	}
+	return d
+}
+
+// primaryPayloadType はパケットのプライマリブロックのペイロードタイプを返す。FEC のみのパケットは false
+func (d *redDecoder) primaryPayloadType(pkt *rtp.Packet) (uint8, bool) {
+	blocks, err := parseRED(pkt.Payload)
+	if err != nil {
+		return 0, false
+	}
+	pt := blocks[len(blocks)-1].payloadType
+	return pt, d.fecPayloadType == 0 || pt != d.fecPayloadType
+}
+
+func (d *redDecoder) decode(pkt *rtp.Packet) []*rtp.Packet {
+	blocks, err := parseRED(pkt.Payload)
+	if err != nil {
+		return nil
+	}
+	if d.kind == webrtc.RTPCodecTypeAudio {
+		return d.decodeAudio(pkt, blocks)
+	}
+	return d.decodeVideo(pkt, blocks[len(blocks)-1])
+}
+
+func (d *redDecoder) decodeAudio(pkt *rtp.Packet, blocks []redBlock) []*rtp.Packet {
+	pkts := []*rtp.Packet{}
+
+	// 直前に受け取ったパケットとの間の欠損を冗長ブロックで埋める
+	if d.started && isNewerSequence(pkt.SequenceNumber, d.lastSeq) {
+		lost := int(pkt.SequenceNumber - d.lastSeq - 1)
+		redundant := blocks[:len(blocks)-1]
+		if lost > len(redundant) {
+			lost = len(redundant)
+		}
+		for k := lost; k > 0; k-- {
+			b := redundant[len(redundant)-k]
+			pkts = append(pkts, &rtp.Packet{
+				Header:  d.header(pkt, b, pkt.SequenceNumber-uint16(k)),
+				Payload: b.payload,
+			})
+		}
+	}
+	if !d.started || isNewerSequence(pkt.SequenceNumber, d.lastSeq) {
+		d.started = true
+		d.lastSeq = pkt.SequenceNumber
+	}
+
+	primary := blocks[len(blocks)-1]
+	return append(pkts, &rtp.Packet{
+		Header:  d.header(pkt, primary, pkt.SequenceNumber),
+		Payload: primary.payload,
+	})
+}
+
+// decodeVideo は ULPFEC を SFU で終端する。
+// FEC は保護するパケットの SSRC やシーケンス番号に依存し、購読者ごとに書き換えたパケットには使えないので転送しない
+func (d *redDecoder) decodeVideo(pkt *rtp.Packet, primary redBlock) []*rtp.Packet {
+	if d.fecPayloadType != 0 && primary.payloadType == d.fecPayloadType {
+		recovered := d.fec.AddFEC(pkt.SequenceNumber, primary.payload)
+
+		// FEC パケットの分のシーケンス番号は空のパディングで埋め、受信側に欠損と判断させない
+		padding := &rtp.Packet{Header: pkt.Header.Clone(), PaddingSize: 1}
+		padding.Header.Padding = true
+		padding.Header.Marker = false
+		return append([]*rtp.Packet{padding}, recovered...)
+	}
+
+	media := &rtp.Packet{
+		Header:  d.header(pkt, primary, pkt.SequenceNumber),
+		Payload: primary.payload,
+	}
+	return append([]*rtp.Packet{media}, d.fec.AddMedia(media)...)
+}
+
+func (d *redDecoder) header(pkt *rtp.Packet, b redBlock, seq uint16) rtp.Header {
+	h := pkt.Header.Clone()
+	h.PayloadType = b.payloadType
+	h.SequenceNumber = seq
+	h.Timestamp = pkt.Timestamp - b.timestampOffset
+	if seq != pkt.SequenceNumber {
+		h.Marker = false
+	}
+	return h
+}
+
+func isNewerSequence(a, b uint16) bool {
+	return a != b && a-b < 0x8000
+}
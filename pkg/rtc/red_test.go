@@ -0,0 +1,114 @@
+package rtc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	testOpusPayloadType = 111
+	testOpusFrame       = 960
+)
+
+// opusREDPacket は直前の RED_DISTANCE 個のペイロードを冗長ブロックに持つ RED パケットを作る
+func opusREDPacket(seq uint16, payloads [][]byte) *rtp.Packet {
+	n := int(seq)
+	pkt := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(n * testOpusFrame)},
+		Payload: payloads[n],
+	}
+	history := []redHistory{}
+	for k := RED_DISTANCE; k > 0; k-- {
+		if n-k >= 0 {
+			history = append(history, redHistory{timestamp: uint32((n - k) * testOpusFrame), payload: payloads[n-k]})
+		}
+	}
+	return &rtp.Packet{Header: pkt.Header, Payload: encodeRED(testOpusPayloadType, pkt, history)}
+}
+
+func TestEncodeREDRoundTrip(t *testing.T) {
+	pkt := &rtp.Packet{Header: rtp.Header{Timestamp: 3 * testOpusFrame}, Payload: []byte{3, 3, 3}}
+	history := []redHistory{
+		{timestamp: 1 * testOpusFrame, payload: []byte{1}},
+		{timestamp: 2 * testOpusFrame, payload: []byte{2, 2}},
+		// 同じタイムスタンプと、長すぎるブロックは冗長化しない
+		{timestamp: 3 * testOpusFrame, payload: []byte{9}},
+		{timestamp: 0, payload: make([]byte, 1<<10)},
+	}
+
+	blocks, err := parseRED(encodeRED(testOpusPayloadType, pkt, history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []redBlock{
+		{payloadType: testOpusPayloadType, timestampOffset: 2 * testOpusFrame, payload: []byte{1}},
+		{payloadType: testOpusPayloadType, timestampOffset: testOpusFrame, payload: []byte{2, 2}},
+		{payloadType: testOpusPayloadType, payload: []byte{3, 3, 3}},
+	}
+	if len(blocks) != len(want) {
+		t.Fatalf("%d blocks, want %d", len(blocks), len(want))
+	}
+	for i := range want {
+		b := blocks[i]
+		if b.payloadType != want[i].payloadType || b.timestampOffset != want[i].timestampOffset || !bytes.Equal(b.payload, want[i].payload) {
+			t.Errorf("block %d: %+v, want %+v", i, b, want[i])
+		}
+	}
+}
+
+func TestREDDecoderRecoversDroppedOpusPacket(t *testing.T) {
+	payloads := [][]byte{{0xa0}, {0xa1, 0xa1}, {0xa2, 0xa2, 0xa2}, {0xa3}}
+	d := newREDDecoder(webrtc.RTPCodecTypeAudio, nil)
+
+	for _, seq := range []uint16{0, 1} {
+		if pkts := d.decode(opusREDPacket(seq, payloads)); len(pkts) != 1 {
+			t.Fatalf("packet %d: %d packets decoded, want 1", seq, len(pkts))
+		}
+	}
+	// 2 番目のパケットを落とすと、次のパケットの冗長ブロックから復元する
+	pkts := d.decode(opusREDPacket(3, payloads))
+	if len(pkts) != 2 {
+		t.Fatalf("%d packets decoded, want the recovered and the primary packet", len(pkts))
+	}
+	for i, seq := range []uint16{2, 3} {
+		p := pkts[i]
+		if p.SequenceNumber != seq || p.Timestamp != uint32(seq)*testOpusFrame || p.PayloadType != testOpusPayloadType {
+			t.Errorf("packet %d: header %+v, want sequence %d", i, p.Header, seq)
+		}
+		if !bytes.Equal(p.Payload, payloads[seq]) {
+			t.Errorf("packet %d: payload %x, want %x", i, p.Payload, payloads[seq])
+		}
+	}
+
+	// 遅れて届いたパケットはプライマリだけを返し、復元済みの欠損を埋め直さない
+	if pkts := d.decode(opusREDPacket(2, payloads)); len(pkts) != 1 || pkts[0].SequenceNumber != 2 {
+		t.Errorf("late packet decoded to %d packets, want only the primary", len(pkts))
+	}
+}
+
+func TestParseREDRejectsMalformedPayloads(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"only redundant headers", []byte{0x80 | testOpusPayloadType, 0x0f, 0x00, 0x01}},
+		{"truncated header", []byte{0x80 | testOpusPayloadType, 0x0f}},
+		{"block longer than payload", []byte{0x80 | testOpusPayloadType, 0x0f, 0x00, 0x08, testOpusPayloadType, 0x01}},
+	} {
+		if _, err := parseRED(c.payload); err != ErrInvalidREDPacket {
+			t.Errorf("%s: %v, want ErrInvalidREDPacket", c.name, err)
+		}
+	}
+
+	// 途中で切れたパケットを渡してもパニックしない
+	payloads := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	full := opusREDPacket(2, payloads)
+	for n := 0; n < len(full.Payload); n++ {
+		d := newREDDecoder(webrtc.RTPCodecTypeAudio, nil)
+		d.decode(&rtp.Packet{Header: full.Header, Payload: full.Payload[:n]})
+	}
+}
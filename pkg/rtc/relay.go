@@ -0,0 +1,188 @@
+package rtc
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"ruyka/pkg/token"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+const (
+	RELAY_RECONNECT_INTERVAL = 3 * time.Second
+	// 上流のノードに渡す参加トークンの有効期間。トークンは接続するときにだけ検証される
+	RELAY_TOKEN_TTL = time.Minute
+	// 上流のノードの管理 API に表示される中継の参加者名
+	RELAY_IDENTITY = "relay"
+)
+
+// relay は上流のノードに購読者として接続し、受信したトラックをこのノードのルームに配信する。
+// 接続が切れた場合は ctx が終わるまで再接続を繰り返す。
+// 再接続しても同じ参加者としてトラックを配信し直すので、参加者の worker は 1 つだけ起動する
+func (r *room) relay(ctx context.Context, upstream, secret string, tlsConfig *tls.Config, conf webrtc.Configuration) {
+	id := PeerConnectionID(xid.New())
+	logger := participantLogger(RoomLogger(zap.L(), r.name).With(zap.String("upstream", upstream)), upstream, id)
+	// 中継はルームを閉じたときに ctx で止まるので、closer は渡さない
+	ch, err := r.track.Publish(id, upstream, nil)
+	if err != nil {
+		logger.Warn("relay: failed to publish", zap.Error(err))
+		return
+	}
+	for {
+		err := r.relayOnce(ctx, upstream, secret, tlsConfig, conf, id, ch, logger)
+		if ctx.Err() != nil {
+			logger.Info("relay: stopped")
+			return
+		}
+		logger.Warn("relay: disconnected from upstream", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			logger.Info("relay: stopped")
+			return
+		case <-time.After(RELAY_RECONNECT_INTERVAL):
+		}
+	}
+}
+
+func (r *room) relayOnce(
+	ctx context.Context,
+	upstream, secret string,
+	tlsConfig *tls.Config,
+	conf webrtc.Configuration,
+	id PeerConnectionID,
+	ch chan<- RTCEventMessage,
+	logger *zap.Logger,
+) error {
+	// 上流のノードは空の sdp を解釈できないので、使わないフィールドは送らない
+	type message struct {
+		Event              EventType                     `json:"event"`
+		SessionDescription *SessionDescriptionSerializer `json:"sdp,omitempty"`
+		ICECandidate       *ICECandidateSerializer       `json:"ice,omitempty"`
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("room", r.name)
+	if secret != "" {
+		// 中継は上流のトラックを購読するだけなので、配信は許可しない
+		t, err := token.Create(secret, token.Grant{
+			Room:         r.name,
+			Identity:     RELAY_IDENTITY,
+			CanSubscribe: true,
+		}, RELAY_TOKEN_TTL)
+		if err != nil {
+			return err
+		}
+		q.Set("token", t)
+	}
+	u.RawQuery = q.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	ws, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	// ctx が終わったらシグナリングの受信待ちを切り上げる
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+	sc := NewSignalConnection(ws)
+
+	p, err := r.api.NewPeerConnection(conf)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// 接続が切れると受信が終わり、publish がトラックを取り除く。参加者としては退出しない
+	p.OnTrack(func(tr *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.publish(ch, id, p, tr, receiver, logger)
+	})
+	p.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateFailed {
+			// 上流からのシグナリングを待たずに再接続する
+			ws.Close()
+		}
+	})
+	p.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+		err := sc.WriteMessage(message{
+			Event:        EventTypeCandidate,
+			ICECandidate: &ICECandidateSerializer{ICECandidateInit: i.ToJSON()},
+		})
+		if err != nil {
+			logger.Warn(err.Error())
+		}
+	})
+
+	logger.Info("relay: connected to upstream")
+
+	// オファーより先に届いた ICE candidate は remote description を設定するまで保留する
+	pending := []webrtc.ICECandidateInit{}
+	for {
+		msg := message{}
+		if err := sc.ReadMessage(&msg); err != nil {
+			return err
+		}
+
+		switch msg.Event {
+		case EventTypeOffer:
+			if msg.SessionDescription == nil {
+				continue
+			}
+			if err := p.SetRemoteDescription(msg.SessionDescription.SessionDescription); err != nil {
+				return err
+			}
+			for _, c := range pending {
+				if err := p.AddICECandidate(c); err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+
+			answer, err := p.CreateAnswer(nil)
+			if err != nil {
+				return err
+			}
+			if err := p.SetLocalDescription(answer); err != nil {
+				return err
+			}
+			if err := sc.WriteMessage(message{
+				Event:              EventTypeAnswer,
+				SessionDescription: &SessionDescriptionSerializer{SessionDescription: answer},
+			}); err != nil {
+				return err
+			}
+		case EventTypeCandidate:
+			if msg.ICECandidate == nil {
+				continue
+			}
+			if p.RemoteDescription() == nil {
+				pending = append(pending, msg.ICECandidate.ICECandidateInit)
+				continue
+			}
+			if err := p.AddICECandidate(msg.ICECandidate.ICECandidateInit); err != nil {
+				return err
+			}
+		}
+	}
+}
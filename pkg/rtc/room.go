@@ -0,0 +1,150 @@
+package rtc
+
+import (
+	"crypto/tls"
+	"errors"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_ROOM = "default"
+	// 配信ソフトの再接続やプレイヤーのループの間にルームを閉じないよう、空になってから待つ時間
+	DEFAULT_EMPTY_TIMEOUT = 5 * time.Minute
+)
+
+type RoomOptions struct {
+	Codecs CodecPolicy
+	// パケットロスの多い購読者に向けて音声を RED で冗長化する
+	AdaptiveRED bool
+	// 空でなければ、このシグナリング URL のノードから同名のルームのトラックを中継する
+	Upstream string
+	// 上流のノードの auth.secret。空の場合はトークンを付けずに接続する
+	UpstreamSecret string
+	// 上流のノードに wss で接続するときの設定。nil の場合は既定の設定で接続する
+	UpstreamTLS *tls.Config
+
+	// 0 の場合は上限なし
+	MaxParticipants int
+	MaxPublishers   int
+	// 最後の参加者が退出してからルームを閉じるまでの時間。0 の場合は空になっても閉じない
+	EmptyTimeout time.Duration
+	// 最初の参加者が入室してからルームを閉じるまでの時間。0 の場合は無制限
+	MaxDuration time.Duration
+
+	// 配信者がトラックごとに送れるビットレート (bps)。0 の場合は制限しない
+	MaxAudioBitrate uint64
+	MaxVideoBitrate uint64
+	// ルーム全体で購読者に送るビットレート (bps)。0 の場合は制限しない
+	EgressBitrate uint64
+}
+
+type room struct {
+	name        string
+	api         *webrtc.API
+	options     RoomOptions
+	audioCodecs []webrtc.RTPCodecParameters
+	videoCodecs []webrtc.RTPCodecParameters
+	egress      *egressBudget
+	track       TrackManager
+}
+
+func newRoom(
+	name string,
+	s *webrtc.SettingEngine,
+	o RoomOptions,
+	st store.Store,
+	instance string,
+	hook webhook.Notifier,
+	onClose func(markClosed func() bool),
+) (*room, error) {
+	audio, video, err := o.Codecs.Parameters()
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMediaEngine(o.Codecs)
+	if err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := registerInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	// 再起動前から Store にあるルームは作成時刻を引き継ぐ
+	if _, err := st.Room(name); errors.Is(err, store.ErrRoomNotFound) {
+		err = st.PutRoom(store.Room{Name: name, CreatedAt: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &room{
+		name: name,
+		api: webrtc.NewAPI(
+			webrtc.WithSettingEngine(*s),
+			webrtc.WithMediaEngine(m),
+			webrtc.WithInterceptorRegistry(i),
+		),
+		options:     o,
+		audioCodecs: audio,
+		videoCodecs: video,
+		egress:      newEgressBudget(o.EgressBitrate),
+		track:       newTrackManager(name, o, st, instance, hook, onClose),
+	}, nil
+}
+
+func (r *room) codecs(kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return r.audioCodecs
+	}
+	return r.videoCodecs
+}
+
+// addRecvonlyTransceiver は許可されたコーデックだけを優先度順に受け付けるトランシーバを追加する
+func (r *room) addRecvonlyTransceiver(p *webrtc.PeerConnection, kind webrtc.RTPCodecType) error {
+	codecs := r.codecs(kind)
+	if len(codecs) == 0 {
+		return nil
+	}
+
+	t, err := p.AddTransceiverFromKind(
+		kind,
+		webrtc.RTPTransceiverInit{
+			Direction:     webrtc.RTPTransceiverDirectionRecvonly,
+			SendEncodings: []webrtc.RTPEncodingParameters{},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return t.SetCodecPreferences(codecs)
+}
+
+// publish は受信したトラックをルームに配信し、受信が終わるまで転送を続ける。logger には配信者のロガーを渡す
+func (r *room) publish(
+	ch chan<- RTCEventMessage,
+	owner PeerConnectionID,
+	p *webrtc.PeerConnection,
+	tr *webrtc.TrackRemote,
+	receiver *webrtc.RTPReceiver,
+	logger *zap.Logger,
+) {
+	f, err := newForwarder(owner, p, tr, receiver, r.options, r.egress, logger)
+	if err != nil {
+		logger.Warn("on track: failed new forwarder", zap.String("track", tr.ID()), zap.Error(err))
+		return
+	}
+	ch <- RTCEventMessage{Event: RTCEventTypeAddTrack, LocalTrack: f.local, forwarder: f}
+	defer func() {
+		ch <- RTCEventMessage{Event: RTCEventTypeRemoveTrack, LocalTrack: f.local}
+	}()
+
+	f.forward()
+}
@@ -4,23 +4,61 @@ import (
 	"encoding/json"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// 切断を相手に伝えるのを待つ時間
+const SIGNAL_CLOSE_TIMEOUT = time.Second
+
 type EventType string
 
 const (
 	EventTypeOffer     EventType = "offer"
 	EventTypeAnswer    EventType = "answer"
 	EventTypeCandidate EventType = "candidate"
+
+	EventTypeMute       EventType = "mute"
+	EventTypeUnmute     EventType = "unmute"
+	EventTypeTrackMuted EventType = "track-muted"
+	EventTypeLayer      EventType = "layer"
+	EventTypeError      EventType = "error"
+
+	EventTypeParticipantJoined EventType = "participant-joined"
+	EventTypeParticipantLeft   EventType = "participant-left"
+)
+
+type ErrorCode string
+
+const (
+	ErrorCodeRoomFull            ErrorCode = "room-full"
+	ErrorCodeRoomClosed          ErrorCode = "room-closed"
+	ErrorCodePublishNotPermitted ErrorCode = "publish-not-permitted"
+	ErrorCodeKicked              ErrorCode = "kicked"
+	ErrorCodeMuteFailed          ErrorCode = "mute-failed"
 )
 
+type ErrorMessage struct {
+	Event   EventType `json:"event"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func NewErrorMessage(code ErrorCode, err error) ErrorMessage {
+	return ErrorMessage{
+		Event:   EventTypeError,
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
 type Message interface{}
 
 type SignalConnection interface {
 	ReadMessage(Message) error
 	WriteMessage(Message) error
+	Close() error
 }
 
 type signalConnection struct {
@@ -59,3 +97,13 @@ func (c *signalConnection) WriteMessage(msg Message) error {
 	}
 	return c.conn.WriteMessage(websocket.TextMessage, data)
 }
+
+// Close は相手に切断を伝えてから WebSocket を閉じる。読み込み中の ReadMessage はエラーを返す
+func (c *signalConnection) Close() error {
+	c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(SIGNAL_CLOSE_TIMEOUT),
+	)
+	return c.conn.Close()
+}
@@ -0,0 +1,195 @@
+package rtc
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// TrackSink は WebRTC 以外の経路 (HLS や RTP の転送など) でトラックを購読する
+type TrackSink interface {
+	WriteRTP(*rtp.Packet) error
+	// トラックの配信が終わったときに呼ばれる
+	Close() error
+}
+
+// PublishedTrack はサーバ内の購読者に渡すトラックの情報
+type PublishedTrack struct {
+	Room        string
+	TrackID     string
+	StreamID    string
+	Participant string
+	Kind        webrtc.RTPCodecType
+	Codec       webrtc.RTPCodecCapability
+	// 配信者にキーフレームを要求する。要求は forwarder で間引かれる
+	RequestKeyframe func()
+}
+
+// TrackObserver は配信されたトラックを購読するかどうかを決める。
+// nil を返したトラックは購読しない。ルームのロックを持った状態で呼ばれるので、ルームを操作してはいけない
+type TrackObserver interface {
+	TrackPublished(t PublishedTrack) TrackSink
+}
+
+type sinks struct {
+	mux   sync.RWMutex
+	sinks []TrackSink
+}
+
+func (f *forwarder) PublishedTrack(room string) PublishedTrack {
+	return PublishedTrack{
+		Room:        room,
+		TrackID:     f.ID(),
+		StreamID:    f.local.StreamID(),
+		Participant: f.owner.String(),
+		Kind:        f.local.Kind(),
+		Codec:       f.local.Codec(),
+		RequestKeyframe: func() {
+			f.RequestKeyframe(keyframeRequestTypeFIR)
+		},
+	}
+}
+
+func (f *forwarder) addSink(s TrackSink) {
+	f.sinks.mux.Lock()
+	defer f.sinks.mux.Unlock()
+	f.sinks.sinks = append(f.sinks.sinks, s)
+}
+
+func (f *forwarder) removeSink(s TrackSink) bool {
+	f.sinks.mux.Lock()
+	defer f.sinks.mux.Unlock()
+	for i := range f.sinks.sinks {
+		if f.sinks.sinks[i] == s {
+			f.sinks.sinks = append(f.sinks.sinks[:i], f.sinks.sinks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// writeSinks は購読者と同じパケットをサーバ内の購読者に渡す。
+// 書き込みに失敗した購読者は取り除く
+func (f *forwarder) writeSinks(pkt *rtp.Packet) {
+	f.sinks.mux.RLock()
+	failed := []TrackSink{}
+	for _, s := range f.sinks.sinks {
+		if err := s.WriteRTP(pkt.Clone()); err != nil {
+			f.logger.Warn("forwarder: failed to write to sink", zap.Error(err))
+			failed = append(failed, s)
+		}
+	}
+	f.sinks.mux.RUnlock()
+
+	for _, s := range failed {
+		if f.removeSink(s) {
+			s.Close()
+		}
+	}
+}
+
+// closeSinks は配信の終了をサーバ内の購読者に伝える
+func (f *forwarder) closeSinks() {
+	f.sinks.mux.Lock()
+	closing := f.sinks.sinks
+	f.sinks.sinks = nil
+	f.sinks.mux.Unlock()
+
+	for _, s := range closing {
+		if err := s.Close(); err != nil {
+			f.logger.Warn("forwarder: failed to close sink", zap.Error(err))
+		}
+	}
+}
+
+// Observe はルームで配信されているトラックと、これから配信されるトラックを o に渡す
+func (m *manager) Observe(o TrackObserver) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.observers = append(m.observers, o)
+	for id := range m.forwarders {
+		m.observe(o, m.forwarders[id])
+	}
+}
+
+// observe は m.mux を Lock した状態で呼ぶ
+func (m *manager) observe(o TrackObserver, f *forwarder) {
+	if s := o.TrackPublished(f.PublishedTrack(m.room)); s != nil {
+		f.addSink(s)
+	}
+}
+
+// Observe は全てのルームのトラックを o に渡す。後から作られたルームにも適用する
+func (r *rtc) Observe(o TrackObserver) {
+	r.mux.Lock()
+	r.observers = append(r.observers, o)
+	r.mux.Unlock()
+
+	r.eachRoom(func(rm *room) {
+		rm.track.Observe(o)
+	})
+}
+
+// Subscribe は trackID のトラックを s で購読する。トラックの配信が終わると s.Close が呼ばれる
+func (m *manager) Subscribe(trackID string, s TrackSink) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	f, ok := m.forwarders[trackID]
+	if !ok {
+		return ErrTrackNotFound
+	}
+	f.addSink(s)
+	return nil
+}
+
+// Unsubscribe は s の購読をやめる。s.Close は呼ばない
+func (m *manager) Unsubscribe(trackID string, s TrackSink) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	if f, ok := m.forwarders[trackID]; ok {
+		f.removeSink(s)
+	}
+}
+
+// PublishedTrack は trackID のトラックの情報を返す
+func (m *manager) PublishedTrack(trackID string) (PublishedTrack, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	f, ok := m.forwarders[trackID]
+	if !ok {
+		return PublishedTrack{}, ErrTrackNotFound
+	}
+	return f.PublishedTrack(m.room), nil
+}
+
+func (r *rtc) PublishedTrack(trackID string) (PublishedTrack, error) {
+	t, err := PublishedTrack{}, ErrTrackNotFound
+	r.eachRoom(func(rm *room) {
+		if err == ErrTrackNotFound {
+			t, err = rm.track.PublishedTrack(trackID)
+		}
+	})
+	return t, err
+}
+
+func (r *rtc) Subscribe(trackID string, s TrackSink) error {
+	err := ErrTrackNotFound
+	r.eachRoom(func(rm *room) {
+		if err == ErrTrackNotFound {
+			err = rm.track.Subscribe(trackID, s)
+		}
+	})
+	return err
+}
+
+func (r *rtc) Unsubscribe(trackID string, s TrackSink) {
+	r.eachRoom(func(rm *room) {
+		rm.track.Unsubscribe(trackID, s)
+	})
+}
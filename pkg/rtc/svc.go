@@ -0,0 +1,333 @@
+package rtc
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	dependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+	// 上限を指定しない場合は全てのレイヤーを転送する
+	MAX_LAYER = 0xff
+)
+
+type layerInfo struct {
+	spatial  uint8
+	temporal uint8
+	// 空間レイヤーのフレームの先頭と末尾
+	start bool
+	end   bool
+	// ピクチャ (全空間レイヤーのまとまり) の先頭
+	pictureStart bool
+	keyframe     bool
+	// 上位の時間レイヤーに切り替えられる位置
+	switchUp bool
+}
+
+type layerParser interface {
+	Parse(pkt *rtp.Packet) (layerInfo, bool)
+}
+
+// newLayerParser はコーデックに応じてスケーラビリティ情報のパーサを返す。対応しない場合は nil
+func newLayerParser(
+	codec webrtc.RTPCodecCapability,
+	extensions []webrtc.RTPHeaderExtensionParameter,
+) layerParser {
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		return &vp8LayerParser{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		return &vp9LayerParser{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeAV1):
+		for _, ext := range extensions {
+			if ext.URI == dependencyDescriptorURI {
+				return &dependencyDescriptorParser{id: uint8(ext.ID)}
+			}
+		}
+	}
+	return nil
+}
+
+// ref: https://www.rfc-editor.org/rfc/rfc7741#section-4.2
+// VP8 は空間レイヤーを持たないので、時間レイヤーだけを扱う
+type vp8LayerParser struct{}
+
+func (vp8LayerParser) Parse(pkt *rtp.Packet) (layerInfo, bool) {
+	p := &codecs.VP8Packet{}
+	if _, err := p.Unmarshal(pkt.Payload); err != nil || p.T == 0 {
+		return layerInfo{}, false
+	}
+	start := p.S == 1 && p.PID == 0
+	return layerInfo{
+		temporal:     p.TID,
+		start:        start,
+		end:          pkt.Marker,
+		pictureStart: start,
+		// ペイロードヘッダの P bit が 0 ならキーフレーム
+		keyframe: start && len(p.Payload) > 0 && p.Payload[0]&0x01 == 0,
+		switchUp: p.Y == 1 || p.TID == 0,
+	}, true
+}
+
+type vp9LayerParser struct{}
+
+func (vp9LayerParser) Parse(pkt *rtp.Packet) (layerInfo, bool) {
+	p := &codecs.VP9Packet{}
+	if _, err := p.Unmarshal(pkt.Payload); err != nil {
+		return layerInfo{}, false
+	}
+	return layerInfo{
+		spatial:      p.SID,
+		temporal:     p.TID,
+		start:        p.B,
+		end:          p.E,
+		pictureStart: p.B && p.SID == 0,
+		keyframe:     !p.P && p.B && p.SID == 0,
+		switchUp:     p.U || p.TID == 0,
+	}, true
+}
+
+// ref: https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension
+// レイヤーの判定に必要なテンプレートのレイヤー情報までを読む
+type dependencyDescriptorParser struct {
+	id uint8
+
+	// Parse を呼ぶ goroutine からのみ触る
+	templateIDOffset uint8
+	templateLayers   [][2]uint8
+}
+
+func (d *dependencyDescriptorParser) Parse(pkt *rtp.Packet) (layerInfo, bool) {
+	ext := pkt.Header.GetExtension(d.id)
+	if len(ext) < 3 {
+		return layerInfo{}, false
+	}
+
+	r := &bitReader{buf: ext}
+	start := r.read(1) == 1
+	end := r.read(1) == 1
+	templateID := uint8(r.read(6))
+	r.read(16) // frame_number
+
+	structurePresent := false
+	if len(ext) > 3 {
+		structurePresent = r.read(1) == 1
+		r.read(4) // active_decode_targets_present_flag, custom_dtis_flag, custom_fdiffs_flag, custom_chains_flag
+		if structurePresent {
+			d.readTemplateStructure(r)
+		}
+	}
+	if r.overrun || len(d.templateLayers) == 0 {
+		return layerInfo{}, false
+	}
+
+	index := int((templateID + 64 - d.templateIDOffset) % 64)
+	if index >= len(d.templateLayers) {
+		return layerInfo{}, false
+	}
+	spatial, temporal := d.templateLayers[index][0], d.templateLayers[index][1]
+	return layerInfo{
+		spatial:      spatial,
+		temporal:     temporal,
+		start:        start,
+		end:          end,
+		pictureStart: start && spatial == 0,
+		// テンプレート構造はキーフレームにのみ付与される
+		keyframe: start && spatial == 0 && structurePresent,
+		switchUp: temporal == 0,
+	}, true
+}
+
+func (d *dependencyDescriptorParser) readTemplateStructure(r *bitReader) {
+	d.templateIDOffset = uint8(r.read(6))
+	r.read(5) // dt_cnt_minus_one
+
+	layers := [][2]uint8{}
+	spatial, temporal := uint8(0), uint8(0)
+	for !r.overrun {
+		layers = append(layers, [2]uint8{spatial, temporal})
+		next := r.read(2)
+		if next == 3 {
+			break
+		}
+		switch next {
+		case 1:
+			temporal++
+		case 2:
+			temporal = 0
+			spatial++
+		}
+	}
+	if !r.overrun {
+		d.templateLayers = layers
+	}
+}
+
+type bitReader struct {
+	buf     []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.buf)*8 {
+			r.overrun = true
+			return 0
+		}
+		bit := r.buf[r.pos/8] >> (7 - r.pos%8) & 0x01
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+type layerMapping struct {
+	valid        bool
+	seq          uint16
+	source       uint16
+	marker       bool
+	pictureDelta uint16
+}
+
+// layerSelector は購読者ごとに転送するレイヤーを選び、間引いた分の番号を詰める
+type layerSelector struct {
+	target atomic.Uint32
+
+	// WriteRTP を呼ぶ goroutine からのみ触る
+	spatial      uint8
+	temporal     uint8
+	seqOffset    uint16
+	pictureDelta uint16
+
+	mux      sync.Mutex
+	mappings [PACKET_CACHE_SIZE]layerMapping
+}
+
+func newLayerSelector() *layerSelector {
+	s := &layerSelector{spatial: MAX_LAYER, temporal: MAX_LAYER}
+	s.SetTarget(MAX_LAYER, MAX_LAYER)
+	return s
+}
+
+// SetTarget は転送するレイヤーの上限を設定し、上位の空間レイヤーへの切り替えかどうかを返す
+func (s *layerSelector) SetTarget(spatial, temporal uint8) bool {
+	before := s.target.Swap(uint32(spatial)<<8 | uint32(temporal))
+	return spatial > uint8(before>>8)
+}
+
+// selectLayer はピクチャの区切りで目標のレイヤーに切り替え、パケットを転送するかどうかを返す
+func (s *layerSelector) selectLayer(li layerInfo) bool {
+	if li.pictureStart {
+		target := s.target.Load()
+		spatial, temporal := uint8(target>>8), uint8(target)
+
+		// 上位の空間レイヤーはキーフレームからしかデコードできない
+		if spatial <= s.spatial || li.keyframe {
+			s.spatial = spatial
+		}
+		if temporal <= s.temporal || li.switchUp {
+			s.temporal = temporal
+		}
+	}
+	return li.spatial <= s.spatial && li.temporal <= s.temporal
+}
+
+// forward は購読者に送るヘッダと、ペイロード中の番号を詰める量を返す。false の場合はパケットを送らない
+func (s *layerSelector) forward(pkt *rtp.Packet, li layerInfo, ok bool) (rtp.Header, layerMapping, bool) {
+	header := pkt.Header
+	if ok {
+		if !s.selectLayer(li) {
+			s.seqOffset++
+			// 時間レイヤーを間引いたピクチャは丸ごと欠けるので番号を詰める
+			if li.pictureStart && li.temporal > s.temporal {
+				s.pictureDelta++
+			}
+			return header, layerMapping{}, false
+		}
+		// 上位の空間レイヤーを間引いた場合はピクチャの末尾を示す marker を付け直す
+		if li.end && li.spatial == s.spatial {
+			header.Marker = true
+		}
+	}
+
+	header.SequenceNumber = pkt.SequenceNumber - s.seqOffset
+
+	m := layerMapping{
+		valid:        true,
+		seq:          header.SequenceNumber,
+		source:       pkt.SequenceNumber,
+		marker:       header.Marker,
+		pictureDelta: s.pictureDelta,
+	}
+	s.mux.Lock()
+	s.mappings[header.SequenceNumber%PACKET_CACHE_SIZE] = m
+	s.mux.Unlock()
+	return header, m, true
+}
+
+// skip は購読者に送らなかったパケットの分だけシーケンス番号を詰める
+func (s *layerSelector) skip() {
+	s.seqOffset++
+}
+
+// source は購読者に送ったシーケンス番号から元のシーケンス番号を引く
+func (s *layerSelector) source(seq uint16) (layerMapping, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	m := s.mappings[seq%PACKET_CACHE_SIZE]
+	return m, m.valid && m.seq == seq
+}
+
+// rewritePictureID はペイロード記述子のピクチャ ID を詰めたコピーを返す。
+// 間引くのは上位の時間レイヤーのピクチャだけで、TL0 のピクチャは全て転送するので、
+// TL0PICIDX は元の値のままで基本レイヤーのピクチャごとに 1 ずつ進む
+func rewritePictureID(mimeType string, payload []byte, m layerMapping) []byte {
+	if m.pictureDelta == 0 || len(payload) < 2 {
+		return payload
+	}
+
+	pictureID := -1
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// X bit と I bit があればピクチャ ID がある
+		if payload[0]&0x80 != 0 && payload[1]&0x80 != 0 {
+			pictureID = 2
+		}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		if payload[0]&0x80 != 0 {
+			pictureID = 1
+		}
+	default:
+		return payload
+	}
+	if pictureID < 0 || pictureID >= len(payload) {
+		return payload
+	}
+
+	out := append([]byte(nil), payload...)
+	rewriteVarPictureID(out, pictureID, m.pictureDelta)
+	return out
+}
+
+// rewriteVarPictureID は 7 bit または 15 bit (M bit) のピクチャ ID をその場で書き換える
+func rewriteVarPictureID(payload []byte, i int, delta uint16) {
+	if payload[i]&0x80 == 0 {
+		payload[i] = (payload[i] - byte(delta)) & 0x7f
+		return
+	}
+	if i+1 >= len(payload) {
+		return
+	}
+	id := (uint16(payload[i]&0x7f)<<8 | uint16(payload[i+1])) - delta
+	payload[i] = 0x80 | byte(id>>8)&0x7f
+	payload[i+1] = byte(id)
+}
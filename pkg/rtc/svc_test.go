@@ -0,0 +1,334 @@
+package rtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// vp8TemporalPacket は 15 bit のピクチャ ID、TL0PICIDX、TID を持つ VP8 のパケットを作る
+func vp8TemporalPacket(seq, pictureID uint16, tl0PicIdx, tid uint8, keyframe bool) *rtp.Packet {
+	header := byte(0x01) // P bit: インターフレーム
+	if keyframe {
+		header = 0x00
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{Version: 2, SequenceNumber: seq, Marker: true},
+		Payload: []byte{
+			0x90,                           // X, S
+			0xe0,                           // I, L, T
+			0x80 | byte(pictureID>>8)&0x7f, // M
+			byte(pictureID),
+			tl0PicIdx,
+			tid<<6 | 0x20, // Y
+			header, 0x00, 0x00,
+		},
+	}
+}
+
+func TestLayerSelectorVP8TemporalContinuity(t *testing.T) {
+	// L1T3 の時間レイヤーの並び
+	pattern := []uint8{0, 2, 1, 2}
+
+	for _, target := range []uint8{0, 1, 2} {
+		s := newLayerSelector()
+		s.SetTarget(MAX_LAYER, target)
+
+		var (
+			forwarded     int
+			lastSeq       uint16
+			lastPictureID uint16
+			lastTL0PicIdx uint8
+		)
+		// ピクチャ ID と TL0PICIDX の折り返しをまたぐ
+		pictureID, tl0PicIdx := uint16(0x7ff0), uint8(0xfd)
+		for i := 0; i < 32; i++ {
+			tid := pattern[i%len(pattern)]
+			if tid == 0 && i > 0 {
+				tl0PicIdx++
+			}
+			pkt := vp8TemporalPacket(uint16(65530+i), pictureID, tl0PicIdx, tid, i == 0)
+			pictureID = (pictureID + 1) & 0x7fff
+
+			li, ok := vp8LayerParser{}.Parse(pkt)
+			if !ok {
+				t.Fatalf("target %d: packet %d: failed to parse", target, i)
+			}
+			header, m, ok := s.forward(pkt, li, ok)
+			if tid > target {
+				if ok {
+					t.Fatalf("target %d: packet %d: TID %d forwarded", target, i, tid)
+				}
+				continue
+			}
+			if !ok {
+				t.Fatalf("target %d: packet %d: TID %d dropped", target, i, tid)
+			}
+
+			p := &codecs.VP8Packet{}
+			if _, err := p.Unmarshal(rewritePictureID(webrtc.MimeTypeVP8, pkt.Payload, m)); err != nil {
+				t.Fatalf("target %d: packet %d: %v", target, i, err)
+			}
+			if forwarded > 0 {
+				if header.SequenceNumber != lastSeq+1 {
+					t.Errorf("target %d: packet %d: sequence number %d, want %d", target, i, header.SequenceNumber, lastSeq+1)
+				}
+				if want := (lastPictureID + 1) & 0x7fff; p.PictureID != want {
+					t.Errorf("target %d: packet %d: picture id %d, want %d", target, i, p.PictureID, want)
+				}
+				// TL0PICIDX は TL0 のピクチャでだけ 1 進む
+				want := lastTL0PicIdx
+				if tid == 0 {
+					want++
+				}
+				if p.TL0PICIDX != want {
+					t.Errorf("target %d: packet %d: TL0PICIDX %d, want %d", target, i, p.TL0PICIDX, want)
+				}
+			}
+			forwarded++
+			lastSeq, lastPictureID, lastTL0PicIdx = header.SequenceNumber, p.PictureID, p.TL0PICIDX
+		}
+	}
+}
+
+// svcLayer は L2T2 の 1 つのレイヤーフレーム。各レイヤーフレームは 1 パケットに収まるものとする
+type svcLayer struct {
+	spatial, temporal uint8
+}
+
+// l2t2Pictures は TL0 と TL1 を交互にした L2T2 のピクチャを n 個並べる
+func l2t2Pictures(n int) [][]svcLayer {
+	pictures := [][]svcLayer{}
+	for i := 0; i < n; i++ {
+		tid := uint8(i % 2)
+		pictures = append(pictures, []svcLayer{{0, tid}, {1, tid}})
+	}
+	return pictures
+}
+
+// vp9Packet は VP9 のペイロード記述子を持つパケットを作る。
+// flexible の場合は直前のピクチャを参照する P_DIFF を、そうでなければ TL0PICIDX を付ける
+func vp9Packet(seq, pictureID uint16, l svcLayer, keyframe, flexible bool) *rtp.Packet {
+	header := byte(0x80 | 0x20 | 0x08 | 0x04) // I, L, B, E
+	if !keyframe {
+		header |= 0x40 // P
+	}
+	if flexible {
+		header |= 0x10 // F
+	}
+	layer := l.temporal<<5 | l.spatial<<1
+	if l.temporal == 0 {
+		layer |= 0x10 // U
+	}
+	if l.spatial > 0 {
+		layer |= 0x01 // D
+	}
+	payload := []byte{header, 0x80 | byte(pictureID>>8)&0x7f, byte(pictureID), layer}
+	switch {
+	case !flexible:
+		payload = append(payload, byte(pictureID))
+	case !keyframe:
+		payload = append(payload, 1<<1)
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Marker: l.spatial == 1},
+		Payload: append(payload, 0x00),
+	}
+}
+
+func TestVP9LayerParser(t *testing.T) {
+	for _, flexible := range []bool{false, true} {
+		for _, c := range []struct {
+			layer    svcLayer
+			keyframe bool
+			want     layerInfo
+		}{
+			{svcLayer{0, 0}, true, layerInfo{start: true, end: true, pictureStart: true, keyframe: true, switchUp: true}},
+			{svcLayer{1, 0}, true, layerInfo{spatial: 1, start: true, end: true, switchUp: true}},
+			{svcLayer{0, 1}, false, layerInfo{temporal: 1, start: true, end: true, pictureStart: true}},
+			{svcLayer{1, 1}, false, layerInfo{spatial: 1, temporal: 1, start: true, end: true}},
+		} {
+			li, ok := vp9LayerParser{}.Parse(vp9Packet(1, 0x1234, c.layer, c.keyframe, flexible))
+			if !ok {
+				t.Fatalf("flexible %t: %+v: failed to parse", flexible, c.layer)
+			}
+			if li != c.want {
+				t.Errorf("flexible %t: %+v: %+v, want %+v", flexible, c.layer, li, c.want)
+			}
+		}
+	}
+
+	// 15 bit のピクチャ ID の途中で切れた記述子は読まない
+	if _, ok := (vp9LayerParser{}).Parse(&rtp.Packet{Payload: []byte{0xa0, 0x80}}); ok {
+		t.Error("truncated descriptor is parsed")
+	}
+}
+
+const testDependencyDescriptorID = 5
+
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *bitWriter) write(v uint32, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&0x01) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+// l2t2TemplateOffset はテンプレート ID の折り返しを確かめるため 64 の手前に置く
+const l2t2TemplateOffset = 62
+
+// av1Packet は L2T2 のテンプレートを参照する dependency descriptor を持つパケットを作る。
+// structure の場合はテンプレート構造を付け、そうでなければ前に受け取った構造を使わせる
+func av1Packet(seq, frame uint16, l svcLayer, structure bool) *rtp.Packet {
+	w := &bitWriter{}
+	w.write(1, 1) // start_of_frame
+	w.write(1, 1) // end_of_frame
+	w.write((l2t2TemplateOffset+uint32(l.spatial)*2+uint32(l.temporal))%64, 6)
+	w.write(uint32(frame), 16)
+	if structure {
+		w.write(1, 1) // template_dependency_structure_present_flag
+		w.write(0, 4)
+		w.write(l2t2TemplateOffset, 6)
+		w.write(3, 5) // dt_cnt_minus_one
+		// (0, 0) -> (0, 1) -> (1, 0) -> (1, 1)
+		for _, next := range []uint32{1, 2, 1, 3} {
+			w.write(next, 2)
+		}
+		// 以降の DTI やチェインはパーサが読まないので省く
+	}
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Marker: l.spatial == 1}, Payload: []byte{0x00}}
+	if err := pkt.Header.SetExtension(testDependencyDescriptorID, w.buf); err != nil {
+		panic(err)
+	}
+	return pkt
+}
+
+func newTestDependencyDescriptorParser() layerParser {
+	return newLayerParser(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1},
+		[]webrtc.RTPHeaderExtensionParameter{{URI: dependencyDescriptorURI, ID: testDependencyDescriptorID}},
+	)
+}
+
+func TestDependencyDescriptorParser(t *testing.T) {
+	p := newTestDependencyDescriptorParser()
+
+	// テンプレート構造を受け取るまではレイヤーを判定できない
+	if _, ok := p.Parse(av1Packet(0, 0, svcLayer{0, 1}, false)); ok {
+		t.Fatal("descriptor without a template structure is parsed")
+	}
+
+	for _, c := range []struct {
+		layer     svcLayer
+		structure bool
+		want      layerInfo
+	}{
+		{svcLayer{0, 0}, true, layerInfo{start: true, end: true, pictureStart: true, keyframe: true, switchUp: true}},
+		// テンプレート ID が 64 で折り返しても、保持したテンプレートから引く
+		{svcLayer{1, 0}, false, layerInfo{spatial: 1, start: true, end: true, switchUp: true}},
+		{svcLayer{0, 1}, false, layerInfo{temporal: 1, start: true, end: true, pictureStart: true}},
+		{svcLayer{1, 1}, false, layerInfo{spatial: 1, temporal: 1, start: true, end: true}},
+	} {
+		li, ok := p.Parse(av1Packet(1, 1, c.layer, c.structure))
+		if !ok {
+			t.Fatalf("%+v: failed to parse", c.layer)
+		}
+		if li != c.want {
+			t.Errorf("%+v: %+v, want %+v", c.layer, li, c.want)
+		}
+	}
+
+	// 途中で切れたテンプレート構造は読まず、前の構造を使い続ける
+	truncated := av1Packet(2, 2, svcLayer{0, 0}, true)
+	ext := truncated.Header.GetExtension(testDependencyDescriptorID)
+	if err := truncated.Header.SetExtension(testDependencyDescriptorID, ext[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Parse(truncated); ok {
+		t.Error("truncated template structure is parsed")
+	}
+	if li, ok := p.Parse(av1Packet(3, 3, svcLayer{1, 1}, false)); !ok || li.spatial != 1 || li.temporal != 1 {
+		t.Errorf("%+v, %t: want the cached S1T1 template", li, ok)
+	}
+}
+
+// forwardedLayers は pictures を順に selector に通し、転送したレイヤーと marker を返す。
+// switchAt のピクチャの前で目標を (1, 1) に上げる
+func forwardedLayers(
+	t *testing.T,
+	p layerParser,
+	packet func(seq uint16, picture int, l svcLayer, keyframe bool) *rtp.Packet,
+	pictures [][]svcLayer,
+	keyInterval int,
+	switchAt int,
+) ([]svcLayer, []bool) {
+	t.Helper()
+
+	s := newLayerSelector()
+	s.SetTarget(0, 0)
+	layers, markers := []svcLayer{}, []bool{}
+	seq := uint16(0)
+	for i, picture := range pictures {
+		if i == switchAt {
+			s.SetTarget(1, 1)
+		}
+		for _, l := range picture {
+			pkt := packet(seq, i, l, i%keyInterval == 0)
+			seq++
+			li, ok := p.Parse(pkt)
+			if !ok {
+				t.Fatalf("picture %d: %+v: failed to parse", i, l)
+			}
+			header, _, forward := s.forward(pkt, li, ok)
+			if forward {
+				layers = append(layers, l)
+				markers = append(markers, header.Marker)
+			}
+		}
+	}
+	return layers, markers
+}
+
+func TestLayerSelectorSVC(t *testing.T) {
+	const keyInterval = 4
+	pictures := l2t2Pictures(6)
+	// 時間レイヤーは TL0 で上げられるが、空間レイヤーは次のキーフレームまで上げない
+	want := []svcLayer{{0, 0}, {0, 0}, {0, 1}, {0, 0}, {1, 0}, {0, 1}, {1, 1}}
+	// S1 を間引いている間は S0 に marker を付け直す
+	wantMarkers := []bool{true, true, true, false, true, false, true}
+
+	for _, c := range []struct {
+		name   string
+		parser layerParser
+		packet func(seq uint16, picture int, l svcLayer, keyframe bool) *rtp.Packet
+	}{
+		{"vp9", &vp9LayerParser{}, func(seq uint16, picture int, l svcLayer, keyframe bool) *rtp.Packet {
+			return vp9Packet(seq, uint16(picture), l, keyframe, false)
+		}},
+		{"vp9 flexible", &vp9LayerParser{}, func(seq uint16, picture int, l svcLayer, keyframe bool) *rtp.Packet {
+			return vp9Packet(seq, uint16(picture), l, keyframe, true)
+		}},
+		{"av1", newTestDependencyDescriptorParser(), func(seq uint16, picture int, l svcLayer, keyframe bool) *rtp.Packet {
+			return av1Packet(seq, uint16(picture), l, keyframe && l.spatial == 0)
+		}},
+	} {
+		layers, markers := forwardedLayers(t, c.parser, c.packet, pictures, keyInterval, 2)
+		if len(layers) != len(want) {
+			t.Fatalf("%s: forwarded %+v, want %+v", c.name, layers, want)
+		}
+		for i := range want {
+			if layers[i] != want[i] || markers[i] != wantMarkers[i] {
+				t.Errorf("%s: packet %d: %+v marker %t, want %+v marker %t", c.name, i, layers[i], markers[i], want[i], wantMarkers[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package rtc
 
 import (
+	"errors"
+	"io"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
 	"sync"
 	"time"
 
@@ -9,100 +13,260 @@ import (
 )
 
 const (
-	DISPATCH_KEYFRAME_INTERVAL           = 3 * time.Second
 	SYNC_PEER_CONNECTIONS_RETRY_INTERVAL = 3 * time.Second
 	SYNC_PEER_CONNECTIONS_ATTEMPT_LIMIT  = 25
 )
 
+var (
+	ErrTrackNotFound       = errors.New("track is not found")
+	ErrTrackNotOwned       = errors.New("track is not owned by the peer connection")
+	ErrTrackServerMuted    = errors.New("track is muted by the server")
+	ErrRoomFull            = errors.New("room is full")
+	ErrPublishersFull      = errors.New("room has too many publishers")
+	ErrRoomClosed          = errors.New("room is closed")
+	ErrRoomNotFound        = errors.New("room is not found")
+	ErrParticipantNotFound = errors.New("participant is not found")
+	ErrKicked              = errors.New("participant is kicked by the server")
+)
+
 type RTCEventType int
 
 const (
 	RTCEventTypeSyncSDP RTCEventType = iota
 	RTCEventTypeAddTrack
 	RTCEventTypeRemoveTrack
+	RTCEventTypeLeave
 )
 
 type RTCEventMessage struct {
 	Event      RTCEventType
-	LocalTrack *webrtc.TrackLocalStaticRTP
+	LocalTrack webrtc.TrackLocal
+	forwarder  *forwarder
+	// RTCEventTypeLeave で退出するピア
+	participant PeerConnectionID
 }
 
-type TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+type TrackLocals map[string]webrtc.TrackLocal
+
+type TrackStats struct {
+	Room          string `json:"room"`
+	TrackID       string `json:"track"`
+	Participant   string `json:"participant"`
+	Kind          string `json:"kind"`
+	Muted         bool   `json:"muted"`
+	NACKReceived  uint64 `json:"nack_received"`
+	Retransmitted uint64 `json:"retransmitted"`
+	CacheMissed   uint64 `json:"cache_missed"`
+}
 
 type TrackManager interface {
-	Join(p PeerConnection) chan<- RTCEventMessage
+	Join(p PeerConnection) (chan<- RTCEventMessage, error)
+	Publish(id PeerConnectionID, name string, closer io.Closer) (chan<- RTCEventMessage, error)
+	CanPublish(id PeerConnectionID) error
+	Kick(id PeerConnectionID) error
+	Mute(id PeerConnectionID, trackID string, muted bool) error
+	ServerMute(trackID string, muted bool) error
+	Stats() []TrackStats
+	Observe(o TrackObserver)
+	PublishedTrack(trackID string) (PublishedTrack, error)
+	Subscribe(trackID string, s TrackSink) error
+	Unsubscribe(trackID string, s TrackSink)
 }
 
 type manager struct {
+	room        string
+	options     RoomOptions
+	store       store.Store
+	instance    string
+	hook        webhook.Notifier
+	onClose     func(markClosed func() bool)
 	mux         sync.RWMutex
 	connections map[PeerConnectionID]PeerConnection
+	// Join で参加した、購読しない参加者も含めた参加者。参加者数の上限と空のルームの判定に使う
+	members map[PeerConnectionID]bool
+	// Publish で参加したサーバ内の参加者。ルームを閉じるときに nil でない closer を閉じる
+	publishers  map[PeerConnectionID]io.Closer
 	trackLocals TrackLocals
+	forwarders  map[string]*forwarder
+	observers   []TrackObserver
+
+	closed        bool
+	emptyTimer    *time.Timer
+	durationTimer *time.Timer
 }
 
-func newTrackManager() TrackManager {
+// newTrackManager は onClose をルームのポリシーで閉じたときに呼ぶ。
+// onClose はルームを一覧から取り除いてから markClosed を呼び、markClosed が false の場合は閉じ済みとして何もしない
+func newTrackManager(
+	room string,
+	o RoomOptions,
+	s store.Store,
+	instance string,
+	hook webhook.Notifier,
+	onClose func(markClosed func() bool),
+) TrackManager {
 	m := &manager{
+		room:        room,
+		options:     o,
+		store:       s,
+		instance:    instance,
+		hook:        hook,
+		onClose:     onClose,
 		mux:         sync.RWMutex{},
 		connections: make(map[PeerConnectionID]PeerConnection),
-		trackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+		members:     make(map[PeerConnectionID]bool),
+		publishers:  make(map[PeerConnectionID]io.Closer),
+		trackLocals: make(TrackLocals),
+		forwarders:  make(map[string]*forwarder),
 	}
 
-	go m.dispatchKeyframeWorker()
 	return m
 }
 
-func (m *manager) Join(p PeerConnection) chan<- RTCEventMessage {
-	join := func() {
+func (m *manager) Join(p PeerConnection) (chan<- RTCEventMessage, error) {
+	join := func() error {
 		m.mux.Lock()
 		defer m.mux.Unlock()
+
+		switch {
+		case m.closed:
+			return ErrRoomClosed
+		case m.options.MaxParticipants > 0 && len(m.members) >= m.options.MaxParticipants:
+			return ErrRoomFull
+		}
 		m.connections[p.ID()] = p
+		m.admit(p.ID(), nil, false)
+		return nil
+	}
+	if err := join(); err != nil {
+		return nil, err
+	}
+	m.notifyMutedTracks(p)
+	m.notifyParticipants(p)
+	name := ""
+	// サーバ内の参加者とトークンで参加した参加者は名前を持つ
+	switch p := p.(type) {
+	case *localPeer:
+		name = p.name
+	case *connection:
+		name = p.permission.Identity
+	}
+	return m.start(p.ID(), name, p.Logger()), nil
+}
+
+// Publish はトラックを購読しない参加者 (他ノードからの中継など) として、トラックの追加・削除だけを受け付ける。
+// サーバ側の参加者なので参加者数の上限は適用せず、配信していてもルームが空になったときの EmptyTimeout を止めない。
+// closer が nil でなければ、ルームを閉じるときに閉じる
+func (m *manager) Publish(id PeerConnectionID, name string, closer io.Closer) (chan<- RTCEventMessage, error) {
+	publish := func() error {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+
+		if m.closed {
+			return ErrRoomClosed
+		}
+		m.admit(id, closer, true)
+		// 参加者のいないルームに配信するだけでは、ルームを開いたままにしない
+		if len(m.members) == 0 && m.emptyTimer == nil {
+			m.startEmptyTimer()
+		}
+		return nil
+	}
+	if err := publish(); err != nil {
+		return nil, err
+	}
+	return m.start(id, name, participantLogger(m.logger(), name, id)), nil
+}
+
+// admit は参加者をルームに加える。publisher の場合は Publish で参加したサーバ内の参加者として加える。
+// m.mux を Lock した状態で呼ぶ
+func (m *manager) admit(id PeerConnectionID, closer io.Closer, publisher bool) {
+	if m.emptyTimer != nil && !publisher {
+		m.emptyTimer.Stop()
+		m.emptyTimer = nil
+	}
+	if len(m.members) == 0 && len(m.publishers) == 0 {
+		m.hook.Notify(webhook.Event{Event: webhook.EventTypeRoomStarted, Room: m.room})
+		if m.durationTimer == nil && m.options.MaxDuration > 0 && m.options.Upstream == "" {
+			m.durationTimer = time.AfterFunc(m.options.MaxDuration, m.close)
+		}
+	}
+	if publisher {
+		m.publishers[id] = closer
+	} else {
+		m.members[id] = true
+	}
+	m.notifyParticipant(EventTypeParticipantJoined, id)
+	m.hook.Notify(webhook.Event{
+		Event:       webhook.EventTypeParticipantJoined,
+		Room:        m.room,
+		Participant: id.String(),
+	})
+}
+
+// start は参加者のイベントを処理する worker を起動する。worker のログには logger を使う
+func (m *manager) start(id PeerConnectionID, name string, logger *zap.Logger) chan<- RTCEventMessage {
+	if err := m.store.PutParticipant(store.Participant{
+		ID:       id.String(),
+		Room:     m.room,
+		Name:     name,
+		Instance: m.instance,
+		JoinedAt: time.Now(),
+	}); err != nil {
+		logger.Warn("track manager: failed to store participant", zap.Error(err))
 	}
-	join()
 
 	ch := make(chan RTCEventMessage)
-	go m.rtcEventWorker(ch)
+	go m.rtcEventWorker(ch, logger)
 	return ch
 }
 
-func (m *manager) rtcEventWorker(ch chan RTCEventMessage) {
+// logger はルーム全体に関するログに使う。サーバが起動した後に差し替わるグローバルなロガーを、呼ぶたびに参照する
+func (m *manager) logger() *zap.Logger {
+	return RoomLogger(zap.L(), m.room)
+}
+
+// CanPublish は配信者数の上限を確かめる。すでに配信している参加者は追加のトラックを配信できる
+func (m *manager) CanPublish(id PeerConnectionID) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	if m.options.MaxPublishers == 0 {
+		return nil
+	}
+	publishers := map[PeerConnectionID]bool{}
+	for trackID := range m.forwarders {
+		publishers[m.forwarders[trackID].owner] = true
+	}
+	if !publishers[id] && len(publishers) >= m.options.MaxPublishers {
+		return ErrPublishersFull
+	}
+	return nil
+}
+
+func (m *manager) rtcEventWorker(ch chan RTCEventMessage, logger *zap.Logger) {
 	defer close(ch)
 	for {
 		msg := <-ch
 		switch msg.Event {
 		case RTCEventTypeSyncSDP:
-			zap.L().Info("rtc event worker: received sync sdp event")
+			logger.Info("rtc event worker: received sync sdp event")
 			m.syncSessionDescriptionBetweenPeers()
 		case RTCEventTypeAddTrack:
-			m.addTrackLocal(msg.LocalTrack)
+			m.addTrackLocal(msg.LocalTrack, msg.forwarder)
 		case RTCEventTypeRemoveTrack:
 			m.removeTrackLocal(msg.LocalTrack)
+		case RTCEventTypeLeave:
+			m.leave(msg.participant)
 		default:
-			zap.L().Warn("rtc event worker: received invalid message")
+			logger.Warn("rtc event worker: received invalid message")
 		}
 	}
 }
 
-func (m *manager) dispatchKeyframe() {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-
-	for id := range m.connections {
-		m.connections[id].DispatchKeyframeRequest()
-	}
-}
-
-func (m *manager) dispatchKeyframeWorker() {
-	ticker := time.NewTicker(DISPATCH_KEYFRAME_INTERVAL)
-	for range ticker.C {
-		m.dispatchKeyframe()
-	}
-}
-
 func (m *manager) syncSessionDescriptionBetweenPeers() {
 	m.mux.Lock()
-	defer func() {
-		m.mux.Unlock()
-		m.dispatchKeyframe()
-	}()
+	defer m.mux.Unlock()
 
 	synk := func() bool {
 		for id := range m.connections {
@@ -134,22 +298,309 @@ func (m *manager) syncSessionDescriptionBetweenPeers() {
 	}
 }
 
-func (m *manager) addTrackLocal(tr *webrtc.TrackLocalStaticRTP) {
-	m.mux.Lock()
-	defer func() {
-		m.mux.Unlock()
-		m.syncSessionDescriptionBetweenPeers()
+// Store への書き込みは他のインスタンスを待つことがあるので、m.mux を Unlock してから行う
+func (m *manager) addTrackLocal(tr webrtc.TrackLocal, f *forwarder) {
+	func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+
+		m.trackLocals[tr.ID()] = tr
+		if f != nil {
+			m.forwarders[tr.ID()] = f
+			m.notifyTrack(webhook.EventTypeTrackPublished, f)
+			for _, o := range m.observers {
+				m.observe(o, f)
+			}
+		}
 	}()
+	if f != nil {
+		m.putTrack(f)
+	}
+	m.syncSessionDescriptionBetweenPeers()
+}
+
+func (m *manager) removeTrackLocal(tr webrtc.TrackLocal) {
+	published := func() bool {
+		m.mux.Lock()
+		defer m.mux.Unlock()
 
-	m.trackLocals[tr.ID()] = tr
+		delete(m.trackLocals, tr.ID())
+		f, ok := m.forwarders[tr.ID()]
+		if ok {
+			delete(m.forwarders, tr.ID())
+			f.closeSinks()
+			m.notifyTrack(webhook.EventTypeTrackUnpublished, f)
+		}
+		return ok
+	}()
+	if published {
+		if err := m.store.DeleteTrack(m.room, tr.ID()); err != nil && !errors.Is(err, store.ErrTrackNotFound) {
+			m.logger().Warn("track manager: failed to delete track", zap.String("track", tr.ID()), zap.Error(err))
+		}
+	}
+	m.syncSessionDescriptionBetweenPeers()
 }
 
-func (m *manager) removeTrackLocal(tr *webrtc.TrackLocalStaticRTP) {
-	m.mux.Lock()
-	defer func() {
-		m.mux.Unlock()
-		m.syncSessionDescriptionBetweenPeers()
+func (m *manager) leave(id PeerConnectionID) {
+	func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+
+		delete(m.connections, id)
+		_, publisher := m.publishers[id]
+		if !m.members[id] && !publisher {
+			return
+		}
+		delete(m.members, id)
+		delete(m.publishers, id)
+		m.notifyParticipant(EventTypeParticipantLeft, id)
+		m.hook.Notify(webhook.Event{
+			Event:       webhook.EventTypeParticipantLeft,
+			Room:        m.room,
+			Participant: id.String(),
+		})
+		if len(m.members) == 0 && m.emptyTimer == nil {
+			m.startEmptyTimer()
+		}
 	}()
+	if err := m.store.DeleteParticipant(m.room, id.String()); err != nil && !errors.Is(err, store.ErrParticipantNotFound) {
+		m.logger().Warn("track manager: failed to delete participant", zap.Stringer("peer_connection_id", id), zap.Error(err))
+	}
+	m.syncSessionDescriptionBetweenPeers()
+}
+
+// startEmptyTimer は EmptyTimeout の後にルームを閉じるタイマーを始める。m.mux を Lock した状態で呼ぶ
+func (m *manager) startEmptyTimer() {
+	if m.closed || m.options.EmptyTimeout <= 0 || m.options.Upstream != "" {
+		return
+	}
+	m.emptyTimer = time.AfterFunc(m.options.EmptyTimeout, m.closeIfEmpty)
+}
+
+func (m *manager) closeIfEmpty() {
+	m.mux.RLock()
+	empty := len(m.members) == 0
+	m.mux.RUnlock()
 
-	delete(m.trackLocals, tr.ID())
+	if empty {
+		m.close()
+	}
+}
+
+// close はルームの全ての接続を切り、ルームを閉じる。
+// 中継するルームは上流の接続を保つために閉じない
+func (m *manager) close() {
+	var connections []PeerConnection
+	var publishers []io.Closer
+	closed := false
+	m.onClose(func() bool {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		if m.closed {
+			return false
+		}
+		m.closed = true
+		for _, t := range []*time.Timer{m.emptyTimer, m.durationTimer} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		connections = make([]PeerConnection, 0, len(m.connections))
+		for id := range m.connections {
+			connections = append(connections, m.connections[id])
+		}
+		publishers = make([]io.Closer, 0, len(m.publishers))
+		for id := range m.publishers {
+			if m.publishers[id] != nil {
+				publishers = append(publishers, m.publishers[id])
+			}
+		}
+		closed = true
+		return true
+	})
+	if !closed {
+		return
+	}
+
+	msg := NewErrorMessage(ErrorCodeRoomClosed, ErrRoomClosed)
+	for _, c := range connections {
+		if err := c.Notify(msg); err != nil {
+			c.Logger().Warn(err.Error())
+		}
+		if err := c.Close(); err != nil {
+			c.Logger().Warn(err.Error())
+		}
+	}
+	for _, c := range publishers {
+		if err := c.Close(); err != nil {
+			m.logger().Warn("track manager: failed to close publisher", zap.Error(err))
+		}
+	}
+	m.hook.Notify(webhook.Event{Event: webhook.EventTypeRoomFinished, Room: m.room})
+}
+
+// Kick は参加者に退出させられたことを伝えてから接続を切る。
+// Publish で参加したサーバ内の参加者は接続を持たないので対象にならない
+func (m *manager) Kick(id PeerConnectionID) error {
+	m.mux.RLock()
+	c, ok := m.connections[id]
+	m.mux.RUnlock()
+	if !ok {
+		return ErrParticipantNotFound
+	}
+
+	c.Logger().Info("kicked by the server")
+	if err := c.Notify(NewErrorMessage(ErrorCodeKicked, ErrKicked)); err != nil {
+		c.Logger().Warn(err.Error())
+	}
+	return c.Close()
+}
+
+func (m *manager) notifyTrack(typ webhook.EventType, f *forwarder) {
+	t := f.Metadata(m.room)
+	m.hook.Notify(webhook.Event{
+		Event:       typ,
+		Room:        m.room,
+		Participant: t.Participant,
+		Track:       &t,
+	})
+}
+
+func (m *manager) putTrack(f *forwarder) {
+	if err := m.store.PutTrack(f.Metadata(m.room)); err != nil {
+		m.logger().Warn("track manager: failed to store track", zap.String("track", f.ID()), zap.Error(err))
+	}
+}
+
+func (m *manager) Mute(id PeerConnectionID, trackID string, muted bool) error {
+	m.mux.RLock()
+	f, ok := m.forwarders[trackID]
+	m.mux.RUnlock()
+
+	switch {
+	case !ok:
+		return ErrTrackNotFound
+	case f.owner != id:
+		return ErrTrackNotOwned
+	case !muted && f.ServerMuted():
+		return ErrTrackServerMuted
+	}
+	if f.setMuted(muted, false) {
+		m.putTrack(f)
+		m.notifyTrackMuted(f)
+	}
+	return nil
+}
+
+func (m *manager) ServerMute(trackID string, muted bool) error {
+	m.mux.RLock()
+	f, ok := m.forwarders[trackID]
+	m.mux.RUnlock()
+
+	if !ok {
+		return ErrTrackNotFound
+	}
+	if f.setMuted(muted, true) {
+		m.putTrack(f)
+		m.notifyTrackMuted(f)
+	}
+	return nil
+}
+
+func (m *manager) Stats() []TrackStats {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	stats := make([]TrackStats, 0, len(m.forwarders))
+	for id := range m.forwarders {
+		stats = append(stats, m.forwarders[id].Stats())
+	}
+	return stats
+}
+
+type trackMutedMessage struct {
+	Event       EventType `json:"event"`
+	TrackID     string    `json:"track"`
+	Participant string    `json:"participant"`
+	Muted       bool      `json:"muted"`
+	ServerMuted bool      `json:"server_muted"`
+}
+
+func newTrackMutedMessage(f *forwarder) trackMutedMessage {
+	return trackMutedMessage{
+		Event:       EventTypeTrackMuted,
+		TrackID:     f.ID(),
+		Participant: f.owner.String(),
+		Muted:       f.Muted(),
+		ServerMuted: f.ServerMuted(),
+	}
+}
+
+func (m *manager) notifyTrackMuted(f *forwarder) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	msg := newTrackMutedMessage(f)
+	for id := range m.connections {
+		if err := m.connections[id].Notify(msg); err != nil {
+			m.connections[id].Logger().Warn(err.Error())
+		}
+	}
+}
+
+// 途中から参加したピアにも現在のミュート状態を伝える
+func (m *manager) notifyMutedTracks(p PeerConnection) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	for id := range m.forwarders {
+		f := m.forwarders[id]
+		if !f.Muted() {
+			continue
+		}
+		if err := p.Notify(newTrackMutedMessage(f)); err != nil {
+			p.Logger().Warn(err.Error())
+		}
+	}
+}
+
+type participantMessage struct {
+	Event       EventType `json:"event"`
+	Participant string    `json:"participant"`
+}
+
+// notifyParticipant は参加者の入退室を他のピアに伝える。m.mux を Lock した状態で呼ぶ
+func (m *manager) notifyParticipant(typ EventType, participant PeerConnectionID) {
+	msg := participantMessage{Event: typ, Participant: participant.String()}
+	for id := range m.connections {
+		if id == participant {
+			continue
+		}
+		if err := m.connections[id].Notify(msg); err != nil {
+			m.connections[id].Logger().Warn(err.Error())
+		}
+	}
+}
+
+// 途中から参加したピアにも、すでにいる参加者を伝える
+func (m *manager) notifyParticipants(p PeerConnection) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	ids := make([]PeerConnectionID, 0, len(m.members)+len(m.publishers))
+	for id := range m.members {
+		ids = append(ids, id)
+	}
+	for id := range m.publishers {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if id == p.ID() {
+			continue
+		}
+		msg := participantMessage{Event: EventTypeParticipantJoined, Participant: id.String()}
+		if err := p.Notify(msg); err != nil {
+			p.Logger().Warn(err.Error())
+		}
+	}
 }
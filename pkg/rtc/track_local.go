@@ -0,0 +1,285 @@
+package rtc
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// RTCP RR の fraction lost (1/256 単位) がこの値を超えたら RED を有効にし、下回ったら無効にする
+	RED_ENABLE_FRACTION_LOST  = 13
+	RED_DISABLE_FRACTION_LOST = 3
+)
+
+type trackBinding struct {
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+
+	// 購読者が RED をネゴシエートしていない場合は 0
+	redPayloadType webrtc.PayloadType
+	red            atomic.Bool
+
+	layers *layerSelector
+	// ルームの送信予算を超えて映像を止めている。WriteRTP を呼ぶ goroutine からのみ触る
+	paused bool
+}
+
+// trackLocal は TrackLocalStaticRTP に送信済みパケットのキャッシュを持たせ、
+// 購読者からの NACK に SFU 自身が再送で応答できるようにする。
+// 購読者ごとに送り方を変えられるよう、パケットの書き込みは自前で行う
+type trackLocal struct {
+	*webrtc.TrackLocalStaticRTP
+
+	keyframe    func(keyframeRequestType)
+	adaptiveRED bool
+	parser      layerParser
+	budget      *egressBudget
+	cache       *packetCache
+	mux         sync.RWMutex
+	bindings    map[webrtc.SSRC]*trackBinding
+
+	// WriteRTP を呼ぶ goroutine からのみ触る
+	redHistory []redHistory
+	// 送信を再開するためにキーフレームを最後に要求した時刻。WriteRTP を呼ぶ goroutine からのみ触る
+	resumeRequestedAt time.Time
+
+	nackReceived  atomic.Uint64
+	retransmitted atomic.Uint64
+	cacheMissed   atomic.Uint64
+}
+
+func newTrackLocal(
+	t *webrtc.TrackLocalStaticRTP,
+	keyframe func(keyframeRequestType),
+	adaptiveRED bool,
+	parser layerParser,
+	budget *egressBudget,
+) *trackLocal {
+	return &trackLocal{
+		TrackLocalStaticRTP: t,
+		keyframe:            keyframe,
+		adaptiveRED:         adaptiveRED && strings.EqualFold(t.Codec().MimeType, webrtc.MimeTypeOpus),
+		parser:              parser,
+		budget:              budget,
+		cache:               newPacketCache(),
+		mux:                 sync.RWMutex{},
+		bindings:            make(map[webrtc.SSRC]*trackBinding),
+	}
+}
+
+func (t *trackLocal) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	// コーデックの照合は TrackLocalStaticRTP に任せる
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+
+	b := &trackBinding{
+		ssrc:        ctx.SSRC(),
+		payloadType: codec.PayloadType,
+		writeStream: ctx.WriteStream(),
+		layers:      newLayerSelector(),
+	}
+	if t.adaptiveRED {
+		for _, c := range ctx.CodecParameters() {
+			if strings.EqualFold(c.MimeType, mimeTypeAudioRED) {
+				b.redPayloadType = c.PayloadType
+			}
+		}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.bindings[ctx.SSRC()] = b
+
+	// 新しい購読者がすぐに映像をデコードできるようにする
+	go t.keyframe(keyframeRequestTypeFIR)
+	return codec, nil
+}
+
+func (t *trackLocal) Unbind(ctx webrtc.TrackLocalContext) error {
+	func() {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		delete(t.bindings, ctx.SSRC())
+	}()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+func (t *trackLocal) WriteRTP(pkt *rtp.Packet) error {
+	t.cache.Push(pkt)
+	defer t.pushREDHistory(pkt)
+
+	var li layerInfo
+	hasLayer := false
+	if t.parser != nil {
+		li, hasLayer = t.parser.Parse(pkt)
+	}
+	mimeType := t.Codec().MimeType
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	errs := []error{}
+	for _, b := range t.bindings {
+		if !t.admit(b, pkt, mimeType) {
+			b.layers.skip()
+			continue
+		}
+		header, m, ok := b.layers.forward(pkt, li, hasLayer)
+		if !ok {
+			continue
+		}
+		header.SSRC = uint32(b.ssrc)
+		header.PayloadType = uint8(b.payloadType)
+		payload := rewritePictureID(mimeType, packetPayload(pkt), m)
+
+		if b.red.Load() {
+			header.PayloadType = uint8(b.redPayloadType)
+			payload = encodeRED(uint8(b.payloadType), pkt, t.redHistory)
+		}
+		if _, err := b.writeStream.WriteRTP(&header, payload); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// admit はルームの送信予算からパケットを送れるかどうかを決める。
+// 音声は常に送り、映像は予算が尽きたら止めて、回復した後にキーフレームから再開する
+func (t *trackLocal) admit(b *trackBinding, pkt *rtp.Packet, mimeType string) bool {
+	if t.budget == nil {
+		return true
+	}
+	n := len(pkt.Payload)
+	if t.Kind() != webrtc.RTPCodecTypeVideo {
+		return t.budget.Take(n, true)
+	}
+
+	if b.paused {
+		if !t.budget.Allow(n) {
+			return false
+		}
+		if !isKeyframe(mimeType, pkt.Payload) {
+			// キーフレームが届くまでの間、パケットごとに goroutine を作らないよう間引く
+			if now := time.Now(); now.Sub(t.resumeRequestedAt) >= KEYFRAME_REQUEST_MIN_INTERVAL {
+				t.resumeRequestedAt = now
+				go t.keyframe(keyframeRequestTypePLI)
+			}
+			return false
+		}
+		b.paused = false
+	}
+	if !t.budget.Take(n, false) {
+		b.paused = true
+		return false
+	}
+	return true
+}
+
+func (t *trackLocal) pushREDHistory(pkt *rtp.Packet) {
+	if !t.adaptiveRED || len(pkt.Payload) == 0 {
+		return
+	}
+
+	t.redHistory = append(t.redHistory, redHistory{
+		timestamp: pkt.Timestamp,
+		payload:   pkt.Payload,
+	})
+	if len(t.redHistory) > RED_DISTANCE {
+		t.redHistory = t.redHistory[len(t.redHistory)-RED_DISTANCE:]
+	}
+}
+
+// reportLoss は購読者の受信レポートからパケットロス率を受け取り、RED の有効・無効を切り替える
+func (t *trackLocal) reportLoss(ssrc uint32, fractionLost uint8) {
+	t.mux.RLock()
+	b, ok := t.bindings[webrtc.SSRC(ssrc)]
+	t.mux.RUnlock()
+	if !ok || b.redPayloadType == 0 {
+		return
+	}
+
+	switch {
+	case fractionLost >= RED_ENABLE_FRACTION_LOST:
+		b.red.Store(true)
+	case fractionLost <= RED_DISABLE_FRACTION_LOST:
+		b.red.Store(false)
+	}
+}
+
+// retransmit は NACK で要求されたパケットを要求元の購読者にだけ再送する
+func (t *trackLocal) retransmit(nack *rtcp.TransportLayerNack) {
+	t.mux.RLock()
+	b, ok := t.bindings[webrtc.SSRC(nack.MediaSSRC)]
+	t.mux.RUnlock()
+	if !ok {
+		return
+	}
+
+	mimeType := t.Codec().MimeType
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			t.nackReceived.Add(1)
+			m, ok := b.layers.source(seq)
+			if !ok {
+				t.cacheMissed.Add(1)
+				continue
+			}
+			pkt, ok := t.cache.Get(m.source)
+			if !ok {
+				t.cacheMissed.Add(1)
+				continue
+			}
+
+			header := pkt.Header.Clone()
+			header.SSRC = uint32(b.ssrc)
+			header.PayloadType = uint8(b.payloadType)
+			header.SequenceNumber = m.seq
+			header.Marker = m.marker
+			payload := rewritePictureID(mimeType, packetPayload(pkt), m)
+			if _, err := b.writeStream.WriteRTP(&header, payload); err != nil {
+				return
+			}
+			t.retransmitted.Add(1)
+		}
+	}
+}
+
+// setTargetLayer は購読者に転送するレイヤーの上限を変更する
+func (t *trackLocal) setTargetLayer(ssrc webrtc.SSRC, spatial, temporal uint8) error {
+	t.mux.RLock()
+	b, ok := t.bindings[ssrc]
+	t.mux.RUnlock()
+	if !ok {
+		return ErrTrackNotFound
+	}
+
+	// 上位の空間レイヤーに切り替えるにはキーフレームが必要
+	if b.layers.SetTarget(spatial, temporal) {
+		t.keyframe(keyframeRequestTypePLI)
+	}
+	return nil
+}
+
+// packetPayload はパディングを含めたペイロードを返す。
+// rtp.Packet の Payload からはパディングが取り除かれているので、ヘッダと食い違わないように戻す
+func packetPayload(pkt *rtp.Packet) []byte {
+	if !pkt.Header.Padding || pkt.PaddingSize == 0 {
+		return pkt.Payload
+	}
+
+	payload := make([]byte, len(pkt.Payload)+int(pkt.PaddingSize))
+	copy(payload, pkt.Payload)
+	payload[len(payload)-1] = pkt.PaddingSize
+	return payload
+}
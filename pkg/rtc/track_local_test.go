@@ -0,0 +1,152 @@
+package rtc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestAdmitThrottlesKeyframeRequestsWhilePaused(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	static, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	track := newTrackLocal(static, func(keyframeRequestType) {
+		requests.Add(1)
+	}, false, nil, newEgressBudget(10_000_000))
+	b := &trackBinding{paused: true}
+
+	// S bit を立てたインターフレーム
+	interframe := &rtp.Packet{Payload: []byte{0x10, 0x01, 0x00, 0x00}}
+	for i := 0; i < 1000; i++ {
+		if track.admit(b, interframe, webrtc.MimeTypeVP8) {
+			t.Fatalf("packet %d: interframe admitted while paused", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d keyframe requests, want 1", n)
+	}
+
+	keyframe := &rtp.Packet{Payload: []byte{0x10, 0x00, 0x00, 0x00}}
+	if !track.admit(b, keyframe, webrtc.MimeTypeVP8) {
+		t.Error("keyframe is not admitted")
+	}
+	if b.paused {
+		t.Error("binding is still paused after a keyframe")
+	}
+}
+
+// recordingWriter は購読者の TrackLocalWriter として書き込まれたパケットを記録する
+type recordingWriter struct {
+	pkts []*rtp.Packet
+}
+
+func (w *recordingWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.pkts = append(w.pkts, &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)})
+	return len(payload), nil
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	w.pkts = append(w.pkts, pkt)
+	return len(b), nil
+}
+
+func TestRetransmitMapsRewrittenSequenceToSource(t *testing.T) {
+	const ssrc = 1234
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	static, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := newTrackLocal(static, func(keyframeRequestType) {}, false, vp8LayerParser{}, nil)
+	w := &recordingWriter{}
+	b := &trackBinding{ssrc: ssrc, payloadType: 96, writeStream: w, layers: newLayerSelector()}
+	// TL1 を間引くので、購読者に送るシーケンス番号は元の番号から詰められる
+	b.layers.SetTarget(MAX_LAYER, 0)
+	track.bindings[ssrc] = b
+
+	// シーケンス番号の折り返しをまたいで TL0 と TL1 を交互に送る
+	sources := []uint16{65534, 65535, 0, 1, 2}
+	for i, seq := range sources {
+		tid := uint8(i % 2)
+		if err := track.WriteRTP(vp8TemporalPacket(seq, uint16(10+i), 0, tid, i == 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.pkts) != 3 {
+		t.Fatalf("%d packets forwarded, want 3", len(w.pkts))
+	}
+	forwarded := w.pkts
+	w.pkts = nil
+
+	// 65535 と 0 は購読者に送った番号で、元の 0 と 2 に対応する。100 は送っていない
+	track.retransmit(&rtcp.TransportLayerNack{
+		MediaSSRC: ssrc,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{65535, 0, 100}),
+	})
+	if len(w.pkts) != 2 {
+		t.Fatalf("%d packets retransmitted, want 2", len(w.pkts))
+	}
+	for i, want := range forwarded[1:] {
+		got := w.pkts[i]
+		if got.SequenceNumber != want.SequenceNumber || got.SSRC != ssrc || got.PayloadType != 96 {
+			t.Errorf("retransmission %d: seq %d, ssrc %d, pt %d, want %d, %d, 96",
+				i, got.SequenceNumber, got.SSRC, got.PayloadType, want.SequenceNumber, ssrc)
+		}
+		// ピクチャ ID も転送したときと同じく詰められている
+		p, q := &codecs.VP8Packet{}, &codecs.VP8Packet{}
+		if _, err := p.Unmarshal(got.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Unmarshal(want.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if p.PictureID != q.PictureID {
+			t.Errorf("retransmission %d: picture id %d, want %d", i, p.PictureID, q.PictureID)
+		}
+	}
+	if n := track.nackReceived.Load(); n != 3 {
+		t.Errorf("nackReceived: %d, want 3", n)
+	}
+	if n := track.retransmitted.Load(); n != 2 {
+		t.Errorf("retransmitted: %d, want 2", n)
+	}
+	if n := track.cacheMissed.Load(); n != 1 {
+		t.Errorf("cacheMissed: %d, want 1", n)
+	}
+
+	// 対応は残っていても、元のパケットがキャッシュから追い出されていれば再送しない
+	w.pkts = nil
+	track.cache.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2 + PACKET_CACHE_SIZE}})
+	track.retransmit(&rtcp.TransportLayerNack{
+		MediaSSRC: ssrc,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{0}),
+	})
+	if len(w.pkts) != 0 {
+		t.Errorf("%d packets retransmitted after eviction, want 0", len(w.pkts))
+	}
+	if n := track.cacheMissed.Load(); n != 2 {
+		t.Errorf("cacheMissed after eviction: %d, want 2", n)
+	}
+
+	// 別の購読者宛ての NACK は数えない
+	track.retransmit(&rtcp.TransportLayerNack{
+		MediaSSRC: ssrc + 1,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{65534}),
+	})
+	if n := track.nackReceived.Load(); n != 4 {
+		t.Errorf("nackReceived after unknown ssrc: %d, want 4", n)
+	}
+}
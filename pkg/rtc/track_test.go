@@ -0,0 +1,98 @@
+package rtc
+
+import (
+	"errors"
+	"ruyka/pkg/store"
+	"ruyka/pkg/webhook"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/xid"
+)
+
+func newTestRTC(t *testing.T, o RoomOptions) RTC {
+	t.Helper()
+	o.Codecs = DefaultCodecPolicy
+	r, err := NewAPI(&webrtc.SettingEngine{}, &webrtc.Configuration{}, o, nil, store.NewMemoryStore(), "node-1", webhook.New(nil, "", time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestLocalParticipantLeavesWhenRoomCloses(t *testing.T) {
+	r := newTestRTC(t, RoomOptions{MaxDuration: 50 * time.Millisecond})
+	p, err := r.NewLocalParticipant("room", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.NewTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("local participant is not closed after max_duration")
+	}
+	if _, err := p.NewTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}, "audio", "stream"); !errors.Is(err, ErrPeerConnClosed) {
+		t.Errorf("NewTrack: %v, want ErrPeerConnClosed", err)
+	}
+}
+
+func TestPublishRejectsClosedRoom(t *testing.T) {
+	m := newTrackManager("room", RoomOptions{}, store.NewMemoryStore(), "node-1", webhook.New(nil, "", time.Second), func(markClosed func() bool) {
+		markClosed()
+	}).(*manager)
+	m.close()
+
+	if _, err := m.Publish(PeerConnectionID(xid.New()), "ingest", nil); !errors.Is(err, ErrRoomClosed) {
+		t.Errorf("Publish: %v, want ErrRoomClosed", err)
+	}
+}
+
+func TestLocalParticipantsDoNotCountAsMembers(t *testing.T) {
+	r := newTestRTC(t, RoomOptions{MaxParticipants: 1})
+	for _, name := range []string{"relay", "ingest"} {
+		if _, err := r.NewLocalParticipant("room", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.JoinLocalParticipant("room", "viewer"); err != nil {
+		t.Fatalf("JoinLocalParticipant: %v, want the server-side publishers not to take the slot", err)
+	}
+	if _, err := r.JoinLocalParticipant("room", "other"); !errors.Is(err, ErrRoomFull) {
+		t.Errorf("JoinLocalParticipant: %v, want ErrRoomFull", err)
+	}
+}
+
+func TestEmptyTimeoutClosesRoomWithOnlyLocalParticipants(t *testing.T) {
+	r := newTestRTC(t, RoomOptions{EmptyTimeout: 50 * time.Millisecond})
+	ingest, err := r.NewLocalParticipant("room", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := r.JoinLocalParticipant("room", "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 参加者がいる間は閉じない
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-ingest.Done():
+		t.Fatal("room is closed while a member is in it")
+	default:
+	}
+
+	if err := viewer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ingest.Done():
+	case <-time.After(time.Second):
+		t.Fatal("room with only an idle ingest is not closed after empty_timeout")
+	}
+}
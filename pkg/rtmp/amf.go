@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// ref: https://rtmp.veriskope.com/pdf/amf0-file-format-specification.pdf
+// コマンドメッセージの読み書きに必要な型だけを扱う
+
+var (
+	ErrUnsupportedAMF0Type = errors.New("unsupported amf0 type")
+	ErrAMF0TooDeep         = errors.New("amf0 value is nested too deeply")
+)
+
+// 入れ子になったオブジェクトと配列の深さの上限。コマンドは数段しか使わない
+const AMF0_MAX_DEPTH = 32
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+)
+
+// decodeAMF0 は値を float64, bool, string, map[string]interface{}, []interface{}, nil のいずれかで返す。
+// depth は入れ子の深さで、悪意のある入力でスタックを使い切らないよう AMF0_MAX_DEPTH で打ち切る
+func decodeAMF0(r *bytes.Reader, depth int) (interface{}, error) {
+	if depth > AMF0_MAX_DEPTH {
+		return nil, ErrAMF0TooDeep
+	}
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case amf0Number:
+		var v uint64
+		if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amf0String:
+		return readAMF0String(r, 2)
+	case amf0LongString:
+		return readAMF0String(r, 4)
+	case amf0Object:
+		return readAMF0Properties(r, depth+1)
+	case amf0ECMAArray:
+		// 要素数は当てにならないので終端まで読む
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return readAMF0Properties(r, depth+1)
+	case amf0StrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		values := []interface{}{}
+		for i := uint32(0); i < n; i++ {
+			v, err := decodeAMF0(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case amf0Date:
+		// 8 バイトの時刻と 2 バイトのタイムゾーン
+		var v uint64
+		if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(2, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case amf0Null, amf0Undefined:
+		return nil, nil
+	default:
+		return nil, ErrUnsupportedAMF0Type
+	}
+}
+
+func readAMF0String(r *bytes.Reader, lengthSize int) (string, error) {
+	header := make([]byte, lengthSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	n := 0
+	for _, b := range header {
+		n = n<<8 | int(b)
+	}
+	if n > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func readAMF0Properties(r *bytes.Reader, depth int) (map[string]interface{}, error) {
+	properties := map[string]interface{}{}
+	for {
+		key, err := readAMF0String(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			end, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if end == amf0ObjectEnd {
+				return properties, nil
+			}
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+		}
+		v, err := decodeAMF0(r, depth)
+		if err != nil {
+			return nil, err
+		}
+		properties[key] = v
+	}
+}
+
+// decodeAMF0Values はメッセージ本文に並んだ値を全て読む
+func decodeAMF0Values(payload []byte) ([]interface{}, error) {
+	r := bytes.NewReader(payload)
+	values := []interface{}{}
+	for r.Len() > 0 {
+		v, err := decodeAMF0(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func encodeAMF0(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case float64:
+		buf.WriteByte(amf0Number)
+		return binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		return encodeAMF0(buf, float64(v))
+	case bool:
+		buf.WriteByte(amf0Boolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		buf.WriteByte(amf0String)
+		writeAMF0String(buf, v)
+	case map[string]interface{}:
+		buf.WriteByte(amf0Object)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeAMF0String(buf, key)
+			if err := encodeAMF0(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		writeAMF0String(buf, "")
+		buf.WriteByte(amf0ObjectEnd)
+	case nil:
+		buf.WriteByte(amf0Null)
+	default:
+		return ErrUnsupportedAMF0Type
+	}
+	return nil
+}
+
+func writeAMF0String(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s) >> 8))
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
+
+func encodeAMF0Values(values ...interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, v := range values {
+		if err := encodeAMF0(buf, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
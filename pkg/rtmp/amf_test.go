@@ -0,0 +1,101 @@
+package rtmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	values := []interface{}{
+		"connect",
+		1.0,
+		map[string]interface{}{
+			"app":      "live",
+			"tcUrl":    "rtmp://localhost/live",
+			"fpad":     false,
+			"audio":    map[string]interface{}{"codecs": 3191.0},
+			"metadata": nil,
+		},
+		nil,
+		true,
+	}
+	payload, err := encodeAMF0Values(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeAMF0Values(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("decoded %#v, want %#v", got, values)
+	}
+}
+
+func TestDecodeAMF0Types(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+		want    interface{}
+	}{
+		{"long string", []byte{amf0LongString, 0, 0, 0, 2, 'o', 'k'}, "ok"},
+		{"undefined", []byte{amf0Undefined}, nil},
+		{"ecma array", []byte{amf0ECMAArray, 0, 0, 0, 9, 0, 1, 'a', amf0Boolean, 1, 0, 0, amf0ObjectEnd}, map[string]interface{}{"a": true}},
+		{"strict array", []byte{amf0StrictArray, 0, 0, 0, 2, amf0Null, amf0Boolean, 0}, []interface{}{nil, false}},
+		{"date", []byte{amf0Date, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0.0},
+	}
+	for _, c := range cases {
+		values, err := decodeAMF0Values(c.payload)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(values) != 1 || !reflect.DeepEqual(values[0], c.want) {
+			t.Errorf("%s: %#v, want %#v", c.name, values, c.want)
+		}
+	}
+}
+
+func TestDecodeAMF0RejectsMalformedInput(t *testing.T) {
+	nested := []byte{}
+	for i := 0; i <= AMF0_MAX_DEPTH+1; i++ {
+		nested = append(nested, amf0StrictArray, 0, 0, 0, 1)
+	}
+	nested = append(nested, amf0Null)
+
+	cases := []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{"unsupported type", []byte{0x11}, ErrUnsupportedAMF0Type},
+		{"string longer than payload", []byte{amf0String, 0xff, 0xff, 'a'}, nil},
+		{"long string longer than payload", []byte{amf0LongString, 0x7f, 0xff, 0xff, 0xff}, nil},
+		{"object without end", []byte{amf0Object, 0, 1, 'a', amf0Null}, nil},
+		{"strict array shorter than count", []byte{amf0StrictArray, 0xff, 0xff, 0xff, 0xff, amf0Null}, nil},
+		{"ecma array without count", []byte{amf0ECMAArray, 0, 0}, nil},
+		{"nested too deeply", nested, ErrAMF0TooDeep},
+	}
+	for _, c := range cases {
+		_, err := decodeAMF0Values(c.payload)
+		switch {
+		case err == nil:
+			t.Errorf("%s: decoded", c.name)
+		case c.want != nil && !errors.Is(err, c.want):
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	// 途中で切れたコマンドはパニックせずにエラーになる。値の境目で切れた場合だけ読める
+	payload, err := encodeAMF0Values("connect", 1.0, map[string]interface{}{"app": "live", "tcUrl": "rtmp://localhost/live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundaries := map[int]bool{0: true, 10: true, 19: true}
+	for n := 0; n < len(payload); n++ {
+		if _, err := decodeAMF0Values(payload[:n]); (err == nil) != boundaries[n] {
+			t.Errorf("%d bytes: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ref: https://rtmp.veriskope.com/docs/spec/#53chunking
+
+var ErrInvalidChunk = errors.New("invalid rtmp chunk")
+
+const (
+	DEFAULT_CHUNK_SIZE = 128
+	// 受け付けるメッセージの大きさの上限
+	MAX_MESSAGE_SIZE = 16 << 20
+
+	extendedTimestamp = 0xffffff
+)
+
+const (
+	messageTypeSetChunkSize     = 1
+	messageTypeAbort            = 2
+	messageTypeAcknowledgement  = 3
+	messageTypeUserControl      = 4
+	messageTypeWindowAckSize    = 5
+	messageTypeSetPeerBandwidth = 6
+	messageTypeAudio            = 8
+	messageTypeVideo            = 9
+	messageTypeDataAMF3         = 15
+	messageTypeCommandAMF3      = 17
+	messageTypeDataAMF0         = 18
+	messageTypeCommandAMF0      = 20
+)
+
+type message struct {
+	typ       uint8
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool
+
+	payload []byte
+}
+
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStream
+	// Acknowledgement を返すために読んだバイト数を数える
+	bytesRead uint32
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{
+		r:         bufio.NewReader(r),
+		chunkSize: DEFAULT_CHUNK_SIZE,
+		streams:   make(map[uint32]*chunkStream),
+	}
+}
+
+func (c *chunkReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	c.bytesRead += uint32(n)
+	return buf, nil
+}
+
+func readUint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// readMessage はチャンクを読み進め、組み上がったメッセージを返す
+func (c *chunkReader) readMessage() (*message, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+func (c *chunkReader) readChunk() (*message, error) {
+	b, err := c.read(1)
+	if err != nil {
+		return nil, err
+	}
+	format := b[0] >> 6
+	csid := uint32(b[0] & 0x3f)
+	switch csid {
+	case 0:
+		b, err := c.read(1)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0])
+	case 1:
+		b, err := c.read(2)
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	s, ok := c.streams[csid]
+	if !ok {
+		if format != 0 {
+			return nil, ErrInvalidChunk
+		}
+		s = &chunkStream{}
+		c.streams[csid] = s
+	}
+
+	// 新しいメッセージの先頭かどうか。fmt 3 は前のメッセージの続きか、同じヘッダの新しいメッセージ
+	start := len(s.payload) == 0
+	var timestamp uint32
+	switch format {
+	case 0:
+		h, err := c.read(11)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = readUint24(h[0:3])
+		s.length = readUint24(h[3:6])
+		s.typ = h[6]
+		s.streamID = binary.LittleEndian.Uint32(h[7:11])
+	case 1:
+		h, err := c.read(7)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = readUint24(h[0:3])
+		s.length = readUint24(h[3:6])
+		s.typ = h[6]
+	case 2:
+		h, err := c.read(3)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = readUint24(h[0:3])
+	case 3:
+		timestamp = s.delta
+	}
+	if format != 3 {
+		s.extended = timestamp == extendedTimestamp
+	}
+	if s.extended {
+		h, err := c.read(4)
+		if err != nil {
+			return nil, err
+		}
+		// fmt 3 の拡張タイムスタンプは前のヘッダの値の繰り返しなので、差分には前のヘッダの差分を使う
+		if format != 3 {
+			timestamp = binary.BigEndian.Uint32(h)
+		}
+	}
+	if format != 0 && format != 3 && !start {
+		return nil, ErrInvalidChunk
+	}
+	if start {
+		if format == 0 {
+			s.timestamp = timestamp
+			s.delta = 0
+		} else {
+			s.delta = timestamp
+			s.timestamp += timestamp
+		}
+	}
+	if s.length > MAX_MESSAGE_SIZE {
+		return nil, ErrInvalidChunk
+	}
+
+	n := s.length - uint32(len(s.payload))
+	if n > c.chunkSize {
+		n = c.chunkSize
+	}
+	body, err := c.read(int(n))
+	if err != nil {
+		return nil, err
+	}
+	s.payload = append(s.payload, body...)
+	if uint32(len(s.payload)) < s.length {
+		return nil, nil
+	}
+
+	msg := &message{
+		typ:       s.typ,
+		streamID:  s.streamID,
+		timestamp: s.timestamp,
+		payload:   s.payload,
+	}
+	s.payload = nil
+	return msg, nil
+}
+
+type chunkWriter struct {
+	mux       sync.Mutex
+	w         *bufio.Writer
+	chunkSize uint32
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		mux:       sync.Mutex{},
+		w:         bufio.NewWriter(w),
+		chunkSize: DEFAULT_CHUNK_SIZE,
+	}
+}
+
+// writeMessage は最初のチャンクを fmt 0、続きを fmt 3 で書き出す。csid は 2 から 63 まで
+func (c *chunkWriter) writeMessage(csid uint8, msg *message) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	timestamp := msg.timestamp
+	extended := timestamp >= extendedTimestamp
+	if extended {
+		timestamp = extendedTimestamp
+	}
+
+	header := []byte{
+		csid & 0x3f,
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(len(msg.payload) >> 16), byte(len(msg.payload) >> 8), byte(len(msg.payload)),
+		msg.typ,
+		0, 0, 0, 0,
+	}
+	binary.LittleEndian.PutUint32(header[8:12], msg.streamID)
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, msg.timestamp)
+	}
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	payload := msg.payload
+	for {
+		n := len(payload)
+		if n > int(c.chunkSize) {
+			n = int(c.chunkSize)
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+
+		continuation := []byte{0xc0 | csid&0x3f}
+		if extended {
+			continuation = binary.BigEndian.AppendUint32(continuation, msg.timestamp)
+		}
+		if _, err := c.w.Write(continuation); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,172 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	cases := []struct {
+		name      string
+		chunkSize uint32
+		msg       message
+	}{
+		{"single chunk", DEFAULT_CHUNK_SIZE, message{typ: messageTypeVideo, streamID: 1, timestamp: 1000, payload: testPayload(100)}},
+		{"exact chunk size", DEFAULT_CHUNK_SIZE, message{typ: messageTypeVideo, streamID: 1, timestamp: 1000, payload: testPayload(DEFAULT_CHUNK_SIZE)}},
+		{"continuations", DEFAULT_CHUNK_SIZE, message{typ: messageTypeAudio, streamID: 1, timestamp: 20, payload: testPayload(1000)}},
+		{"large chunk size", SERVER_CHUNK_SIZE, message{typ: messageTypeVideo, streamID: 1, timestamp: 40, payload: testPayload(10000)}},
+		// fmt 3 の続きのチャンクにも拡張タイムスタンプが付く
+		{"extended timestamp", DEFAULT_CHUNK_SIZE, message{typ: messageTypeVideo, streamID: 1, timestamp: 0x01000000, payload: testPayload(300)}},
+		{"empty", DEFAULT_CHUNK_SIZE, message{typ: messageTypeCommandAMF0}},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		w := newChunkWriter(buf)
+		w.chunkSize = c.chunkSize
+		if err := w.writeMessage(csidStream, &c.msg); err != nil {
+			t.Fatal(err)
+		}
+		r := newChunkReader(buf)
+		r.chunkSize = c.chunkSize
+		msg, err := r.readMessage()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if msg.typ != c.msg.typ || msg.streamID != c.msg.streamID || msg.timestamp != c.msg.timestamp || !bytes.Equal(msg.payload, c.msg.payload) {
+			t.Errorf("%s: message %d %d %d (%d bytes), want %d %d %d (%d bytes)", c.name,
+				msg.typ, msg.streamID, msg.timestamp, len(msg.payload),
+				c.msg.typ, c.msg.streamID, c.msg.timestamp, len(c.msg.payload))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", c.name, buf.Len())
+		}
+	}
+}
+
+func TestChunkReaderFollowsChunkSizeChanges(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := newChunkWriter(buf)
+	first := &message{typ: messageTypeVideo, streamID: 1, timestamp: 0, payload: testPayload(300)}
+	second := &message{typ: messageTypeVideo, streamID: 1, timestamp: 33, payload: testPayload(3000)}
+	if err := w.writeMessage(csidStream, first); err != nil {
+		t.Fatal(err)
+	}
+	w.chunkSize = SERVER_CHUNK_SIZE
+	if err := w.writeMessage(csidStream, second); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newChunkReader(buf)
+	for i, want := range []*message{first, second} {
+		msg, err := r.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.payload, want.payload) || msg.timestamp != want.timestamp {
+			t.Errorf("message %d: %d bytes at %d, want %d bytes at %d", i, len(msg.payload), msg.timestamp, len(want.payload), want.timestamp)
+		}
+		// Set Chunk Size を受け取ったセッションと同じく、次のメッセージから大きさを変える
+		r.chunkSize = SERVER_CHUNK_SIZE
+	}
+}
+
+// chunkHeader は csid 5 の fmt 0 から 3 のヘッダを作る。timestamp が 0xffffff 以上なら拡張タイムスタンプを付ける
+func chunkHeader(format uint8, timestamp uint32, length int, typ uint8) []byte {
+	h := []byte{format<<6 | csidStream}
+	field := timestamp
+	if timestamp >= extendedTimestamp {
+		field = extendedTimestamp
+	}
+	switch format {
+	case 0:
+		h = append(h, byte(field>>16), byte(field>>8), byte(field), byte(length>>16), byte(length>>8), byte(length), typ)
+		h = binary.LittleEndian.AppendUint32(h, 1)
+	case 1:
+		h = append(h, byte(field>>16), byte(field>>8), byte(field), byte(length>>16), byte(length>>8), byte(length), typ)
+	case 2:
+		h = append(h, byte(field>>16), byte(field>>8), byte(field))
+	}
+	if timestamp >= extendedTimestamp {
+		h = binary.BigEndian.AppendUint32(h, timestamp)
+	}
+	return h
+}
+
+func TestChunkReaderTimestamps(t *testing.T) {
+	const ext = 0x01000000
+	cases := []struct {
+		name   string
+		chunks [][]byte
+		want   []uint32
+	}{
+		{"deltas", [][]byte{
+			append(chunkHeader(0, 1000, 1, messageTypeAudio), 0),
+			append(chunkHeader(1, 20, 1, messageTypeAudio), 0),
+			append(chunkHeader(2, 30, 0, 0), 0),
+			// fmt 3 の新しいメッセージは直前の差分を繰り返す
+			append(chunkHeader(3, 0, 0, 0), 0),
+		}, []uint32{1000, 1020, 1050, 1080}},
+		{"extended absolute", [][]byte{
+			append(chunkHeader(0, ext, 1, messageTypeAudio), 0),
+			// fmt 0 の後の fmt 3 は同じタイムスタンプのメッセージで、拡張タイムスタンプは繰り返しにすぎない
+			append(chunkHeader(3, ext, 0, 0), 0),
+		}, []uint32{ext, ext}},
+		{"extended delta", [][]byte{
+			append(chunkHeader(0, 0, 1, messageTypeAudio), 0),
+			append(chunkHeader(2, ext, 0, 0), 0),
+			append(chunkHeader(3, ext, 0, 0), 0),
+		}, []uint32{0, ext, 2 * ext}},
+	}
+	for _, c := range cases {
+		r := newChunkReader(bytes.NewReader(bytes.Join(c.chunks, nil)))
+		for i, want := range c.want {
+			msg, err := r.readMessage()
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", c.name, i, err)
+			}
+			if msg.timestamp != want {
+				t.Errorf("%s: message %d: timestamp %d, want %d", c.name, i, msg.timestamp, want)
+			}
+		}
+	}
+}
+
+func TestChunkReaderRejectsInvalidChunks(t *testing.T) {
+	cases := []struct {
+		name  string
+		input []byte
+	}{
+		{"continuation of unknown stream", append(chunkHeader(1, 0, 1, messageTypeAudio), 0)},
+		// fmt 1 と 2 はメッセージの途中に来てはいけない
+		{"header in the middle", append(append(chunkHeader(0, 0, 200, messageTypeVideo), testPayload(DEFAULT_CHUNK_SIZE)...), append(chunkHeader(2, 10, 0, 0), 0)...)},
+	}
+	for _, c := range cases {
+		r := newChunkReader(bytes.NewReader(c.input))
+		if _, err := r.readMessage(); err != ErrInvalidChunk {
+			t.Errorf("%s: %v, want ErrInvalidChunk", c.name, err)
+		}
+	}
+
+	// 途中で切れた入力はパニックせずにエラーになる
+	buf := &bytes.Buffer{}
+	w := newChunkWriter(buf)
+	if err := w.writeMessage(csidStream, &message{typ: messageTypeVideo, timestamp: 0x01000000, payload: testPayload(300)}); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < buf.Len(); n++ {
+		r := newChunkReader(bytes.NewReader(buf.Bytes()[:n]))
+		if _, err := r.readMessage(); err == nil {
+			t.Errorf("%d bytes: read a truncated message", n)
+		}
+	}
+}
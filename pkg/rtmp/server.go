@@ -0,0 +1,355 @@
+package rtmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ref: https://rtmp.veriskope.com/docs/spec/
+// 配信ソフトからの publish だけを受け付ける最小限のサーバ
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported rtmp version")
+	ErrNotPublishing      = errors.New("stream is not published")
+)
+
+const (
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+	// 配信ソフトからデータが届かなくなったら切断する
+	READ_TIMEOUT = 30 * time.Second
+
+	SERVER_CHUNK_SIZE = 4096
+	WINDOW_ACK_SIZE   = 2500000
+
+	handshakeSize = 1536
+	rtmpVersion   = 3
+
+	csidControl = 2
+	csidCommand = 3
+	csidStream  = 5
+
+	// createStream で割り当てるメッセージストリーム ID
+	publishStreamID = 1
+)
+
+// Handler は publish されたストリームキーを検証し、メディアの受け取り先を返す
+type Handler interface {
+	Publish(app, key string) (Stream, error)
+}
+
+// Stream は FLV タグの本文と同じ形式で音声と映像を受け取る
+type Stream interface {
+	WriteAudio(timestamp uint32, data []byte) error
+	WriteVideo(timestamp uint32, data []byte) error
+	// Done はルームが閉じられるなど、受け取り先が無くなると閉じられる。閉じられたら接続を切る
+	Done() <-chan struct{}
+	Close() error
+}
+
+type Server struct {
+	listener net.Listener
+	handler  Handler
+}
+
+func NewServer(l net.Listener, h Handler) *Server {
+	return &Server{listener: l, handler: h}
+}
+
+// Serve は Close されるまで接続を受け付ける
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				zap.L().Warn("rtmp: connection closed", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+type session struct {
+	conn    net.Conn
+	handler Handler
+	reader  *chunkReader
+	writer  *chunkWriter
+
+	app    string
+	stream Stream
+	// stream を close で閉じたときに閉じる。Done を待つ goroutine に接続を切らせない
+	unpublished   chan struct{}
+	windowAckSize uint32
+	lastAck       uint32
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := handshake(conn); err != nil {
+		return err
+	}
+	ss := &session{
+		conn:    conn,
+		handler: s.handler,
+		reader:  newChunkReader(conn),
+		writer:  newChunkWriter(conn),
+	}
+	defer ss.close()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
+			return err
+		}
+		msg, err := ss.reader.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := ss.acknowledge(); err != nil {
+			return err
+		}
+		if err := ss.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake は C0/C1/C2 を受け取り S0/S1/S2 を返す。ダイジェストを使わない単純なハンドシェイクで応答する
+func handshake(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT)); err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(conn, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return ErrUnsupportedVersion
+	}
+
+	s0s1s2 := make([]byte, 1+handshakeSize*2)
+	s0s1s2[0] = rtmpVersion
+	s1 := s0s1s2[1 : 1+handshakeSize]
+	binary.BigEndian.PutUint32(s1[0:4], uint32(time.Now().Unix()))
+	if _, err := rand.Read(s1[8:]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := conn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(conn, c2)
+	return err
+}
+
+func (ss *session) close() {
+	if ss.stream == nil {
+		return
+	}
+	close(ss.unpublished)
+	if err := ss.stream.Close(); err != nil {
+		zap.L().Warn("rtmp: failed to close stream", zap.Error(err))
+	}
+	ss.stream = nil
+}
+
+func (ss *session) acknowledge() error {
+	if ss.windowAckSize == 0 || ss.reader.bytesRead-ss.lastAck < ss.windowAckSize {
+		return nil
+	}
+	ss.lastAck = ss.reader.bytesRead
+	return ss.writeControl(messageTypeAcknowledgement, binary.BigEndian.AppendUint32(nil, ss.lastAck))
+}
+
+func (ss *session) handle(msg *message) error {
+	switch msg.typ {
+	case messageTypeSetChunkSize:
+		if len(msg.payload) < 4 {
+			return ErrInvalidChunk
+		}
+		size := binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+		if size == 0 || size > MAX_MESSAGE_SIZE {
+			return ErrInvalidChunk
+		}
+		ss.reader.chunkSize = size
+	case messageTypeWindowAckSize:
+		if len(msg.payload) < 4 {
+			return ErrInvalidChunk
+		}
+		ss.windowAckSize = binary.BigEndian.Uint32(msg.payload)
+	case messageTypeCommandAMF3:
+		// AMF3 コマンドの先頭 1 バイトを除けば AMF0 として読める
+		if len(msg.payload) == 0 {
+			return ErrInvalidChunk
+		}
+		return ss.handleCommand(msg.payload[1:])
+	case messageTypeCommandAMF0:
+		return ss.handleCommand(msg.payload)
+	case messageTypeAudio:
+		if ss.stream == nil {
+			return ErrNotPublishing
+		}
+		if len(msg.payload) == 0 {
+			return nil
+		}
+		return ss.stream.WriteAudio(msg.timestamp, msg.payload)
+	case messageTypeVideo:
+		if ss.stream == nil {
+			return ErrNotPublishing
+		}
+		if len(msg.payload) == 0 {
+			return nil
+		}
+		return ss.stream.WriteVideo(msg.timestamp, msg.payload)
+	}
+	// メタデータや帯域の通知など、転送に関係しないメッセージは読み捨てる
+	return nil
+}
+
+func (ss *session) handleCommand(payload []byte) error {
+	values, err := decodeAMF0Values(payload)
+	if err != nil {
+		return err
+	}
+	if len(values) < 2 {
+		return nil
+	}
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if obj, ok := values[2].(map[string]interface{}); ok {
+				ss.app, _ = obj["app"].(string)
+			}
+		}
+		return ss.connect(transactionID)
+	case "releaseStream", "FCPublish":
+		return ss.writeCommand(csidCommand, 0, "_result", transactionID, nil)
+	case "createStream":
+		return ss.writeCommand(csidCommand, 0, "_result", transactionID, nil, publishStreamID)
+	case "publish":
+		key := ""
+		if len(values) > 3 {
+			key, _ = values[3].(string)
+		}
+		return ss.publish(key)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		ss.close()
+	}
+	return nil
+}
+
+func (ss *session) connect(transactionID float64) error {
+	if err := ss.writeControl(messageTypeWindowAckSize, binary.BigEndian.AppendUint32(nil, WINDOW_ACK_SIZE)); err != nil {
+		return err
+	}
+	// 帯域の上限は dynamic (2) で通知する
+	if err := ss.writeControl(messageTypeSetPeerBandwidth, append(binary.BigEndian.AppendUint32(nil, WINDOW_ACK_SIZE), 2)); err != nil {
+		return err
+	}
+	if err := ss.writeControl(messageTypeSetChunkSize, binary.BigEndian.AppendUint32(nil, SERVER_CHUNK_SIZE)); err != nil {
+		return err
+	}
+	ss.writer.chunkSize = SERVER_CHUNK_SIZE
+
+	return ss.writeCommand(csidCommand, 0, "_result", transactionID,
+		map[string]interface{}{
+			"fmsVer":       "FMS/3,0,1,123",
+			"capabilities": 31,
+		},
+		map[string]interface{}{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"description":    "Connection succeeded.",
+			"objectEncoding": 0,
+		},
+	)
+}
+
+func (ss *session) publish(key string) error {
+	// OBS などはストリームキーにクエリを付けることがある
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		key = key[:i]
+	}
+
+	ss.close()
+	stream, err := ss.handler.Publish(ss.app, key)
+	if err != nil {
+		if err := ss.onStatus("error", "NetStream.Publish.BadName", err.Error()); err != nil {
+			return err
+		}
+		return err
+	}
+	ss.stream = stream
+	ss.unpublished = make(chan struct{})
+	go ss.watch(stream.Done(), ss.unpublished)
+
+	// User Control の StreamBegin
+	begin := binary.BigEndian.AppendUint32([]byte{0, 0}, publishStreamID)
+	if err := ss.writeControl(messageTypeUserControl, begin); err != nil {
+		return err
+	}
+	return ss.onStatus("status", "NetStream.Publish.Start", "Start publishing.")
+}
+
+// watch は配信中に受け取り先が無くなったら接続を切り、配信ソフトに配信の終わりを伝える
+func (ss *session) watch(done, unpublished <-chan struct{}) {
+	select {
+	case <-done:
+	case <-unpublished:
+		return
+	}
+	// close で閉じた場合は Done も閉じられるので、先に閉じられている unpublished を確かめる
+	select {
+	case <-unpublished:
+		return
+	default:
+	}
+	zap.L().Info("rtmp: stream is closed by the server", zap.String("remote", ss.conn.RemoteAddr().String()))
+	ss.conn.Close()
+}
+
+func (ss *session) onStatus(level, code, description string) error {
+	return ss.writeCommand(csidStream, publishStreamID, "onStatus", 0, nil, map[string]interface{}{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+func (ss *session) writeControl(typ uint8, payload []byte) error {
+	return ss.writer.writeMessage(csidControl, &message{typ: typ, payload: payload})
+}
+
+func (ss *session) writeCommand(csid uint8, streamID uint32, values ...interface{}) error {
+	payload, err := encodeAMF0Values(values...)
+	if err != nil {
+		return err
+	}
+	return ss.writer.writeMessage(csid, &message{
+		typ:      messageTypeCommandAMF0,
+		streamID: streamID,
+		payload:  payload,
+	})
+}
@@ -0,0 +1,214 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testStream struct {
+	mux    sync.Mutex
+	video  []message
+	done   chan struct{}
+	closed chan struct{}
+}
+
+func (s *testStream) WriteAudio(timestamp uint32, data []byte) error {
+	return nil
+}
+
+func (s *testStream) WriteVideo(timestamp uint32, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.video = append(s.video, message{timestamp: timestamp, payload: data})
+	return nil
+}
+
+func (s *testStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *testStream) Close() error {
+	close(s.closed)
+	return nil
+}
+
+type testHandler struct {
+	app, key string
+	stream   *testStream
+}
+
+func (h *testHandler) Publish(app, key string) (Stream, error) {
+	if key != "key" {
+		return nil, errors.New("unknown stream key")
+	}
+	h.app, h.key = app, key
+	return h.stream, nil
+}
+
+// testClient は配信ソフトとしてサーバに接続する
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *chunkReader
+	w    *chunkWriter
+}
+
+func dial(t *testing.T, h Handler) *testClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l, h)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// C0 と C1 を送り、S0, S1, S2 を受け取ってから C2 として S1 を返す
+	c0c1 := append([]byte{rtmpVersion}, testPayload(handshakeSize)...)
+	if _, err := conn.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	s0s1s2 := make([]byte, 1+handshakeSize*2)
+	if _, err := io.ReadFull(conn, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if s0s1s2[0] != rtmpVersion || !bytes.Equal(s0s1s2[1+handshakeSize:], c0c1[1:]) {
+		t.Fatal("S2 does not echo C1")
+	}
+	if _, err := conn.Write(s0s1s2[1 : 1+handshakeSize]); err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, r: newChunkReader(conn), w: newChunkWriter(conn)}
+}
+
+func (c *testClient) command(values ...interface{}) {
+	c.t.Helper()
+	payload, err := encodeAMF0Values(values...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.w.writeMessage(csidCommand, &message{typ: messageTypeCommandAMF0, payload: payload}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect はコマンド name が届くまで読み進め、その値を返す。途中の Set Chunk Size は反映する
+func (c *testClient) expect(name string) []interface{} {
+	c.t.Helper()
+	for {
+		msg, err := c.r.readMessage()
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", name, err)
+		}
+		switch msg.typ {
+		case messageTypeSetChunkSize:
+			c.r.chunkSize = binary.BigEndian.Uint32(msg.payload)
+		case messageTypeCommandAMF0:
+			values, err := decodeAMF0Values(msg.payload)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			if values[0] == name {
+				return values
+			}
+		}
+	}
+}
+
+// publish は connect から publish までを行い、onStatus のコードを返す
+func (c *testClient) publish(key string) string {
+	c.t.Helper()
+	c.command("connect", 1, map[string]interface{}{"app": "live", "tcUrl": "rtmp://localhost/live"})
+	if values := c.expect("_result"); len(values) < 4 {
+		c.t.Fatalf("connect result %v", values)
+	}
+	c.command("createStream", 2, nil)
+	if values := c.expect("_result"); len(values) < 4 || values[3] != float64(publishStreamID) {
+		c.t.Fatalf("createStream result %v, want stream id %d", values, publishStreamID)
+	}
+	c.command("publish", 3, nil, key, "live")
+	status := c.expect("onStatus")
+	info, _ := status[3].(map[string]interface{})
+	code, _ := info["code"].(string)
+	return code
+}
+
+func TestServerAcceptsPublish(t *testing.T) {
+	h := &testHandler{stream: &testStream{done: make(chan struct{}), closed: make(chan struct{})}}
+	c := dial(t, h)
+	if code := c.publish("key?token=x"); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish status %s", code)
+	}
+	if h.app != "live" || h.key != "key" {
+		t.Errorf("published %s/%s, want live/key", h.app, h.key)
+	}
+
+	// 配信ソフトがチャンクの大きさを変えた後の映像もメッセージとして組み上がる
+	if err := c.w.writeMessage(csidControl, &message{typ: messageTypeSetChunkSize, payload: binary.BigEndian.AppendUint32(nil, SERVER_CHUNK_SIZE)}); err != nil {
+		t.Fatal(err)
+	}
+	c.w.chunkSize = SERVER_CHUNK_SIZE
+	video := testPayload(10000)
+	if err := c.w.writeMessage(csidStream, &message{typ: messageTypeVideo, streamID: publishStreamID, timestamp: 0x01000000, payload: video}); err != nil {
+		t.Fatal(err)
+	}
+	c.command("FCUnpublish", 4, nil, "key")
+
+	select {
+	case <-h.stream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is not closed by FCUnpublish")
+	}
+	h.stream.mux.Lock()
+	defer h.stream.mux.Unlock()
+	if len(h.stream.video) != 1 || h.stream.video[0].timestamp != 0x01000000 || !bytes.Equal(h.stream.video[0].payload, video) {
+		t.Errorf("%d video messages, want the 10000 bytes message", len(h.stream.video))
+	}
+}
+
+func TestServerRejectsUnknownStreamKey(t *testing.T) {
+	c := dial(t, &testHandler{})
+	if code := c.publish("other"); code != "NetStream.Publish.BadName" {
+		t.Errorf("publish status %s, want NetStream.Publish.BadName", code)
+	}
+	// 拒否した後は接続を切る
+	if _, err := c.r.readMessage(); err == nil {
+		t.Error("connection is kept after rejecting the stream key")
+	}
+}
+
+func TestServerDisconnectsWhenStreamIsDone(t *testing.T) {
+	h := &testHandler{stream: &testStream{done: make(chan struct{}), closed: make(chan struct{})}}
+	c := dial(t, h)
+	if code := c.publish("key"); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish status %s", code)
+	}
+
+	close(h.stream.done)
+	for {
+		if _, err := c.r.readMessage(); err != nil {
+			break
+		}
+	}
+	select {
+	case <-h.stream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is not closed after disconnecting")
+	}
+}
@@ -9,9 +9,37 @@ import (
 func route(
 	e *echo.Echo,
 	rtcService service.Service,
+	adminService service.AdminService,
+	hlsService service.Service,
 ) error {
 	apiv1 := e.Group("api/v1")
 	apiv1.GET("/signaling", rtcService.Serve())
 
+	admin := apiv1.Group("/admin", adminService.Authorize())
+	admin.POST("/tracks/:track/mute", adminService.MuteTrack())
+	admin.POST("/tracks/:track/unmute", adminService.UnmuteTrack())
+	admin.GET("/stats", adminService.Stats())
+	admin.GET("/rooms", adminService.Rooms())
+	admin.GET("/rooms/:room/participants", adminService.Participants())
+	admin.DELETE("/rooms/:room/participants/:participant", adminService.KickParticipant())
+	admin.GET("/rooms/:room/tracks", adminService.Tracks())
+	admin.POST("/tracks/:track/forwards", adminService.StartRTPForward())
+	admin.GET("/forwards", adminService.RTPForwards())
+	admin.GET("/forwards/:forward/sdp", adminService.RTPForwardSDP())
+	admin.DELETE("/forwards/:forward", adminService.StopRTPForward())
+	admin.POST("/rooms/:room/ingests", adminService.StartRTPIngest())
+	admin.GET("/ingests", adminService.RTPIngests())
+	admin.DELETE("/ingests/:ingest", adminService.StopRTPIngest())
+	admin.POST("/rooms/:room/playbacks", adminService.StartPlayback())
+	admin.GET("/playbacks", adminService.Playbacks())
+	admin.DELETE("/playbacks/:playback", adminService.StopPlayback())
+	admin.GET("/log-level", adminService.LogLevel())
+	admin.PUT("/log-level", adminService.SetLogLevel())
+
+	// HLS は無効の場合は nil
+	if hlsService != nil {
+		e.GET("/hls/:room/:file", hlsService.Serve())
+	}
+
 	return nil
 }
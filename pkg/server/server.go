@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"ruyka/app"
+	"ruyka/pkg/rtc"
 	"ruyka/pkg/service"
+	"ruyka/pkg/store"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -16,49 +21,79 @@ const gracefulShutdownTimeout = 10 * time.Second
 
 type Server interface {
 	Run()
+	// Shutdown は SIGINT を受け取るまで待ってから Close する
 	Shutdown() error
+	Close() error
+	// HTTP サーバが待ち受けているアドレス。ポートに 0 を指定した場合に使う
+	Addr() net.Addr
+	// 設定から作ったロガー。グローバルなロガーにするかどうかは呼び出し側が決める
+	Logger() *zap.Logger
+}
+
+// Runner は HTTP サーバと並行して動かすサーバ (RTMP など)
+type Runner interface {
+	Serve() error
+	Close() error
 }
 
 type server struct {
-	exit   chan os.Signal
-	engine *echo.Echo
-	logger *zap.Logger
+	exit    chan os.Signal
+	engine  *echo.Echo
+	logger  *zap.Logger
+	rtc     rtc.RTC
+	store   store.Store
+	runners []Runner
 }
 
+// New の r と st は Close で HTTP サーバを止めた後に閉じる
 func New(
 	engine *echo.Echo,
 	logger *zap.Logger,
+	r rtc.RTC,
+	st store.Store,
 	rtcService service.Service,
+	adminService service.AdminService,
+	hlsService service.Service,
 	isDevelopment bool,
+	appDir string,
+	runners ...Runner,
 ) (Server, error) {
 	if err := route(
 		engine,
 		rtcService,
+		adminService,
+		hlsService,
 	); err != nil {
 		return nil, err
 	}
 	if isDevelopment {
-		err := app.Router(engine)
+		err := app.Router(engine, appDir)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return &server{
-		exit:   make(chan os.Signal, 1),
-		engine: engine,
-		logger: logger,
+		exit:    make(chan os.Signal, 1),
+		engine:  engine,
+		logger:  logger,
+		rtc:     r,
+		store:   st,
+		runners: runners,
 	}, nil
 }
 
 func (s *server) Run() {
-	repair := zap.ReplaceGlobals(s.logger)
-	defer func() {
-		s.logger.Sync()
-		repair()
-	}()
+	defer s.logger.Sync()
 
-	if err := s.engine.Start(""); err != nil {
-		zap.L().Fatal(err.Error())
+	for _, r := range s.runners {
+		go func(r Runner) {
+			if err := r.Serve(); err != nil {
+				s.logger.Error(err.Error())
+			}
+		}(r)
+	}
+	if err := s.engine.Start(""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Fatal(err.Error())
 	}
 }
 
@@ -66,8 +101,31 @@ func (s *server) Shutdown() error {
 	signal.Notify(s.exit, os.Interrupt)
 
 	<-s.exit
+	return s.Close()
+}
+
+func (s *server) Close() error {
+	for _, r := range s.runners {
+		if err := r.Close(); err != nil {
+			s.logger.Warn(err.Error())
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
 	defer cancel()
 
-	return s.engine.Shutdown(ctx)
+	if err := s.engine.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := s.rtc.Close(); err != nil {
+		s.logger.Warn(err.Error())
+	}
+	return s.store.Close()
+}
+
+func (s *server) Addr() net.Addr {
+	return s.engine.Listener.Addr()
+}
+
+func (s *server) Logger() *zap.Logger {
+	return s.logger
 }
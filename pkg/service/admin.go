@@ -0,0 +1,367 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"ruyka/pkg/egress"
+	"ruyka/pkg/ingest"
+	"ruyka/pkg/player"
+	"ruyka/pkg/rtc"
+	"ruyka/pkg/store"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	ErrAdminNotLoopback = errors.New("admin api without admin.key is only available from loopback addresses")
+)
+
+type AdminService interface {
+	Authorize() echo.MiddlewareFunc
+	MuteTrack() echo.HandlerFunc
+	UnmuteTrack() echo.HandlerFunc
+	Stats() echo.HandlerFunc
+	Rooms() echo.HandlerFunc
+	Participants() echo.HandlerFunc
+	KickParticipant() echo.HandlerFunc
+	Tracks() echo.HandlerFunc
+	StartRTPForward() echo.HandlerFunc
+	StopRTPForward() echo.HandlerFunc
+	RTPForwards() echo.HandlerFunc
+	RTPForwardSDP() echo.HandlerFunc
+	StartRTPIngest() echo.HandlerFunc
+	StopRTPIngest() echo.HandlerFunc
+	RTPIngests() echo.HandlerFunc
+	StartPlayback() echo.HandlerFunc
+	StopPlayback() echo.HandlerFunc
+	Playbacks() echo.HandlerFunc
+	LogLevel() echo.HandlerFunc
+	SetLogLevel() echo.HandlerFunc
+}
+
+type adminService struct {
+	rtc       rtc.RTC
+	store     store.Store
+	forwarder egress.RTPForwarder
+	ingester  ingest.RTPIngester
+	player    player.Player
+	level     zap.AtomicLevel
+	key       string
+}
+
+func NewAdminService(
+	r rtc.RTC,
+	st store.Store,
+	forwarder egress.RTPForwarder,
+	ingester ingest.RTPIngester,
+	p player.Player,
+	level zap.AtomicLevel,
+	key string,
+) AdminService {
+	return &adminService{
+		rtc:       r,
+		store:     st,
+		forwarder: forwarder,
+		ingester:  ingester,
+		player:    p,
+		level:     level,
+		key:       key,
+	}
+}
+
+// Authorize は admin.key が空の場合、ループバックアドレスからのリクエストだけを受け付ける。
+// X-Forwarded-For などのヘッダは偽装できるので、接続元のアドレスで判定する
+func (s *adminService) Authorize() echo.MiddlewareFunc {
+	if s.key == "" {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(cxt echo.Context) error {
+				if !isLoopback(cxt.Request().RemoteAddr) {
+					return echo.NewHTTPError(http.StatusForbidden, ErrAdminNotLoopback.Error())
+				}
+				return next(cxt)
+			}
+		}
+	}
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Validator: func(key string, _ echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(s.key)) == 1, nil
+		},
+	})
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *adminService) MuteTrack() echo.HandlerFunc {
+	return s.muteTrack(true)
+}
+
+func (s *adminService) UnmuteTrack() echo.HandlerFunc {
+	return s.muteTrack(false)
+}
+
+func (s *adminService) muteTrack(muted bool) echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		err := s.rtc.MuteTrack(cxt.Param("track"), muted)
+		if errors.Is(err, rtc.ErrTrackNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.NoContent(http.StatusNoContent)
+	}
+}
+
+func (s *adminService) Stats() echo.HandlerFunc {
+	type response struct {
+		Tracks []rtc.TrackStats `json:"tracks"`
+	}
+	return func(cxt echo.Context) error {
+		return cxt.JSON(http.StatusOK, response{
+			Tracks: s.rtc.TrackStats(),
+		})
+	}
+}
+
+func (s *adminService) Rooms() echo.HandlerFunc {
+	type response struct {
+		Rooms []store.Room `json:"rooms"`
+	}
+	return func(cxt echo.Context) error {
+		rooms, err := s.store.Rooms()
+		if err != nil {
+			return err
+		}
+		return cxt.JSON(http.StatusOK, response{Rooms: rooms})
+	}
+}
+
+func (s *adminService) Participants() echo.HandlerFunc {
+	type response struct {
+		Participants []store.Participant `json:"participants"`
+	}
+	return func(cxt echo.Context) error {
+		participants, err := s.store.Participants(cxt.Param("room"))
+		if errors.Is(err, store.ErrRoomNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.JSON(http.StatusOK, response{Participants: participants})
+	}
+}
+
+// KickParticipant は参加者に kicked のエラーを送ってから接続を切る
+func (s *adminService) KickParticipant() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		err := s.rtc.KickParticipant(cxt.Param("room"), cxt.Param("participant"))
+		if errors.Is(err, rtc.ErrRoomNotFound) || errors.Is(err, rtc.ErrParticipantNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.NoContent(http.StatusNoContent)
+	}
+}
+
+func (s *adminService) Tracks() echo.HandlerFunc {
+	type response struct {
+		Tracks []store.Track `json:"tracks"`
+	}
+	return func(cxt echo.Context) error {
+		tracks, err := s.store.Tracks(cxt.Param("room"))
+		if errors.Is(err, store.ErrRoomNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.JSON(http.StatusOK, response{Tracks: tracks})
+	}
+}
+
+func (s *adminService) StartRTPForward() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		o := egress.RTPForwardOptions{}
+		if err := cxt.Bind(&o); err != nil {
+			return err
+		}
+		f, err := s.forwarder.Start(cxt.Param("track"), o)
+		switch {
+		case errors.Is(err, rtc.ErrTrackNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		case errors.Is(err, egress.ErrInvalidForwardDst),
+			errors.Is(err, egress.ErrForwardDstNotAllowed),
+			errors.Is(err, egress.ErrUnsupportedSRTPSuite),
+			errors.Is(err, egress.ErrInvalidSRTPKey):
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		case err != nil:
+			return err
+		}
+		return cxt.JSON(http.StatusCreated, f)
+	}
+}
+
+func (s *adminService) StopRTPForward() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		err := s.forwarder.Stop(cxt.Param("forward"))
+		if errors.Is(err, egress.ErrForwardNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.NoContent(http.StatusNoContent)
+	}
+}
+
+func (s *adminService) RTPForwards() echo.HandlerFunc {
+	type response struct {
+		Forwards []egress.RTPForward `json:"forwards"`
+	}
+	return func(cxt echo.Context) error {
+		return cxt.JSON(http.StatusOK, response{Forwards: s.forwarder.Forwards()})
+	}
+}
+
+// RTPForwardSDP は転送先で ffmpeg -i や GStreamer の sdpdemux に渡す SDP ファイルを返す
+func (s *adminService) RTPForwardSDP() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		f, err := s.forwarder.Forward(cxt.Param("forward"))
+		if errors.Is(err, egress.ErrForwardNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.Blob(http.StatusOK, "application/sdp", []byte(f.SDP))
+	}
+}
+
+func (s *adminService) StartRTPIngest() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		o := ingest.RTPIngestOptions{}
+		if err := cxt.Bind(&o); err != nil {
+			return err
+		}
+		in, err := s.ingester.Start(cxt.Param("room"), o)
+		switch {
+		case errors.Is(err, ingest.ErrUnsupportedCodec):
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		case errors.Is(err, rtc.ErrPublishersFull):
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		case err != nil:
+			return err
+		}
+		return cxt.JSON(http.StatusCreated, in)
+	}
+}
+
+func (s *adminService) StopRTPIngest() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		err := s.ingester.Stop(cxt.Param("ingest"))
+		if errors.Is(err, ingest.ErrIngestNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.NoContent(http.StatusNoContent)
+	}
+}
+
+func (s *adminService) RTPIngests() echo.HandlerFunc {
+	type response struct {
+		Ingests []ingest.RTPIngest `json:"ingests"`
+	}
+	return func(cxt echo.Context) error {
+		return cxt.JSON(http.StatusOK, response{Ingests: s.ingester.Ingests()})
+	}
+}
+
+func (s *adminService) StartPlayback() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		o := player.Options{}
+		if err := cxt.Bind(&o); err != nil {
+			return err
+		}
+		pb, err := s.player.Start(cxt.Param("room"), o)
+		switch {
+		case errors.Is(err, player.ErrNoFiles),
+			errors.Is(err, player.ErrInvalidFrameRate),
+			errors.Is(err, player.ErrUnsupportedFile):
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		case errors.Is(err, fs.ErrNotExist):
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		case errors.Is(err, rtc.ErrRoomFull), errors.Is(err, rtc.ErrPublishersFull):
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		case err != nil:
+			return err
+		}
+		return cxt.JSON(http.StatusCreated, pb)
+	}
+}
+
+func (s *adminService) StopPlayback() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		err := s.player.Stop(cxt.Param("playback"))
+		if errors.Is(err, player.ErrPlaybackNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return cxt.NoContent(http.StatusNoContent)
+	}
+}
+
+func (s *adminService) Playbacks() echo.HandlerFunc {
+	type response struct {
+		Playbacks []player.Playback `json:"playbacks"`
+	}
+	return func(cxt echo.Context) error {
+		return cxt.JSON(http.StatusOK, response{Playbacks: s.player.Playbacks()})
+	}
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *adminService) LogLevel() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		return cxt.JSON(http.StatusOK, logLevel{Level: s.level.String()})
+	}
+}
+
+// SetLogLevel は再起動せずにログの出力レベルを変更する
+func (s *adminService) SetLogLevel() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		req := logLevel{}
+		if err := cxt.Bind(&req); err != nil {
+			return err
+		}
+		level, err := zapcore.ParseLevel(req.Level)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		s.level.SetLevel(level)
+		zap.L().Info("log level changed", zap.Stringer("level", level))
+		return cxt.JSON(http.StatusOK, logLevel{Level: level.String()})
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"ruyka/pkg/egress"
+	"ruyka/pkg/hls"
+	"ruyka/pkg/token"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const hlsPlaylistName = "index.m3u8"
+
+type hlsService struct {
+	hls    egress.HLS
+	secret string
+}
+
+// NewHLSService は secret が空でなければ、シグナリングと同じく ?token= で渡された参加トークンを検証する
+func NewHLSService(h egress.HLS, secret string) Service {
+	return &hlsService{hls: h, secret: secret}
+}
+
+// authorize はトークンがルームの購読を許可していることを確かめ、検証したトークンを返す
+func (s *hlsService) authorize(cxt echo.Context) (string, error) {
+	if s.secret == "" {
+		return "", nil
+	}
+	t := cxt.QueryParam("token")
+	claims, err := token.Verify(s.secret, t)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if claims.Room != cxt.Param("room") || !claims.CanSubscribe {
+		return "", echo.NewHTTPError(http.StatusForbidden, "token is not valid for the room")
+	}
+	return t, nil
+}
+
+// withToken はプレイヤーがセグメントなどを取得するときにもトークンを渡すよう、プレイリストの URI に付け加える
+func withToken(playlist []byte, t string) []byte {
+	query := "?token=" + url.QueryEscape(t)
+	lines := bytes.Split(playlist, []byte("\n"))
+	for i, line := range lines {
+		switch {
+		case len(line) == 0:
+		case line[0] != '#':
+			lines[i] = append(line, query...)
+		default:
+			// #EXT-X-MAP:URI="init.mp4" などの属性の URI
+			if start := bytes.Index(line, []byte(`URI="`)); start >= 0 {
+				start += len(`URI="`)
+				end := start + bytes.IndexByte(line[start:], '"')
+				if end >= start {
+					lines[i] = bytes.Join([][]byte{line[:end], []byte(query), line[end:]}, nil)
+				}
+			}
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// Serve はルームのプレイリストとセグメントを返す。
+// LL-HLS のブロッキングリクエスト (_HLS_msn, _HLS_part) はセグメントができるまで待たせる
+func (s *hlsService) Serve() echo.HandlerFunc {
+	return func(cxt echo.Context) error {
+		t, err := s.authorize(cxt)
+		if err != nil {
+			return err
+		}
+		m, ok := s.hls.Muxer(cxt.Param("room"))
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "room is not streaming")
+		}
+		ctx := cxt.Request().Context()
+		name := cxt.Param("file")
+
+		if name == hlsPlaylistName {
+			msn, part := int64(-1), -1
+			if v := cxt.QueryParam("_HLS_msn"); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n < 0 {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid _HLS_msn")
+				}
+				msn = n
+			}
+			if v := cxt.QueryParam("_HLS_part"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || msn < 0 {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid _HLS_part")
+				}
+				part = n
+			}
+
+			b, err := m.Playlist(ctx, msn, part)
+			if errors.Is(err, hls.ErrBadRequest) {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if err != nil {
+				return err
+			}
+			if t != "" {
+				b = withToken(b, t)
+			}
+			cxt.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+			return cxt.Blob(http.StatusOK, "application/vnd.apple.mpegurl", b)
+		}
+
+		b, err := m.File(ctx, name)
+		if errors.Is(err, hls.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		contentType := "video/iso.segment"
+		if path.Ext(name) == ".mp4" {
+			contentType = "video/mp4"
+		}
+		// 作られたセグメントは変わらない
+		cxt.Response().Header().Set(echo.HeaderCacheControl, "max-age=3600")
+		return cxt.Blob(http.StatusOK, contentType, b)
+	}
+}
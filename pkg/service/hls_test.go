@@ -0,0 +1,22 @@
+package service
+
+import "testing"
+
+func TestWithTokenAddsTokenToURIs(t *testing.T) {
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"#EXT-X-PART:DURATION=0.200,URI=\"part-0-0.m4s\",INDEPENDENT=YES\n" +
+		"#EXTINF:1.000,\n" +
+		"segment-0.m4s\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-1-0.m4s\"\n"
+	want := "#EXTM3U\n" +
+		"#EXT-X-MAP:URI=\"init.mp4?token=a%2Bb\"\n" +
+		"#EXT-X-PART:DURATION=0.200,URI=\"part-0-0.m4s?token=a%2Bb\",INDEPENDENT=YES\n" +
+		"#EXTINF:1.000,\n" +
+		"segment-0.m4s?token=a%2Bb\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-1-0.m4s?token=a%2Bb\"\n"
+
+	if got := string(withToken([]byte(playlist), "a+b")); got != want {
+		t.Errorf("playlist:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -1,7 +1,10 @@
 package service
 
 import (
+	"errors"
+	"net/http"
 	"ruyka/pkg/rtc"
+	"ruyka/pkg/token"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,11 +15,14 @@ import (
 
 type rtcService struct {
 	rtc      rtc.RTC
+	secret   string
 	upgrader websocket.Upgrader
 }
 
+// NewRTCService は secret が空でなければ、?token= で渡された参加トークンを検証する
 func NewRTCService(
 	r rtc.RTC,
+	secret string,
 ) Service {
 	const (
 		WebSocketHandshakeTimeout = 30 * time.Second
@@ -24,7 +30,8 @@ func NewRTCService(
 		WebSocketWriteBufferSize  = 1024
 	)
 	return &rtcService{
-		rtc: r,
+		rtc:    r,
+		secret: secret,
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: WebSocketHandshakeTimeout,
 			ReadBufferSize:   WebSocketReadBufferSize,
@@ -38,25 +45,38 @@ func (s *rtcService) Serve() echo.HandlerFunc {
 		Event              rtc.EventType                    `json:"event"`
 		SessionDescription rtc.SessionDescriptionSerializer `json:"sdp,omitempty"`
 		ICECandidate       rtc.ICECandidateSerializer       `json:"ice,omitempty"`
+		TrackID            string                           `json:"track,omitempty"`
+		SpatialLayer       *uint8                           `json:"spatial,omitempty"`
+		TemporalLayer      *uint8                           `json:"temporal,omitempty"`
 	}
 	return func(cxt echo.Context) error {
 		if !websocket.IsWebSocketUpgrade(cxt.Request()) {
 			return nil
 		}
+		room, perm, err := s.authorize(cxt)
+		if err != nil {
+			return err
+		}
 		c, err := s.upgrader.Upgrade(cxt.Response(), cxt.Request(), nil)
 		if err != nil {
 			return err
 		}
 		defer c.Close()
 
+		// RequestID ミドルウェアが付けた ID で、HTTP のログと参加者のログを結び付ける
+		logger := zap.L().With(zap.String("request_id", cxt.Response().Header().Get(echo.HeaderXRequestID)))
 		sc := rtc.NewSignalConnection(c)
-		peer, err := s.rtc.NewPeerConnection(sc)
+		peer, err := s.rtc.NewPeerConnection(room, sc, perm, logger)
+		if errors.Is(err, rtc.ErrRoomFull) {
+			return sc.WriteMessage(rtc.NewErrorMessage(rtc.ErrorCodeRoomFull, err))
+		}
 		if err != nil {
 			return err
 		}
 		defer peer.Close()
 
-		zap.L().Info("new peer connection joined")
+		logger = peer.Logger()
+		logger.Info("new peer connection joined")
 		for {
 			msg := message{}
 			if err := sc.ReadMessage(&msg); err != nil {
@@ -65,9 +85,9 @@ func (s *rtcService) Serve() echo.HandlerFunc {
 					websocket.CloseGoingAway,
 					websocket.CloseNormalClosure,
 				) {
-					zap.L().Warn(err.Error())
+					logger.Warn(err.Error())
 				} else {
-					zap.L().Info("websocket connection closed")
+					logger.Info("websocket connection closed", zap.Error(err))
 				}
 				return nil
 			}
@@ -75,17 +95,59 @@ func (s *rtcService) Serve() echo.HandlerFunc {
 			switch msg.Event {
 			case rtc.EventTypeAnswer:
 				if err := peer.UpdateRemoteDescription(msg.SessionDescription); err != nil {
-					zap.L().Warn(err.Error())
+					logger.Warn(err.Error())
 					return err
 				}
 			case rtc.EventTypeCandidate:
 				if err := peer.UpdateICECandidate(msg.ICECandidate); err != nil {
-					zap.L().Warn(err.Error())
+					logger.Warn(err.Error())
 					return err
 				}
+			case rtc.EventTypeMute, rtc.EventTypeUnmute:
+				muted := msg.Event == rtc.EventTypeMute
+				if err := peer.MuteTrack(msg.TrackID, muted); err != nil {
+					logger.Warn(err.Error())
+					// クライアントが指定したトラックが違う場合などに、ミュートできていないことを伝える
+					if err := peer.Notify(rtc.NewErrorMessage(rtc.ErrorCodeMuteFailed, err)); err != nil {
+						logger.Warn(err.Error())
+					}
+				}
+			case rtc.EventTypeLayer:
+				spatial, temporal := uint8(rtc.MAX_LAYER), uint8(rtc.MAX_LAYER)
+				if msg.SpatialLayer != nil {
+					spatial = *msg.SpatialLayer
+				}
+				if msg.TemporalLayer != nil {
+					temporal = *msg.TemporalLayer
+				}
+				if err := peer.SetLayer(msg.TrackID, spatial, temporal); err != nil {
+					logger.Warn(err.Error())
+				}
 			default:
 				return nil
 			}
 		}
 	}
 }
+
+// authorize は参加するルームと許可する操作を返す。
+// トークンを検証する場合は、トークンのルームにだけ参加できる
+func (s *rtcService) authorize(cxt echo.Context) (string, rtc.Permission, error) {
+	room := cxt.QueryParam("room")
+	if s.secret == "" {
+		return room, rtc.FullPermission, nil
+	}
+
+	claims, err := token.Verify(s.secret, cxt.QueryParam("token"))
+	if err != nil {
+		return "", rtc.Permission{}, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if room != "" && room != claims.Room {
+		return "", rtc.Permission{}, echo.NewHTTPError(http.StatusForbidden, "token is not valid for the room")
+	}
+	return claims.Room, rtc.Permission{
+		Identity:     claims.Identity,
+		CanPublish:   claims.CanPublish,
+		CanSubscribe: claims.CanSubscribe,
+	}, nil
+}
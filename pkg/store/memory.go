@@ -0,0 +1,167 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryStore struct {
+	mux          sync.RWMutex
+	rooms        map[string]Room
+	participants map[string]map[string]Participant
+	tracks       map[string]map[string]Track
+}
+
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		mux:          sync.RWMutex{},
+		rooms:        make(map[string]Room),
+		participants: make(map[string]map[string]Participant),
+		tracks:       make(map[string]map[string]Track),
+	}
+}
+
+func (s *memoryStore) PutRoom(r Room) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.rooms[r.Name] = r
+	return nil
+}
+
+// DeleteRoom はルームに属する参加者とトラックもまとめて削除する
+func (s *memoryStore) DeleteRoom(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.rooms[name]; !ok {
+		return ErrRoomNotFound
+	}
+	delete(s.rooms, name)
+	delete(s.participants, name)
+	delete(s.tracks, name)
+	return nil
+}
+
+func (s *memoryStore) Room(name string) (Room, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	r, ok := s.rooms[name]
+	if !ok {
+		return Room{}, ErrRoomNotFound
+	}
+	return r, nil
+}
+
+func (s *memoryStore) Rooms() ([]Room, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	rooms := make([]Room, 0, len(s.rooms))
+	for name := range s.rooms {
+		rooms = append(rooms, s.rooms[name])
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms, nil
+}
+
+func (s *memoryStore) PutParticipant(p Participant) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.rooms[p.Room]; !ok {
+		return ErrRoomNotFound
+	}
+	if _, ok := s.participants[p.Room]; !ok {
+		s.participants[p.Room] = make(map[string]Participant)
+	}
+	s.participants[p.Room][p.ID] = p
+	return nil
+}
+
+// DeleteParticipant は参加者が配信していたトラックもまとめて削除する
+func (s *memoryStore) DeleteParticipant(room, id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.participants[room][id]; !ok {
+		return ErrParticipantNotFound
+	}
+	delete(s.participants[room], id)
+	for trackID, t := range s.tracks[room] {
+		if t.Participant == id {
+			delete(s.tracks[room], trackID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Participants(room string) ([]Participant, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	participants := make([]Participant, 0, len(s.participants[room]))
+	for id := range s.participants[room] {
+		participants = append(participants, s.participants[room][id])
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+	return participants, nil
+}
+
+func (s *memoryStore) PutTrack(t Track) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.participants[t.Room][t.Participant]; !ok {
+		return ErrParticipantNotFound
+	}
+	if _, ok := s.tracks[t.Room]; !ok {
+		s.tracks[t.Room] = make(map[string]Track)
+	}
+	s.tracks[t.Room][t.ID] = t
+	return nil
+}
+
+func (s *memoryStore) DeleteTrack(room, id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.tracks[room][id]; !ok {
+		return ErrTrackNotFound
+	}
+	delete(s.tracks[room], id)
+	return nil
+}
+
+func (s *memoryStore) Tracks(room string) ([]Track, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return nil, ErrRoomNotFound
+	}
+	tracks := make([]Track, 0, len(s.tracks[room]))
+	for id := range s.tracks[room] {
+		tracks = append(tracks, s.tracks[room][id])
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].PublishedAt.Before(tracks[j].PublishedAt)
+	})
+	return tracks, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
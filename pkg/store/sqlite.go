@@ -0,0 +1,221 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// 他のインスタンスが書き込んでいる間に待つ時間 (ミリ秒)
+const SQLITE_BUSY_TIMEOUT = 5000
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS rooms (
+	name       TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS participants (
+	room      TEXT NOT NULL REFERENCES rooms (name) ON DELETE CASCADE,
+	id        TEXT NOT NULL,
+	name      TEXT NOT NULL,
+	instance  TEXT NOT NULL,
+	joined_at INTEGER NOT NULL,
+	PRIMARY KEY (room, id)
+);
+CREATE TABLE IF NOT EXISTS tracks (
+	room         TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	participant  TEXT NOT NULL,
+	kind         TEXT NOT NULL,
+	mime_type    TEXT NOT NULL,
+	muted        INTEGER NOT NULL,
+	server_muted INTEGER NOT NULL,
+	published_at INTEGER NOT NULL,
+	PRIMARY KEY (room, id),
+	FOREIGN KEY (room, participant) REFERENCES participants (room, id) ON DELETE CASCADE
+);
+`
+
+// sqliteStore は SQLite のファイルに保存する。
+// WAL モードで開くので、同じファイルを複数の ruyka のインスタンスから共有できる。
+// 変更は 1 行ずつ書き込み、全体を書き出すことはしない
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (Store, error) {
+	q := url.Values{}
+	// WAL への切り替えも他のインスタンスを待つので、busy_timeout を先に設定する
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", SQLITE_BUSY_TIMEOUT))
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "foreign_keys(1)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// affected は更新した行がなければ notFound を返す
+func affected(res sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) PutRoom(r Room) error {
+	_, err := s.db.Exec(
+		`INSERT INTO rooms (name, created_at) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET created_at = excluded.created_at`,
+		r.Name, r.CreatedAt.UnixNano(),
+	)
+	return err
+}
+
+// DeleteRoom はルームに属する参加者とトラックもまとめて削除する
+func (s *sqliteStore) DeleteRoom(name string) error {
+	res, err := s.db.Exec(`DELETE FROM rooms WHERE name = ?`, name)
+	return affected(res, err, ErrRoomNotFound)
+}
+
+func (s *sqliteStore) Room(name string) (Room, error) {
+	r := Room{Name: name}
+	var created int64
+	err := s.db.QueryRow(`SELECT created_at FROM rooms WHERE name = ?`, name).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Room{}, ErrRoomNotFound
+	}
+	if err != nil {
+		return Room{}, err
+	}
+	r.CreatedAt = time.Unix(0, created)
+	return r, nil
+}
+
+func (s *sqliteStore) Rooms() ([]Room, error) {
+	rows, err := s.db.Query(`SELECT name, created_at FROM rooms ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		r := Room{}
+		var created int64
+		if err := rows.Scan(&r.Name, &created); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.Unix(0, created)
+		rooms = append(rooms, r)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *sqliteStore) PutParticipant(p Participant) error {
+	res, err := s.db.Exec(
+		`INSERT INTO participants (room, id, name, instance, joined_at)
+		SELECT ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM rooms WHERE name = ?)
+		ON CONFLICT (room, id) DO UPDATE SET
+			name = excluded.name, instance = excluded.instance, joined_at = excluded.joined_at`,
+		p.Room, p.ID, p.Name, p.Instance, p.JoinedAt.UnixNano(), p.Room,
+	)
+	return affected(res, err, ErrRoomNotFound)
+}
+
+// DeleteParticipant は参加者が配信していたトラックもまとめて削除する
+func (s *sqliteStore) DeleteParticipant(room, id string) error {
+	res, err := s.db.Exec(`DELETE FROM participants WHERE room = ? AND id = ?`, room, id)
+	return affected(res, err, ErrParticipantNotFound)
+}
+
+func (s *sqliteStore) Participants(room string) ([]Participant, error) {
+	if _, err := s.Room(room); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		`SELECT id, name, instance, joined_at FROM participants WHERE room = ? ORDER BY joined_at`,
+		room,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	participants := []Participant{}
+	for rows.Next() {
+		p := Participant{Room: room}
+		var joined int64
+		if err := rows.Scan(&p.ID, &p.Name, &p.Instance, &joined); err != nil {
+			return nil, err
+		}
+		p.JoinedAt = time.Unix(0, joined)
+		participants = append(participants, p)
+	}
+	return participants, rows.Err()
+}
+
+func (s *sqliteStore) PutTrack(t Track) error {
+	res, err := s.db.Exec(
+		`INSERT INTO tracks (room, id, participant, kind, mime_type, muted, server_muted, published_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM participants WHERE room = ? AND id = ?)
+		ON CONFLICT (room, id) DO UPDATE SET
+			participant = excluded.participant, kind = excluded.kind, mime_type = excluded.mime_type,
+			muted = excluded.muted, server_muted = excluded.server_muted, published_at = excluded.published_at`,
+		t.Room, t.ID, t.Participant, t.Kind, t.MimeType, t.Muted, t.ServerMuted, t.PublishedAt.UnixNano(),
+		t.Room, t.Participant,
+	)
+	return affected(res, err, ErrParticipantNotFound)
+}
+
+func (s *sqliteStore) DeleteTrack(room, id string) error {
+	res, err := s.db.Exec(`DELETE FROM tracks WHERE room = ? AND id = ?`, room, id)
+	return affected(res, err, ErrTrackNotFound)
+}
+
+func (s *sqliteStore) Tracks(room string) ([]Track, error) {
+	if _, err := s.Room(room); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		`SELECT id, participant, kind, mime_type, muted, server_muted, published_at
+		FROM tracks WHERE room = ? ORDER BY published_at`,
+		room,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []Track{}
+	for rows.Next() {
+		t := Track{Room: room}
+		var published int64
+		if err := rows.Scan(&t.ID, &t.Participant, &t.Kind, &t.MimeType, &t.Muted, &t.ServerMuted, &published); err != nil {
+			return nil, err
+		}
+		t.PublishedAt = time.Unix(0, published)
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrRoomNotFound        = errors.New("room is not found")
+	ErrParticipantNotFound = errors.New("participant is not found")
+	ErrTrackNotFound       = errors.New("track is not found")
+)
+
+type Room struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Participant struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// サーバ内の参加者 (RTMP の取り込みや中継など) に付ける名前
+	Name string `json:"name,omitempty"`
+	// 参加者が接続している ruyka のインスタンス。Store を複数のインスタンスで共有するときに区別する
+	Instance string    `json:"instance,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type Track struct {
+	ID          string    `json:"id"`
+	Room        string    `json:"room"`
+	Participant string    `json:"participant"`
+	Kind        string    `json:"kind"`
+	MimeType    string    `json:"mime_type"`
+	Muted       bool      `json:"muted"`
+	ServerMuted bool      `json:"server_muted"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Store はルーム、参加者、配信中のトラックのメタデータを保持する。
+// メディアそのものや PeerConnection はプロセス内にしか置けないので扱わない
+type Store interface {
+	PutRoom(Room) error
+	DeleteRoom(name string) error
+	Room(name string) (Room, error)
+	Rooms() ([]Room, error)
+
+	PutParticipant(Participant) error
+	DeleteParticipant(room, id string) error
+	Participants(room string) ([]Participant, error)
+
+	PutTrack(Track) error
+	DeleteTrack(room, id string) error
+	Tracks(room string) ([]Track, error)
+
+	Close() error
+}
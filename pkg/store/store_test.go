@@ -0,0 +1,235 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores は同じケースを実行する Store の実装
+var stores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(*testing.T) Store { return NewMemoryStore() }},
+	{"sqlite", func(t *testing.T) Store { return openSQLite(t, filepath.Join(t.TempDir(), "store.db")) }},
+}
+
+func openSQLite(t *testing.T, path string) Store {
+	t.Helper()
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+// testTime は SQLite に保存したときに単調時計の値を落とした時刻と比べられるよう、壁時計だけを持つ
+func testTime(sec int64) time.Time {
+	return time.Unix(1700000000+sec, 0)
+}
+
+// populate はルーム room に参加者 alice と bob、alice のトラック audio と video を作る
+func populate(t *testing.T, s Store, room string) {
+	t.Helper()
+	if err := s.PutRoom(Room{Name: room, CreatedAt: testTime(0)}); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"alice", "bob"} {
+		if err := s.PutParticipant(Participant{ID: id, Room: room, Instance: "node-1", JoinedAt: testTime(int64(i + 1))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range []string{"audio", "video"} {
+		if err := s.PutTrack(Track{ID: id, Room: room, Participant: "alice", Kind: id, PublishedAt: testTime(int64(i + 3))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"not found", func(t *testing.T, s Store) {
+			if _, err := s.Room("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("Room: %v, want ErrRoomNotFound", err)
+			}
+			if err := s.DeleteRoom("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("DeleteRoom: %v, want ErrRoomNotFound", err)
+			}
+			if _, err := s.Participants("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("Participants: %v, want ErrRoomNotFound", err)
+			}
+			if _, err := s.Tracks("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("Tracks: %v, want ErrRoomNotFound", err)
+			}
+			populate(t, s, "room")
+			if err := s.DeleteParticipant("room", "carol"); !errors.Is(err, ErrParticipantNotFound) {
+				t.Errorf("DeleteParticipant: %v, want ErrParticipantNotFound", err)
+			}
+			if err := s.DeleteTrack("room", "screen"); !errors.Is(err, ErrTrackNotFound) {
+				t.Errorf("DeleteTrack: %v, want ErrTrackNotFound", err)
+			}
+		}},
+		{"participant into a missing room", func(t *testing.T, s Store) {
+			err := s.PutParticipant(Participant{ID: "alice", Room: "missing", JoinedAt: testTime(0)})
+			if !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("PutParticipant: %v, want ErrRoomNotFound", err)
+			}
+			if _, err := s.Room("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("Room: %v, want the room not to be created", err)
+			}
+		}},
+		{"track of a missing participant", func(t *testing.T, s Store) {
+			populate(t, s, "room")
+			err := s.PutTrack(Track{ID: "screen", Room: "room", Participant: "carol", PublishedAt: testTime(0)})
+			if !errors.Is(err, ErrParticipantNotFound) {
+				t.Errorf("PutTrack: %v, want ErrParticipantNotFound", err)
+			}
+		}},
+		{"upsert", func(t *testing.T, s Store) {
+			populate(t, s, "room")
+			if err := s.PutRoom(Room{Name: "room", CreatedAt: testTime(10)}); err != nil {
+				t.Fatal(err)
+			}
+			if r, err := s.Room("room"); err != nil || !r.CreatedAt.Equal(testTime(10)) {
+				t.Errorf("Room: %+v, %v, want created_at updated", r, err)
+			}
+			if err := s.PutTrack(Track{ID: "audio", Room: "room", Participant: "alice", Kind: "audio", Muted: true, PublishedAt: testTime(3)}); err != nil {
+				t.Fatal(err)
+			}
+			tracks, err := s.Tracks("room")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tracks) != 2 || tracks[0].ID != "audio" || !tracks[0].Muted {
+				t.Errorf("tracks %+v, want audio muted without a duplicate", tracks)
+			}
+			// 更新しても参加者は残る
+			if participants, err := s.Participants("room"); err != nil || len(participants) != 2 {
+				t.Errorf("participants %+v, %v, want 2", participants, err)
+			}
+		}},
+		{"ordered", func(t *testing.T, s Store) {
+			populate(t, s, "b")
+			populate(t, s, "a")
+			rooms, err := s.Rooms()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rooms) != 2 || rooms[0].Name != "a" || rooms[1].Name != "b" {
+				t.Errorf("rooms %+v, want a, b", rooms)
+			}
+			participants, err := s.Participants("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(participants) != 2 || participants[0].ID != "alice" || participants[0].Instance != "node-1" {
+				t.Errorf("participants %+v, want alice first", participants)
+			}
+			if !participants[1].JoinedAt.Equal(testTime(2)) {
+				t.Errorf("joined_at %v, want %v", participants[1].JoinedAt, testTime(2))
+			}
+		}},
+		{"delete participant deletes tracks", func(t *testing.T, s Store) {
+			populate(t, s, "room")
+			if err := s.DeleteParticipant("room", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if tracks, err := s.Tracks("room"); err != nil || len(tracks) != 0 {
+				t.Errorf("tracks %+v, %v, want none", tracks, err)
+			}
+			if participants, err := s.Participants("room"); err != nil || len(participants) != 1 || participants[0].ID != "bob" {
+				t.Errorf("participants %+v, %v, want bob", participants, err)
+			}
+		}},
+		{"delete room cascades", func(t *testing.T, s Store) {
+			populate(t, s, "room")
+			populate(t, s, "other")
+			if err := s.DeleteRoom("room"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteParticipant("room", "bob"); !errors.Is(err, ErrParticipantNotFound) {
+				t.Errorf("DeleteParticipant: %v, want the participant deleted with the room", err)
+			}
+			if err := s.DeleteTrack("room", "audio"); !errors.Is(err, ErrTrackNotFound) {
+				t.Errorf("DeleteTrack: %v, want the track deleted with the room", err)
+			}
+			// 作り直した同名のルームに前の参加者は残らない
+			if err := s.PutRoom(Room{Name: "room", CreatedAt: testTime(10)}); err != nil {
+				t.Fatal(err)
+			}
+			if participants, err := s.Participants("room"); err != nil || len(participants) != 0 {
+				t.Errorf("participants %+v, %v, want none", participants, err)
+			}
+			if tracks, err := s.Tracks("other"); err != nil || len(tracks) != 2 {
+				t.Errorf("other room tracks %+v, %v, want 2", tracks, err)
+			}
+		}},
+	}
+
+	for _, st := range stores {
+		for _, c := range cases {
+			t.Run(st.name+"/"+c.name, func(t *testing.T) {
+				c.run(t, st.open(t))
+			})
+		}
+	}
+}
+
+func TestSQLiteStoreSharedBetweenInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	a := openSQLite(t, path)
+	b := openSQLite(t, path)
+
+	populate(t, a, "room")
+	if err := b.PutParticipant(Participant{ID: "carol", Room: "room", Instance: "node-2", JoinedAt: testTime(5)}); err != nil {
+		t.Fatal(err)
+	}
+	participants, err := a.Participants("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 3 || participants[2].ID != "carol" || participants[2].Instance != "node-2" {
+		t.Fatalf("participants %+v, want carol of node-2 written by the other store", participants)
+	}
+
+	if err := b.DeleteRoom("room"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Room("room"); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("Room: %v, want the room deleted by the other store", err)
+	}
+	if err := a.PutTrack(Track{ID: "screen", Room: "room", Participant: "alice", PublishedAt: testTime(6)}); !errors.Is(err, ErrParticipantNotFound) {
+		t.Errorf("PutTrack: %v, want ErrParticipantNotFound", err)
+	}
+}
+
+func TestSQLiteStoreKeepsRowsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate(t, s, "room")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSQLite(t, path)
+	tracks, err := s.Tracks("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[0].ID != "audio" || !tracks[1].PublishedAt.Equal(testTime(4)) {
+		t.Errorf("tracks %+v, want audio and video after reopening", tracks)
+	}
+}
@@ -0,0 +1,100 @@
+package token
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrNoSecret        = errors.New("token secret is not configured")
+	ErrMissingRoom     = errors.New("token must specify a room")
+	ErrMissingIdentity = errors.New("token must specify an identity")
+	ErrMissingExpiry   = errors.New("token must specify an expiry")
+	ErrInvalidTTL      = errors.New("token ttl must be positive")
+	ErrInvalidToken    = errors.New("token is invalid")
+	ErrTokenExpired    = errors.New("token is expired")
+)
+
+// Grant はトークンで参加を許可する内容
+type Grant struct {
+	Room     string `json:"room"`
+	Identity string `json:"identity"`
+	// 配信と購読を許可する
+	CanPublish   bool `json:"can_publish"`
+	CanSubscribe bool `json:"can_subscribe"`
+}
+
+// Claims は HS256 で署名する JWT の内容
+type Claims struct {
+	Grant
+	jwt.StandardClaims
+}
+
+func (c Claims) Valid() error {
+	if c.Room == "" {
+		return ErrMissingRoom
+	}
+	if c.Identity == "" {
+		return ErrMissingIdentity
+	}
+	// exp の無いトークンは StandardClaims.Valid を通ってしまい、期限なく使えてしまう
+	if c.ExpiresAt == 0 {
+		return ErrMissingExpiry
+	}
+	return c.StandardClaims.Valid()
+}
+
+// Create は secret で署名した ttl の間だけ有効なトークンを作る
+func Create(secret string, g Grant, ttl time.Duration) (string, error) {
+	if secret == "" {
+		return "", ErrNoSecret
+	}
+	if ttl <= 0 {
+		return "", ErrInvalidTTL
+	}
+	now := time.Now()
+	c := Claims{
+		Grant: g,
+		StandardClaims: jwt.StandardClaims{
+			Id:        xid.New().String(),
+			Subject:   g.Identity,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	if err := c.Valid(); err != nil {
+		return "", err
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(secret))
+}
+
+// Verify は secret で署名された有効期限内のトークンであることを確かめ、内容を返す
+func Verify(secret, s string) (Claims, error) {
+	if secret == "" {
+		return Claims{}, ErrNoSecret
+	}
+	c := Claims{}
+	_, err := jwt.ParseWithClaims(s, &c, func(t *jwt.Token) (interface{}, error) {
+		// alg を書き換えたトークンを受け付けない
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, ErrInvalidToken
+		}
+		return []byte(secret), nil
+	})
+	ve := &jwt.ValidationError{}
+	switch {
+	case err == nil:
+		return c, nil
+	case errors.As(err, &ve) && ve.Errors&jwt.ValidationErrorExpired != 0:
+		return Claims{}, ErrTokenExpired
+	case errors.As(err, &ve) && ve.Errors&jwt.ValidationErrorClaimsInvalid != 0 && ve.Inner != nil:
+		// Claims.Valid が返した理由はそのまま返し、署名の不一致などは ErrInvalidToken にまとめる
+		return Claims{}, ve.Inner
+	default:
+		return Claims{}, ErrInvalidToken
+	}
+}
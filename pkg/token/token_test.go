@@ -0,0 +1,99 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const testSecret = "secret"
+
+var testGrant = Grant{Room: "room", Identity: "alice", CanPublish: true, CanSubscribe: true}
+
+// sign は Create を通さずに claims を method で署名する
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, c Claims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, c).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func claims(g Grant, expiresAt time.Time) Claims {
+	c := Claims{Grant: g, StandardClaims: jwt.StandardClaims{Subject: g.Identity}}
+	if !expiresAt.IsZero() {
+		c.ExpiresAt = expiresAt.Unix()
+	}
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	valid, err := Create(testSecret, testGrant, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Verify(testSecret, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Grant != testGrant || c.Subject != testGrant.Identity {
+		t.Errorf("claims %+v, want %+v", c, testGrant)
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Minute)
+
+	cases := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", sign(t, jwt.SigningMethodHS256, []byte(testSecret), claims(testGrant, time.Now().Add(-time.Minute))), ErrTokenExpired},
+		{"no expiry", sign(t, jwt.SigningMethodHS256, []byte(testSecret), claims(testGrant, time.Time{})), ErrMissingExpiry},
+		{"wrong secret", sign(t, jwt.SigningMethodHS256, []byte("other"), claims(testGrant, expiresAt)), ErrInvalidToken},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(testGrant, expiresAt)), ErrInvalidToken},
+		{"alg RS256", sign(t, jwt.SigningMethodRS256, key, claims(testGrant, expiresAt)), ErrInvalidToken},
+		{"missing room", sign(t, jwt.SigningMethodHS256, []byte(testSecret), claims(Grant{Identity: "alice"}, expiresAt)), ErrMissingRoom},
+		{"missing identity", sign(t, jwt.SigningMethodHS256, []byte(testSecret), claims(Grant{Room: "room"}, expiresAt)), ErrMissingIdentity},
+		{"malformed", "not a token", ErrInvalidToken},
+	}
+	for _, c := range cases {
+		if _, err := Verify(testSecret, c.token); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	if _, err := Verify("", sign(t, jwt.SigningMethodHS256, []byte(testSecret), claims(testGrant, expiresAt))); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("empty secret: %v, want ErrNoSecret", err)
+	}
+}
+
+func TestCreateRejectsInvalidGrants(t *testing.T) {
+	cases := []struct {
+		name   string
+		secret string
+		grant  Grant
+		ttl    time.Duration
+		want   error
+	}{
+		{"no secret", "", testGrant, time.Minute, ErrNoSecret},
+		{"zero ttl", testSecret, testGrant, 0, ErrInvalidTTL},
+		{"missing room", testSecret, Grant{Identity: "alice"}, time.Minute, ErrMissingRoom},
+		{"missing identity", testSecret, Grant{Room: "room"}, time.Minute, ErrMissingIdentity},
+	}
+	for _, c := range cases {
+		if _, err := Create(c.secret, c.grant, c.ttl); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// receiver はテストのためにプロセス内で Webhook を受け取る HTTP サーバ。
+// 署名を検証し、受け取ったイベントを順に記録する
+type receiver struct {
+	*httptest.Server
+
+	secret    string
+	mux       sync.Mutex
+	delivered []Event
+	// 再送を確かめるため、指定した回数だけ 500 を返す
+	failures int
+	received chan struct{}
+}
+
+func newReceiver(secret string) *receiver {
+	r := &receiver{
+		secret:   secret,
+		mux:      sync.Mutex{},
+		received: make(chan struct{}, 1),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *receiver) handle(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !Verify(r.secret, body, req.Header.Get(SignatureHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	e := Event{}
+	if err := json.Unmarshal(body, &e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.delivered = append(r.delivered, e)
+	select {
+	case r.received <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// failNext は次の n 回の配送を失敗させる
+func (r *receiver) failNext(n int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.failures = n
+}
+
+func (r *receiver) events() []Event {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]Event(nil), r.delivered...)
+}
+
+// wait は typ のイベントが届くまで待つ
+func (r *receiver) wait(typ EventType, timeout time.Duration) (Event, bool) {
+	deadline := time.After(timeout)
+	for {
+		for _, e := range r.events() {
+			if e.Event == typ {
+				return e, true
+			}
+		}
+		select {
+		case <-r.received:
+		case <-deadline:
+			return Event{}, false
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"ruyka/pkg/store"
+	"time"
+
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+const (
+	WEBHOOK_QUEUE_SIZE     = 256
+	WEBHOOK_MAX_ATTEMPTS   = 5
+	WEBHOOK_RETRY_INTERVAL = time.Second
+
+	// 本文の HMAC-SHA256 を "sha256=<hex>" の形式で付与する
+	SignatureHeader = "X-Ruyka-Signature"
+)
+
+type EventType string
+
+const (
+	EventTypeRoomStarted       EventType = "room_started"
+	EventTypeRoomFinished      EventType = "room_finished"
+	EventTypeParticipantJoined EventType = "participant_joined"
+	EventTypeParticipantLeft   EventType = "participant_left"
+	EventTypeTrackPublished    EventType = "track_published"
+	EventTypeTrackUnpublished  EventType = "track_unpublished"
+	EventTypeRecordingFinished EventType = "recording_finished"
+)
+
+type Event struct {
+	ID          string       `json:"id"`
+	Event       EventType    `json:"event"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Room        string       `json:"room"`
+	Participant string       `json:"participant,omitempty"`
+	Track       *store.Track `json:"track,omitempty"`
+	// recording_finished で終端した HLS のプレイリストのパスを示す
+	Location string `json:"location,omitempty"`
+}
+
+type Notifier interface {
+	// Notify はイベントを送信キューに積み、配送を待たずに戻る
+	Notify(Event)
+}
+
+type notifier struct {
+	secret string
+	client *http.Client
+	queues []chan []byte
+}
+
+// New は urls のそれぞれに署名付きでイベントを配送する Notifier を返す。
+// URL ごとにキューを持ち、失敗した配送は間隔を倍にしながら再送する
+func New(urls []string, secret string, timeout time.Duration) Notifier {
+	n := &notifier{
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		queues: make([]chan []byte, 0, len(urls)),
+	}
+	for _, url := range urls {
+		q := make(chan []byte, WEBHOOK_QUEUE_SIZE)
+		n.queues = append(n.queues, q)
+		go n.deliver(url, q)
+	}
+	return n
+}
+
+func (n *notifier) Notify(e Event) {
+	if len(n.queues) == 0 {
+		return
+	}
+	if e.ID == "" {
+		e.ID = xid.New().String()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		zap.L().Warn("webhook: failed to encode event", zap.Error(err))
+		return
+	}
+
+	for _, q := range n.queues {
+		select {
+		case q <- body:
+		default:
+			zap.L().Warn("webhook: queue is full, event dropped", zap.String("event", string(e.Event)))
+		}
+	}
+}
+
+// deliver はキューの順にイベントを配送する。再送中は後続のイベントを待たせて順序を保つ
+func (n *notifier) deliver(url string, q <-chan []byte) {
+	for body := range q {
+		interval := WEBHOOK_RETRY_INTERVAL
+		for attempt := 1; ; attempt++ {
+			err := n.post(url, body)
+			if err == nil {
+				break
+			}
+			if attempt == WEBHOOK_MAX_ATTEMPTS {
+				zap.L().Warn("webhook: delivery failed", zap.String("url", url), zap.Error(err))
+				break
+			}
+			time.Sleep(interval)
+			interval *= 2
+		}
+	}
+}
+
+func (n *notifier) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(n.secret, body))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify は受信側で署名を検証する
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
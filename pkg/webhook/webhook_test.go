@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+// 再送の間隔を含めてイベントが届くのを待つ時間
+const receiveTimeout = 5 * time.Second
+
+func TestNotifierDeliversSignedEvents(t *testing.T) {
+	r := newReceiver("secret")
+	defer r.Close()
+	n := New([]string{r.URL}, "secret", time.Second)
+
+	n.Notify(Event{Event: EventTypeRoomStarted, Room: "room"})
+	n.Notify(Event{Event: EventTypeRecordingFinished, Room: "room", Location: "/hls/room/index.m3u8"})
+
+	e, ok := r.wait(EventTypeRecordingFinished, receiveTimeout)
+	if !ok {
+		t.Fatal("recording_finished is not delivered")
+	}
+	if e.Location != "/hls/room/index.m3u8" {
+		t.Errorf("location %q, want /hls/room/index.m3u8", e.Location)
+	}
+	// 配送は Notify の順に行われる
+	events := r.events()
+	if len(events) != 2 || events[0].Event != EventTypeRoomStarted {
+		t.Fatalf("events %+v, want room_started then recording_finished", events)
+	}
+	if events[0].ID == "" || events[0].CreatedAt.IsZero() {
+		t.Errorf("event %+v has no id or created_at", events[0])
+	}
+}
+
+func TestNotifierRetriesFailedDelivery(t *testing.T) {
+	r := newReceiver("secret")
+	defer r.Close()
+	r.failNext(1)
+	n := New([]string{r.URL}, "secret", time.Second)
+
+	n.Notify(Event{Event: EventTypeParticipantJoined, Room: "room", Participant: "alice"})
+	e, ok := r.wait(EventTypeParticipantJoined, receiveTimeout)
+	if !ok {
+		t.Fatal("participant_joined is not delivered after a failure")
+	}
+	if e.Participant != "alice" {
+		t.Errorf("participant %q, want alice", e.Participant)
+	}
+	if events := r.events(); len(events) != 1 {
+		t.Errorf("%d events delivered, want 1", len(events))
+	}
+}
+
+func TestVerifyRejectsOtherSecret(t *testing.T) {
+	body := []byte(`{"event":"room_started"}`)
+	if !Verify("secret", body, Sign("secret", body)) {
+		t.Error("signature with the same secret is rejected")
+	}
+	if Verify("secret", body, Sign("other", body)) {
+		t.Error("signature with another secret is accepted")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"ruyka/pkg/admin"
+	"ruyka/pkg/player"
+
+	"github.com/urfave/cli"
+)
+
+// admin API を呼び出すサブコマンドの接続先
+var serverFlag = &cli.StringFlag{
+	Name:   "server",
+	EnvVar: "RUYKA_SERVER",
+	Value:  "http://127.0.0.1:19000",
+	Usage:  "base URL of the running ruyka server",
+}
+
+var playerCommand = cli.Command{
+	Name:  "player",
+	Usage: "play media files on the server into a room as a participant",
+	Subcommands: []cli.Command{
+		{
+			Name:      "start",
+			Usage:     "start playing files (ivf, h264, ogg) relative to the server's player.dir",
+			ArgsUsage: "FILE...",
+			Flags: []cli.Flag{
+				serverFlag,
+				&cli.StringFlag{
+					Name:     "room",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "participant",
+					Value: "player",
+				},
+				&cli.BoolFlag{
+					Name:  "loop",
+					Usage: "repeat the files until stopped",
+				},
+				&cli.Float64Flag{
+					Name:  "frame-rate",
+					Value: player.DEFAULT_FRAME_RATE,
+					Usage: "frame rate of h264 (annex-b) files",
+				},
+			},
+			Action: startPlayback,
+		},
+		{
+			Name:   "list",
+			Usage:  "list running playbacks",
+			Flags:  []cli.Flag{serverFlag},
+			Action: listPlaybacks,
+		},
+		{
+			Name:      "stop",
+			Usage:     "stop a playback",
+			ArgsUsage: "ID",
+			Flags:     []cli.Flag{serverFlag},
+			Action:    stopPlayback,
+		},
+	},
+}
+
+// adminClient はサーバと同じ設定 (--config と --admin-key) から admin.key と tls.client を読む
+func adminClient(cxt *cli.Context) (admin.Client, error) {
+	c, err := loadConfig(cxt)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := c.TLS.Client.Build()
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(cxt.String("server"), c.Admin.Key, tlsConfig), nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func startPlayback(cxt *cli.Context) error {
+	if cxt.NArg() == 0 {
+		return errors.New("at least one file is required")
+	}
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	pb, err := client.StartPlayback(cxt.String("room"), player.Options{
+		Participant: cxt.String("participant"),
+		Files:       cxt.Args(),
+		Loop:        cxt.Bool("loop"),
+		FrameRate:   cxt.Float64("frame-rate"),
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(pb)
+}
+
+func listPlaybacks(cxt *cli.Context) error {
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	playbacks, err := client.Playbacks()
+	if err != nil {
+		return err
+	}
+	return printJSON(playbacks)
+}
+
+func stopPlayback(cxt *cli.Context) error {
+	if cxt.NArg() != 1 {
+		return errors.New("playback id is required")
+	}
+	client, err := adminClient(cxt)
+	if err != nil {
+		return err
+	}
+	return client.StopPlayback(cxt.Args().First())
+}
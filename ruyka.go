@@ -7,20 +7,69 @@ import (
 	"ruyka/pkg/version"
 
 	"github.com/urfave/cli"
+	"go.uber.org/zap"
 )
 
 func main() {
 	ruyka := cli.App{
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "config",
+				EnvVar:   "RUYKA_CONFIG",
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "development",
 				EnvVar:   "RUYKA_DEVELOPMENT",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "admin-key",
+				EnvVar:   "RUYKA_ADMIN_KEY",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "auth-secret",
+				EnvVar:   "RUYKA_AUTH_SECRET",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "ca",
+				Usage:    "CA certificate to verify the server (tls.client.ca_file)",
+				EnvVar:   "RUYKA_TLS_CA",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "cert",
+				Usage:    "client certificate presented to the server (tls.client.cert_file)",
+				EnvVar:   "RUYKA_TLS_CERT",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "key",
+				Usage:    "private key of the client certificate (tls.client.key_file)",
+				EnvVar:   "RUYKA_TLS_KEY",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "insecure",
+				Usage:    "do not verify the server certificate (tls.client.insecure)",
+				EnvVar:   "RUYKA_TLS_INSECURE",
+				Required: false,
+			},
+		},
+		Action:  run,
+		Version: version.Version,
+		Commands: []cli.Command{
+			playerCommand,
+			loadtestCommand,
+			tokenCommand,
+			roomsCommand,
+			participantsCommand,
+			participantCommand,
+			statsCommand,
+			logLevelCommand,
 		},
-		Action:   run,
-		Version:  version.Version,
-		Commands: []cli.Command{},
 	}
 
 	if err := ruyka.Run(os.Args); err != nil {
@@ -29,15 +78,51 @@ func main() {
 }
 
 func run(cxt *cli.Context) error {
-	c := config.New()
-	if cxt.Bool("development") {
-		c.DevMode()
+	c, err := loadConfig(cxt)
+	if err != nil {
+		return err
 	}
 
 	server, err := c.Build()
 	if err != nil {
 		return err
 	}
+	// グローバルなロガーはプロセスに 1 つなので、サーバごとではなくここで差し替える
+	defer zap.ReplaceGlobals(server.Logger())()
 	go server.Run()
 	return server.Shutdown()
 }
+
+// loadConfig はサーバと同じ手順で設定を読み込む。サブコマンドからも使う
+func loadConfig(cxt *cli.Context) (*config.Config, error) {
+	c := config.New()
+	if path := cxt.GlobalString("config"); path != "" {
+		loaded, err := config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		c = loaded
+	}
+	if cxt.GlobalBool("development") {
+		c.DevMode()
+	}
+	if key := cxt.GlobalString("admin-key"); key != "" {
+		c.Admin.Key = key
+	}
+	if secret := cxt.GlobalString("auth-secret"); secret != "" {
+		c.Auth.Secret = secret
+	}
+	if ca := cxt.GlobalString("ca"); ca != "" {
+		c.TLS.Client.CAFile = ca
+	}
+	if cert := cxt.GlobalString("cert"); cert != "" {
+		c.TLS.Client.CertFile = cert
+	}
+	if key := cxt.GlobalString("key"); key != "" {
+		c.TLS.Client.KeyFile = key
+	}
+	if cxt.GlobalBool("insecure") {
+		c.TLS.Client.Insecure = true
+	}
+	return c, nil
+}
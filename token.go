@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"ruyka/pkg/token"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var tokenCommand = cli.Command{
+	Name:  "token",
+	Usage: "create and verify join tokens signed with the server's auth.secret",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a join token and print it with a signaling URL",
+			Flags: []cli.Flag{
+				serverFlag,
+				&cli.StringFlag{
+					Name:     "room",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "identity",
+					Required: true,
+					Usage:    "participant name shown in the admin API",
+				},
+				&cli.DurationFlag{
+					Name:  "ttl",
+					Value: time.Hour,
+				},
+				&cli.BoolTFlag{
+					Name:  "can-publish",
+					Usage: "allow publishing tracks (use --can-publish=false to deny)",
+				},
+				&cli.BoolTFlag{
+					Name:  "can-subscribe",
+					Usage: "allow subscribing to tracks (use --can-subscribe=false to deny)",
+				},
+			},
+			Action: createToken,
+		},
+		{
+			Name:      "verify",
+			Usage:     "verify a join token and print its claims",
+			ArgsUsage: "TOKEN",
+			Action:    verifyToken,
+		},
+	},
+}
+
+// authSecret はサーバと同じ設定から参加トークンの署名に使う secret を読む
+func authSecret(cxt *cli.Context) (string, error) {
+	c, err := loadConfig(cxt)
+	if err != nil {
+		return "", err
+	}
+	if c.Auth.Secret == "" {
+		return "", errors.New("auth.secret is not configured: set it in --config or --auth-secret")
+	}
+	return c.Auth.Secret, nil
+}
+
+func createToken(cxt *cli.Context) error {
+	secret, err := authSecret(cxt)
+	if err != nil {
+		return err
+	}
+	room := cxt.String("room")
+	t, err := token.Create(secret, token.Grant{
+		Room:         room,
+		Identity:     cxt.String("identity"),
+		CanPublish:   cxt.BoolT("can-publish"),
+		CanSubscribe: cxt.BoolT("can-subscribe"),
+	}, cxt.Duration("ttl"))
+	if err != nil {
+		return err
+	}
+
+	u, err := signalingURL(cxt.String("server"))
+	if err != nil {
+		return err
+	}
+	meet, err := url.Parse(strings.TrimSuffix(cxt.String("server"), "/") + "/ruyka/meet")
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("room", room)
+	q.Set("token", t)
+	meet.RawQuery = q.Encode()
+
+	fmt.Printf("token:         %s\n", t)
+	fmt.Printf("signaling url: %s?%s\n", u, q.Encode())
+	fmt.Printf("meet url:      %s\n", meet)
+	return nil
+}
+
+func verifyToken(cxt *cli.Context) error {
+	if cxt.NArg() != 1 {
+		return errors.New("token is required")
+	}
+	secret, err := authSecret(cxt)
+	if err != nil {
+		return err
+	}
+	claims, err := token.Verify(secret, cxt.Args().First())
+	if err != nil {
+		return err
+	}
+	return printJSON(struct {
+		token.Grant
+		ExpiresAt time.Time `json:"expires_at"`
+	}{claims.Grant, time.Unix(claims.ExpiresAt, 0)})
+}